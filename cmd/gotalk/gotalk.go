@@ -5,6 +5,7 @@ import (
 	"flag"
 	"github.com/chang144/gotalk/internal/him/services/gateway"
 	"github.com/chang144/gotalk/internal/him/services/logicServer"
+	"github.com/chang144/gotalk/internal/him/services/router"
 	"github.com/spf13/cobra"
 )
 
@@ -22,6 +23,7 @@ func main() {
 
 	root.AddCommand(gateway.NewServerStartCmd(ctx, version))
 	root.AddCommand(logicServer.NewServerStartCmd(ctx, version))
+	root.AddCommand(router.NewServerStartCmd(ctx, version))
 
 	if err := root.Execute(); err != nil {
 		return
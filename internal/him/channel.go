@@ -1,8 +1,10 @@
 package him
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/klintcheng/kim/logger"
@@ -16,8 +18,12 @@ type Channel interface {
 	ReadLoop(MessageListener) error
 	SetWriteWait(time.Duration)
 	SetReadWait(time.Duration)
+	// Drain 等待已经推送的消息写完或者ctx结束，关闭之前仍然接收推送
+	Drain(ctx context.Context) error
 }
 
+var ErrChannelClosed = errors.New("channel closed")
+
 type channelImpl struct {
 	sync.Mutex
 	id string
@@ -27,6 +33,11 @@ type channelImpl struct {
 	writeWait time.Duration
 	readWait  time.Duration
 	closed    *Event
+	// draining 为1时Close先写完队列中的推送，drained在标记之前与之后的推送都写完时触发
+	draining int32
+	drained  *Event
+	// stopped writeLoop退出之后触发
+	stopped *Event
 }
 
 func NewChannel(id string, conn Conn) Channel {
@@ -41,8 +52,11 @@ func NewChannel(id string, conn Conn) Channel {
 		writeWait: DefaultWriteWait,
 		readWait:  DefaultReadWait,
 		closed:    NewEvent(),
+		drained:   NewEvent(),
+		stopped:   NewEvent(),
 	}
 	go func() {
+		defer ch.stopped.Fire()
 		err := ch.writeLoop()
 		if err != nil {
 			log.Info(err)
@@ -52,32 +66,49 @@ func NewChannel(id string, conn Conn) Channel {
 	return ch
 }
 
+// writeLoop nil消息是Drain写入的标记，写到标记之后队列为空时触发drained
 func (ch *channelImpl) writeLoop() error {
+	var marked bool
 	for {
 		select {
 		case payload := <-ch.writeChan:
-			err := ch.WriteFrame(OpBinary, payload)
-			if err != nil {
+			if payload == nil {
+				marked = true
+			} else if err := ch.WriteFrame(OpBinary, payload); err != nil {
 				return err
 			}
-			chanlen := len(ch.writeChan)
-			for i := 0; i < chanlen; i++ {
-				payload = <-ch.writeChan
-				err := ch.WriteFrame(OpBinary, payload)
-				if err != nil {
-					return err
-				}
-			}
-			err = ch.Conn.Flush()
-			if err != nil {
+			if err := ch.writePending(&marked); err != nil {
 				return err
 			}
+			if marked && len(ch.writeChan) == 0 {
+				ch.drained.Fire()
+			}
 		case <-ch.closed.Done():
+			// 排空中的连接在关闭之前写完已经接收的推送
+			if atomic.LoadInt32(&ch.draining) == 1 {
+				return ch.writePending(&marked)
+			}
 			return nil
 		}
 	}
 }
 
+// writePending 写出队列中已有的推送并flush
+func (ch *channelImpl) writePending(marked *bool) error {
+	chanlen := len(ch.writeChan)
+	for i := 0; i < chanlen; i++ {
+		payload := <-ch.writeChan
+		if payload == nil {
+			*marked = true
+			continue
+		}
+		if err := ch.WriteFrame(OpBinary, payload); err != nil {
+			return err
+		}
+	}
+	return ch.Conn.Flush()
+}
+
 // ReadLoop read loop from channel
 // 是一个阻塞的方法，把消息的读取和心跳处理的逻辑封装在一起
 func (ch *channelImpl) ReadLoop(lst MessageListener) error {
@@ -101,13 +132,17 @@ func (ch *channelImpl) ReadLoop(lst MessageListener) error {
 		if frame.GetOpCode() == OpPing {
 			log.Trace("recv a ping: resp with a pong")
 			_ = ch.WriteFrame(OpPong, nil)
+			if hl, ok := lst.(HeartbeatListener); ok {
+				hl.Heartbeat(ch)
+			}
 			continue
 		}
 		payload := frame.GetPayload()
 		if len(payload) == 0 {
 			continue
 		}
-		go lst.Receive(ch, payload)
+		// 在读取的goroutine中调用，lst需要自己控制并发，Server传入的是WorkerPool.Listener
+		lst.Receive(ch, payload)
 	}
 
 }
@@ -115,14 +150,52 @@ func (ch *channelImpl) ReadLoop(lst MessageListener) error {
 // Push message to channel
 // 通过管道writeChan，发送给一个独立的goruntine中的writeLoop()执行,使得Push变成了一个线程安全方法
 func (ch *channelImpl) Push(payload []byte) error {
-	if ch.closed.HasFired() {
-		return errors.New("channel")
+	if ch.closed.HasFired() || ch.stopped.HasFired() {
+		return ErrChannelClosed
+	}
+	if payload == nil {
+		return nil
 	}
 	// 异步写
-	ch.writeChan <- payload
+	select {
+	case ch.writeChan <- payload:
+		return nil
+	case <-ch.stopped.Done():
+		return ErrChannelClosed
+	}
+}
+
+// Drain 写入一个标记，writeLoop写到标记并且队列为空时推送都已经发出
+// 客户端收到GoAway之后才会重连，这段时间的推送不能拒绝，否则会丢失
+func (ch *channelImpl) Drain(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&ch.draining, 0, 1) {
+		select {
+		case ch.writeChan <- nil:
+		case <-ch.stopped.Done():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-ch.drained.Done():
+	case <-ch.stopped.Done():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	return nil
 }
 
+// Close 停止writeLoop并关闭连接，排空中的连接等待队列中的推送写完，其它连接没有写完的推送被丢弃
+func (ch *channelImpl) Close() error {
+	ch.closed.Fire()
+	if atomic.LoadInt32(&ch.draining) == 1 {
+		// 写操作有超时，这里不会一直阻塞
+		<-ch.stopped.Done()
+	}
+	return ch.Conn.Close()
+}
+
 // WriteFrame overwrite him.Conn.WriteFrame
 // 增加了重置写超时的逻辑
 func (ch *channelImpl) WriteFrame(code OpCode, payload []byte) error {
@@ -155,12 +228,17 @@ func (ch *channelImpl) SetReadWait(readwait time.Duration) {
 type ChannelMap interface {
 	Add(Channel)
 	Remove(id string)
+	// RemoveChannel 只有id对应的仍然是channel时才删除，被新连接替换的旧连接断开时不影响新连接
+	RemoveChannel(channel Channel) bool
 	Get(id string) (Channel, bool)
 	All() []Channel
+	// Len 连接数，不需要像All一样复制全部连接
+	Len() int
 }
 
 type ChannelMapImpl struct {
 	channels *sync.Map
+	size     int64
 }
 
 // Add channel to channelMap
@@ -171,11 +249,23 @@ func (c *ChannelMapImpl) Add(channel Channel) {
 		}).Error("channel id is required")
 	}
 
-	c.channels.Store(channel.ID(), channel)
+	if _, loaded := c.channels.Swap(channel.ID(), channel); !loaded {
+		atomic.AddInt64(&c.size, 1)
+	}
 }
 
 func (c *ChannelMapImpl) Remove(id string) {
-	c.channels.Delete(id)
+	if _, loaded := c.channels.LoadAndDelete(id); loaded {
+		atomic.AddInt64(&c.size, -1)
+	}
+}
+
+func (c *ChannelMapImpl) RemoveChannel(channel Channel) bool {
+	if !c.channels.CompareAndDelete(channel.ID(), channel) {
+		return false
+	}
+	atomic.AddInt64(&c.size, -1)
+	return true
 }
 
 func (c *ChannelMapImpl) Get(id string) (Channel, bool) {
@@ -201,6 +291,10 @@ func (c *ChannelMapImpl) All() []Channel {
 	return arr
 }
 
+func (c *ChannelMapImpl) Len() int {
+	return int(atomic.LoadInt64(&c.size))
+}
+
 func NewChannelMap(num int) ChannelMap {
 	return &ChannelMapImpl{
 		channels: new(sync.Map),
@@ -0,0 +1,385 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState 熔断器状态
+type BreakerState int32
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// 熔断器的默认参数
+const (
+	DefaultBreakerWindow       = time.Second * 10
+	DefaultBreakerMinRequests  = 20
+	DefaultBreakerFailureRatio = 0.5
+	DefaultBreakerConsecutive  = 5
+	DefaultBreakerOpenTime     = time.Second * 10
+	DefaultBreakerProbes       = 3
+	DefaultBreakerSlowCall     = time.Second * 2
+	DefaultBreakerTimeout      = time.Second * 10
+	// maxPending 等待响应的请求数上限，超过之后不再统计响应
+	maxPending = 10000
+)
+
+// BreakerOptions 为0的参数使用默认值
+type BreakerOptions struct {
+	// Window 统计失败率的时间窗口
+	Window time.Duration
+	// MinRequests 窗口内的请求数达到MinRequests之后才按照失败率熔断
+	MinRequests  int
+	FailureRatio float64
+	// Consecutive 连续失败多少次之后直接熔断
+	Consecutive int
+	// OpenTime 熔断之后多久进入半开状态
+	OpenTime time.Duration
+	// Probes 半开状态下允许的探测请求数，全部成功之后恢复
+	Probes int
+	// SlowCall 响应时间超过SlowCall视为失败
+	SlowCall time.Duration
+	// Timeout 超过Timeout没有响应视为失败
+	Timeout time.Duration
+}
+
+func (o *BreakerOptions) withDefault() BreakerOptions {
+	opts := *o
+	if opts.Window <= 0 {
+		opts.Window = DefaultBreakerWindow
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = DefaultBreakerMinRequests
+	}
+	if opts.FailureRatio <= 0 {
+		opts.FailureRatio = DefaultBreakerFailureRatio
+	}
+	if opts.Consecutive <= 0 {
+		opts.Consecutive = DefaultBreakerConsecutive
+	}
+	if opts.OpenTime <= 0 {
+		opts.OpenTime = DefaultBreakerOpenTime
+	}
+	if opts.Probes <= 0 {
+		opts.Probes = DefaultBreakerProbes
+	}
+	if opts.SlowCall <= 0 {
+		opts.SlowCall = DefaultBreakerSlowCall
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultBreakerTimeout
+	}
+	return opts
+}
+
+// BreakerStats 监控输出
+type BreakerStats struct {
+	State       BreakerState `json:"state"`
+	Requests    int          `json:"requests"`
+	Failures    int          `json:"failures"`
+	Consecutive int          `json:"consecutive"`
+	Pending     int          `json:"pending"`
+	// OpenedAt 最近一次熔断的时间
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+}
+
+// Breaker 一个上游服务的熔断器
+// closed: 正常放行，按照窗口失败率或者连续失败熔断
+// open: 拒绝请求，OpenTime之后进入half-open
+// half-open: 放行Probes个探测请求，全部成功时恢复，任意失败时重新熔断
+type Breaker struct {
+	sync.Mutex
+	opts BreakerOptions
+	now  func() time.Time
+
+	state       BreakerState
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	// probes 半开状态下已经放行的探测请求数，successes为其中成功的数量
+	probes    int
+	successes int
+	// probeAt 最近一次放行探测请求的时间
+	probeAt time.Time
+}
+
+func NewBreaker(opts BreakerOptions) *Breaker {
+	return &Breaker{
+		opts: opts.withDefault(),
+		now:  time.Now,
+	}
+}
+
+// Available 是否可以参与选择，不占用探测名额
+func (b *Breaker) Available() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+	return b.state == BreakerClosed || (b.state == BreakerHalfOpen && b.probes < b.opts.Probes)
+}
+
+// Allow 放行一个请求，半开状态下占用一个探测名额
+func (b *Breaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.probes < b.opts.Probes {
+			b.probes++
+			b.probeAt = b.now()
+			return true
+		}
+	}
+	return false
+}
+
+// Record 记录一个请求的结果
+func (b *Breaker) Record(success bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+	switch b.state {
+	case BreakerHalfOpen:
+		if !success {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.opts.Probes {
+			b.reset(BreakerClosed)
+		}
+	case BreakerClosed:
+		now := b.now()
+		if now.Sub(b.windowStart) > b.opts.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if success {
+			b.consecutive = 0
+			return
+		}
+		b.failures++
+		b.consecutive++
+		if b.consecutive >= b.opts.Consecutive ||
+			(b.requests >= b.opts.MinRequests && float64(b.failures) >= b.opts.FailureRatio*float64(b.requests)) {
+			b.open()
+		}
+	}
+}
+
+func (b *Breaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+	return b.state
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+	return BreakerStats{
+		State:       b.state,
+		Requests:    b.requests,
+		Failures:    b.failures,
+		Consecutive: b.consecutive,
+		OpenedAt:    b.openedAt,
+	}
+}
+
+// advance open状态超过OpenTime之后进入half-open
+// half-open状态下探测请求超过Timeout仍没有结果时视为失败，重新熔断，避免名额一直被占用
+func (b *Breaker) advance() {
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) >= b.opts.OpenTime {
+			b.reset(BreakerHalfOpen)
+		}
+	case BreakerHalfOpen:
+		if b.probes > b.successes && b.now().Sub(b.probeAt) >= b.opts.Timeout {
+			b.open()
+		}
+	}
+}
+
+func (b *Breaker) open() {
+	b.reset(BreakerOpen)
+	b.openedAt = b.now()
+}
+
+func (b *Breaker) reset(state BreakerState) {
+	b.state = state
+	b.windowStart = b.now()
+	b.requests, b.failures, b.consecutive = 0, 0, 0
+	b.probes, b.successes = 0, 0
+}
+
+// breakerClient 带有熔断器的上游服务客户端
+// 请求包等待响应之后按照状态码与耗时记录结果，其它包在发送之后记录
+type breakerClient struct {
+	him.Client
+	breaker *Breaker
+
+	pendingLock sync.Mutex
+	pending     map[string]time.Time
+	lastSweep   time.Time
+
+	// meta 注册中心更新之后的服务元数据，为nil时使用客户端创建时的元数据
+	metaLock sync.RWMutex
+	meta     map[string]string
+}
+
+func newBreakerClient(cli him.Client, opts BreakerOptions) *breakerClient {
+	return &breakerClient{
+		Client:  cli,
+		breaker: NewBreaker(opts),
+		pending: make(map[string]time.Time),
+	}
+}
+
+// Available ClientMap.Services据此排除熔断的服务，顺便清理超时的请求
+func (c *breakerClient) Available() bool {
+	c.expire()
+	return c.breaker.Available()
+}
+
+func (c *breakerClient) GetMeta() map[string]string {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if c.meta != nil {
+		return c.meta
+	}
+	return c.Client.GetMeta()
+}
+
+// setMeta 替换为新的元数据，保留发现服务的时间用于慢启动
+// 选择器并发读取元数据，这里复制一份而不是修改原来的map
+func (c *breakerClient) setMeta(meta map[string]string) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	old := c.meta
+	if old == nil {
+		old = c.Client.GetMeta()
+	}
+	m := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		m[k] = v
+	}
+	if since, ok := old[KeyServiceSince]; ok {
+		m[KeyServiceSince] = since
+	}
+	c.meta = m
+}
+
+// Send 熔断时直接返回ErrCircuitOpen
+func (c *breakerClient) Send(payload []byte) error {
+	if !c.breaker.Allow() {
+		return ErrCircuitOpen
+	}
+	err := c.Client.Send(payload)
+	if err != nil {
+		c.breaker.Record(false)
+	}
+	return err
+}
+
+// sendPacket 请求包在发送成功之后等待响应，其它包发送成功即记录成功
+func (c *breakerClient) sendPacket(packet *pkt.LogicPkt) error {
+	if err := c.Send(pkt.Marshal(packet)); err != nil {
+		return err
+	}
+	if packet.Flag != pkt.Flag_Request || !c.track(&packet.Header) {
+		c.breaker.Record(true)
+	}
+	return nil
+}
+
+// track 记录请求的发送时间，顺便清理超时的请求
+func (c *breakerClient) track(header *pkt.Header) bool {
+	c.expire()
+	c.pendingLock.Lock()
+	ok := len(c.pending) < maxPending
+	if ok {
+		c.pending[pendingKey(header)] = c.breaker.now()
+	}
+	c.pendingLock.Unlock()
+	return ok
+}
+
+// expire 超过Timeout没有响应的请求记录为失败，每个Timeout最多遍历一次
+func (c *breakerClient) expire() {
+	now := c.breaker.now()
+	timeout := c.breaker.opts.Timeout
+	c.pendingLock.Lock()
+	if now.Sub(c.lastSweep) < timeout {
+		c.pendingLock.Unlock()
+		return
+	}
+	var expired int
+	for key, at := range c.pending {
+		if now.Sub(at) >= timeout {
+			delete(c.pending, key)
+			expired++
+		}
+	}
+	c.lastSweep = now
+	c.pendingLock.Unlock()
+	for i := 0; i < expired; i++ {
+		c.breaker.Record(false)
+	}
+}
+
+// done 收到响应，系统错误或者响应过慢视为失败
+func (c *breakerClient) done(header *pkt.Header) {
+	key := pendingKey(header)
+	c.pendingLock.Lock()
+	at, ok := c.pending[key]
+	delete(c.pending, key)
+	c.pendingLock.Unlock()
+	if !ok {
+		return
+	}
+	c.breaker.Record(header.Status != pkt.Status_SystemException && c.breaker.now().Sub(at) < c.breaker.opts.SlowCall)
+}
+
+func (c *breakerClient) stats() BreakerStats {
+	stats := c.breaker.Stats()
+	c.pendingLock.Lock()
+	stats.Pending = len(c.pending)
+	c.pendingLock.Unlock()
+	return stats
+}
+
+func pendingKey(header *pkt.Header) string {
+	return fmt.Sprintf("%s/%d", header.ChannelId, header.Sequence)
+}
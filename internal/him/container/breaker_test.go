@@ -0,0 +1,201 @@
+package container
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/tcp"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClient struct {
+	him.Client
+	err error
+}
+
+func (c *fakeClient) ServiceID() string {
+	return "chat1"
+}
+
+func (c *fakeClient) GetMeta() map[string]string {
+	return nil
+}
+
+func (c *fakeClient) Send([]byte) error {
+	return c.err
+}
+
+func Test_breaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(BreakerOptions{MinRequests: 4, Consecutive: 3, OpenTime: time.Second, Probes: 2})
+	b.now = func() time.Time { return now }
+
+	// 连续失败
+	b.Record(false)
+	b.Record(false)
+	assert.Equal(t, BreakerClosed, b.State())
+	b.Record(false)
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.False(t, b.Available())
+	assert.False(t, b.Allow())
+
+	// 半开状态只放行Probes个请求，任意失败重新熔断
+	now = now.Add(time.Second)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Available())
+	b.Record(true)
+	b.Record(false)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	// 探测全部成功之后恢复
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	b.Record(true)
+	b.Record(true)
+	assert.Equal(t, BreakerClosed, b.State())
+
+	// 按照失败率
+	b.Record(false)
+	b.Record(true)
+	b.Record(true)
+	assert.Equal(t, BreakerClosed, b.State())
+	b.Record(false)
+	assert.Equal(t, BreakerOpen, b.State())
+}
+
+func Test_breaker_client(t *testing.T) {
+	now := time.Now()
+	fake := &fakeClient{}
+	cli := newBreakerClient(fake, BreakerOptions{Consecutive: 2, SlowCall: time.Second, Timeout: time.Second * 5})
+	cli.breaker.now = func() time.Time { return now }
+	clients := NewClientMap(1)
+	clients.Add(cli)
+
+	request := func(seq uint32) *pkt.LogicPkt {
+		return pkt.New(wire.CommandChatUserTalk, pkt.WithChannel("gate01_{test1}_1"), pkt.WithSeq(seq))
+	}
+	response := func(p *pkt.LogicPkt, status pkt.Status) {
+		resp := pkt.NewLogicPkt(&p.Header)
+		resp.Flag = pkt.Flag_Response
+		resp.Status = status
+		cli.done(&resp.Header)
+	}
+
+	// 请求在收到响应之后记录，业务错误不计入失败
+	p1 := request(1)
+	assert.Nil(t, cli.sendPacket(p1))
+	assert.Equal(t, 1, cli.stats().Pending)
+	response(p1, pkt.Status_NotFriend)
+	assert.Equal(t, 0, cli.stats().Pending)
+	assert.Equal(t, 0, cli.stats().Failures)
+
+	// 系统错误与慢响应
+	p2, p3 := request(2), request(3)
+	assert.Nil(t, cli.sendPacket(p2))
+	assert.Nil(t, cli.sendPacket(p3))
+	response(p2, pkt.Status_SystemException)
+	now = now.Add(time.Second * 2)
+	response(p3, pkt.Status_Success)
+	assert.Equal(t, BreakerOpen, cli.stats().State)
+	assert.Empty(t, clients.Services())
+	assert.Len(t, clients.All(), 1)
+	assert.Equal(t, ErrCircuitOpen, cli.sendPacket(request(4)))
+
+	// 半开之后的探测请求发送失败
+	now = now.Add(DefaultBreakerOpenTime)
+	assert.Len(t, clients.Services(), 1)
+	fake.err = errors.New("broken pipe")
+	assert.NotNil(t, cli.sendPacket(request(5)))
+	assert.Equal(t, BreakerOpen, cli.stats().State)
+
+	// 不需要响应的包发送成功即记录成功
+	fake.err = nil
+	now = now.Add(DefaultBreakerOpenTime)
+	for i := 0; i < DefaultBreakerProbes; i++ {
+		p := request(uint32(10 + i))
+		p.Flag = pkt.Flag_Push
+		assert.Nil(t, cli.sendPacket(p))
+	}
+	assert.Equal(t, BreakerClosed, cli.stats().State)
+
+	// 超时没有响应
+	assert.Nil(t, cli.sendPacket(request(6)))
+	assert.Nil(t, cli.sendPacket(request(7)))
+	now = now.Add(time.Second * 5)
+	assert.Nil(t, cli.sendPacket(request(8)))
+	assert.Equal(t, BreakerOpen, cli.stats().State)
+}
+
+func Test_breaker_client_touch(t *testing.T) {
+	now := time.Now()
+	cli := newBreakerClient(&fakeClient{}, BreakerOptions{Consecutive: 2, Timeout: time.Second})
+	cli.breaker.now = func() time.Time { return now }
+
+	// 逻辑服务不回复touch，与网关一样按照推送发送，不会等待响应
+	for i := 0; i < 5; i++ {
+		touch := pkt.New(wire.CommandLoginTouch, pkt.WithChannel("gate01_{test1}_1"))
+		touch.Flag = pkt.Flag_Push
+		assert.Nil(t, cli.sendPacket(touch))
+		now = now.Add(time.Second * 2)
+	}
+	assert.True(t, cli.Available())
+	stats := cli.stats()
+	assert.Equal(t, BreakerClosed, stats.State)
+	assert.Equal(t, 0, stats.Pending)
+	assert.Equal(t, 0, stats.Failures)
+}
+
+func Test_breaker_probe_without_response(t *testing.T) {
+	now := time.Now()
+	cli := newBreakerClient(&fakeClient{}, BreakerOptions{Consecutive: 1, OpenTime: time.Second, Probes: 1, Timeout: time.Second * 5})
+	cli.breaker.now = func() time.Time { return now }
+	request := func(seq uint32) *pkt.LogicPkt {
+		return pkt.New(wire.CommandChatUserTalk, pkt.WithChannel("gate01_{test1}_1"), pkt.WithSeq(seq))
+	}
+	cli.breaker.Record(false)
+	now = now.Add(time.Second)
+
+	// 探测请求一直没有响应，名额被占用
+	assert.Nil(t, cli.sendPacket(request(1)))
+	assert.False(t, cli.Available())
+	assert.Equal(t, ErrCircuitOpen, cli.sendPacket(request(2)))
+
+	// 超时之后视为失败重新熔断，OpenTime之后可以再次探测
+	now = now.Add(time.Second * 5)
+	assert.False(t, cli.Available())
+	assert.Equal(t, BreakerOpen, cli.stats().State)
+	assert.Equal(t, 0, cli.stats().Pending)
+	now = now.Add(time.Second)
+	assert.True(t, cli.Available())
+	p := request(3)
+	assert.Nil(t, cli.sendPacket(p))
+	resp := pkt.NewLogicPkt(&p.Header)
+	resp.Flag = pkt.Flag_Response
+	cli.done(&resp.Header)
+	assert.Equal(t, BreakerClosed, cli.stats().State)
+}
+
+func Test_breaker_client_meta(t *testing.T) {
+	cli := tcp.NewClientWithProps("chat1", wire.SNChat, map[string]string{KeyServiceSince: "100"}, tcp.ClientOptions{})
+	bc := newBreakerClient(cli, BreakerOptions{})
+	assert.Equal(t, "100", bc.GetMeta()[KeyServiceSince])
+
+	// 注册中心更新负载之后，选择器读到新的元数据，慢启动的开始时间不变
+	meta := make(map[string]string)
+	(&naming.Load{CPU: 50, Time: time.Now()}).Fill(meta)
+	bc.setMeta(meta)
+	load, ok := naming.ParseLoad(bc.GetMeta())
+	assert.True(t, ok)
+	assert.EqualValues(t, 50, load.CPU)
+	assert.Equal(t, "100", bc.GetMeta()[KeyServiceSince])
+	_, ok = meta[KeyServiceSince]
+	assert.False(t, ok)
+}
@@ -13,6 +13,8 @@ type ClientMap interface {
 	Get(clientId string) (client him.Client, ok bool)
 
 	Services(kvs ...string) []him.Service
+	// All 返回全部客户端，包括熔断的
+	All() []him.Client
 }
 
 type ClientMapImpl struct {
@@ -46,7 +48,7 @@ func (ch *ClientMapImpl) Get(clientId string) (client him.Client, ok bool) {
 	return val.(him.Client), true
 }
 
-// Services 返回服务列表
+// Services 返回可用的服务列表，kvs为一组key、value时只返回Meta中匹配的服务
 // TODO: 优化kvs传参
 func (ch *ClientMapImpl) Services(kvs ...string) []him.Service {
 	kvLen := len(kvs)
@@ -56,14 +58,28 @@ func (ch *ClientMapImpl) Services(kvs ...string) []him.Service {
 	serviceArr := make([]him.Service, 0)
 	ch.client.Range(func(key, value any) bool {
 		ser := value.(him.Service)
+		// 熔断的服务不参与选择
+		if b, ok := value.(interface{ Available() bool }); ok && !b.Available() {
+			return true
+		}
 		if kvLen > 0 && ser.GetMeta()[kvs[0]] != kvs[1] {
-			serviceArr = append(serviceArr, ser)
+			return true
 		}
+		serviceArr = append(serviceArr, ser)
 		return true
 	})
 	return serviceArr
 }
 
+func (ch *ClientMapImpl) All() []him.Client {
+	list := make([]him.Client, 0)
+	ch.client.Range(func(key, value any) bool {
+		list = append(list, value.(him.Client))
+		return true
+	})
+	return list
+}
+
 func NewClientMap(num int) ClientMap {
 	return &ClientMapImpl{client: new(sync.Map)}
 }
@@ -5,8 +5,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -30,19 +30,12 @@ const (
 	stateClosed
 )
 
-// 新/旧服务
-const (
-	StateYoung = "young"
-	StateAdult = "adult"
-)
-
-const (
-	KeyServiceState = "service_state"
-)
+// KeyServiceSince 服务被发现的时间(unix纳秒)，启动时已经存在的服务为0
+// 选择器据此对新服务慢启动
+const KeyServiceSince = "service_since"
 
 type Container struct {
 	sync.RWMutex
-
 	Naming    naming.Naming
 	Srv       him.Server
 	state     int32
@@ -51,24 +44,88 @@ type Container struct {
 	dialer    him.Dialer
 	// 需要依赖的服务
 	deps map[string]struct{}
+	// kickout 带有MetaKickout的消息推送之后回调，由网关关闭连接
+	kickout func(channels []string)
+	// load 为nil时不上报负载
+	load *LoadOptions
+	// breaker 每个上游服务客户端的熔断参数
+	breaker BreakerOptions
+	// shutdownTimeout Run在ctx结束之后关闭的超时时间
+	shutdownTimeout time.Duration
+	done            chan struct{}
+	// stopped Shutdown完成之后关闭
+	stopped chan struct{}
+}
+
+// DefaultShutdownTimeout Run在ctx结束之后关闭容器的超时时间
+const DefaultShutdownTimeout = time.Second * 10
+
+// Options 容器的参数，Server与Naming必须设置
+type Options struct {
+	Server him.Server
+	// Deps 依赖的服务
+	Deps   []string
+	Naming naming.Naming
+	// Dialer 连接依赖服务，Deps不为空时必须设置
+	Dialer him.Dialer
+	// Selector 为nil时使用HashSelector
+	Selector Selector
+	Kickout  func(channels []string)
+	// Load 为nil时不上报负载
+	Load    *LoadOptions
+	Breaker BreakerOptions
+	// ShutdownTimeout 推送GoAway之后等待消息写完的时间，为0时使用DefaultShutdownTimeout
+	ShutdownTimeout time.Duration
 }
 
 var log = logger.WithFields(logger.Fields{"module": "container"})
 
-// default Container
-// 单例模式
-var c = &Container{
-	state:    0,
-	selector: &HashSelector{},
-	deps:     make(map[string]struct{}),
+// defaultContainer 包级函数使用的默认容器
+var defaultContainer = newContainer()
+
+func newContainer() *Container {
+	return &Container{
+		state:           stateUninitialized,
+		selector:        &HashSelector{},
+		deps:            make(map[string]struct{}),
+		srvClient:       make(map[string]ClientMap),
+		shutdownTimeout: DefaultShutdownTimeout,
+		done:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
 }
 
-func Default() *Container {
+// New 创建一个容器，同一个进程中可以运行多个容器
+func New(opts Options) *Container {
+	c := newContainer()
+	c.Srv = opts.Server
+	c.Naming = opts.Naming
+	c.dialer = opts.Dialer
+	if opts.Selector != nil {
+		c.selector = opts.Selector
+	}
+	c.kickout = opts.Kickout
+	c.breaker = opts.Breaker
+	if opts.ShutdownTimeout > 0 {
+		c.shutdownTimeout = opts.ShutdownTimeout
+	}
+	if opts.Load != nil {
+		c.EnableLoadReport(*opts.Load)
+	}
+	for _, dep := range opts.Deps {
+		c.deps[dep] = struct{}{}
+	}
+	c.state = stateInitialized
 	return c
 }
 
-// Init 初始化服务，由上层传入依赖服务
+func Default() *Container {
+	return defaultContainer
+}
+
+// Init 初始化默认容器，由上层传入依赖服务
 func Init(srv him.Server, deps ...string) error {
+	c := defaultContainer
 	if !atomic.CompareAndSwapInt32(&c.state, stateUninitialized, stateInitialized) {
 		return errors.New("has Initialized")
 	}
@@ -81,36 +138,62 @@ func Init(srv him.Server, deps ...string) error {
 		c.deps[dep] = struct{}{}
 	}
 	log.WithField("func", "Init").Infof("srv %s:%s - deps %v", srv.ServiceID(), srv.ServiceName(), c.deps)
-	c.srvClient = make(map[string]ClientMap, len(deps))
 	return nil
 }
 
 // SetDialer set tcp dialer
 func SetDialer(dialer him.Dialer) {
-	c.dialer = dialer
+	defaultContainer.dialer = dialer
 }
 
 // SetSelector set a default selector
 // 用于上层业务注册一个自定义的服务路由器
 func SetSelector(selector Selector) {
-	c.selector = selector
+	defaultContainer.selector = selector
 }
 
-func EnableMonitor(listen string) error {
-	return nil
+// SetKickout 设置踢下线回调，逻辑服务推送的下线通知送达之后调用
+func SetKickout(kickout func(channels []string)) {
+	defaultContainer.kickout = kickout
+}
+
+// SetBreaker 设置熔断参数，在Start之前调用
+func SetBreaker(opts BreakerOptions) {
+	defaultContainer.breaker = opts
 }
 
 // SetServiceNaming set service naming
 func SetServiceNaming(nm naming.Naming) {
-	c.Naming = nm
+	defaultContainer.Naming = nm
 }
 
-// Start 启动容器
-// step1: 服务注册
-// step2：启动Server
-// step3：监听依赖服务
-// step4：系统退出
+// Start 启动默认容器，收到退出信号之后关闭
 func Start() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	return defaultContainer.Run(ctx)
+}
+
+// Push a message to gateway
+// 逻辑服务-消息下行，使用默认容器
+func Push(server string, p *pkt.LogicPkt) error {
+	return defaultContainer.Push(server, p)
+}
+
+// Forward 通过默认容器转发消息
+func Forward(serviceName string, packet *pkt.LogicPkt) error {
+	return defaultContainer.Forward(serviceName, packet)
+}
+
+// Run 启动容器，阻塞到ctx结束或者调用了Shutdown
+// step1: 启动Server
+// step2：监听依赖服务
+// step3：服务注册
+// step4：ctx结束之后在ShutdownTimeout内关闭
+func (c *Container) Run(ctx context.Context) error {
+	if c.Srv == nil {
+		return fmt.Errorf("server is nil")
+	}
 	if c.Naming == nil {
 		return fmt.Errorf("naming is nil")
 	}
@@ -119,17 +202,15 @@ func Start() error {
 	}
 
 	// 启动服务Server
+	errs := make(chan error, 1)
 	go func(src him.Server) {
-		err := src.Start()
-		if err != nil {
-			log.Errorln(err)
-		}
+		errs <- src.Start()
 	}(c.Srv)
 
 	// 与依赖的服务建立连接
 	for service := range c.deps {
 		go func(service string) {
-			err := connectToService(service)
+			err := c.connectToService(service)
 			if err != nil {
 				log.Errorln(err)
 			}
@@ -137,39 +218,80 @@ func Start() error {
 	}
 
 	if c.Srv.PublicAddress() != "" && c.Srv.PublicPort() != 0 {
-		err := c.Naming.Register(c.Srv)
-		if err != nil {
+		if c.load != nil {
+			// 注册时带上负载，之后定时或者负载变化时重新注册
+			reporter := newLoadReporter(*c.load, c.Srv, c.Naming)
+			if err := reporter.register(reporter.sample(time.Now())); err != nil {
+				log.Errorln(err)
+			}
+			go reporter.run(c.done)
+		} else if err := c.Naming.Register(c.Srv); err != nil {
 			log.Errorln(err)
 		}
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	var err error
+	select {
+	case <-c.stopped:
+		return nil
+	case err = <-errs:
+		if atomic.LoadInt32(&c.state) == stateClosed {
+			<-c.stopped
+			return nil
+		}
+		log.Errorln(err)
+	case <-ctx.Done():
+		log.Infoln("shutdown", ctx.Err())
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+	defer cancel()
+	if c.Shutdown(sctx) != nil {
+		// 已经由其它goroutine关闭
+		<-c.stopped
+	}
+	return err
+}
+
+// Shutdown 注销服务之后关闭Server，最后退订依赖服务并断开与它们的连接
+// 可以在Run返回之前由其它goroutine调用
+func (c *Container) Shutdown(ctx context.Context) error {
+	return c.shutdown(ctx, true)
+}
 
-	log.Infoln("shutdown", <-c)
-	return shutdown()
+// Release 监听已经交给新进程时调用，与Shutdown相同但是不注销服务，注册信息由新进程继续使用
+func (c *Container) Release(ctx context.Context) error {
+	return c.shutdown(ctx, false)
 }
 
-func shutdown() error {
+func (c *Container) shutdown(ctx context.Context, deregister bool) error {
 	if !atomic.CompareAndSwapInt32(&c.state, stateStarted, stateClosed) {
 		return errors.New("has closed")
 	}
-	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
-	defer cancel()
-	// 优雅关机
+	defer close(c.stopped)
+	close(c.done)
+	// 先从注册中心注销服务，新的连接不再分配到这里
+	if deregister {
+		if err := c.Naming.Deregister(c.Srv.ServiceID()); err != nil {
+			log.Warn(err)
+		}
+	}
+	// 优雅关机，Server推送GoAway通知并等待推送写完
 	err := c.Srv.Shutdown(ctx)
 	if err != nil {
 		log.Error(err)
 	}
-	// 从注册中心注销服务
-	err = c.Naming.Deregister(c.Srv.ServiceID())
-	if err != nil {
-		log.Warn(err)
-	}
 	// 退订服务变更
 	for dep := range c.deps {
 		_ = c.Naming.Unsubscribe(dep)
 	}
+	// 关闭与依赖服务的连接
+	c.RLock()
+	for _, clients := range c.srvClient {
+		for _, cli := range clients.All() {
+			cli.Close()
+		}
+	}
+	c.RUnlock()
 
 	log.Infoln("shutdown")
 	return nil
@@ -177,56 +299,57 @@ func shutdown() error {
 
 // Push a message to gateway
 // 逻辑服务-消息下行
-func Push(server string, p *pkt.LogicPkt) error {
+func (c *Container) Push(server string, p *pkt.LogicPkt) error {
+	return c.PushTo(server, server, p)
+}
+
+// PushTo 通过网关进程的连接推送，conn为连接的InstanceId，server为网关的ServiceId
+// 网关交接期间同一个ServiceId的新旧进程分别连接，按照channel所在的进程选择连接
+func (c *Container) PushTo(conn string, server string, p *pkt.LogicPkt) error {
+	p.DelMeta(wire.MetaDestServer)
 	p.AddStringMeta(wire.MetaDestServer, server)
-	return c.Srv.Push(server, pkt.Marshal(p))
+	return c.Srv.Push(conn, pkt.Marshal(p))
 }
 
 // connectToService is used to connect to service: login or chat
-func connectToService(serviceName string) error {
+func (c *Container) connectToService(serviceName string) error {
 	clients := NewClientMap(10)
+	c.Lock()
 	c.srvClient[serviceName] = clients
+	c.Unlock()
 
-	// 首先：watch服务的新增
-	delay := time.Second * 10
-	err := c.Naming.Subscribe(serviceName, func(services []him.ServiceRegistration) {
-		for _, service := range services {
-			if _, ok := clients.Get(service.ServiceID()); ok {
-				continue
-			}
-			log.WithField("func", "connectToService").Infof("Watch a new service: %v", service)
-			service.GetMeta()[KeyServiceState] = StateYoung
-			// delay 目的：新服务暂时不使用
-			go func(service him.ServiceRegistration) {
-				time.Sleep(delay)
-				service.GetMeta()[KeyServiceState] = StateAdult
-			}(service)
-
-			_, err := buildClient(clients, service)
-			if err != nil {
-				logger.Warn(err)
-			}
-		}
-	})
-	if err != nil {
-		return err
-	}
-
-	// 查询已经存在的服务
+	// 首先查询已经存在的服务，它们不需要慢启动
 	service, err := c.Naming.Find(serviceName)
 	if err != nil {
 		return err
 	}
 	log.Info("find service", service)
 	for _, s := range service {
-		// 标记为StateAdult
-		s.GetMeta()[KeyServiceState] = StateAdult
-		_, err := buildClient(clients, s)
+		s.GetMeta()[KeyServiceSince] = "0"
+		_, err := c.buildClient(clients, s)
 		if err != nil {
 			logger.Warn(err)
 		}
 	}
-	return nil
+
+	// 然后watch服务的变化：新增的服务建立连接，已经连接的服务更新负载等元数据
+	return c.Naming.Subscribe(serviceName, func(services []him.ServiceRegistration) {
+		for _, service := range services {
+			if cli, ok := clients.Get(service.ServiceID()); ok {
+				if bc, ok := cli.(*breakerClient); ok {
+					bc.setMeta(service.GetMeta())
+				}
+				continue
+			}
+			log.WithField("func", "connectToService").Infof("Watch a new service: %v", service)
+			service.GetMeta()[KeyServiceSince] = strconv.FormatInt(time.Now().UnixNano(), 10)
+
+			_, err := c.buildClient(clients, service)
+			if err != nil {
+				logger.Warn(err)
+			}
+		}
+	})
 }
 
 // buildClient 构建客户端
@@ -234,9 +357,8 @@ func connectToService(serviceName string) error {
 // 校验协议，服务之间只允许tcp协议
 // 读取消息readLoop
 // 添加到客户端集合
-func buildClient(clients ClientMap, service him.ServiceRegistration) (him.Client, error) {
-	c.Lock()
-	defer c.Unlock()
+// 建立连接时不持有锁，避免一个服务连接超时阻塞其它服务的连接与转发
+func (c *Container) buildClient(clients ClientMap, service him.ServiceRegistration) (him.Client, error) {
 	var (
 		id   = service.ServiceID()
 		name = service.ServiceName()
@@ -250,37 +372,50 @@ func buildClient(clients ClientMap, service him.ServiceRegistration) (him.Client
 	if service.GetProtocol() != string(wire.ProtocolTCP) {
 		return nil, fmt.Errorf("unexpected service Protocol: %s", service.GetProtocol())
 	}
+	c.RLock()
+	dialer, breaker := c.dialer, c.breaker
+	c.RUnlock()
+	if dialer == nil {
+		return nil, fmt.Errorf("dialer is nil")
+	}
 
 	// 构建客户端并建立连接
-	cli := tcp.NewClientWithProps(id, name, meta, tcp.ClientOptions{
+	cli := tcp.NewClientWithTags(id, name, meta, service.GetTags(), tcp.ClientOptions{
 		Heartbeat: him.DefaultHeartbeat,
 		ReadWait:  him.DefaultReadWait,
 		WriteWait: him.DefaultWriteWait,
 	})
-	if c.dialer == nil {
-		return nil, fmt.Errorf("dialer is nil")
-	}
-	cli.SetDialer(c.dialer)
-	err := cli.Connect(service.ServiceID())
+	cli.SetDialer(dialer)
+	err := cli.Connect(service.DialURL())
 	if err != nil {
 		return nil, err
 	}
+	bc := newBreakerClient(cli, breaker)
+
+	// 并发建立了同一个服务的连接时，保留先加入的一个
+	c.Lock()
+	if _, ok := clients.Get(id); ok {
+		c.Unlock()
+		cli.Close()
+		return nil, nil
+	}
+	clients.Add(bc)
+	c.Unlock()
+
 	// 读取消息
-	go func(cli him.Client) {
-		err := readLoop(cli)
+	go func(cli *breakerClient) {
+		err := c.readLoop(cli)
 		if err != nil {
 			log.Debug(err)
 		}
 		clients.Remove(id)
 		cli.Close()
-	}(cli)
-
-	clients.Add(cli)
-	return cli, nil
+	}(bc)
+	return bc, nil
 }
 
 // read Loop 服务间的消息读取
-func readLoop(cli him.Client) error {
+func (c *Container) readLoop(cli *breakerClient) error {
 	log := logger.WithFields(logger.Fields{
 		"module": "container",
 		"func":   "readLoop",
@@ -301,7 +436,10 @@ func readLoop(cli him.Client) error {
 			log.Info(err)
 			continue
 		}
-		err = pushMessage(packet)
+		if packet.Flag == pkt.Flag_Response {
+			cli.done(&packet.Header)
+		}
+		err = c.pushMessage(packet)
 		if err != nil {
 			log.Info(err)
 		}
@@ -311,21 +449,23 @@ func readLoop(cli him.Client) error {
 // pushMessage 消息下行
 // 根据设计的定位规则，把消息通过Server写到指定的Channel
 // 消息通过网关服务器推送到channel
-func pushMessage(packet *pkt.LogicPkt) error {
+func (c *Container) pushMessage(packet *pkt.LogicPkt) error {
 	server, _ := packet.GetMeta(wire.MetaDestServer)
 	if server != c.Srv.ServiceID() {
 		return fmt.Errorf("dest_server is incorrect, %s != %s", server, c.Srv.ServiceID())
 	}
 	channels, ok := packet.GetMeta(wire.MetaDestChannels)
 	if !ok {
-		return fmt.Errorf("dest_channels is incorrect, %s !=")
+		return fmt.Errorf("dest_channels is empty")
 	}
 
 	channelIds := strings.Split(channels.(string), ",")
 	packet.DelMeta(wire.MetaDestServer)
 	packet.DelMeta(wire.MetaDestChannels)
+	_, kickout := packet.GetMeta(wire.MetaKickout)
+	packet.DelMeta(wire.MetaKickout)
 	payload := pkt.Marshal(packet)
-	log.Debug("push to %v %v", channelIds, packet)
+	log.Debugf("push to %v %v", channelIds, packet)
 
 	for _, channel := range channelIds {
 		err := c.Srv.Push(channel, payload)
@@ -333,12 +473,15 @@ func pushMessage(packet *pkt.LogicPkt) error {
 			log.Debug(err)
 		}
 	}
+	if kickout && c.kickout != nil {
+		c.kickout(channelIds)
+	}
 	return nil
 }
 
 // Forward
 // 消息上行主要用于 下游服务（长连网关） 发送消息到上游服务（如LoginServer）
-func Forward(serviceName string, packet *pkt.LogicPkt) error {
+func (c *Container) Forward(serviceName string, packet *pkt.LogicPkt) error {
 	if packet == nil {
 		return errors.New("packet is nil")
 	}
@@ -351,28 +494,38 @@ func Forward(serviceName string, packet *pkt.LogicPkt) error {
 		return errors.New("ChannelId is empty in packet")
 	}
 
-	return forwardWithSelector(serviceName, packet, c.selector)
+	return c.forwardWithSelector(serviceName, packet, c.selector)
 }
 
-func forwardWithSelector(serviceName string, packet *pkt.LogicPkt, selector Selector) error {
-	client, err := lookup(serviceName, &packet.Header, selector)
+func (c *Container) forwardWithSelector(serviceName string, packet *pkt.LogicPkt, selector Selector) error {
+	client, err := c.lookup(serviceName, &packet.Header, selector)
 	if err != nil {
 		return err
 	}
 	// add a tag in packet
 	packet.AddStringMeta(wire.MetaDestServer, c.Srv.ServiceID())
-	log.Debug("forward message to %v with %s", client.ServiceID(), &packet.Header)
-	return client.Send(pkt.Marshal(packet))
+	log.Debugf("forward message to %v with %s", client.ServiceID(), &packet.Header)
+	if bc, ok := client.(*breakerClient); ok {
+		err = bc.sendPacket(packet)
+	} else {
+		err = client.Send(pkt.Marshal(packet))
+	}
+	if o, ok := selector.(Observer); ok {
+		o.Observe(client.ServiceID(), err)
+	}
+	return err
 }
 
-func lookup(serviceName string, header *pkt.Header, selector Selector) (him.Client, error) {
+func (c *Container) lookup(serviceName string, header *pkt.Header, selector Selector) (him.Client, error) {
+	c.RLock()
 	clients, ok := c.srvClient[serviceName]
+	c.RUnlock()
 	if !ok {
-		fmt.Errorf("service %s not found", serviceName)
+		return nil, fmt.Errorf("service %s not found", serviceName)
 	}
-	srvs := clients.Services(KeyServiceState, StateAdult)
+	srvs := clients.Services()
 	if len(srvs) == 0 {
-		fmt.Errorf("no service found for %s", serviceName)
+		return nil, fmt.Errorf("no service found for %s", serviceName)
 	}
 	id := selector.Lookup(header, srvs)
 	if cli, ok := clients.Get(id); ok {
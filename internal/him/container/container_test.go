@@ -0,0 +1,184 @@
+package container
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+type memNaming struct {
+	naming.Naming
+	sync.Mutex
+	services map[string]him.ServiceRegistration
+}
+
+func (n *memNaming) Register(s him.ServiceRegistration) error {
+	n.Lock()
+	defer n.Unlock()
+	n.services[s.ServiceID()] = s
+	return nil
+}
+
+func (n *memNaming) Deregister(id string) error {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.services, id)
+	return nil
+}
+
+func (n *memNaming) registered(id string) bool {
+	n.Lock()
+	defer n.Unlock()
+	_, ok := n.services[id]
+	return ok
+}
+
+type fakeServer struct {
+	him.Server
+	id     string
+	stop   chan struct{}
+	once   sync.Once
+	pushed chan string
+}
+
+func newFakeServer(id string) *fakeServer {
+	return &fakeServer{id: id, stop: make(chan struct{}), pushed: make(chan string, 10)}
+}
+
+func (s *fakeServer) ServiceID() string     { return s.id }
+func (s *fakeServer) ServiceName() string   { return "chat" }
+func (s *fakeServer) PublicAddress() string { return "127.0.0.1" }
+func (s *fakeServer) PublicPort() int       { return 8000 }
+
+func (s *fakeServer) Start() error {
+	<-s.stop
+	return nil
+}
+
+func (s *fakeServer) Push(id string, _ []byte) error {
+	s.pushed <- id
+	return nil
+}
+
+func (s *fakeServer) Shutdown(context.Context) error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
+
+func Test_containers_run(t *testing.T) {
+	ns := &memNaming{services: make(map[string]him.ServiceRegistration)}
+	srvA, srvB := newFakeServer("chat01"), newFakeServer("chat02")
+	a := New(Options{Server: srvA, Naming: ns})
+	b := New(Options{Server: srvB, Naming: ns})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	doneA, doneB := make(chan error, 1), make(chan error, 1)
+	go func() { doneA <- a.Run(ctx) }()
+	go func() { doneB <- b.Run(context.Background()) }()
+
+	assert.Eventually(t, func() bool {
+		return ns.registered("chat01") && ns.registered("chat02")
+	}, time.Second, time.Millisecond*10)
+
+	// 每个容器通过自己的Server推送
+	assert.Nil(t, a.Push("gateway01", pkt.New("chat.user.talk")))
+	assert.Equal(t, "gateway01", <-srvA.pushed)
+	assert.Len(t, srvB.pushed, 0)
+
+	// ctx结束只关闭a
+	cancel()
+	assert.Nil(t, <-doneA)
+	assert.False(t, ns.registered("chat01"))
+	assert.True(t, ns.registered("chat02"))
+	assert.NotNil(t, a.Run(context.Background()))
+
+	// 由其它goroutine关闭b
+	assert.Nil(t, b.Shutdown(context.Background()))
+	select {
+	case err := <-doneB:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run not returned after Shutdown")
+	}
+	assert.False(t, ns.registered("chat02"))
+	assert.NotNil(t, b.Shutdown(context.Background()))
+
+	// 包级函数使用的默认容器不受影响
+	assert.NotEqual(t, a, Default())
+}
+
+// blockingDialer 连接slow服务时阻塞直到release关闭，其它服务直接连接到addr
+type blockingDialer struct {
+	addr    string
+	release chan struct{}
+}
+
+func (d *blockingDialer) DialAndHandshake(ctx him.DialerContext) (net.Conn, error) {
+	if ctx.Id == "slow" {
+		<-d.release
+	}
+	return net.Dial("tcp", d.addr)
+}
+
+func Test_build_client_concurrently(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer lst.Close()
+	go func() {
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+
+	dialer := &blockingDialer{addr: lst.Addr().String(), release: make(chan struct{})}
+	c := New(Options{Server: newFakeServer("gateway01"), Dialer: dialer})
+	clients := NewClientMap(10)
+	slow := naming.NewEntry("slow", wire.SNChat, string(wire.ProtocolTCP), "localhost", 8001)
+	fast := naming.NewEntry("fast", wire.SNChat, string(wire.ProtocolTCP), "localhost", 8002)
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := c.buildClient(clients, slow)
+		slowDone <- err
+	}()
+	// 连接slow阻塞时不影响连接其它服务
+	fastDone := make(chan error, 1)
+	go func() {
+		_, err := c.buildClient(clients, fast)
+		fastDone <- err
+	}()
+	select {
+	case err := <-fastDone:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("buildClient blocked by another dial")
+	}
+	_, ok := clients.Get("fast")
+	assert.True(t, ok)
+
+	// 并发连接同一个服务时只保留一个客户端
+	close(dialer.release)
+	cli, err := c.buildClient(clients, slow)
+	assert.Nil(t, err)
+	assert.Nil(t, <-slowDone)
+	got, ok := clients.Get("slow")
+	assert.True(t, ok)
+	if cli != nil {
+		assert.Equal(t, cli, got)
+	}
+	assert.Len(t, clients.All(), 2)
+}
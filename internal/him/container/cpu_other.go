@@ -0,0 +1,10 @@
+//go:build !unix
+
+package container
+
+import "time"
+
+// processCPUTime 不支持的平台不上报CPU
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
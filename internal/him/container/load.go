@@ -0,0 +1,152 @@
+package container
+
+import (
+	"math"
+	"runtime"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+)
+
+// 负载上报的默认参数
+const (
+	DefaultLoadInterval  = time.Second * 30
+	DefaultLoadSample    = time.Second * 5
+	DefaultLoadThreshold = 0.2
+)
+
+// LoadOptions 负载通过重新注册服务写入Meta，服务消费方通过Find或Subscribe读取
+type LoadOptions struct {
+	// Interval 负载没有明显变化时重新注册的间隔
+	Interval time.Duration
+	// Sample 采样间隔
+	Sample time.Duration
+	// Threshold 与上次上报相比变化超过这个比例时立即重新注册
+	Threshold float64
+	// Connections 当前连接数，为nil时上报0
+	Connections func() int
+	// Queue 待处理的推送消息数，为nil时上报0
+	Queue func() int
+}
+
+// EnableLoadReport 默认容器上报负载，在Start之前调用
+func EnableLoadReport(opts LoadOptions) {
+	defaultContainer.EnableLoadReport(opts)
+}
+
+// EnableLoadReport 在Run之前调用
+func (c *Container) EnableLoadReport(opts LoadOptions) {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultLoadInterval
+	}
+	if opts.Sample <= 0 {
+		opts.Sample = DefaultLoadSample
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultLoadThreshold
+	}
+	c.load = &opts
+}
+
+// loadRegistration 注册信息中的Meta替换为带有负载的副本，不修改Server本身的Meta
+type loadRegistration struct {
+	him.ServiceRegistration
+	meta map[string]string
+}
+
+func (s *loadRegistration) GetMeta() map[string]string {
+	return s.meta
+}
+
+type loadReporter struct {
+	opts   LoadOptions
+	srv    him.ServiceRegistration
+	naming naming.Naming
+	cpu    cpuSampler
+	last   naming.Load
+}
+
+func newLoadReporter(opts LoadOptions, srv him.ServiceRegistration, ns naming.Naming) *loadReporter {
+	return &loadReporter{
+		opts:   opts,
+		srv:    srv,
+		naming: ns,
+	}
+}
+
+func (r *loadReporter) run(done <-chan struct{}) {
+	ticker := time.NewTicker(r.opts.Sample)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			load := r.sample(now)
+			if now.Sub(r.last.Time) < r.opts.Interval && !r.changed(load) {
+				continue
+			}
+			if err := r.register(load); err != nil {
+				log.WithField("func", "reportLoad").Warn(err)
+			}
+		}
+	}
+}
+
+func (r *loadReporter) sample(now time.Time) naming.Load {
+	load := naming.Load{
+		CPU:  r.cpu.percent(),
+		Time: now,
+	}
+	if r.opts.Connections != nil {
+		load.Connections = r.opts.Connections()
+	}
+	if r.opts.Queue != nil {
+		load.Queue = r.opts.Queue()
+	}
+	return load
+}
+
+// changed 连接数与队列以100为下限、CPU以10为下限计算变化比例，避免空闲时频繁注册
+func (r *loadReporter) changed(load naming.Load) bool {
+	exceed := func(prev, cur, floor float64) bool {
+		return math.Abs(cur-prev) > r.opts.Threshold*math.Max(prev, floor)
+	}
+	return exceed(float64(r.last.Connections), float64(load.Connections), 100) ||
+		exceed(r.last.CPU, load.CPU, 10) ||
+		exceed(float64(r.last.Queue), float64(load.Queue), 100)
+}
+
+func (r *loadReporter) register(load naming.Load) error {
+	meta := make(map[string]string, len(r.srv.GetMeta())+4)
+	for k, v := range r.srv.GetMeta() {
+		meta[k] = v
+	}
+	load.Fill(meta)
+	if err := r.naming.Register(&loadRegistration{ServiceRegistration: r.srv, meta: meta}); err != nil {
+		return err
+	}
+	r.last = load
+	return nil
+}
+
+// cpuSampler 根据两次采样之间进程占用的CPU时间计算使用率
+type cpuSampler struct {
+	wall time.Time
+	cpu  time.Duration
+}
+
+func (s *cpuSampler) percent() float64 {
+	cpu, ok := processCPUTime()
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	var p float64
+	if elapsed := now.Sub(s.wall); !s.wall.IsZero() && elapsed > 0 {
+		p = float64(cpu-s.cpu) / float64(elapsed) / float64(runtime.NumCPU()) * 100
+	}
+	s.wall, s.cpu = now, cpu
+	return math.Min(math.Max(p, 0), 100)
+}
@@ -0,0 +1,51 @@
+package container
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNaming struct {
+	naming.Naming
+	registered []him.ServiceRegistration
+}
+
+func (n *fakeNaming) Register(s him.ServiceRegistration) error {
+	n.registered = append(n.registered, s)
+	return nil
+}
+
+func Test_load_reporter(t *testing.T) {
+	srv := &naming.RegisterService{Id: "gate01", Name: "wgateway", Meta: map[string]string{"zone": "sh"}}
+	ns := &fakeNaming{}
+	r := newLoadReporter(LoadOptions{
+		Interval:    time.Minute,
+		Threshold:   DefaultLoadThreshold,
+		Connections: func() int { return 1000 },
+		Queue:       func() int { return 5 },
+	}, srv, ns)
+
+	assert.Nil(t, r.register(r.sample(time.Now())))
+	assert.Len(t, ns.registered, 1)
+	meta := ns.registered[0].GetMeta()
+	assert.Equal(t, "sh", meta["zone"])
+	load, ok := naming.ParseLoad(meta)
+	assert.True(t, ok)
+	assert.Equal(t, 1000, load.Connections)
+	assert.Equal(t, 5, load.Queue)
+	// 不修改Server本身的Meta
+	_, ok = naming.ParseLoad(srv.GetMeta())
+	assert.False(t, ok)
+
+	r.last.CPU = 0
+	assert.False(t, r.changed(naming.Load{Connections: 1100, Queue: 5}))
+	assert.True(t, r.changed(naming.Load{Connections: 1300, Queue: 5}))
+	assert.True(t, r.changed(naming.Load{Connections: 1000, Queue: 5, CPU: 30}))
+	// 空闲时以下限计算，小的波动不触发注册
+	r.last = naming.Load{Connections: 1, CPU: 1}
+	assert.False(t, r.changed(naming.Load{Connections: 15, CPU: 2}))
+}
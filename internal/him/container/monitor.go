@@ -0,0 +1,78 @@
+package container
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// ServiceStatus 监控输出中的一个上游服务
+type ServiceStatus struct {
+	ID      string       `json:"id"`
+	Breaker BreakerStats `json:"breaker"`
+}
+
+type MonitorStatus struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Services 依赖的服务名对应的客户端
+	Services map[string][]ServiceStatus `json:"services"`
+}
+
+// EnableMonitor 启动默认容器的监控接口
+func EnableMonitor(listen string) error {
+	return defaultContainer.EnableMonitor(listen)
+}
+
+// Status 默认容器依赖服务的当前状态
+func Status() *MonitorStatus {
+	return defaultContainer.Status()
+}
+
+// EnableMonitor 启动监控接口
+func (c *Container) EnableMonitor(listen string) error {
+	go func() {
+		if err := http.ListenAndServe(listen, c.MonitorHandler()); err != nil {
+			log.WithField("func", "EnableMonitor").Error(err)
+		}
+	}()
+	return nil
+}
+
+// MonitorHandler /health 用于注册中心的健康检查，/monitor 输出依赖服务的熔断状态
+func (c *Container) MonitorHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/monitor", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Status())
+	})
+	return mux
+}
+
+// Status 依赖服务的当前状态
+func (c *Container) Status() *MonitorStatus {
+	c.RLock()
+	defer c.RUnlock()
+	status := &MonitorStatus{Services: make(map[string][]ServiceStatus, len(c.srvClient))}
+	if c.Srv != nil {
+		status.ID, status.Name = c.Srv.ServiceID(), c.Srv.ServiceName()
+	}
+	for name, clients := range c.srvClient {
+		list := make([]ServiceStatus, 0)
+		for _, cli := range clients.All() {
+			item := ServiceStatus{ID: cli.ServiceID()}
+			if bc, ok := cli.(*breakerClient); ok {
+				item.Breaker = bc.stats()
+			}
+			list = append(list, item)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].ID < list[j].ID
+		})
+		status.Services[name] = list
+	}
+	return status
+}
@@ -0,0 +1,263 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+)
+
+// Buckets 账号哈希之后的桶数，Rule.Buckets按照百分比配置
+const Buckets = 100
+
+// Rule 灰度规则，条件都满足时路由到带有Tags中全部标签的服务
+// 为空的条件不做限制
+type Rule struct {
+	Name  string   `json:"name"`
+	Apps  []string `json:"apps"`
+	Zones []string `json:"zones"`
+	// Buckets 账号哈希到[0,100)之后落在[From, To)中时命中，To为0时不限制
+	Buckets struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+	} `json:"buckets"`
+	// MinVersion 与 MaxVersion 客户端版本范围，包含两端
+	MinVersion string `json:"min_version"`
+	MaxVersion string `json:"max_version"`
+	// Tags 目标服务需要带有的标签
+	Tags []string `json:"tags"`
+	// Exclusive 目标服务只接收命中这条规则的消息
+	Exclusive bool `json:"exclusive"`
+}
+
+// match 网关转发时在包中添加了连接属性，没有属性的包只匹配不限制该属性的规则
+func (r *Rule) match(header *pkt.Header) bool {
+	if len(r.Apps) > 0 && !contains(r.Apps, metaOf(header, wire.MetaApp)) {
+		return false
+	}
+	if len(r.Zones) > 0 && !contains(r.Zones, metaOf(header, wire.MetaZone)) {
+		return false
+	}
+	if r.Buckets.To > 0 {
+		bucket := HashCode(metaOf(header, wire.MetaAccount)) % Buckets
+		if bucket < r.Buckets.From || bucket >= r.Buckets.To {
+			return false
+		}
+	}
+	if r.MinVersion != "" || r.MaxVersion != "" {
+		version := metaOf(header, wire.MetaVersion)
+		if version == "" {
+			return false
+		}
+		if r.MinVersion != "" && CompareVersion(version, r.MinVersion) < 0 {
+			return false
+		}
+		if r.MaxVersion != "" && CompareVersion(version, r.MaxVersion) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// RuleSelector 按照规则选出服务子集，再交给fallback在子集中选择
+// 没有命中规则或者命中规则的服务都不可用时，在非独占的服务中选择
+type RuleSelector struct {
+	rules    atomic.Value // []Rule
+	fallback Selector
+}
+
+// NewRuleSelector fallback为nil时使用HashSelector
+func NewRuleSelector(rules []Rule, fallback Selector) *RuleSelector {
+	if fallback == nil {
+		fallback = &HashSelector{}
+	}
+	s := &RuleSelector{fallback: fallback}
+	s.SetRules(rules)
+	return s
+}
+
+// SetRules 替换全部规则，可以在运行时调用
+func (s *RuleSelector) SetRules(rules []Rule) {
+	if rules == nil {
+		rules = []Rule{}
+	}
+	s.rules.Store(rules)
+}
+
+func (s *RuleSelector) Rules() []Rule {
+	return s.rules.Load().([]Rule)
+}
+
+func (s *RuleSelector) Lookup(header *pkt.Header, services []him.Service) string {
+	rules := s.Rules()
+	for i := range rules {
+		if !rules[i].match(header) {
+			continue
+		}
+		if list := filterTags(services, rules[i].Tags); len(list) > 0 {
+			return s.fallback.Lookup(header, list)
+		}
+	}
+	// 排除独占的服务
+	list := make([]him.Service, 0, len(services))
+	for _, srv := range services {
+		exclusive := false
+		for i := range rules {
+			if rules[i].Exclusive && hasTags(srv, rules[i].Tags) {
+				exclusive = true
+				break
+			}
+		}
+		if !exclusive {
+			list = append(list, srv)
+		}
+	}
+	if len(list) == 0 {
+		list = services
+	}
+	return s.fallback.Lookup(header, list)
+}
+
+// Observe 把发送结果交给fallback
+func (s *RuleSelector) Observe(serviceID string, err error) {
+	if o, ok := s.fallback.(Observer); ok {
+		o.Observe(serviceID, err)
+	}
+}
+
+// Watch 每隔interval检查一次规则文件，内容变化时重新加载，直到ctx结束
+func (s *RuleSelector) Watch(ctx context.Context, file string, interval time.Duration) {
+	var last []byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			buf, err := os.ReadFile(file)
+			if err != nil {
+				log.WithField("func", "RuleSelector.Watch").Warn(err)
+				continue
+			}
+			if bytes.Equal(buf, last) {
+				continue
+			}
+			rules, err := ParseRules(buf)
+			if err != nil {
+				log.WithField("func", "RuleSelector.Watch").Warn(err)
+				continue
+			}
+			s.SetRules(rules)
+			last = buf
+			log.Infof("%d route rules loaded from %s", len(rules), file)
+		}
+	}
+}
+
+// LoadRules 从JSON文件中读取规则
+func LoadRules(file string) ([]Rule, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(buf)
+}
+
+func ParseRules(buf []byte) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// CompareVersion 按照点分隔的数字比较版本，非数字部分按照字符串比较
+func CompareVersion(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		if x == "" {
+			xn, xerr = 0, nil
+		}
+		if y == "" {
+			yn, yerr = 0, nil
+		}
+		if xerr == nil && yerr == nil {
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func metaOf(header *pkt.Header, key string) string {
+	for _, m := range header.GetMeta() {
+		if m.GetKey() == key {
+			return m.GetValue()
+		}
+	}
+	return ""
+}
+
+// tagsOf 客户端没有标签时返回nil
+func tagsOf(srv him.Service) []string {
+	if t, ok := srv.(interface{ GetTags() []string }); ok {
+		return t.GetTags()
+	}
+	return nil
+}
+
+func hasTags(srv him.Service, tags []string) bool {
+	own := tagsOf(srv)
+	for _, tag := range tags {
+		if !contains(own, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func filterTags(services []him.Service, tags []string) []him.Service {
+	list := make([]him.Service, 0, len(services))
+	for _, srv := range services {
+		if hasTags(srv, tags) {
+			list = append(list, srv)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
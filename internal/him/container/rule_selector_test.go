@@ -0,0 +1,74 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/tcp"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func header(app, account, zone, version string) *pkt.Header {
+	p := pkt.New(wire.CommandChatUserTalk, pkt.WithChannel("gate01_{"+account+"}_1"))
+	p.AddStringMeta(wire.MetaApp, app)
+	p.AddStringMeta(wire.MetaAccount, account)
+	p.AddStringMeta(wire.MetaZone, zone)
+	p.AddStringMeta(wire.MetaVersion, version)
+	return &p.Header
+}
+
+func Test_rule_selector(t *testing.T) {
+	services := []him.Service{
+		tcp.NewClientWithTags("chat1", wire.SNChat, nil, nil, tcp.ClientOptions{}),
+		tcp.NewClientWithTags("chat2", wire.SNChat, nil, []string{"zone:sh"}, tcp.ClientOptions{}),
+		tcp.NewClientWithTags("gray1", wire.SNChat, nil, []string{"gray"}, tcp.ClientOptions{}),
+	}
+	rules, err := LoadRules("../services/gateway/route_rules.example.json")
+	assert.Nil(t, err)
+	s := NewRuleSelector(rules, nil)
+
+	// 新版本客户端
+	assert.Equal(t, "gray1", s.Lookup(header("im", "test1", "", "2.1"), services))
+	assert.Equal(t, "gray1", s.Lookup(header("kim", "test1", "", "v10.0.1"), services))
+	// 按照区域
+	assert.Equal(t, "chat2", s.Lookup(header("kim", "test1", "sh", "1.9.9"), services))
+
+	// 按照账号哈希的10%进入灰度，其它账号不会路由到独占的灰度服务
+	gray := 0
+	for i := 0; i < 1000; i++ {
+		id := s.Lookup(header("im", fmt.Sprintf("u%d", i), "", "1.0"), services)
+		if id == "gray1" {
+			gray++
+		}
+	}
+	assert.InDelta(t, 100, gray, 40)
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(t, "gray1", s.Lookup(header("kim", fmt.Sprintf("u%d", i), "", "1.0"), services))
+	}
+
+	// 灰度服务不可用时回退到其它服务
+	assert.NotEmpty(t, s.Lookup(header("im", "test1", "", "2.1"), services[:2]))
+	// 只剩下独占的服务时仍然可用
+	assert.Equal(t, "gray1", s.Lookup(header("kim", "test1", "", "1.0"), services[2:]))
+
+	// 运行时替换规则
+	file := filepath.Join(t.TempDir(), "rules.json")
+	assert.Nil(t, os.WriteFile(file, []byte(`[{"apps":["kim"],"tags":["gray"]}]`), 0644))
+	rules, err = LoadRules(file)
+	assert.Nil(t, err)
+	s.SetRules(rules)
+	assert.Equal(t, "gray1", s.Lookup(header("kim", "test1", "", ""), services))
+	assert.NotEqual(t, "gray1", s.Lookup(header("im", "test1", "", "2.1"), services))
+}
+
+func Test_compare_version(t *testing.T) {
+	assert.Equal(t, 0, CompareVersion("1.2", "1.2.0"))
+	assert.Equal(t, -1, CompareVersion("1.9", "1.10"))
+	assert.Equal(t, 1, CompareVersion("v2.0.1", "2.0"))
+	assert.Equal(t, -1, CompareVersion("2.0.0-beta", "2.0.0-rc"))
+}
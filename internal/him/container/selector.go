@@ -9,3 +9,8 @@ import (
 type Selector interface {
 	Lookup(*pkt.Header, []him.Service) string
 }
+
+// Observer 选择器实现这个接口时，容器在每次转发之后回调发送结果
+type Observer interface {
+	Observe(serviceID string, err error)
+}
@@ -0,0 +1,151 @@
+package container
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+)
+
+// 加权选择器的默认参数
+const (
+	DefaultSlowStart     = time.Second * 30
+	DefaultMinWeight     = 0.1
+	DefaultEjectFailures = 5
+	DefaultEjectTime     = time.Second * 30
+	// QueueBase 待处理消息数达到QueueBase时权重减半
+	QueueBase = 1000
+)
+
+type WeightedOptions struct {
+	// SlowStart 新服务的权重在这段时间内从MinWeight线性增加到1
+	SlowStart time.Duration
+	MinWeight float64
+	// EjectFailures 连续发送失败多少次之后暂时摘除
+	EjectFailures int
+	// EjectTime 摘除的时间，之后重新参与选择
+	EjectTime time.Duration
+}
+
+// outlier 连续失败的服务
+type outlier struct {
+	failures int
+	until    time.Time
+}
+
+// WeightedSelector 按照上报的负载与慢启动计算权重，使用加权的最高随机权重哈希(rendezvous hashing)选择服务
+// 同一个ChannelId在服务列表与权重不变时总是选中同一个服务，服务上下线时只有它的连接会迁移
+// 连续发送失败的服务被暂时摘除，全部被摘除时仍然在全部服务中选择
+type WeightedSelector struct {
+	opts WeightedOptions
+
+	sync.Mutex
+	outliers map[string]*outlier
+	now      func() time.Time
+}
+
+func NewWeightedSelector(opts WeightedOptions) *WeightedSelector {
+	if opts.SlowStart <= 0 {
+		opts.SlowStart = DefaultSlowStart
+	}
+	if opts.MinWeight <= 0 || opts.MinWeight > 1 {
+		opts.MinWeight = DefaultMinWeight
+	}
+	if opts.EjectFailures <= 0 {
+		opts.EjectFailures = DefaultEjectFailures
+	}
+	if opts.EjectTime <= 0 {
+		opts.EjectTime = DefaultEjectTime
+	}
+	return &WeightedSelector{
+		opts:     opts,
+		outliers: make(map[string]*outlier),
+		now:      time.Now,
+	}
+}
+
+func (s *WeightedSelector) Lookup(header *pkt.Header, services []him.Service) string {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	list := make([]him.Service, 0, len(services))
+	for _, srv := range services {
+		if o, ok := s.outliers[srv.ServiceID()]; ok && now.Before(o.until) {
+			continue
+		}
+		list = append(list, srv)
+	}
+	if len(list) == 0 {
+		list = services
+	}
+	var key string
+	if header != nil {
+		key = header.ChannelId
+	}
+	best, bestScore := 0, math.Inf(-1)
+	for i, srv := range list {
+		score := -s.weight(srv, now) / math.Log(rendezvous(key, srv.ServiceID()))
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return list[best].ServiceID()
+}
+
+// Observe 记录连续失败次数，达到EjectFailures时摘除
+func (s *WeightedSelector) Observe(serviceID string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err == nil {
+		delete(s.outliers, serviceID)
+		return
+	}
+	o, ok := s.outliers[serviceID]
+	if !ok {
+		o = &outlier{}
+		s.outliers[serviceID] = o
+	}
+	o.failures++
+	if o.failures >= s.opts.EjectFailures {
+		o.failures = 0
+		o.until = s.now().Add(s.opts.EjectTime)
+		log.WithField("func", "WeightedSelector.Observe").Warnf("%s ejected for %v: %v", serviceID, s.opts.EjectTime, err)
+	}
+}
+
+// weight 负载权重乘以慢启动系数
+func (s *WeightedSelector) weight(srv him.Service, now time.Time) float64 {
+	meta := srv.GetMeta()
+	w := 1.0
+	if load, ok := naming.ParseLoad(meta); ok {
+		w = math.Max(1-load.CPU/100, 0.05) * QueueBase / (QueueBase + math.Max(float64(load.Queue), 0))
+	}
+	since, _ := strconv.ParseInt(meta[KeyServiceSince], 10, 64)
+	if since > 0 {
+		if elapsed := now.Sub(time.Unix(0, since)); elapsed < s.opts.SlowStart {
+			w *= math.Max(float64(elapsed)/float64(s.opts.SlowStart), s.opts.MinWeight)
+		}
+	}
+	return w
+}
+
+// rendezvous 把key与服务ID哈希到(0,1)之间的均匀分布
+func rendezvous(key, serviceID string) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(serviceID))
+	// splitmix64的混合函数，让相近的输入也均匀分布
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,97 @@
+package container
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/tcp"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_weighted_selector(t *testing.T) {
+	now := time.Now()
+	s := NewWeightedSelector(WeightedOptions{SlowStart: time.Minute, EjectFailures: 3, EjectTime: time.Second * 10})
+	s.now = func() time.Time { return now }
+
+	busy := map[string]string{KeyServiceSince: "0"}
+	(&naming.Load{CPU: 70, Time: now}).Fill(busy)
+	services := []him.Service{
+		tcp.NewClientWithProps("idle", wire.SNChat, map[string]string{KeyServiceSince: "0"}, tcp.ClientOptions{}),
+		tcp.NewClientWithProps("busy", wire.SNChat, busy, tcp.ClientOptions{}),
+		tcp.NewClientWithProps("young", wire.SNChat, map[string]string{
+			KeyServiceSince: strconv.FormatInt(now.UnixNano(), 10),
+		}, tcp.ClientOptions{}),
+	}
+	count := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			counts[s.Lookup(&pkt.Header{ChannelId: "gate01_" + strconv.Itoa(i)}, services)]++
+		}
+		return counts
+	}
+
+	counts := count()
+	assert.Greater(t, counts["idle"], counts["busy"])
+	assert.Greater(t, counts["busy"], counts["young"])
+
+	// 慢启动结束之后与空闲的服务相当
+	now = now.Add(time.Minute)
+	counts = count()
+	assert.InDelta(t, counts["idle"], counts["young"], 150)
+
+	// 连续失败之后被摘除，到期之后恢复
+	for i := 0; i < 3; i++ {
+		s.Observe("idle", errors.New("broken pipe"))
+	}
+	assert.Zero(t, count()["idle"])
+	now = now.Add(time.Second * 10)
+	assert.Greater(t, count()["idle"], 0)
+
+	// 成功之后清除失败计数
+	s.Observe("idle", errors.New("broken pipe"))
+	s.Observe("idle", nil)
+	s.Observe("idle", errors.New("broken pipe"))
+	s.Observe("idle", errors.New("broken pipe"))
+	assert.Greater(t, count()["idle"], 0)
+
+	// 全部被摘除时仍然可以选择
+	for _, id := range []string{"idle", "busy", "young"} {
+		for i := 0; i < 3; i++ {
+			s.Observe(id, errors.New("broken pipe"))
+		}
+	}
+	assert.NotEmpty(t, s.Lookup(nil, services))
+}
+
+func Test_weighted_selector_sticky(t *testing.T) {
+	s := NewWeightedSelector(WeightedOptions{EjectFailures: 1})
+	services := []him.Service{
+		tcp.NewClientWithProps("chat01", wire.SNChat, map[string]string{}, tcp.ClientOptions{}),
+		tcp.NewClientWithProps("chat02", wire.SNChat, map[string]string{}, tcp.ClientOptions{}),
+		tcp.NewClientWithProps("chat03", wire.SNChat, map[string]string{}, tcp.ClientOptions{}),
+	}
+	picked := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		header := &pkt.Header{ChannelId: "gate01_" + strconv.Itoa(i)}
+		picked[header.ChannelId] = s.Lookup(header, services)
+		// 同一个连接总是选中同一个服务，与服务列表的顺序无关
+		assert.Equal(t, picked[header.ChannelId], s.Lookup(header, []him.Service{services[2], services[0], services[1]}))
+	}
+
+	// 摘除一个服务之后，只有原来选中它的连接迁移
+	s.Observe("chat02", errors.New("broken pipe"))
+	for channel, id := range picked {
+		got := s.Lookup(&pkt.Header{ChannelId: channel}, services)
+		if id == "chat02" {
+			assert.NotEqual(t, "chat02", got)
+		} else {
+			assert.Equal(t, id, got)
+		}
+	}
+}
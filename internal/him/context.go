@@ -103,30 +103,26 @@ func (c *ContextImpl) Dispatch(body proto.Message, recs ...*Location) error {
 		return nil
 	}
 
-	logicPkt := pkt.NewLogicPkt(&c.requestPkt.Header)
-	logicPkt.Flag = pkt.Flag_Push
-	logicPkt.WriteBody(body)
-
 	group := make(map[string][]string)
 	for _, recv := range recs {
-		if recv.ChannelId == c.session.GetChannelId() {
+		if recv.ChannelId == c.Session().GetChannelId() {
 			continue
 		}
-		if _, ok := group[recv.GateId]; !ok {
-			group[recv.GateId] = make([]string, 0)
-		}
 		group[recv.GateId] = append(group[recv.GateId], recv.ChannelId)
 	}
 
+	var err error
 	for gateway, ids := range group {
-		err := c.Push(gateway, ids, logicPkt)
-		if err != nil {
-			logger.Error(err)
+		// 每个网关使用独立的包，Push会在包中写入目标网关与channels
+		logicPkt := pkt.NewLogicPkt(&c.requestPkt.Header)
+		logicPkt.Flag = pkt.Flag_Push
+		logicPkt.WriteBody(body)
+		if e := c.Push(gateway, ids, logicPkt); e != nil {
+			logger.Error(e)
+			err = e
 		}
-		return err
 	}
-
-	return nil
+	return err
 }
 
 func (c *ContextImpl) reset() {
@@ -0,0 +1,328 @@
+//go:build linux
+
+package epoll
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+)
+
+const (
+	// headerSize opcode(1字节)加上payload长度(4字节)，与tcp.Server的帧格式相同
+	headerSize = 5
+	// MaxFrameSize 单个帧的payload上限，超过时关闭连接
+	MaxFrameSize = 4 << 20
+	// MaxWriteBuffer 没有写出去的数据上限，超过时认为客户端过慢并关闭连接
+	MaxWriteBuffer = 4 << 20
+)
+
+var errEventLoop = errors.New("frames are read by the event loop")
+
+// conn 注册到事件循环中的连接，实现了him.Channel
+// 空闲时只占用连接本身，没有读写goroutine，也不持有缓冲区
+type conn struct {
+	// Conn 握手使用的连接，用于地址与关闭，读写直接使用fd
+	net.Conn
+	id     string
+	fd     int
+	server *Server
+	loop   *poller
+
+	sync.Mutex
+	// in 没有读完整的帧
+	in []byte
+	// out 没有写出去的数据，不为空时监听可写事件
+	out           []byte
+	writeDeadline time.Time
+	closed        bool
+	// added 已经加入ChannelMap
+	added bool
+	// draining 关闭之前尽量写完out
+	draining bool
+	// drained out写完之后关闭
+	drained chan struct{}
+
+	lastRead  int64
+	readWait  time.Duration
+	writeWait time.Duration
+}
+
+func newConn(id string, raw net.Conn, fd int, s *Server, loop *poller) *conn {
+	return &conn{
+		Conn:      raw,
+		id:        id,
+		fd:        fd,
+		server:    s,
+		loop:      loop,
+		lastRead:  time.Now().UnixNano(),
+		readWait:  s.options.readWait,
+		writeWait: s.options.writeWait,
+	}
+}
+
+func (c *conn) ID() string {
+	return c.id
+}
+
+// Push 直接写socket，写不完的部分交给事件循环，排空中的连接在关闭之前仍然接收推送
+func (c *conn) Push(payload []byte) error {
+	if payload == nil {
+		return nil
+	}
+	return c.WriteFrame(him.OpBinary, payload)
+}
+
+func (c *conn) WriteFrame(code him.OpCode, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = byte(code)
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+	return c.write(buf)
+}
+
+func (c *conn) write(buf []byte) error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return him.ErrChannelClosed
+	}
+	if len(c.out) > 0 {
+		if len(c.out)+len(buf) > MaxWriteBuffer {
+			c.Unlock()
+			_ = c.Close()
+			return errors.New("write buffer is full")
+		}
+		c.out = append(c.out, buf...)
+		c.Unlock()
+		return nil
+	}
+	n, err := writeFd(c.fd, buf)
+	if err != nil {
+		c.Unlock()
+		_ = c.Close()
+		return err
+	}
+	if n < len(buf) {
+		c.out = append(c.out, buf[n:]...)
+		c.writeDeadline = time.Now().Add(c.writeWait)
+		err = c.loop.modify(c.fd, syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLOUT)
+	}
+	c.Unlock()
+	return err
+}
+
+// onWritable 继续写out中的数据，写完之后不再监听可写事件
+func (c *conn) onWritable() {
+	c.Lock()
+	if c.closed || len(c.out) == 0 {
+		c.Unlock()
+		return
+	}
+	n, err := writeFd(c.fd, c.out)
+	if err != nil {
+		c.Unlock()
+		_ = c.Close()
+		return
+	}
+	if n < len(c.out) {
+		c.out = c.out[n:]
+		c.Unlock()
+		return
+	}
+	c.out = nil
+	_ = c.loop.modify(c.fd, syscall.EPOLLIN|syscall.EPOLLRDHUP)
+	if c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+	c.Unlock()
+}
+
+// onReadable 读取到buf中并解析出完整的帧，buf由事件循环复用
+func (c *conn) onReadable(buf []byte) {
+	for {
+		// 关闭之后fd可能被新的连接复用，读之前检查
+		c.Lock()
+		if c.closed {
+			c.Unlock()
+			return
+		}
+		n, err := syscall.Read(c.fd, buf)
+		c.Unlock()
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return
+		}
+		if err != nil || n == 0 {
+			_ = c.Close()
+			return
+		}
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		if !c.parse(buf[:n]) {
+			_ = c.Close()
+			return
+		}
+		if n < len(buf) {
+			return
+		}
+	}
+}
+
+// parse 处理完整的帧，剩余的部分复制到in中等待下一次读取
+func (c *conn) parse(data []byte) bool {
+	if len(c.in) > 0 {
+		c.in = append(c.in, data...)
+		data = c.in
+	}
+	for len(data) >= headerSize {
+		size := binary.BigEndian.Uint32(data[1:headerSize])
+		if size > MaxFrameSize {
+			return false
+		}
+		if len(data) < headerSize+int(size) {
+			break
+		}
+		if !c.handle(him.OpCode(data[0]), data[headerSize:headerSize+int(size)]) {
+			return false
+		}
+		data = data[headerSize+int(size):]
+	}
+	if len(data) == 0 {
+		c.in = nil
+	} else {
+		c.in = append([]byte(nil), data...)
+	}
+	return true
+}
+
+func (c *conn) handle(code him.OpCode, payload []byte) bool {
+	switch code {
+	case him.OpClose:
+		return false
+	case him.OpPing:
+		_ = c.WriteFrame(him.OpPong, nil)
+		if hl, ok := c.server.listener.(him.HeartbeatListener); ok {
+			hl.Heartbeat(c)
+		}
+		return true
+	}
+	if len(payload) == 0 {
+		return true
+	}
+	// payload指向复用的缓冲区，交给上层之前复制一份
+	c.server.listener.Receive(c, append([]byte(nil), payload...))
+	return true
+}
+
+// expired 读超时或者写超时
+func (c *conn) expired(now time.Time) bool {
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastRead))) > c.readWait {
+		return true
+	}
+	c.Lock()
+	defer c.Unlock()
+	return len(c.out) > 0 && now.After(c.writeDeadline)
+}
+
+// Drain 等待out中的数据写完
+func (c *conn) Drain(ctx context.Context) error {
+	c.Lock()
+	c.draining = true
+	if c.closed || len(c.out) == 0 {
+		c.Unlock()
+		return nil
+	}
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	drained := c.drained
+	c.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close 从事件循环中移除并关闭连接，之后回调Disconnect
+func (c *conn) Close() error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil
+	}
+	c.closed = true
+	added := c.added
+	// 排空中的连接最后再尝试写一次Drain之后接收的推送
+	if c.draining && len(c.out) > 0 {
+		_, _ = writeFd(c.fd, c.out)
+	}
+	c.out = nil
+	if c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+	c.Unlock()
+	c.loop.remove(c.fd)
+	err := c.Conn.Close()
+	c.server.disconnect(c, added)
+	return err
+}
+
+func (c *conn) ReadFrame() (him.Frame, error) {
+	return nil, errEventLoop
+}
+
+func (c *conn) ReadLoop(him.MessageListener) error {
+	return errEventLoop
+}
+
+func (c *conn) Flush() error {
+	return nil
+}
+
+func (c *conn) SetWriteWait(writeWait time.Duration) {
+	if writeWait == 0 {
+		return
+	}
+	c.writeWait = writeWait
+}
+
+func (c *conn) SetReadWait(readWait time.Duration) {
+	if readWait == 0 {
+		return
+	}
+	c.readWait = readWait
+}
+
+// writeFd 非阻塞写，socket缓冲区满时返回已经写出的长度
+func writeFd(fd int, buf []byte) (int, error) {
+	var written int
+	for written < len(buf) {
+		n, err := syscall.Write(fd, buf[written:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+var _ him.Channel = (*conn)(nil)
@@ -0,0 +1,171 @@
+//go:build linux
+
+package epoll
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// readBufferSize 每个事件循环复用的读缓冲区大小
+	readBufferSize = 64 << 10
+	// waitTimeout EpollWait的超时时间(毫秒)，用于检查超时与退出
+	waitTimeout = 1000
+	maxEvents   = 256
+	// maxWaitRetries EpollWait连续失败的次数达到之后放弃这个事件循环
+	maxWaitRetries = 5
+)
+
+var errPollerClosed = errors.New("event loop is closed")
+
+// poller 一个事件循环，连接按照fd分配到固定的poller
+type poller struct {
+	fd int
+	sync.RWMutex
+	conns map[int]*conn
+	// failed EpollWait无法恢复时为true，不再接收新的连接
+	failed bool
+}
+
+func newPoller() (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{fd: fd, conns: make(map[int]*conn)}, nil
+}
+
+// add 持有锁注册，与fail互斥，失败的事件循环不会再加入连接
+func (p *poller) add(c *conn) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.failed {
+		return errPollerClosed
+	}
+	err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, c.fd, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP,
+		Fd:     int32(c.fd),
+	})
+	if err != nil {
+		return err
+	}
+	p.conns[c.fd] = c
+	return nil
+}
+
+func (p *poller) modify(fd int, events uint32) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)})
+}
+
+// remove 在关闭fd之前调用，避免fd被复用之后收到旧连接的事件
+func (p *poller) remove(fd int) {
+	_ = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+	p.Lock()
+	delete(p.conns, fd)
+	p.Unlock()
+}
+
+func (p *poller) get(fd int) (*conn, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	c, ok := p.conns[fd]
+	return c, ok
+}
+
+// run 处理读写事件，每隔scan检查一次超时的连接，直到stop触发
+func (p *poller) run(stop <-chan struct{}, scan time.Duration) {
+	buf := make([]byte, readBufferSize)
+	events := make([]syscall.EpollEvent, maxEvents)
+	lastScan := time.Now()
+	var failures int
+	for {
+		select {
+		case <-stop:
+			p.close()
+			return
+		default:
+		}
+		n, err := syscall.EpollWait(p.fd, events, waitTimeout)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			failures++
+			log.Errorf("epoll wait failed %d times: %v", failures, err)
+			if failures >= maxWaitRetries {
+				p.fail()
+				return
+			}
+			time.Sleep(time.Millisecond * 100 * time.Duration(failures))
+			continue
+		}
+		failures = 0
+		for i := 0; i < n; i++ {
+			ev := events[i]
+			c, ok := p.get(int(ev.Fd))
+			if !ok {
+				continue
+			}
+			if ev.Events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				// 先读完对端关闭之前发来的数据，读到EOF时关闭
+				c.onReadable(buf)
+			}
+			if ev.Events&syscall.EPOLLOUT != 0 {
+				c.onWritable()
+			}
+		}
+		if now := time.Now(); now.Sub(lastScan) >= scan {
+			lastScan = now
+			p.expire(now)
+		}
+	}
+}
+
+// fail 事件循环无法继续时关闭它的全部连接，客户端重连之后分配到其它事件循环或者重新尝试
+func (p *poller) fail() {
+	p.Lock()
+	if p.failed {
+		p.Unlock()
+		return
+	}
+	p.failed = true
+	list := make([]*conn, 0, len(p.conns))
+	for _, c := range p.conns {
+		list = append(list, c)
+	}
+	p.Unlock()
+	for _, c := range list {
+		_ = c.Close()
+	}
+	_ = syscall.Close(p.fd)
+}
+
+// close 停止之后不再接收新的连接，fail已经关闭时不重复关闭fd
+func (p *poller) close() {
+	p.Lock()
+	failed := p.failed
+	p.failed = true
+	p.Unlock()
+	if !failed {
+		_ = syscall.Close(p.fd)
+	}
+}
+
+// expire 关闭读写超时的连接
+func (p *poller) expire(now time.Time) {
+	var list []*conn
+	p.RLock()
+	for _, c := range p.conns {
+		if c.expired(now) {
+			list = append(list, c)
+		}
+	}
+	p.RUnlock()
+	for _, c := range list {
+		log.Infof("channel %s expired", c.id)
+		_ = c.Close()
+	}
+}
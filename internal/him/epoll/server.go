@@ -0,0 +1,321 @@
+//go:build linux
+
+// Package epoll 基于epoll事件循环的him.Server，帧格式与tcp.Server相同
+// 握手阶段与tcp.Server一样使用一个goroutine，握手完成之后连接注册到事件循环中，
+// 只有可读时才读取，写操作直接写socket，空闲的连接不占用goroutine
+package epoll
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/tcp"
+	"github.com/klintcheng/kim/logger"
+	"github.com/segmentio/ksuid"
+)
+
+var ErrTLSNotSupported = errors.New("tls is not supported by the epoll server, use tcp.Server instead")
+
+var log = logger.WithFields(logger.Fields{"module": "epoll.server"})
+
+type ServerOptions struct {
+	loginWait time.Duration
+	writeWait time.Duration
+	readWait  time.Duration
+	// loops 事件循环的数量
+	loops int
+}
+
+// Server is an epoll implement of him.Server
+type Server struct {
+	listen string
+
+	him.ServiceRegistration
+	him.ChannelMap
+	him.Acceptor
+	him.MessageListener
+	him.StateListener
+
+	once      sync.Once
+	options   ServerOptions
+	quit      *him.Event
+	tlsConfig *tls.Config
+	// pool 处理收到的消息，保证同一个channel的消息按照顺序处理
+	pool *him.WorkerPool
+	// listener 由事件循环调用，通过pool调用MessageListener
+	listener him.MessageListener
+	// stopped Shutdown完成之后触发，事件循环随之退出
+	stopped *him.Event
+
+	lock    sync.Mutex
+	lst     net.Listener
+	pollers []*poller
+	// conns 握手中与注册的连接，Shutdown等待它们的断开回调完成
+	conns sync.WaitGroup
+}
+
+func NewServer(listen string, service him.ServiceRegistration) him.Server {
+	return &Server{
+		listen:              listen,
+		ServiceRegistration: service,
+		ChannelMap:          him.NewChannelMap(100),
+
+		quit:    him.NewEvent(),
+		stopped: him.NewEvent(),
+		options: ServerOptions{
+			loginWait: him.DefaultLoginWait,
+			writeWait: him.DefaultWriteWait,
+			readWait:  him.DefaultReadWait,
+			loops:     runtime.NumCPU(),
+		},
+	}
+}
+
+func (s *Server) Start() error {
+	log := logger.WithFields(logger.Fields{
+		"module": "epoll.server",
+		"listen": s.listen,
+		"id":     s.ServiceID(),
+	})
+	if s.StateListener == nil {
+		return fmt.Errorf("StateListener is nil")
+	}
+	if s.MessageListener == nil {
+		return fmt.Errorf("MessageListener is nil")
+	}
+	if s.Acceptor == nil {
+		s.Acceptor = new(defaultAcceptor)
+	}
+	if s.tlsConfig != nil {
+		return ErrTLSNotSupported
+	}
+	if s.pool == nil {
+		s.pool = him.DefaultWorkerPool()
+	}
+	s.listener = s.pool.Listener(s.MessageListener)
+
+	s.lock.Lock()
+	lst := s.lst
+	s.lock.Unlock()
+	if lst == nil {
+		var err error
+		if lst, err = net.Listen("tcp", s.listen); err != nil {
+			return err
+		}
+	}
+	pollers := make([]*poller, s.options.loops)
+	for i := range pollers {
+		p, err := newPoller()
+		if err != nil {
+			return err
+		}
+		pollers[i] = p
+	}
+	s.lock.Lock()
+	if s.quit.HasFired() {
+		s.lock.Unlock()
+		return lst.Close()
+	}
+	s.lst, s.pollers = lst, pollers
+	s.lock.Unlock()
+
+	// 读超时按照readWait的四分之一检查
+	scan := s.options.readWait / 4
+	if scan < time.Second {
+		scan = time.Second
+	}
+	for _, p := range pollers {
+		go p.run(s.stopped.Done(), scan)
+	}
+	log.Infof("starting epoll server with %d loops", len(pollers))
+	for {
+		rawconn, err := lst.Accept()
+		if err != nil {
+			if s.quit.HasFired() {
+				return nil
+			}
+			log.Warn(err)
+			continue
+		}
+		s.conns.Add(1)
+		go s.handshake(rawconn)
+	}
+}
+
+// handshake 使用阻塞的连接完成握手，之后注册到事件循环
+func (s *Server) handshake(rawconn net.Conn) {
+	defer s.conns.Done()
+	conn := tcp.NewConn(rawconn)
+	id, err := s.Accept(conn, s.options.loginWait)
+	if err != nil {
+		_ = conn.WriteFrame(him.OpClose, []byte(err.Error()))
+		conn.Close()
+		return
+	}
+	if him.Duplicated(s.ChannelMap, s.Acceptor, id) {
+		log.Warnf("channel %s existed", id)
+		_ = conn.WriteFrame(him.OpClose, []byte("channelId is exists"))
+		conn.Close()
+		return
+	}
+	_ = rawconn.SetDeadline(time.Time{})
+	fd, err := socketFd(rawconn)
+	if err != nil {
+		log.Warn(err)
+		conn.Close()
+		return
+	}
+	c := newConn(id, rawconn, fd, s, s.pollers[fd%len(s.pollers)])
+	s.conns.Add(1)
+	// 先注册到事件循环再加入ChannelMap，加入之后的推送都可以交给事件循环继续写
+	if err = c.loop.add(c); err != nil {
+		log.Warn(err)
+		_ = c.Close()
+		return
+	}
+	// 注册之后事件循环可能已经关闭了连接，关闭的连接不再加入
+	c.Lock()
+	if !c.closed {
+		s.Add(c)
+		c.added = true
+	}
+	c.Unlock()
+	// Shutdown之后加入的连接没有被通知，直接关闭
+	if s.quit.HasFired() {
+		_ = c.Close()
+	}
+}
+
+// disconnect 连接关闭之后回调，由conn.Close调用一次，被替换的连接不回调Disconnect
+func (s *Server) disconnect(c *conn, added bool) {
+	if added && !s.RemoveChannel(c) {
+		s.conns.Done()
+		return
+	}
+	go func() {
+		defer s.conns.Done()
+		if err := s.Disconnect(c.id); err != nil {
+			log.Warn(err)
+		}
+	}()
+}
+
+func (s *Server) Push(id string, data []byte) error {
+	ch, ok := s.ChannelMap.Get(id)
+	if !ok {
+		return errors.New("channel no found")
+	}
+	return ch.Push(data)
+}
+
+// Shutdown 停止接收新连接，推送GoAway通知并等待推送写完之后关闭连接
+func (s *Server) Shutdown(ctx context.Context) error {
+	log := log.WithField("id", s.ServiceID())
+	s.once.Do(func() {
+		defer func() {
+			s.stopped.Fire()
+			log.Infoln("shutdown")
+		}()
+		s.quit.Fire()
+		s.lock.Lock()
+		if s.lst != nil {
+			_ = s.lst.Close()
+		}
+		s.lock.Unlock()
+
+		him.DrainChannels(ctx, s.ChannelMap.All(), s.StateListener)
+
+		// 等待断开回调完成
+		done := make(chan struct{})
+		go func() {
+			s.conns.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Warn(ctx.Err())
+		}
+	})
+	return nil
+}
+
+func (s *Server) SetAcceptor(acceptor him.Acceptor) {
+	s.Acceptor = acceptor
+}
+
+func (s *Server) SetMessageListener(listener him.MessageListener) {
+	s.MessageListener = listener
+}
+
+func (s *Server) SetStateListener(listener him.StateListener) {
+	s.StateListener = listener
+}
+
+func (s *Server) SetReadWait(readWait time.Duration) {
+	s.options.readWait = readWait
+}
+
+func (s *Server) SetChannelMap(channelMap him.ChannelMap) {
+	s.ChannelMap = channelMap
+}
+
+// SetTLSConfig 事件循环直接读写socket，不支持TLS，设置之后Start返回ErrTLSNotSupported
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// SetListener 使用已经建立的监听，在Start之前调用
+func (s *Server) SetListener(lst net.Listener) {
+	s.lock.Lock()
+	s.lst = lst
+	s.lock.Unlock()
+}
+
+// SetWorkerPool 设置处理消息的协程池，在Start之前调用
+func (s *Server) SetWorkerPool(pool *him.WorkerPool) {
+	s.pool = pool
+}
+
+// SetEventLoops 事件循环的数量，默认为CPU数，在Start之前调用
+func (s *Server) SetEventLoops(loops int) {
+	if loops > 0 {
+		s.options.loops = loops
+	}
+}
+
+// socketFd 取出连接的fd，连接保持打开，fd已经是非阻塞的
+func socketFd(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("unexpected conn type %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	err = raw.Control(func(s uintptr) {
+		fd = int(s)
+	})
+	return fd, err
+}
+
+type defaultAcceptor struct {
+}
+
+func (d defaultAcceptor) Accept(conn him.Conn, duration time.Duration) (string, error) {
+	return ksuid.New().String(), nil
+}
+
+var _ him.Server = (*Server)(nil)
+var _ him.Listenable = (*Server)(nil)
+var _ him.Poolable = (*Server)(nil)
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package epoll
+
+import (
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/tcp"
+)
+
+// NewServer 不支持epoll的平台使用tcp.Server
+func NewServer(listen string, service him.ServiceRegistration) him.Server {
+	return tcp.NewServer(listen, service)
+}
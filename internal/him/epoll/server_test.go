@@ -0,0 +1,225 @@
+//go:build linux
+
+package epoll
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/tcp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandler struct {
+	received     chan string
+	disconnected int32
+	heartbeats   int32
+}
+
+func (h *testHandler) Heartbeat(him.Agent) {
+	atomic.AddInt32(&h.heartbeats, 1)
+}
+
+func (h *testHandler) Receive(_ him.Agent, payload []byte) {
+	h.received <- string(payload)
+}
+
+func (h *testHandler) Disconnect(string) error {
+	atomic.AddInt32(&h.disconnected, 1)
+	return nil
+}
+
+func (h *testHandler) GoAway(him.Channel) []byte {
+	return []byte("goaway")
+}
+
+func freeAddr(t testing.TB) string {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer lst.Close()
+	return lst.Addr().String()
+}
+
+func dial(t testing.TB, addr string) net.Conn {
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func Test_epoll_server(t *testing.T) {
+	addr := freeAddr(t)
+	handler := &testHandler{received: make(chan string, 10)}
+	channels := him.NewChannelMap(10)
+	srv := NewServer(addr, &naming.RegisterService{Id: "gate01", Name: "tgateway"})
+	srv.(*Server).SetEventLoops(2)
+	srv.SetChannelMap(channels)
+	srv.SetMessageListener(handler)
+	srv.SetStateListener(handler)
+	started := make(chan error, 1)
+	go func() { started <- srv.Start() }()
+
+	raw := dial(t, addr)
+	conn := tcp.NewConn(raw)
+	assert.Eventually(t, func() bool {
+		return len(channels.All()) == 1
+	}, time.Second, time.Millisecond*10)
+	id := channels.All()[0].ID()
+
+	// 心跳由事件循环直接回复
+	assert.Nil(t, conn.WriteFrame(him.OpPing, nil))
+	frame, err := conn.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, him.OpPong, frame.GetOpCode())
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&handler.heartbeats) == 1
+	}, time.Second, time.Millisecond*10)
+
+	// 一个帧分两次到达
+	_, _ = raw.Write([]byte{byte(him.OpBinary), 0, 0, 0, 5, 'h', 'e'})
+	time.Sleep(time.Millisecond * 20)
+	_, _ = raw.Write([]byte("llo"))
+	select {
+	case payload := <-handler.received:
+		assert.Equal(t, "hello", payload)
+	case <-time.After(time.Second):
+		t.Fatal("frame not received")
+	}
+
+	// 大的推送写不完时由事件循环继续写，关闭时等待写完
+	big := make([]byte, 1<<20)
+	assert.Nil(t, srv.Push(id, []byte("message")))
+	assert.Nil(t, srv.Push(id, big))
+	read := make(chan []int, 1)
+	go func() {
+		var sizes []int
+		for {
+			frame, err := conn.ReadFrame()
+			if err != nil {
+				read <- sizes
+				return
+			}
+			sizes = append(sizes, len(frame.GetPayload()))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	// 排空之后关闭之前的推送仍然接收
+	ch, _ := channels.Get(id)
+	assert.Nil(t, ch.Drain(ctx))
+	assert.Nil(t, srv.Push(id, []byte("after")))
+	assert.Nil(t, srv.Shutdown(ctx))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&handler.disconnected))
+	assert.Nil(t, <-started)
+	assert.Equal(t, []int{len("message"), len(big), len("after"), len("goaway")}, <-read)
+	assert.Len(t, channels.All(), 0)
+}
+
+// BenchmarkIdleConn 比较每个空闲连接占用的内存与goroutine
+// 客户端连接在同一个进程中，两种Server的统计中都包含了它们
+func BenchmarkIdleConn(b *testing.B) {
+	b.Run("goroutine", func(b *testing.B) {
+		benchmarkIdleConn(b, tcp.NewServer)
+	})
+	b.Run("epoll", func(b *testing.B) {
+		benchmarkIdleConn(b, NewServer)
+	})
+}
+
+func benchmarkIdleConn(b *testing.B, newServer func(string, him.ServiceRegistration) him.Server) {
+	const conns = 1000
+	addr := freeAddr(b)
+	handler := &testHandler{received: make(chan string, 10)}
+	channels := him.NewChannelMap(conns)
+	srv := newServer(addr, &naming.RegisterService{Id: "gate01", Name: "tgateway"})
+	srv.SetReadWait(time.Minute)
+	srv.SetChannelMap(channels)
+	srv.SetMessageListener(handler)
+	srv.SetStateListener(handler)
+	go func() { _ = srv.Start() }()
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+	_ = dial(b, addr).Close()
+
+	var bytes, goroutines float64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		heap, stack, routines := memUsage()
+		list := make([]net.Conn, conns)
+		for j := range list {
+			list[j] = dial(b, addr)
+		}
+		for len(channels.All()) < conns {
+			time.Sleep(time.Millisecond)
+		}
+		heap2, stack2, routines2 := memUsage()
+		bytes += float64(int64(heap2+stack2)-int64(heap+stack)) / conns
+		goroutines += float64(routines2-routines) / conns
+
+		for _, conn := range list {
+			_ = conn.Close()
+		}
+		for len(channels.All()) > 0 || runtime.NumGoroutine() > routines {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	b.ReportMetric(bytes/float64(b.N), "B/conn")
+	b.ReportMetric(goroutines/float64(b.N), "goroutines/conn")
+}
+
+func memUsage() (heap, stack uint64, goroutines int) {
+	// 第二次GC之后才释放空闲的栈
+	runtime.GC()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc, stats.StackInuse, runtime.NumGoroutine()
+}
+
+func Test_epoll_loop_failed(t *testing.T) {
+	addr := freeAddr(t)
+	handler := &testHandler{received: make(chan string, 10)}
+	channels := him.NewChannelMap(10)
+	srv := NewServer(addr, &naming.RegisterService{Id: "gate01", Name: "tgateway"})
+	srv.(*Server).SetEventLoops(1)
+	srv.SetChannelMap(channels)
+	srv.SetMessageListener(handler)
+	srv.SetStateListener(handler)
+	go func() { _ = srv.Start() }()
+	defer srv.Shutdown(context.Background())
+
+	raw := dial(t, addr)
+	defer raw.Close()
+	assert.Eventually(t, func() bool {
+		return channels.Len() == 1
+	}, time.Second, time.Millisecond*10)
+
+	// 事件循环失败之后关闭它的连接，不再接收新的连接
+	loop := srv.(*Server).pollers[0]
+	loop.fail()
+	assert.Eventually(t, func() bool {
+		return channels.Len() == 0 && atomic.LoadInt32(&handler.disconnected) == 1
+	}, time.Second, time.Millisecond*10)
+	_, err := tcp.NewConn(raw).ReadFrame()
+	assert.NotNil(t, err)
+
+	raw2 := dial(t, addr)
+	defer raw2.Close()
+	_, err = tcp.NewConn(raw2).ReadFrame()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, channels.Len())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&handler.disconnected))
+}
@@ -0,0 +1,24 @@
+package him
+
+import "github.com/chang144/gotalk/internal/him/wire/pkt"
+
+// FriendStorage 定义好友关系与黑名单存储
+// 好友关系是双向的，黑名单是单向的，都只在同一个app内有效
+type FriendStorage interface {
+	// AddRequest 保存发给to的好友请求，同一个账号的请求只保留最新的一条
+	AddRequest(app string, to string, req *pkt.FriendRequest) error
+	// TakeRequest 删除并返回from发给account的请求，不存在时返回nil
+	TakeRequest(app string, account string, from string) (*pkt.FriendRequest, error)
+	// Requests 返回account未处理的好友请求
+	Requests(app string, account string) ([]*pkt.FriendRequest, error)
+	AddFriend(app string, a string, b string) error
+	DeleteFriend(app string, a string, b string) error
+	IsFriend(app string, a string, b string) (bool, error)
+	Friends(app string, account string) ([]string, error)
+	// Block account把target加入黑名单
+	Block(app string, account string, target string) error
+	Unblock(app string, account string, target string) error
+	// IsBlocked account是否把target加入了黑名单
+	IsBlocked(app string, account string, target string) (bool, error)
+	Blocklist(app string, account string) ([]string, error)
+}
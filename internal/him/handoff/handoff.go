@@ -0,0 +1,55 @@
+// Package handoff 通过unix socket把监听socket从旧进程交给新进程，用于网关不停机升级
+// 旧进程调用Serve等待升级；新进程调用Inherit取得监听，准备好之后调用Ack，
+// 旧进程收到确认之后开始优雅关闭，新的连接由新进程接收
+package handoff
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/klintcheng/kim/logger"
+)
+
+const (
+	// DefaultTimeout Inherit等待旧进程发送监听的时间
+	DefaultTimeout = time.Second * 10
+	// DefaultAckTimeout 旧进程等待新进程确认的时间，超时之后继续服务
+	DefaultAckTimeout = time.Second * 30
+	// MaxListeners 一次交接的监听数量上限
+	MaxListeners = 16
+)
+
+var (
+	ErrNotSupported = errors.New("listener handoff is not supported on this platform")
+	ErrNotAcked     = errors.New("handoff is not acknowledged")
+)
+
+var log = logger.WithFields(logger.Fields{"module": "handoff"})
+
+// ackMessage 新进程的确认
+const ackMessage = "ok"
+
+// header 与监听的文件描述符一起发送，Names与描述符一一对应
+type header struct {
+	Names []string `json:"names"`
+}
+
+// Handoff 新进程继承的监听
+type Handoff struct {
+	Listeners map[string]net.Listener
+	conn      net.Conn
+}
+
+// Ack 通知旧进程交接完成，旧进程随后关闭自己的监听
+func (h *Handoff) Ack() error {
+	if _, err := h.conn.Write([]byte(ackMessage)); err != nil {
+		return err
+	}
+	return h.conn.Close()
+}
+
+// Close 没有确认时调用，旧进程继续服务
+func (h *Handoff) Close() error {
+	return h.conn.Close()
+}
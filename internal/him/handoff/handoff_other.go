@@ -0,0 +1,19 @@
+//go:build !unix
+
+package handoff
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Serve 不支持的平台阻塞到ctx结束
+func Serve(ctx context.Context, path string, listeners map[string]net.Listener) error {
+	<-ctx.Done()
+	return ErrNotSupported
+}
+
+func Inherit(path string, timeout time.Duration) (*Handoff, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,81 @@
+//go:build unix
+
+package handoff
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_handoff(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer lst.Close()
+	addr := lst.Addr().String()
+
+	path := filepath.Join(t.TempDir(), "gateway.sock")
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(context.Background(), path, map[string]net.Listener{"gateway": lst})
+	}()
+
+	var h *Handoff
+	assert.Eventually(t, func() bool {
+		h, err = Inherit(path, time.Second)
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+	// 没有确认时旧进程继续等待
+	assert.Nil(t, h.Close())
+	for _, l := range h.Listeners {
+		_ = l.Close()
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned without ack: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	h, err = Inherit(path, time.Second)
+	assert.Nil(t, err)
+	inherited, ok := h.Listeners["gateway"]
+	assert.True(t, ok)
+	assert.Equal(t, addr, inherited.Addr().String())
+	assert.Nil(t, h.Ack())
+	assert.Nil(t, <-served)
+	defer inherited.Close()
+
+	// 旧进程关闭监听之后新的连接由继承的监听接收
+	assert.Nil(t, lst.Close())
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := inherited.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	select {
+	case c := <-accepted:
+		_ = c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted by inherited listener")
+	}
+}
+
+func Test_serve_cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, filepath.Join(t.TempDir(), "gateway.sock"), nil)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+}
@@ -0,0 +1,157 @@
+//go:build unix
+
+package handoff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Serve 在path上等待新进程，交接成功之后返回nil
+// 新进程没有确认时继续等待下一次升级，ctx结束时返回ctx.Err()
+func Serve(ctx context.Context, path string, listeners map[string]net.Listener) error {
+	if len(listeners) > MaxListeners {
+		return fmt.Errorf("too many listeners: %d", len(listeners))
+	}
+	// 清理上一个进程留下的socket文件
+	_ = os.Remove(path)
+	lst, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// 新进程会在同一个路径上重新监听，关闭时不删除文件
+	lst.SetUnlinkOnClose(false)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		_ = lst.Close()
+	}()
+
+	for {
+		conn, err := lst.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		err = transfer(conn, listeners)
+		_ = conn.Close()
+		if err == nil {
+			log.Infof("listeners handed off via %s", path)
+			return nil
+		}
+		log.Warn(err)
+	}
+}
+
+// transfer 发送监听的文件描述符并等待确认
+func transfer(conn *net.UnixConn, listeners map[string]net.Listener) error {
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fds := make([]int, 0, len(names))
+	for _, name := range names {
+		l, ok := listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s can not be handed off", name)
+		}
+		// File返回复制的描述符，不影响本进程继续使用监听
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+	}
+	buf, err := json.Marshal(&header{Names: names})
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(DefaultAckTimeout))
+	if _, _, err = conn.WriteMsgUnix(buf, syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	ack := make([]byte, len(ackMessage))
+	if _, err = io.ReadFull(conn, ack); err != nil || string(ack) != ackMessage {
+		return ErrNotAcked
+	}
+	return nil
+}
+
+// Inherit 连接path上的旧进程，取得它的全部监听
+func Inherit(path string, timeout time.Duration) (*Handoff, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	uc := conn.(*net.UnixConn)
+	_ = uc.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(MaxListeners*4))
+	n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = uc.SetReadDeadline(time.Time{})
+	listeners, err := parse(buf[:n], oob[:oobn])
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &Handoff{Listeners: listeners, conn: conn}, nil
+}
+
+func parse(buf, oob []byte) (map[string]net.Listener, error) {
+	var fds []int
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	var h header
+	if err = json.Unmarshal(buf, &h); err != nil || len(h.Names) != len(fds) {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("invalid handoff message: %d names, %d fds", len(h.Names), len(fds))
+	}
+	listeners := make(map[string]net.Listener, len(fds))
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), h.Names[i])
+		// FileListener复制描述符，原来的文件可以关闭
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			for _, fd := range fds[i+1:] {
+				_ = syscall.Close(fd)
+			}
+			return nil, err
+		}
+		listeners[h.Names[i]] = l
+	}
+	return listeners, nil
+}
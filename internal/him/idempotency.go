@@ -0,0 +1,20 @@
+package him
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrIdempotencyPending 相同key的请求仍在处理中
+var ErrIdempotencyPending = errors.New("request with the same idempotency key is in progress")
+
+// IdempotencyStorage 保存幂等键对应的处理结果
+type IdempotencyStorage interface {
+	// Acquire 占用key，占用保留ttl，过期之后允许其它请求重新占用
+	// key已经处理完成时返回保存的结果，仍在处理中时返回ErrIdempotencyPending
+	Acquire(key string, ttl time.Duration) (acquired bool, result []byte, err error)
+	// Complete 保存处理结果，ttl内相同key的请求直接返回该结果
+	Complete(key string, result []byte, ttl time.Duration) error
+	// Release 处理失败时释放key，允许重试
+	Release(key string) error
+}
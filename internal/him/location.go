@@ -10,10 +10,15 @@ import (
 type Location struct {
 	// 通道Id
 	ChannelId string
-	// 网关Id
+	// 网关Id，会话挂起时为空
 	GateId string
 }
 
+// Suspended 连接断开后会话处于挂起状态，等待恢复
+func (loc *Location) Suspended() bool {
+	return loc.GateId == ""
+}
+
 func (loc *Location) Bytes() []byte {
 	if loc == nil {
 		return []byte{}
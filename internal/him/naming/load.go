@@ -0,0 +1,48 @@
+package naming
+
+import (
+	"strconv"
+	"time"
+)
+
+// 服务注册时Meta中的负载信息，由容器定时上报
+const (
+	// MetaConnections 服务上的连接数，网关为客户端连接，逻辑服务为网关连接
+	MetaConnections = "load.connections"
+	// MetaCPU 进程的CPU使用率，0-100
+	MetaCPU = "load.cpu"
+	// MetaQueue 待处理的推送消息数
+	MetaQueue = "load.queue"
+	// MetaLoadTime 上报时间，unix秒
+	MetaLoadTime = "load.time"
+)
+
+// Load 服务的实时负载
+type Load struct {
+	Connections int
+	CPU         float64
+	Queue       int
+	Time        time.Time
+}
+
+// Fill 写入meta
+func (l *Load) Fill(meta map[string]string) {
+	meta[MetaConnections] = strconv.Itoa(l.Connections)
+	meta[MetaCPU] = strconv.FormatFloat(l.CPU, 'f', 1, 64)
+	meta[MetaQueue] = strconv.Itoa(l.Queue)
+	meta[MetaLoadTime] = strconv.FormatInt(l.Time.Unix(), 10)
+}
+
+// ParseLoad 没有上报过负载时返回false
+func ParseLoad(meta map[string]string) (Load, bool) {
+	var l Load
+	ts, err := strconv.ParseInt(meta[MetaLoadTime], 10, 64)
+	if err != nil {
+		return l, false
+	}
+	l.Time = time.Unix(ts, 0)
+	l.Connections, _ = strconv.Atoi(meta[MetaConnections])
+	l.CPU, _ = strconv.ParseFloat(meta[MetaCPU], 64)
+	l.Queue, _ = strconv.Atoi(meta[MetaQueue])
+	return l, true
+}
@@ -0,0 +1,9 @@
+package him
+
+import "time"
+
+// NonceStorage 记录已经使用过的随机数，用于拒绝重放的请求
+type NonceStorage interface {
+	// Claim 第一次使用nonce时返回true，记录保留ttl
+	Claim(nonce string, ttl time.Duration) (bool, error)
+}
@@ -0,0 +1,16 @@
+package him
+
+// OnlineLocation 在线连接
+type OnlineLocation struct {
+	Account string
+	Location
+}
+
+// OnlineStorage 按网关索引的在线连接，供运维接口查询
+// 索引随会话的添加、删除与挂起维护，记录与会话同时过期，心跳时一起刷新
+type OnlineStorage interface {
+	// CountByGateway 每个网关上的连接数
+	CountByGateway() (map[string]int64, error)
+	// ScanOnline 遍历gateway上的连接，cursor为0时从头开始，返回的cursor为0表示遍历结束
+	ScanOnline(gateway string, cursor uint64, count int64) ([]*OnlineLocation, uint64, error)
+}
@@ -0,0 +1,26 @@
+package him
+
+import (
+	"time"
+
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+)
+
+// PresenceStorage 定义在线状态存储
+// 在线与否以Location为准，这里只保存离开标记与订阅关系
+type PresenceStorage interface {
+	// MarkAway 标记账号因channelId断开而暂时离开，ttl之后自动过期
+	MarkAway(account string, channelId string, ttl time.Duration) error
+	// ClearAway 清除离开标记，返回账号之前是否处于离开状态
+	ClearAway(account string) (bool, error)
+	// ExpireAway 离开标记仍属于channelId且账号没有重新登录时清除标记并返回true
+	ExpireAway(account string, channelId string) (bool, error)
+	// GetPresences 批量查询在线状态
+	GetPresences(accounts ...string) ([]*pkt.Presence, error)
+	// Subscribe 订阅accounts的在线状态变更
+	Subscribe(subscriber string, accounts ...string) error
+	// Unsubscribe 取消订阅，accounts为空时取消全部订阅
+	Unsubscribe(subscriber string, accounts ...string) error
+	// Subscribers 返回订阅了account的账号
+	Subscribers(account string) ([]string, error)
+}
@@ -0,0 +1,16 @@
+package him
+
+import (
+	"context"
+
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+)
+
+// PushQueue 定义外部服务推送给账号的消息队列
+// 没有长连接的服务(如web服务)通过它把消息交给逻辑服务投递，每条消息只会被一个逻辑服务消费
+type PushQueue interface {
+	// Publish 投递一个消息给accounts
+	Publish(accounts []string, packet *pkt.LogicPkt) error
+	// Consume 阻塞消费消息直到ctx结束，handler返回错误时消息不会被确认，稍后重新投递
+	Consume(ctx context.Context, handler func(accounts []string, packet *pkt.LogicPkt) error) error
+}
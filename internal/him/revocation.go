@@ -0,0 +1,21 @@
+package him
+
+import "time"
+
+// RevocationStorage 定义token吊销存储
+// 吊销记录在集群内共享，吊销账号时通知所有订阅者踢下该账号的在线连接
+type RevocationStorage interface {
+	// RevokeToken 吊销单个token，记录保留到token过期，不通知订阅者
+	RevokeToken(account string, tokenId string, expires time.Time) error
+	// ClaimToken 与RevokeToken相同，token已经被吊销或者已经过期时返回false
+	// 用于只能使用一次的token，并发使用时只有一个可以成功
+	ClaimToken(account string, tokenId string, expires time.Time) (bool, error)
+	// RevokeAccount 吊销账号在at之前签发的全部token，并通知订阅者
+	RevokeAccount(account string, at time.Time) error
+	// Notify 通知订阅者踢下账号的在线连接
+	Notify(account string) error
+	// IsRevoked 检查token是否已经被吊销
+	IsRevoked(account string, tokenId string, issuedAt time.Time) (bool, error)
+	// Subscribe 订阅吊销事件，回调参数为被吊销的账号
+	Subscribe(handler func(account string)) error
+}
@@ -42,6 +42,7 @@ func (r *Router) Serve(pkt *pkt.LogicPkt, dispatcher Dispatcher, cache SessionSt
 	ctx := r.pool.Get().(*ContextImpl)
 	ctx.reset()
 	ctx.requestPkt = pkt
+	ctx.Dispatcher = dispatcher
 	ctx.SessionStorage = cache
 	ctx.session = session
 
@@ -2,7 +2,9 @@ package him
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -43,6 +45,8 @@ type Server interface {
 	SetStateListener(StateListener)
 	SetReadWait(time.Duration)
 	SetChannelMap(ChannelMap)
+	// SetTLSConfig 设置后使用TLS监听，为nil时使用明文连接
+	SetTLSConfig(*tls.Config)
 
 	Start() error
 	Push(string, []byte) error
@@ -91,6 +95,12 @@ type MessageListener interface {
 	Receive(Agent, []byte)
 }
 
+// HeartbeatListener 可选，由MessageListener实现
+// 收到客户端心跳时在读取的goroutine中调用，不能阻塞
+type HeartbeatListener interface {
+	Heartbeat(Agent)
+}
+
 // Acceptor 连接接收器
 type Acceptor interface {
 	// Accept 返回一个握手完成的Channel对象或者一个error。
@@ -98,12 +108,89 @@ type Acceptor interface {
 	Accept(Conn, time.Duration) (string, error)
 }
 
+// Replacer 可选，由Acceptor实现
+// 返回true时相同channelId的新连接替换旧连接，旧连接断开时不再回调Disconnect；没有实现时拒绝新连接
+// 只有确定旧连接已经失效时才应该替换，比如同一个网关进程在本端发现断开之前重新连接
+type Replacer interface {
+	Replace(id string) bool
+}
+
+// InstanceId 网关进程连接逻辑服务使用的ID，也是它生成的channelId的前缀
+// 网关交接时新旧进程的ServiceId相同，按照instance区分，instance为空时就是serviceId
+func InstanceId(serviceId string, instance string) string {
+	if instance == "" {
+		return serviceId
+	}
+	return serviceId + "_" + instance
+}
+
+// InstanceOf 从网关生成的channelId中取出InstanceId，格式不正确时返回空
+func InstanceOf(channelId string) string {
+	i := strings.Index(channelId, "_{")
+	if i <= 0 {
+		return ""
+	}
+	return channelId[:i]
+}
+
 // StateListener 状态监听器
 type StateListener interface {
 	// Disconnect 连接断开回调
 	Disconnect(string) error
 }
 
+// Listenable 可选，由Server实现
+// 设置之后Start在传入的监听上接收连接，不再监听地址，用于从旧进程继承监听
+type Listenable interface {
+	SetListener(net.Listener)
+}
+
+// Poolable 可选，由Server实现
+// 设置处理消息的协程池，在Start之前调用，没有设置时使用DefaultWorkerPool
+type Poolable interface {
+	SetWorkerPool(*WorkerPool)
+}
+
+// GoAwayListener 可选，由StateListener实现
+// Server关闭时在停止接收新连接之后调用，返回的消息在关闭连接之前推送给客户端，为nil时不推送
+type GoAwayListener interface {
+	GoAway(Channel) []byte
+}
+
+// Duplicated 握手之后检查channelId是否已经存在，返回true时拒绝新连接
+func Duplicated(channels ChannelMap, acceptor Acceptor, id string) bool {
+	if _, ok := channels.Get(id); !ok {
+		return false
+	}
+	if r, ok := acceptor.(Replacer); ok && r.Replace(id) {
+		return false
+	}
+	return true
+}
+
+// DrainChannels 优雅关闭连接
+// 先推送GoAway通知，再等待每个连接已经推送的消息写完，ctx结束之后不再等待，最后关闭全部连接
+func DrainChannels(ctx context.Context, channels []Channel, listener StateListener) {
+	if goaway, ok := listener.(GoAwayListener); ok {
+		for _, ch := range channels {
+			if ctx.Err() != nil {
+				break
+			}
+			if payload := goaway.GoAway(ch); payload != nil {
+				_ = ch.Push(payload)
+			}
+		}
+	}
+	for _, ch := range channels {
+		if err := ch.Drain(ctx); err != nil {
+			break
+		}
+	}
+	for _, ch := range channels {
+		_ = ch.Close()
+	}
+}
+
 type Handler interface {
 	MessageListener
 	Acceptor
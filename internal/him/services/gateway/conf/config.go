@@ -3,6 +3,12 @@ package conf
 import (
 	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/container"
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire/token"
 	"github.com/spf13/viper"
 )
 
@@ -15,8 +21,57 @@ type GateWayConfig struct {
 	Tags          []string
 	ConsulURL     string
 	MonitorPort   int `default:"8001"`
-	AppSecret     string
+	// AppSecret 没有配置Keys时使用的HS256默认密钥
+	AppSecret string
+	// Keys 校验登录token的密钥，按照token中的app与kid选择
+	Keys []token.KeyConfig
+	// Audience 不为空时登录token的aud必须包含它
+	Audience string
+	// KeyReloadInterval 重新加载密钥文件的间隔，为0时不重新加载
+	KeyReloadInterval time.Duration
+	// Redis 保存token吊销记录，Addrs为空时使用进程内存储，吊销只在本网关生效
+	Redis storage.RedisOptions
+	// RevocationTTL 账号吊销记录的保留时间，不能短于token的最长有效期
+	RevocationTTL time.Duration
 	LogLevel      string `default:"INFO"`
+	// TLS 面向客户端的TLS配置(wss与TLS over TCP)
+	TLS TLSConfig
+	// InnerSecret 服务之间握手签名的共享密钥，网关与逻辑服务必须一致，为空时拒绝启动
+	InnerSecret string
+	// InnerTLS 连接逻辑服务使用的TLS配置，CertFile为客户端证书
+	InnerTLS TLSConfig
+	// LoadBalance 选择逻辑服务的方式：hash(默认)按照channel哈希，weighted按照负载加权并对新服务慢启动
+	LoadBalance string
+	// SlowStart 新服务的流量逐渐增加到正常水平的时间
+	SlowStart time.Duration
+	// Breaker 逻辑服务的熔断参数，为0的参数使用默认值
+	Breaker container.BreakerOptions
+	// RouteRules 灰度规则文件(JSON)，为空时按照channel哈希选择逻辑服务
+	RouteRules string
+	// RouteReloadInterval 检查规则文件变化的间隔，为0时不重新加载
+	RouteReloadInterval time.Duration
+	// LoadReportInterval 负载没有明显变化时重新注册的间隔，为0时使用默认值
+	LoadReportInterval time.Duration
+	// LoadThreshold 负载变化超过这个比例时立即重新注册
+	LoadThreshold float64
+	// DrainTimeout 关闭时通知客户端重连之后等待推送写完的时间
+	DrainTimeout time.Duration
+	// WorkerPool 处理客户端消息的协程池，同一个连接的消息按照顺序处理，为0的参数使用默认值
+	WorkerPool him.WorkerPoolOptions
+	// EventLoop tcp协议使用epoll事件循环，空闲连接不占用goroutine，不支持TLS
+	EventLoop bool
+	// HandoffSocket 升级时新进程通过这个unix socket继承监听，为空时不支持不停机升级
+	HandoffSocket string
+}
+
+// TLSConfig 证书文件更新后会自动重新加载
+type TLSConfig struct {
+	Enable   bool
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// ServerName 为空时使用逻辑服务的ServiceId校验对端证书
+	ServerName string
 }
 
 func (c GateWayConfig) String() string {
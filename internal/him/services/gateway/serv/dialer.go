@@ -1,38 +1,83 @@
 package serv
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
 	"github.com/chang144/gotalk/internal/him"
 	"github.com/chang144/gotalk/internal/him/tcp"
 	"github.com/chang144/gotalk/internal/him/wire/pkt"
 	"github.com/klintcheng/kim/logger"
 	"google.golang.org/protobuf/proto"
-	"net"
 )
 
 type TcpDialer struct {
 	ServiceId string
+	// Instance 进程的实例ID，与Handler.Instance一致，逻辑服务按照它区分交接时的新旧进程
+	Instance string
+	// Secret 握手签名使用的共享密钥，必须与逻辑服务一致
+	Secret string
+	// TLSConfig 为nil时使用明文连接
+	TLSConfig *tls.Config
 }
 
 // DialAndHandshake 与chat建立tcp连接
 func (t *TcpDialer) DialAndHandshake(ctx him.DialerContext) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", ctx.Address, ctx.Timeout)
+	// 1. 建立连接，启用TLS时校验对端证书是否属于要连接的服务
+	var conn net.Conn
+	var err error
+	if t.TLSConfig != nil {
+		config := t.TLSConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = ctx.Id
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: ctx.Timeout}, "tcp", ctx.Address, config)
+	} else {
+		conn, err = net.DialTimeout("tcp", ctx.Address, ctx.Timeout)
+	}
 	if err != nil {
 		return nil, err
 	}
-	req := &pkt.InnerHandshakeRequest{ServiceId: ctx.Id}
-	logger.Error("send req %v", req)
-	// 2. 把自己的serviceId发送给对方
+	if err = t.handshake(conn, ctx.Timeout); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *TcpDialer) handshake(conn net.Conn, timeout time.Duration) error {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+	req := pkt.NewInnerHandshakeRequest(t.ServiceId, t.Instance, t.Secret)
+	logger.Debugf("send req %v", req)
+	// 2. 把自己的serviceId与签名发送给对方
 	bts, err := proto.Marshal(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	err = tcp.WriteFrame(conn, him.OpBinary, bts)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return conn, nil
+	// 3. 读取握手结果
+	frame, err := tcp.NewConn(conn).ReadFrame()
+	if err != nil {
+		return err
+	}
+	var resp pkt.InnerHandshakeResponse
+	if err = proto.Unmarshal(frame.GetPayload(), &resp); err != nil {
+		return err
+	}
+	if resp.Code != uint32(pkt.Status_Success) {
+		return fmt.Errorf("handshake rejected: %s (code %d, remote version %d)", resp.Error, resp.Code, resp.Version)
+	}
+	return nil
 }
 
-func NewTcpDialer(serviceId string) him.Dialer {
-	return &TcpDialer{ServiceId: serviceId}
+func NewTcpDialer(serviceId string, instance string, secret string, tlsConfig *tls.Config) him.Dialer {
+	return &TcpDialer{ServiceId: serviceId, Instance: instance, Secret: secret, TLSConfig: tlsConfig}
 }
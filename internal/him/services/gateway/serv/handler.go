@@ -8,7 +8,8 @@ import (
 	"github.com/chang144/gotalk/internal/him/wire/pkt"
 	"github.com/chang144/gotalk/internal/him/wire/token"
 	"regexp"
-
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/chang144/gotalk/internal/him"
@@ -22,9 +23,54 @@ var log = logger.WithFields(logger.Fields{
 
 type Handler struct {
 	ServiceId string
-	AppSecret string
+	// Instance 进程的实例ID，加在ChannelID中，交接时新旧进程的序号都从头开始，生成的ChannelID也不会重复
+	Instance string
+	// Container 转发消息到逻辑服务
+	Container *container.Container
+	// Tokens 按照token中的app与kid选择密钥校验登录token
+	Tokens *token.Parser
+	// Revocations 为nil时不检查token是否被吊销
+	Revocations him.RevocationStorage
+	// Channels 网关上的全部连接，用于踢下被吊销的账号
+	Channels him.ChannelMap
+	// kicked 被强制下线的channel，关闭之前丢弃它发送的消息
+	kicked sync.Map
+	// routes 连接的路由属性，转发时写入包中供选择器使用
+	routes sync.Map
+	// touched channel最近一次刷新会话的时间(UnixNano)
+	touched sync.Map
+	// accounts 账号在本网关上登录的channel，踢下账号时不需要遍历全部连接
+	accountsLock sync.Mutex
+	accounts     map[string]map[string]struct{}
+	// alternatives 网关关闭时推荐客户端重连的其它网关
+	goaway       sync.Once
+	alternatives []string
+}
+
+// route 连接登录时的属性
+type route struct {
+	app     string
+	zone    string
+	version string
+}
+
+// apply 添加路由属性，覆盖客户端自己写入的同名属性
+func (r *route) apply(packet *pkt.LogicPkt, account string) {
+	for _, key := range []string{wire.MetaApp, wire.MetaAccount, wire.MetaZone, wire.MetaVersion} {
+		packet.DelMeta(key)
+	}
+	packet.AddStringMeta(wire.MetaApp, r.app)
+	packet.AddStringMeta(wire.MetaAccount, account)
+	packet.AddStringMeta(wire.MetaZone, r.zone)
+	packet.AddStringMeta(wire.MetaVersion, r.version)
 }
 
+// KickoutWait 发送下线通知之后等待多久关闭连接
+const KickoutWait = time.Second
+
+// TouchInterval 收到心跳之后刷新会话过期时间的最小间隔
+const TouchInterval = time.Minute * 10
+
 // Receive 接收SDK发送来的消息
 func (h *Handler) Receive(agent him.Agent, payload []byte) {
 	buf := bytes.NewBuffer(payload)
@@ -37,14 +83,21 @@ func (h *Handler) Receive(agent him.Agent, payload []byte) {
 	if hPkt, ok := packet.(*pkt.HeartbeatPkt); ok {
 		if hPkt.Code == pkt.CodePing {
 			_ = agent.Push(pkt.Marshal(&pkt.HeartbeatPkt{Code: pkt.CodePong}))
+			h.Heartbeat(agent)
 		}
 		return
 	}
 	// 如果是LoginPkt，就转化给逻辑处理服务器
 	if logicPkt, ok := packet.(*pkt.LogicPkt); ok {
+		if _, kicked := h.kicked.Load(agent.ID()); kicked {
+			return
+		}
 		logicPkt.ChannelId = agent.ID()
+		if r, ok := h.routes.Load(agent.ID()); ok {
+			r.(*route).apply(logicPkt, accountOf(agent.ID()))
+		}
 
-		err := container.Forward(logicPkt.ServiceName(), logicPkt)
+		err := h.Container.Forward(logicPkt.ServiceName(), logicPkt)
 		if err != nil {
 			logger.WithFields(logger.Fields{
 				"module": "handler",
@@ -57,10 +110,52 @@ func (h *Handler) Receive(agent him.Agent, payload []byte) {
 	}
 }
 
+// Heartbeat 每个连接按照TouchInterval通知逻辑服务刷新会话与位置信息的过期时间
+func (h *Handler) Heartbeat(agent him.Agent) {
+	now := time.Now().UnixNano()
+	if last, ok := h.touched.Load(agent.ID()); ok && now-last.(int64) < int64(TouchInterval) {
+		return
+	}
+	h.touched.Store(agent.ID(), now)
+	touch := pkt.New(wire.CommandLoginTouch, pkt.WithChannel(agent.ID()))
+	// 逻辑服务不回复touch，按照请求发送会被熔断器当作超时
+	touch.Flag = pkt.Flag_Push
+	if r, ok := h.routes.Load(agent.ID()); ok {
+		r.(*route).apply(touch, accountOf(agent.ID()))
+	}
+	if err := h.Container.Forward(wire.SNLogin, touch); err != nil {
+		logger.WithFields(logger.Fields{
+			"module": "handler",
+			"id":     agent.ID(),
+		}).Error(err)
+	}
+}
+
+// Busy 消息因为处理队列已满被丢弃，通知客户端稍后重试
+func (h *Handler) Busy(agent him.Agent, payload []byte) {
+	packet, err := pkt.MustReadLogicPkt(bytes.NewBuffer(payload))
+	if err != nil {
+		return
+	}
+	resp := pkt.NewLogicPkt(&packet.Header)
+	resp.Status = pkt.Status_Busy
+	resp.Flag = pkt.Flag_Response
+	_ = agent.Push(pkt.Marshal(resp))
+}
+
 func (h *Handler) Disconnect(id string) error {
-	log.Info("disconnect %s", id)
+	log.Infof("disconnect %s", id)
+	h.touched.Delete(id)
+	h.unindex(accountOf(id), id)
 	logout := pkt.New(wire.CommandLoginSignOut, pkt.WithChannel(id))
-	err := container.Forward(wire.SNLogin, logout)
+	// 被强制下线的连接直接登出，不保留会话
+	if _, kicked := h.kicked.LoadAndDelete(id); !kicked {
+		logout.AddStringMeta(wire.MetaDisconnect, "true")
+	}
+	if r, ok := h.routes.LoadAndDelete(id); ok {
+		r.(*route).apply(logout, accountOf(id))
+	}
+	err := h.Container.Forward(wire.SNLogin, logout)
 	if err != nil {
 		logger.WithFields(logger.Fields{
 			"module": "handler",
@@ -84,8 +179,8 @@ func (h *Handler) Accept(conn him.Conn, timeout time.Duration) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	// 判断是不是登录包
-	if req.Command != wire.CommandLoginSignIn {
+	// 判断是不是登录或会话恢复包
+	if req.Command != wire.CommandLoginSignIn && req.Command != wire.CommandLoginResume {
 		resp := pkt.NewLogicPkt(&req.Header)
 		resp.Status = pkt.Status_InvalidCommand
 		_ = conn.WriteFrame(him.OpBinary, pkt.Marshal(resp))
@@ -99,8 +194,7 @@ func (h *Handler) Accept(conn him.Conn, timeout time.Duration) (string, error) {
 		return "", err
 	}
 
-	// 使用默认的DefaultSecret解析token
-	tk, err := token.Parse(token.DefaultSecret, login.Token)
+	tk, err := h.Tokens.Parse(login.Token)
 	if err != nil {
 		// token 无效
 		resp := pkt.NewLogicPkt(&req.Header)
@@ -108,26 +202,204 @@ func (h *Handler) Accept(conn him.Conn, timeout time.Duration) (string, error) {
 		_ = conn.WriteFrame(him.OpBinary, pkt.Marshal(resp))
 		return "", err
 	}
+	if h.Revocations != nil {
+		revoked, err := h.Revocations.IsRevoked(tk.Account, tk.ID, time.Unix(tk.Iat, 0))
+		if err != nil {
+			return "", err
+		}
+		if revoked {
+			resp := pkt.NewLogicPkt(&req.Header)
+			resp.Status = pkt.Status_Unauthorized
+			_ = conn.WriteFrame(him.OpBinary, pkt.Marshal(resp))
+			return "", fmt.Errorf("token of %s is revoked", tk.Account)
+		}
+	}
 	// 生成一个全局唯一的ChannelID
-	id := fmt.Sprintf("%s_%s_%d", h.ServiceId, tk.Account, wire.Seq.Next())
+	// {account}作为redis集群的hash-tag，使会话与位置信息落在同一个slot
+	id := fmt.Sprintf("%s_{%s}_%d", him.InstanceId(h.ServiceId, h.Instance), tk.Account, wire.Seq.Next())
 
 	req.ChannelId = id
+	if req.Command == wire.CommandLoginResume && login.ResumeToken != "" {
+		req.AddStringMeta(wire.MetaResumeToken, login.ResumeToken)
+	}
 	req.WriteBody(&pkt.Session{
 		ChannelId: id,
 		GateId:    h.ServiceId,
 		Account:   tk.Account,
 		RemoteIP:  getIP(conn.RemoteAddr().String()),
 		App:       tk.App,
+		Zone:      login.Zone,
+		Isp:       login.Isp,
+		Tags:      login.Tags,
 	})
+	r := &route{app: tk.App, zone: login.Zone, version: login.Version}
+	r.apply(req, tk.Account)
 	// 7. 把login.转发给Login服务
-	err = container.Forward(wire.SNLogin, req)
+	err = h.Container.Forward(wire.SNLogin, req)
 	if err != nil {
 		return "", err
 	}
+	h.routes.Store(id, r)
+	h.index(tk.Account, id)
+	// 登录时已经写入了过期时间
+	h.touched.Store(id, time.Now().UnixNano())
 	return id, nil
 }
 
+// Kickout 通知账号在本网关上的全部连接下线并关闭连接
+func (h *Handler) Kickout(account string) {
+	if h.Channels == nil {
+		return
+	}
+	for _, id := range h.channelsOf(account) {
+		ch, ok := h.Channels.Get(id)
+		if !ok {
+			continue
+		}
+		// 与逻辑服务发出的KickoutNotify保持一致
+		p := pkt.New(wire.CommandLoginSignIn, pkt.WithChannel(ch.ID()))
+		p.Flag = pkt.Flag_Push
+		p.WriteBody(&pkt.KickoutNotify{ChannelId: ch.ID()})
+		_ = ch.Push(pkt.Marshal(p))
+		h.kick(ch)
+	}
+}
+
+// KickoutChannels 逻辑服务已经推送了下线通知，只需要关闭连接
+func (h *Handler) KickoutChannels(ids []string) {
+	if h.Channels == nil {
+		return
+	}
+	for _, id := range ids {
+		if ch, ok := h.Channels.Get(id); ok {
+			h.kick(ch)
+		}
+	}
+}
+
+// GoAwayReason 网关关闭时推送给客户端的原因
+const GoAwayReason = "server going away"
+
+// GoAway 网关关闭之前通知客户端重连，按照channelId把客户端分散到其它网关
+func (h *Handler) GoAway(ch him.Channel) []byte {
+	h.goaway.Do(func() {
+		h.alternatives = h.findAlternatives()
+		log.Infof("going away, alternatives %v", h.alternatives)
+	})
+	var address string
+	if len(h.alternatives) > 0 {
+		address = h.alternatives[container.HashCode(ch.ID())%len(h.alternatives)]
+	}
+	p := pkt.New(wire.CommandGatewayGoAway, pkt.WithChannel(ch.ID()))
+	p.Flag = pkt.Flag_Push
+	p.WriteBody(&pkt.GoAwayNotify{Reason: GoAwayReason, Address: address})
+	return pkt.Marshal(p)
+}
+
+// Handoff 监听已经交给新进程，通知客户端重连到同一个地址，在GoAway之前调用
+func (h *Handler) Handoff(address string) {
+	h.goaway.Do(func() {
+		h.alternatives = []string{address}
+	})
+}
+
+// findAlternatives 从注册中心查询同名的其它网关，优先同一个区域
+func (h *Handler) findAlternatives() []string {
+	if h.Container == nil || h.Container.Naming == nil {
+		return nil
+	}
+	self := h.Container.Srv
+	services, err := h.Container.Naming.Find(self.ServiceName())
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	zone := zoneOf(self.GetTags())
+	var all, local []string
+	for _, s := range services {
+		if s.ServiceID() == self.ServiceID() {
+			continue
+		}
+		all = append(all, s.DialURL())
+		if zone != "" && zoneOf(s.GetTags()) == zone {
+			local = append(local, s.DialURL())
+		}
+	}
+	if len(local) > 0 {
+		return local
+	}
+	return all
+}
+
+// zoneOf 网关标签中的区域，格式为 zone:sh
+func zoneOf(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "zone:") {
+			return tag
+		}
+	}
+	return ""
+}
+
+// kick 丢弃连接之后发送的消息，等待KickoutWait之后关闭连接
+func (h *Handler) kick(ch him.Channel) {
+	log.Infof("kickout %s", ch.ID())
+	h.kicked.Store(ch.ID(), struct{}{})
+	time.AfterFunc(KickoutWait, func() {
+		_ = ch.Close()
+	})
+}
+
+func (h *Handler) index(account, id string) {
+	h.accountsLock.Lock()
+	defer h.accountsLock.Unlock()
+	if h.accounts == nil {
+		h.accounts = make(map[string]map[string]struct{})
+	}
+	ids, ok := h.accounts[account]
+	if !ok {
+		ids = make(map[string]struct{}, 1)
+		h.accounts[account] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (h *Handler) unindex(account, id string) {
+	h.accountsLock.Lock()
+	defer h.accountsLock.Unlock()
+	ids, ok := h.accounts[account]
+	if !ok {
+		return
+	}
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(h.accounts, account)
+	}
+}
+
+// channelsOf 账号在本网关上登录的channelId
+func (h *Handler) channelsOf(account string) []string {
+	h.accountsLock.Lock()
+	defer h.accountsLock.Unlock()
+	ids := make([]string, 0, len(h.accounts[account]))
+	for id := range h.accounts[account] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// accountOf 从channelId中取出账号
+func accountOf(channelId string) string {
+	start := strings.IndexByte(channelId, '{')
+	end := strings.LastIndexByte(channelId, '}')
+	if start < 0 || end <= start {
+		return ""
+	}
+	return channelId[start+1 : end]
+}
+
 var _ him.Handler = (*Handler)(nil)
+var _ him.GoAwayListener = (*Handler)(nil)
 
 var ipExp = regexp.MustCompile(string("\\:[0-9]+$"))
 
@@ -2,10 +2,19 @@ package gateway
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/chang144/gotalk/internal/him"
 	"github.com/chang144/gotalk/internal/him/container"
+	"github.com/chang144/gotalk/internal/him/epoll"
+	"github.com/chang144/gotalk/internal/him/handoff"
 	"github.com/chang144/gotalk/internal/him/naming"
 	"github.com/chang144/gotalk/internal/him/naming/consul"
 
@@ -13,9 +22,11 @@ import (
 
 	"github.com/chang144/gotalk/internal/him/services/gateway/conf"
 	"github.com/chang144/gotalk/internal/him/services/gateway/serv"
+	"github.com/chang144/gotalk/internal/him/storage"
 	"github.com/chang144/gotalk/internal/him/tcp"
 	websocket "github.com/chang144/gotalk/internal/him/websocket"
 	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/token"
 	"github.com/klintcheng/kim/logger"
 	"github.com/spf13/cobra"
 )
@@ -26,8 +37,16 @@ const DefaultPath = "../../internal/him/services/gateway/conf.yaml"
 type ServerStartOptions struct {
 	config   string
 	protocol string
+	// upgrade 从正在运行的网关继承监听
+	upgrade bool
 }
 
+// 交接的监听名称
+const (
+	listenerGateway = "gateway"
+	listenerMonitor = "monitor"
+)
+
 // NewServerStartCmd 创建一个新的http服务命令
 func NewServerStartCmd(ctx context.Context, version string) *cobra.Command {
 	opts := &ServerStartOptions{}
@@ -41,6 +60,7 @@ func NewServerStartCmd(ctx context.Context, version string) *cobra.Command {
 	}
 	cmd.PersistentFlags().StringVarP(&opts.config, "config", "c", DefaultPath, "Config file")
 	cmd.PersistentFlags().StringVarP(&opts.protocol, "protocol", "p", "ws", "protocol of ws or tcp")
+	cmd.PersistentFlags().BoolVar(&opts.upgrade, "upgrade", false, "inherit listeners from the running gateway")
 
 	return cmd
 }
@@ -51,14 +71,64 @@ func RunServerStart(ctx context.Context, opts *ServerStartOptions, version strin
 	if err != nil {
 		return err
 	}
+	// 逻辑服务拒绝没有签名的握手
+	if config.InnerSecret == "" {
+		return errors.New("InnerSecret is required to handshake with logic servers")
+	}
 	logger.Init(logger.Settings{
 		Level:    "info",
 		Filename: "./data/gateway.log",
 	})
 
+	// 升级时从旧进程继承监听，旧进程收到确认之后开始关闭
+	var inherited *handoff.Handoff
+	if opts.upgrade {
+		inherited, err = handoff.Inherit(config.HandoffSocket, handoff.DefaultTimeout)
+		if err != nil {
+			return err
+		}
+		defer inherited.Close()
+	}
+
+	keyConfigs := config.Keys
+	if len(keyConfigs) == 0 {
+		secret := config.AppSecret
+		if secret == "" {
+			secret = token.DefaultSecret
+		}
+		keyConfigs = []token.KeyConfig{{Algorithm: token.AlgHS256, Secret: secret}}
+	}
+	keys, err := token.NewFileKeyProvider(keyConfigs)
+	if err != nil {
+		return err
+	}
+	if config.KeyReloadInterval > 0 {
+		go keys.Watch(ctx, config.KeyReloadInterval)
+	}
+
+	var revocations him.RevocationStorage
+	if len(config.Redis.Addrs) > 0 {
+		rdb, err := storage.InitUniversalRedis(config.Redis)
+		if err != nil {
+			return err
+		}
+		revocations = storage.NewRedisRevocationStorage(rdb, config.RevocationTTL)
+	} else {
+		revocations = storage.NewMemoryRevocationStorage()
+	}
+
+	// 交接时新旧进程的ServiceId相同，逻辑服务按照实例ID区分两个进程的连接
+	instance := strconv.FormatInt(time.Now().UnixNano(), 36)
 	handler := &serv.Handler{
-		ServiceId: config.ServiceId,
-		AppSecret: config.AppSecret,
+		ServiceId:   config.ServiceId,
+		Instance:    instance,
+		Tokens:      token.NewParser(keys, config.Audience),
+		Revocations: revocations,
+		Channels:    him.NewChannelMap(1000),
+	}
+	// 吊销token时踢下该账号在本网关上的连接
+	if err = revocations.Subscribe(handler.Kickout); err != nil {
+		return err
 	}
 
 	var srv him.Server
@@ -77,26 +147,147 @@ func RunServerStart(ctx context.Context, opts *ServerStartOptions, version strin
 	// 根据protocol建立对应的连接
 	if opts.protocol == "ws" {
 		srv = websocket.NewServer(config.Listen, service)
+	} else if config.EventLoop {
+		srv = epoll.NewServer(config.Listen, service)
 	} else {
 		srv = tcp.NewServer(config.Listen, service)
 	}
 
+	gatewayLst, err := listen(inherited, listenerGateway, config.Listen)
+	if err != nil {
+		return err
+	}
+	srv.(him.Listenable).SetListener(gatewayLst)
+	monitorLst, err := listen(inherited, listenerMonitor, fmt.Sprintf(":%d", config.MonitorPort))
+	if err != nil {
+		return err
+	}
+
 	srv.SetReadWait(time.Minute * 2)
+	srv.SetChannelMap(handler.Channels)
+	pool, err := him.NewWorkerPool(config.WorkerPool)
+	if err != nil {
+		return err
+	}
+	defer pool.Release()
+	srv.(him.Poolable).SetWorkerPool(pool)
 	srv.SetAcceptor(handler)
 	srv.SetMessageListener(handler)
 	srv.SetStateListener(handler)
+	if config.TLS.Enable {
+		tlsConfig, err := him.NewServerTLSConfig(him.TLSOptions{
+			CertFile: config.TLS.CertFile,
+			KeyFile:  config.TLS.KeyFile,
+			CAFile:   config.TLS.CAFile,
+		})
+		if err != nil {
+			return err
+		}
+		srv.SetTLSConfig(tlsConfig)
+	}
 
-	// container 初始化
-	_ = container.Init(srv, wire.SNChat, wire.SNLogin)
-	container.EnableMonitor(fmt.Sprintf(":%d", config.MonitorPort))
+	// 收到退出信号时关闭容器
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	var selector container.Selector = &container.HashSelector{}
+	if config.LoadBalance == "weighted" {
+		selector = container.NewWeightedSelector(container.WeightedOptions{SlowStart: config.SlowStart})
+	}
+	if config.RouteRules != "" {
+		rules, err := container.LoadRules(config.RouteRules)
+		if err != nil {
+			return err
+		}
+		ruleSelector := container.NewRuleSelector(rules, selector)
+		if config.RouteReloadInterval > 0 {
+			go ruleSelector.Watch(ctx, config.RouteRules, config.RouteReloadInterval)
+		}
+		selector = ruleSelector
+	}
 
 	ns, err := consul.NewNaming(config.ConsulURL)
 	if err != nil {
 		return err
 	}
-	container.SetServiceNaming(ns)
 	// set a dialer
-	container.SetDialer(serv.NewTcpDialer(config.ServiceId))
+	var innerTLS *tls.Config
+	if config.InnerTLS.Enable {
+		innerTLS, err = him.NewClientTLSConfig(him.TLSOptions{
+			CertFile:   config.InnerTLS.CertFile,
+			KeyFile:    config.InnerTLS.KeyFile,
+			CAFile:     config.InnerTLS.CAFile,
+			ServerName: config.InnerTLS.ServerName,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// container 初始化
+	cont := container.New(container.Options{
+		Server:   srv,
+		Deps:     []string{wire.SNChat, wire.SNLogin},
+		Naming:   ns,
+		Dialer:   serv.NewTcpDialer(config.ServiceId, instance, config.InnerSecret, innerTLS),
+		Selector: selector,
+		Kickout:  handler.KickoutChannels,
+		Load: &container.LoadOptions{
+			Interval:  config.LoadReportInterval,
+			Threshold: config.LoadThreshold,
+			Connections: func() int {
+				return handler.Channels.Len()
+			},
+		},
+		Breaker:         config.Breaker,
+		ShutdownTimeout: config.DrainTimeout,
+	})
+	handler.Container = cont
+	go func() {
+		if err := http.Serve(monitorLst, cont.MonitorHandler()); err != nil {
+			logger.Warn(err)
+		}
+	}()
 
-	return container.Start()
+	if inherited != nil {
+		if err = inherited.Ack(); err != nil {
+			return err
+		}
+	}
+	if config.HandoffSocket != "" {
+		listeners := map[string]net.Listener{listenerGateway: gatewayLst, listenerMonitor: monitorLst}
+		go handover(ctx, config.HandoffSocket, listeners, cont, handler, service.DialURL(), config.DrainTimeout)
+	}
+
+	return cont.Run(ctx)
+}
+
+// listen 优先使用从旧进程继承的监听
+func listen(inherited *handoff.Handoff, name, addr string) (net.Listener, error) {
+	if inherited != nil {
+		if lst, ok := inherited.Listeners[name]; ok {
+			return lst, nil
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// handover 等待新进程继承监听，之后通知客户端重连到同一个地址，不注销服务直接关闭
+func handover(ctx context.Context, path string, listeners map[string]net.Listener, cont *container.Container,
+	handler *serv.Handler, address string, timeout time.Duration) {
+	if err := handoff.Serve(ctx, path, listeners); err != nil {
+		if ctx.Err() == nil {
+			logger.Warn(err)
+		}
+		return
+	}
+	handler.Handoff(address)
+	if timeout <= 0 {
+		timeout = container.DefaultShutdownTimeout
+	}
+	dctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := cont.Release(dctx); err != nil {
+		logger.Warn(err)
+	}
 }
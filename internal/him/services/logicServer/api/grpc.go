@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MetadataApiKey gRPC请求中携带密钥的metadata
+const MetadataApiKey = "x-api-key"
+
+// appKey 密钥所属的应用在context中的key
+type appKey struct{}
+
+type grpcServer struct {
+	sender *Sender
+}
+
+func (s *grpcServer) Send(ctx context.Context, req *rpc.SendMessageReq) (*rpc.SendMessageResp, error) {
+	app, _ := ctx.Value(appKey{}).(string)
+	if err := bindApp(req, app); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	resp, st, err := s.sender.Send(req)
+	if err != nil {
+		code := grpcCode(st)
+		if err == him.ErrIdempotencyPending {
+			code = codes.Aborted
+		}
+		return nil, status.Error(code, err.Error())
+	}
+	return resp, nil
+}
+
+// NewGrpcServer 注册MessageService并校验metadata中的密钥
+func NewGrpcServer(sender *Sender, keys []KeyConfig, opts ...grpc.ServerOption) *grpc.Server {
+	auth := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var key string
+		if values := md.Get(MetadataApiKey); len(values) > 0 {
+			key = values[0]
+		}
+		app, ok := checkKey(keys, key)
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, ErrInvalidKey.Error())
+		}
+		return handler(context.WithValue(ctx, appKey{}, app), req)
+	}
+	srv := grpc.NewServer(append(opts, grpc.UnaryInterceptor(auth))...)
+	rpc.RegisterMessageServiceServer(srv, &grpcServer{sender: sender})
+	return srv
+}
+
+func grpcCode(st pkt.Status) codes.Code {
+	switch st {
+	case pkt.Status_NoDestination, pkt.Status_InvalidPacketBody:
+		return codes.InvalidArgument
+	case pkt.Status_Blocked, pkt.Status_NotFriend:
+		return codes.PermissionDenied
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// HeaderApiKey 业务服务的密钥
+	HeaderApiKey = "X-Api-Key"
+	// HeaderIdempotencyKey 优先于请求体中的idempotency_key
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// ctxApp 密钥所属的应用
+	ctxApp = "app"
+)
+
+type SendReq struct {
+	App            string `json:"app"`
+	Sender         string `json:"sender" binding:"required,max=60"`
+	Account        string `json:"account" binding:"max=60"`
+	Group          string `json:"group" binding:"max=30"`
+	Type           int32  `json:"type"`
+	Body           string `json:"body" binding:"required,max=5000"`
+	Extra          string `json:"extra" binding:"max=500"`
+	IdempotencyKey string `json:"idempotency_key" binding:"max=100"`
+}
+
+// NewHTTPHandler POST /api/messages
+func NewHTTPHandler(sender *Sender, keys []KeyConfig) http.Handler {
+	r := gin.New()
+	r.Use(gin.Recovery())
+	g := r.Group("/api", func(c *gin.Context) {
+		app, ok := checkKey(keys, c.GetHeader(HeaderApiKey))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrInvalidKey.Error()})
+			return
+		}
+		c.Set(ctxApp, app)
+		c.Next()
+	})
+	g.POST("/messages", func(c *gin.Context) {
+		var req SendReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if key := c.GetHeader(HeaderIdempotencyKey); key != "" {
+			req.IdempotencyKey = key
+		}
+		send := &rpc.SendMessageReq{
+			App:     req.App,
+			Sender:  req.Sender,
+			Account: req.Account,
+			Group:   req.Group,
+			Message: &rpc.Message{
+				Type:  req.Type,
+				Body:  req.Body,
+				Extra: req.Extra,
+			},
+			IdempotencyKey: req.IdempotencyKey,
+		}
+		if err := bindApp(send, c.GetString(ctxApp)); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		resp, status, err := sender.Send(send)
+		if err != nil {
+			code := httpStatus(status)
+			if err == him.ErrIdempotencyPending {
+				code = http.StatusConflict
+			}
+			c.AbortWithStatusJSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message_id": resp.MessageId, "send_time": resp.SendTime})
+	})
+	return r
+}
+
+func httpStatus(status pkt.Status) int {
+	switch status {
+	case pkt.Status_NoDestination, pkt.Status_InvalidPacketBody:
+		return http.StatusBadRequest
+	case pkt.Status_Blocked, pkt.Status_NotFriend:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
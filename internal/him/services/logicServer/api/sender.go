@@ -0,0 +1,176 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/services/logicServer/handler"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"github.com/klintcheng/kim/logger"
+)
+
+const (
+	// DefaultIdempotencyTTL 幂等键默认保留的时间
+	DefaultIdempotencyTTL = time.Hour * 24
+	// IdempotencyLockTTL 处理中的占位保留的时间，进程在处理中退出时，过期之后允许重试
+	IdempotencyLockTTL = time.Second * 30
+)
+
+var (
+	ErrInvalidKey  = errors.New("invalid api key")
+	ErrNoSender    = errors.New("sender is required")
+	ErrNoMessage   = errors.New("message body is required")
+	ErrDestination = errors.New("one of account and group is required")
+	ErrAppMismatch = errors.New("app is not allowed for the api key")
+)
+
+// KeyConfig 业务服务的密钥，每个密钥只能发送App中的消息
+type KeyConfig struct {
+	App string
+	Key string
+}
+
+// Sender 业务服务发送消息，与客户端发送的消息走相同的保存与推送流程
+type Sender struct {
+	Chat *handler.ChatHandler
+	// Idempotency 为nil时不支持幂等键
+	Idempotency him.IdempotencyStorage
+	TTL         time.Duration
+}
+
+func NewSender(chat *handler.ChatHandler, idempotency him.IdempotencyStorage, ttl time.Duration) *Sender {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &Sender{
+		Chat:        chat,
+		Idempotency: idempotency,
+		TTL:         ttl,
+	}
+}
+
+// result 幂等键保存的处理结果，消息已经保存但推送失败时同时保存错误
+type result struct {
+	MessageId int64      `json:"message_id"`
+	SendTime  int64      `json:"send_time"`
+	Status    pkt.Status `json:"status"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Send 相同的幂等键只发送一次，重复的请求返回第一次发送的结果
+func (s *Sender) Send(req *rpc.SendMessageReq) (*rpc.SendMessageResp, pkt.Status, error) {
+	if status, err := validate(req); err != nil {
+		return nil, status, err
+	}
+	if req.IdempotencyKey == "" || s.Idempotency == nil {
+		return s.send(req)
+	}
+	// 幂等键在应用与发送方的范围内唯一
+	key := fmt.Sprintf("%s:%s:%s", req.App, req.Sender, req.IdempotencyKey)
+	acquired, saved, err := s.Idempotency.Acquire(key, IdempotencyLockTTL)
+	if err != nil {
+		return nil, pkt.Status_SystemException, err
+	}
+	if !acquired {
+		var last result
+		if err = json.Unmarshal(saved, &last); err != nil {
+			return nil, pkt.Status_SystemException, err
+		}
+		if last.Error != "" {
+			return nil, last.Status, errors.New(last.Error)
+		}
+		return &rpc.SendMessageResp{MessageId: last.MessageId, SendTime: last.SendTime}, last.Status, nil
+	}
+	resp, status, err := s.send(req)
+	if resp == nil {
+		// 消息没有保存，允许重试
+		_ = s.Idempotency.Release(key)
+		return nil, status, err
+	}
+	// 消息已经保存，推送失败时也记录结果与错误，重试返回相同的错误，避免重复保存
+	last := &result{MessageId: resp.MessageId, SendTime: resp.SendTime, Status: status}
+	if err != nil {
+		last.Error = err.Error()
+	}
+	bts, merr := json.Marshal(last)
+	if merr != nil {
+		return nil, pkt.Status_SystemException, merr
+	}
+	if cerr := s.Idempotency.Complete(key, bts, s.TTL); cerr != nil {
+		logger.WithField("func", "Send").Warn(cerr)
+	}
+	if err != nil {
+		return nil, status, err
+	}
+	return resp, status, nil
+}
+
+func (s *Sender) send(req *rpc.SendMessageReq) (*rpc.SendMessageResp, pkt.Status, error) {
+	talk := &handler.Talk{
+		App:    req.App,
+		Sender: req.Sender,
+		Message: &pkt.MessageReq{
+			Type:  req.Message.Type,
+			Body:  req.Message.Body,
+			Extra: req.Message.Extra,
+		},
+		Trusted: true,
+	}
+	var (
+		resp   *pkt.MessageResp
+		status pkt.Status
+		err    error
+	)
+	if req.Account != "" {
+		talk.Dest = req.Account
+		resp, status, err = s.Chat.SendUser(talk, nil)
+	} else {
+		talk.Dest = req.Group
+		resp, status, err = s.Chat.SendGroup(talk, nil)
+	}
+	if resp == nil {
+		return nil, status, err
+	}
+	// 推送失败时resp为已经保存的消息
+	if err != nil {
+		return &rpc.SendMessageResp{MessageId: resp.MessageId, SendTime: resp.SendTime}, status, err
+	}
+	return &rpc.SendMessageResp{MessageId: resp.MessageId, SendTime: resp.SendTime}, pkt.Status_Success, nil
+}
+
+func validate(req *rpc.SendMessageReq) (pkt.Status, error) {
+	if req.Sender == "" {
+		return pkt.Status_InvalidPacketBody, ErrNoSender
+	}
+	if (req.Account == "") == (req.Group == "") {
+		return pkt.Status_NoDestination, ErrDestination
+	}
+	if req.Message == nil || req.Message.Body == "" {
+		return pkt.Status_InvalidPacketBody, ErrNoMessage
+	}
+	return pkt.Status_Success, nil
+}
+
+// checkKey 返回密钥所属的应用，keys为空时拒绝全部请求
+func checkKey(keys []KeyConfig, key string) (string, bool) {
+	for _, k := range keys {
+		if k.Key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			return k.App, true
+		}
+	}
+	return "", false
+}
+
+// bindApp 请求中的app为空时使用密钥所属的应用，不一致时拒绝
+func bindApp(req *rpc.SendMessageReq, app string) error {
+	if req.App != "" && req.App != app {
+		return ErrAppMismatch
+	}
+	req.App = app
+	return nil
+}
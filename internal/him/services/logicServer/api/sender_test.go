@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chang144/gotalk/internal/him/services/logicServer/handler"
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+type countDispatcher struct {
+	pushed int32
+}
+
+func (d *countDispatcher) Push(gateway string, channels []string, p *pkt.LogicPkt) error {
+	atomic.AddInt32(&d.pushed, int32(len(channels)))
+	return nil
+}
+
+func Test_send_idempotent(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cli, err := storage.InitRedis(mr.Addr(), "")
+	assert.Nil(t, err)
+	cache := storage.NewRedisStorage(cli)
+	assert.Nil(t, cache.Add(&pkt.Session{ChannelId: "gw1_{test1}_1", GateId: "gw1", Account: "test1"}))
+
+	dispatcher := &countDispatcher{}
+	chat := handler.NewChatHandler(cache, dispatcher, handler.ChatOptions{})
+	sender := NewSender(chat, storage.NewRedisIdempotencyStorage(cli), 0)
+
+	req := &rpc.SendMessageReq{
+		Sender:         "order",
+		Account:        "test1",
+		Message:        &rpc.Message{Type: 1, Body: "paid"},
+		IdempotencyKey: "order-1",
+	}
+	first, _, err := sender.Send(req)
+	assert.Nil(t, err)
+	second, _, err := sender.Send(req)
+	assert.Nil(t, err)
+	assert.Equal(t, first.SendTime, second.SendTime)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dispatcher.pushed))
+
+	// 不同的key会再次发送
+	req.IdempotencyKey = "order-2"
+	_, _, err = sender.Send(req)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dispatcher.pushed))
+
+	_, status, err := sender.Send(&rpc.SendMessageReq{Sender: "order", Message: &rpc.Message{Body: "x"}})
+	assert.Equal(t, ErrDestination, err)
+	assert.Equal(t, pkt.Status_NoDestination, status)
+}
+
+// failDispatcher 推送总是失败
+type failDispatcher struct{}
+
+func (failDispatcher) Push(string, []string, *pkt.LogicPkt) error {
+	return errors.New("gateway unavailable")
+}
+
+// countMessages 记录保存的消息数量
+type countMessages struct {
+	inserted int64
+}
+
+func (m *countMessages) InsertUser(string, *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error) {
+	return &rpc.InsertMessageResp{MessageId: atomic.AddInt64(&m.inserted, 1)}, nil
+}
+
+func (m *countMessages) InsertGroup(string, *rpc.InsertMessageReq, []string) (*rpc.InsertMessageResp, error) {
+	return &rpc.InsertMessageResp{MessageId: atomic.AddInt64(&m.inserted, 1)}, nil
+}
+
+func (m *countMessages) InsertSystem(string, *rpc.InsertMessageReq, []string) (*rpc.InsertMessageResp, error) {
+	return &rpc.InsertMessageResp{MessageId: atomic.AddInt64(&m.inserted, 1)}, nil
+}
+
+func Test_send_saved_but_push_failed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cli, err := storage.InitRedis(mr.Addr(), "")
+	assert.Nil(t, err)
+	cache := storage.NewRedisStorage(cli)
+	assert.Nil(t, cache.Add(&pkt.Session{ChannelId: "gw1_{test1}_1", GateId: "gw1", Account: "test1"}))
+
+	messages := &countMessages{}
+	chat := handler.NewChatHandler(cache, failDispatcher{}, handler.ChatOptions{Messages: messages})
+	sender := NewSender(chat, storage.NewRedisIdempotencyStorage(cli), 0)
+	req := &rpc.SendMessageReq{
+		Sender:         "order",
+		Account:        "test1",
+		Message:        &rpc.Message{Type: 1, Body: "paid"},
+		IdempotencyKey: "order-1",
+	}
+	// 消息已经保存，推送失败时返回错误，重试返回相同的错误，不会再次保存
+	_, status, err := sender.Send(req)
+	assert.NotNil(t, err)
+	resp, retried, rerr := sender.Send(req)
+	assert.Nil(t, resp)
+	assert.Equal(t, status, retried)
+	assert.Equal(t, err.Error(), rerr.Error())
+	assert.EqualValues(t, 1, atomic.LoadInt64(&messages.inserted))
+	assert.Greater(t, mr.TTL(storage.KeyIdempotency(":order:order-1")), time.Hour)
+}
+
+func Test_key_bound_to_app(t *testing.T) {
+	keys := []KeyConfig{{App: "app1", Key: "k1"}, {App: "app2", Key: "k2"}}
+	app, ok := checkKey(keys, "k2")
+	assert.True(t, ok)
+	assert.Equal(t, "app2", app)
+	_, ok = checkKey(keys, "k3")
+	assert.False(t, ok)
+
+	// 没有指定app时使用密钥所属的应用，不能发送其它应用的消息
+	req := &rpc.SendMessageReq{}
+	assert.Nil(t, bindApp(req, "app1"))
+	assert.Equal(t, "app1", req.App)
+	req = &rpc.SendMessageReq{App: "app2"}
+	assert.Equal(t, ErrAppMismatch, bindApp(req, "app1"))
+}
@@ -2,6 +2,11 @@ package conf
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/services/logicServer/api"
+	"github.com/chang144/gotalk/internal/him/webhook"
 	"github.com/spf13/viper"
 )
 
@@ -13,8 +18,89 @@ type LogicServerConfig struct {
 	PublicPort    int
 	Tags          []string
 	ConsulRUL     string
-	RedisAddr     string
+	Redis         RedisConfig
 	RpcURL        string
+	// PresenceDebounce 连接断开后等待重连的时间，期间在线状态为away
+	PresenceDebounce time.Duration
+	// LocalCacheSize 本地会话与位置信息缓存的条目上限，为0时不启用缓存
+	LocalCacheSize int
+	LocalCacheTTL  time.Duration
+	// ResumeGrace 连接断开后会话可以恢复的时间，为0时不支持会话恢复
+	ResumeGrace time.Duration
+	// InnerSecret 服务之间握手签名的共享密钥，网关与逻辑服务必须一致，为空时拒绝启动
+	InnerSecret string
+	// FriendOnlyApps 只允许好友之间单聊的应用
+	FriendOnlyApps []string
+	// NodeID 生成消息ID的节点号，集群内唯一
+	NodeID int64
+	// BaseDb 群信息所在的数据库，为空时群聊没有成员
+	BaseDb string
+	// MessageDb 为空时不保存消息
+	MessageDb string
+	// Api 业务服务发送消息的接口
+	Api ApiConfig
+	// TLS 网关连接使用的TLS配置，配置CAFile时要求网关提供证书(mTLS)
+	TLS TLSConfig
+	// Webhooks 按应用配置的业务事件回调
+	Webhooks []webhook.Config
+	Webhook  WebhookConfig
+	// LoadReportInterval 负载没有明显变化时重新注册的间隔，为0时使用默认值
+	LoadReportInterval time.Duration
+	// LoadThreshold 负载变化超过这个比例时立即重新注册
+	LoadThreshold float64
+	// WorkerPool 处理网关消息的协程池，同一个用户的消息按照顺序处理，为0的参数使用默认值
+	WorkerPool him.WorkerPoolOptions
+}
+
+// WebhookConfig 异步投递的参数，为0时使用默认值
+type WebhookConfig struct {
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Workers    int
+	// DeadLetter 重试耗尽的事件写入的文件，为空时只记录日志
+	DeadLetter string
+}
+
+// ApiConfig 监听地址为空时不启动对应的接口
+type ApiConfig struct {
+	HttpListen string
+	GrpcListen string
+	// Keys 业务服务的密钥，每个密钥只能发送所属应用的消息
+	Keys []api.KeyConfig
+	// IdempotencyTTL 幂等键保留的时间
+	IdempotencyTTL time.Duration
+}
+
+// TLSConfig 证书文件更新后会自动重新加载
+type TLSConfig struct {
+	Enable   bool
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// RedisConfig 会话存储使用的redis配置
+// Mode: standalone(默认), sentinel, cluster
+type RedisConfig struct {
+	Mode             string
+	Addrs            []string
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+	TLS              RedisTLSConfig
+}
+
+// RedisTLSConfig Enable为false时使用明文连接
+type RedisTLSConfig struct {
+	Enable             bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
 }
 
 // InitLogicConfig initial logicServer configuration
@@ -2,83 +2,347 @@ package handler
 
 import (
 	"errors"
+	"time"
+
 	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/services/logicServer/service"
+	"github.com/chang144/gotalk/internal/him/webhook"
+	"github.com/chang144/gotalk/internal/him/wire"
 	"github.com/chang144/gotalk/internal/him/wire/pkt"
-	"time"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"github.com/klintcheng/kim/logger"
 )
 
-var ErrNoDestination = errors.New("dest is empty")
+var (
+	ErrNoDestination   = errors.New("dest is empty")
+	ErrMessageRejected = errors.New("message rejected")
+)
 
 type ChatHandler struct {
+	cache      him.SessionStorage
+	dispatcher him.Dispatcher
+	friends    him.FriendStorage
+	// friendOnly 只允许好友之间单聊的应用
+	friendOnly map[string]bool
+	// messages 为nil时不保存消息
+	messages service.Message
+	// groups 为nil时群聊没有成员
+	groups service.Group
+	hooks  *webhook.Client
+}
+
+// ChatOptions 为nil的存储对应的功能不启用
+type ChatOptions struct {
+	// Friends 好友关系与黑名单，为nil时不检查
+	Friends        him.FriendStorage
+	FriendOnlyApps []string
+	Messages       service.Message
+	Groups         service.Group
+	// Webhooks 发送前回调与消息发送事件，为nil时不回调
+	Webhooks *webhook.Client
+}
+
+func NewChatHandler(cache him.SessionStorage, dispatcher him.Dispatcher, opts ChatOptions) *ChatHandler {
+	friendOnly := make(map[string]bool, len(opts.FriendOnlyApps))
+	for _, app := range opts.FriendOnlyApps {
+		friendOnly[app] = true
+	}
+	return &ChatHandler{
+		cache:      cache,
+		dispatcher: dispatcher,
+		friends:    opts.Friends,
+		friendOnly: friendOnly,
+		messages:   opts.Messages,
+		groups:     opts.Groups,
+		hooks:      opts.Webhooks,
+	}
+}
+
+// Talk 一条待发送的消息
+type Talk struct {
+	App    string
+	Sender string
+	// Dest 单聊为接收方账号，群聊为群ID
+	Dest    string
+	Message *pkt.MessageReq
+	// ChannelId 发送方的连接，推送时跳过，由服务端发送时为空
+	ChannelId string
+	// Trusted 由业务服务发送，不检查好友关系
+	Trusted bool
 }
 
 // DoUserTalk 单聊逻辑
 func (h *ChatHandler) DoUserTalk(ctx him.Context) {
+	talk, ok := readTalk(ctx)
+	if !ok {
+		return
+	}
+	resp, status, err := h.SendUser(talk, ctx.Header())
+	if err != nil {
+		_ = ctx.RespWithError(status, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, resp)
+}
+
+// DoGroupTalk 群聊逻辑，群聊的dest是群ID
+func (h *ChatHandler) DoGroupTalk(ctx him.Context) {
+	talk, ok := readTalk(ctx)
+	if !ok {
+		return
+	}
+	resp, status, err := h.SendGroup(talk, ctx.Header())
+	if err != nil {
+		_ = ctx.RespWithError(status, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, resp)
+}
+
+func readTalk(ctx him.Context) (*Talk, bool) {
 	// validate
-	if ctx.Header().Dest == "" {
+	if ctx.Header().GetDest() == "" {
 		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
-		return
+		return nil, false
 	}
 	// 解包
 	var req pkt.MessageReq
 	if err := ctx.ReadBody(&req); err != nil {
-		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrNoDestination)
-		return
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return nil, false
+	}
+	return &Talk{
+		App:       ctx.Session().GetApp(),
+		Sender:    ctx.Session().GetAccount(),
+		Dest:      ctx.Header().GetDest(),
+		Message:   &req,
+		ChannelId: ctx.Session().GetChannelId(),
+	}, true
+}
+
+// SendUser 检查权限、保存消息并推送给在线的接收方
+// header是推送包使用的头部，为nil时按照单聊命令生成
+// 消息保存之后推送失败时同时返回结果与错误，接收方仍然可以拉取到这条消息
+func (h *ChatHandler) SendUser(talk *Talk, header *pkt.Header) (*pkt.MessageResp, pkt.Status, error) {
+	if talk.Dest == "" {
+		return nil, pkt.Status_NoDestination, ErrNoDestination
+	}
+	// 检查黑名单与好友关系
+	if status, err := h.permit(talk); err != nil {
+		return nil, status, err
+	}
+	talk, status, err := h.beforeSend(talk, false)
+	if err != nil {
+		return nil, status, err
 	}
 	// 接受方寻址
-	dest := ctx.Header().GetDest()
-	loc, err := ctx.GetLocation(dest, "")
+	loc, err := h.cache.GetLocation(talk.Dest, "")
 	if err != nil && err != him.ErrSessionNil {
-		_ = ctx.RespWithError(pkt.Status_SystemException, ErrNoDestination)
-		return
+		return nil, pkt.Status_SystemException, err
 	}
 	// 保存离线信息
 	sendTime := time.Now().UnixNano()
-	// TODO: mysql
-
+	messageId, err := h.save(talk, sendTime, nil)
+	if err != nil {
+		return nil, pkt.Status_SystemException, err
+	}
 	// 接收方在线，发送消息
 	if loc != nil {
-		if err = ctx.Dispatch(&pkt.MessagePush{
-			// TODO
-		}, loc); err != nil {
-			_ = ctx.RespWithError(pkt.Status_SystemException, err)
-			return
+		if header == nil {
+			header = &pkt.New(wire.CommandChatUserTalk, pkt.WithDest(talk.Dest)).Header
+		}
+		if err = h.dispatch(header, talk, messageId, sendTime, loc); err != nil {
+			return saved(messageId, sendTime), pkt.Status_SystemException, err
 		}
-
 	}
-	// 5. 返回一条resp消息
-	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageResp{
-		//MessageId: msgId,
-		SendTime: sendTime,
-	})
+	h.fireSent(talk, false, messageId, sendTime)
+	return &pkt.MessageResp{MessageId: messageId, SendTime: sendTime}, pkt.Status_Success, nil
 }
 
-func (h *ChatHandler) DoGroupTalk(ctx him.Context) {
-	if ctx.Header().GetDest() == "" {
-		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
-		return
+// SendGroup 保存消息并推送给在线的群成员，推送失败时与SendUser相同
+func (h *ChatHandler) SendGroup(talk *Talk, header *pkt.Header) (*pkt.MessageResp, pkt.Status, error) {
+	if talk.Dest == "" {
+		return nil, pkt.Status_NoDestination, ErrNoDestination
 	}
-	// 解包
-	var req pkt.MessageReq
-	if err := ctx.ReadBody(&req); err != nil {
-		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
-		return
+	talk, status, err := h.beforeSend(talk, true)
+	if err != nil {
+		return nil, status, err
 	}
-	// 群聊的dest是群ID
-	group := ctx.Header().GetDest()
 	sendTime := time.Now().UnixNano()
+	var members []string
+	if h.groups != nil {
+		if members, err = h.groups.Members(talk.App, talk.Dest); err != nil {
+			return nil, pkt.Status_SystemException, err
+		}
+	}
+	if len(members) == 0 {
+		return &pkt.MessageResp{SendTime: sendTime}, pkt.Status_Success, nil
+	}
+	messageId, err := h.save(talk, sendTime, members)
+	if err != nil {
+		return nil, pkt.Status_SystemException, err
+	}
+	// 批量寻址
+	locs, err := h.cache.GetLocations(members...)
+	if err != nil && err != him.ErrSessionNil {
+		return nil, pkt.Status_SystemException, err
+	}
+	if header == nil {
+		header = &pkt.New(wire.CommandChatGroupTalk, pkt.WithDest(talk.Dest)).Header
+	}
+	// 批量推送消息给成员
+	if err = h.dispatch(header, talk, messageId, sendTime, locs...); err != nil {
+		return saved(messageId, sendTime), pkt.Status_SystemException, err
+	}
+	h.fireSent(talk, true, messageId, sendTime)
+	return &pkt.MessageResp{MessageId: messageId, SendTime: sendTime}, pkt.Status_Success, nil
+}
 
-	// TODO: 保存离线消息
-	// TODO: 读取群成员列表
-	members := make([]string, 5)
+// beforeSend 业务服务可以拒绝或者修改消息，修改时返回talk的副本
+func (h *ChatHandler) beforeSend(talk *Talk, group bool) (*Talk, pkt.Status, error) {
+	if h.hooks == nil {
+		return talk, pkt.Status_Success, nil
+	}
+	resp, err := h.hooks.BeforeSend(&webhook.BeforeSendReq{
+		App:    talk.App,
+		Sender: talk.Sender,
+		Dest:   talk.Dest,
+		Group:  group,
+		Type:   talk.Message.Type,
+		Body:   talk.Message.Body,
+		Extra:  talk.Message.Extra,
+	})
+	if err != nil {
+		return nil, pkt.Status_SystemException, err
+	}
+	if !resp.Allow {
+		if resp.Reason != "" {
+			return nil, pkt.Status_MessageRejected, errors.New(resp.Reason)
+		}
+		return nil, pkt.Status_MessageRejected, ErrMessageRejected
+	}
+	if resp.Body == nil && resp.Extra == nil {
+		return talk, pkt.Status_Success, nil
+	}
+	message := &pkt.MessageReq{
+		Type:  talk.Message.Type,
+		Body:  talk.Message.Body,
+		Extra: talk.Message.Extra,
+	}
+	if resp.Body != nil {
+		message.Body = *resp.Body
+	}
+	if resp.Extra != nil {
+		message.Extra = *resp.Extra
+	}
+	modified := *talk
+	modified.Message = message
+	return &modified, pkt.Status_Success, nil
+}
 
-	// 批量寻址
-	locs, err := ctx.GetLocations(members...)
+func (h *ChatHandler) fireSent(talk *Talk, group bool, messageId, sendTime int64) {
+	h.hooks.Fire(talk.App, webhook.EventMessageSent, &webhook.MessageEvent{
+		MessageId: messageId,
+		Sender:    talk.Sender,
+		Dest:      talk.Dest,
+		Group:     group,
+		Type:      talk.Message.Type,
+		Body:      talk.Message.Body,
+		Extra:     talk.Message.Extra,
+		SendTime:  sendTime,
+	})
+}
+
+// saved 推送失败时返回已经保存的消息，没有保存时返回nil
+func saved(messageId, sendTime int64) *pkt.MessageResp {
+	if messageId == 0 {
+		return nil
+	}
+	return &pkt.MessageResp{MessageId: messageId, SendTime: sendTime}
+}
+
+// save members为nil时保存单聊消息
+func (h *ChatHandler) save(talk *Talk, sendTime int64, members []string) (int64, error) {
+	if h.messages == nil {
+		return 0, nil
+	}
+	req := &rpc.InsertMessageReq{
+		Sender:   talk.Sender,
+		Dest:     talk.Dest,
+		SendTime: sendTime,
+		Message: &rpc.Message{
+			Type:  talk.Message.Type,
+			Body:  talk.Message.Body,
+			Extra: talk.Message.Extra,
+		},
+	}
+	var (
+		resp *rpc.InsertMessageResp
+		err  error
+	)
+	if members == nil {
+		resp, err = h.messages.InsertUser(talk.App, req)
+	} else {
+		resp, err = h.messages.InsertGroup(talk.App, req, members)
+	}
 	if err != nil {
-		ctx.RespWithError(pkt.Status_SystemException, err)
-		return
+		return 0, err
 	}
+	return resp.MessageId, nil
+}
 
-	// 批量推送消息给成员
+// dispatch 按照网关分组推送，跳过发送方自己的连接
+func (h *ChatHandler) dispatch(header *pkt.Header, talk *Talk, messageId, sendTime int64, locs ...*him.Location) error {
+	group := make(map[string][]string)
+	for _, loc := range locs {
+		if loc.ChannelId == talk.ChannelId {
+			continue
+		}
+		group[loc.GateId] = append(group[loc.GateId], loc.ChannelId)
+	}
+	body := &pkt.MessagePush{
+		MessageId: messageId,
+		Type:      talk.Message.Type,
+		Body:      talk.Message.Body,
+		Extra:     talk.Message.Extra,
+		Sender:    talk.Sender,
+		SendTime:  sendTime,
+	}
+	var err error
+	for gateway, ids := range group {
+		// 每个网关使用独立的包，Push会在包中写入目标网关与channels
+		p := pkt.NewLogicPkt(header)
+		p.Flag = pkt.Flag_Push
+		p.WriteBody(body)
+		if e := h.dispatcher.Push(gateway, ids, p); e != nil {
+			logger.WithField("func", "dispatch").Error(e)
+			err = e
+		}
+	}
+	return err
+}
 
+// permit 接收方把发送方加入黑名单，或者应用只允许好友单聊而双方不是好友时拒绝发送
+func (h *ChatHandler) permit(talk *Talk) (pkt.Status, error) {
+	if h.friends == nil {
+		return pkt.Status_Success, nil
+	}
+	blocked, err := h.friends.IsBlocked(talk.App, talk.Dest, talk.Sender)
+	if err != nil {
+		return pkt.Status_SystemException, err
+	}
+	if blocked {
+		return pkt.Status_Blocked, ErrBlocked
+	}
+	if talk.Trusted || !h.friendOnly[talk.App] {
+		return pkt.Status_Success, nil
+	}
+	friend, err := h.friends.IsFriend(talk.App, talk.Sender, talk.Dest)
+	if err != nil {
+		return pkt.Status_SystemException, err
+	}
+	if !friend {
+		return pkt.Status_NotFriend, ErrNotFriend
+	}
+	return pkt.Status_Success, nil
 }
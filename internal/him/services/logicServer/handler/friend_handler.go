@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/klintcheng/kim/logger"
+)
+
+// MaxFriendRequestMessage 好友请求附言的最大长度
+const MaxFriendRequestMessage = 200
+
+var (
+	ErrInvalidAccount   = errors.New("invalid account")
+	ErrFriendRequestNil = errors.New("friend request not found")
+	ErrBlocked          = errors.New("blocked by the account")
+	ErrNotFriend        = errors.New("not friends")
+)
+
+// FriendHandler 好友关系与黑名单
+type FriendHandler struct {
+	store      him.FriendStorage
+	cache      him.SessionStorage
+	dispatcher him.Dispatcher
+}
+
+func NewFriendHandler(store him.FriendStorage, cache him.SessionStorage, dispatcher him.Dispatcher) *FriendHandler {
+	return &FriendHandler{
+		store:      store,
+		cache:      cache,
+		dispatcher: dispatcher,
+	}
+}
+
+// DoRequest 发送好友请求，请求会保存下来，对方离线时可以通过DoRequests拉取
+func (h *FriendHandler) DoRequest(ctx him.Context) {
+	var req pkt.FriendRequestReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	app, self := ctx.Session().GetApp(), ctx.Session().GetAccount()
+	if req.Account == "" || req.Account == self || len(req.Message) > MaxFriendRequestMessage {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidAccount)
+		return
+	}
+	blocked, err := h.store.IsBlocked(app, req.Account, self)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if blocked {
+		_ = ctx.RespWithError(pkt.Status_Blocked, ErrBlocked)
+		return
+	}
+	friend, err := h.store.IsFriend(app, self, req.Account)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if friend {
+		_ = ctx.Resp(pkt.Status_Success, nil)
+		return
+	}
+	request := &pkt.FriendRequest{
+		From:    self,
+		Message: req.Message,
+		Time:    time.Now().UnixMilli(),
+	}
+	if err = h.store.AddRequest(app, req.Account, request); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	h.notify(req.Account, &pkt.FriendNotify{
+		Event:   pkt.FriendEvent_Requested,
+		Account: self,
+		Message: request.Message,
+		Time:    request.Time,
+	})
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoAccept 同意好友请求，并通知请求方
+func (h *FriendHandler) DoAccept(ctx him.Context) {
+	var req pkt.FriendReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	app, self := ctx.Session().GetApp(), ctx.Session().GetAccount()
+	request, err := h.store.TakeRequest(app, self, req.Account)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if request == nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrFriendRequestNil)
+		return
+	}
+	if err = h.store.AddFriend(app, self, req.Account); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	// 双方互相发送过请求时，对方的那一条也不再需要处理
+	_, _ = h.store.TakeRequest(app, req.Account, self)
+
+	h.notify(req.Account, &pkt.FriendNotify{
+		Event:   pkt.FriendEvent_Accepted,
+		Account: self,
+		Time:    time.Now().UnixMilli(),
+	})
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoReject 拒绝好友请求，不通知请求方
+func (h *FriendHandler) DoReject(ctx him.Context) {
+	var req pkt.FriendReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if _, err := h.store.TakeRequest(ctx.Session().GetApp(), ctx.Session().GetAccount(), req.Account); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoDelete 删除好友，双方的关系同时解除
+func (h *FriendHandler) DoDelete(ctx him.Context) {
+	var req pkt.FriendReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if err := h.store.DeleteFriend(ctx.Session().GetApp(), ctx.Session().GetAccount(), req.Account); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoList 好友列表
+func (h *FriendHandler) DoList(ctx him.Context) {
+	accounts, err := h.store.Friends(ctx.Session().GetApp(), ctx.Session().GetAccount())
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.FriendListResp{Accounts: accounts})
+}
+
+// DoRequests 拉取未处理的好友请求
+func (h *FriendHandler) DoRequests(ctx him.Context) {
+	list, err := h.store.Requests(ctx.Session().GetApp(), ctx.Session().GetAccount())
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.FriendRequestsResp{List: list})
+}
+
+// DoBlock 加入黑名单，同时删除对方未处理的好友请求
+func (h *FriendHandler) DoBlock(ctx him.Context) {
+	var req pkt.FriendReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	app, self := ctx.Session().GetApp(), ctx.Session().GetAccount()
+	if req.Account == "" || req.Account == self {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidAccount)
+		return
+	}
+	if err := h.store.Block(app, self, req.Account); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_, _ = h.store.TakeRequest(app, self, req.Account)
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoUnblock 移出黑名单
+func (h *FriendHandler) DoUnblock(ctx him.Context) {
+	var req pkt.FriendReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if err := h.store.Unblock(ctx.Session().GetApp(), ctx.Session().GetAccount(), req.Account); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoBlocklist 黑名单列表
+func (h *FriendHandler) DoBlocklist(ctx him.Context) {
+	accounts, err := h.store.Blocklist(ctx.Session().GetApp(), ctx.Session().GetAccount())
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.FriendListResp{Accounts: accounts})
+}
+
+// notify 推送给在线的account，离线时依靠保存的请求补偿
+func (h *FriendHandler) notify(account string, body *pkt.FriendNotify) {
+	p := pkt.New(wire.CommandFriendNotify)
+	p.WriteBody(body)
+	if err := push(h.cache, h.dispatcher, []string{account}, p); err != nil {
+		logger.WithField("func", "notify").Warn(err)
+	}
+}
@@ -1,19 +1,50 @@
 package handler
 
 import (
+	"bytes"
+	"fmt"
+	"time"
+
 	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/webhook"
+	"github.com/chang144/gotalk/internal/him/wire"
 	"github.com/chang144/gotalk/internal/him/wire/pkt"
 	"github.com/klintcheng/kim/logger"
+	"github.com/segmentio/ksuid"
 )
 
-type LoginHandler struct{}
+type LoginHandler struct {
+	presence *PresenceHandler
+	resume   him.ResumeStorage
+	// grace 连接断开后会话保留的时间
+	grace time.Duration
+	hooks *webhook.Client
+}
+
+// NewLoginHandler presence为nil时不处理在线状态，resume为nil时不支持会话恢复
+func NewLoginHandler(presence *PresenceHandler, resume him.ResumeStorage, grace time.Duration) *LoginHandler {
+	return &LoginHandler{
+		presence: presence,
+		resume:   resume,
+		grace:    grace,
+	}
+}
+
+// SetWebhook 登录、登出与踢下线事件推送给业务服务
+func (h *LoginHandler) SetWebhook(hooks *webhook.Client) {
+	h.hooks = hooks
+}
 
-func NewLoginHandler() *LoginHandler {
-	return &LoginHandler{}
+// DoSysTouch 网关按照客户端心跳定期发送，刷新会话与位置信息的过期时间，不需要回复
+func (h LoginHandler) DoSysTouch(ctx him.Context) {
+	session := ctx.Session()
+	if err := ctx.Touch(session.GetAccount(), session.GetChannelId()); err != nil {
+		logger.WithField("func", "DoSysTouch").Warn(err)
+	}
 }
 
 func (h LoginHandler) DoSysLogin(ctx him.Context) {
-	//log := logger.WithField("func", "DoSysLogin")
+	log := logger.WithField("func", "DoSysLogin")
 	// 序列化
 	var session pkt.Session
 	if err := ctx.ReadBody(&session); err != nil {
@@ -26,10 +57,15 @@ func (h LoginHandler) DoSysLogin(ctx him.Context) {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
-	if old != nil {
+	online := old != nil && !old.Suspended()
+	if online {
 		// 通知用户下线
-		_ = ctx.Dispatch(&pkt.KickoutNotify{ChannelId: old.ChannelId})
-		return
+		_ = ctx.Dispatch(&pkt.KickoutNotify{ChannelId: old.ChannelId}, old)
+		h.hooks.Fire(session.App, webhook.EventKickout, &webhook.SessionEvent{
+			Account:   session.Account,
+			ChannelId: old.ChannelId,
+			GateId:    old.GateId,
+		})
 	}
 	// 添加到会话管理器
 	err = ctx.Add(&session)
@@ -37,21 +73,140 @@ func (h LoginHandler) DoSysLogin(ctx him.Context) {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
+	if h.presence != nil && !online {
+		h.presence.Online(session.Account)
+	}
 	// 返回一个登录成功的消息
 	resp := &pkt.LoginResp{
 		ChannelId: session.ChannelId,
 	}
+	if resp.ResumeToken, err = h.newResumeToken(session.ChannelId); err != nil {
+		log.Warn(err)
+	}
 	_ = ctx.Resp(pkt.Status_Success, resp)
+	h.fireLogin(&session)
+}
+
+// DoSysResume 会话恢复
+// 把挂起的会话重新绑定到新的channel，并重放断开期间缓存的推送，恢复失败时按照普通登录处理
+func (h LoginHandler) DoSysResume(ctx him.Context) {
+	log := logger.WithField("func", "DoSysResume")
+	var session pkt.Session
+	if err := ctx.ReadBody(&session); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	var old *pkt.Session
+	if token, ok := ctx.Header().LookupMeta(wire.MetaResumeToken); ok && h.resume != nil {
+		var err error
+		old, err = h.resume.TakeSuspended(fmt.Sprint(token))
+		if err != nil && err != him.ErrSessionNil {
+			log.Warn(err)
+		}
+	}
+	if old == nil || old.Account != session.Account {
+		h.DoSysLogin(ctx)
+		return
+	}
+	// 切换位置信息之前先重放断开期间的推送，这期间的新推送仍然缓存在旧的会话中
+	h.replay(ctx, old.ChannelId, &session)
+	// 位置信息指向新的channel之后再删除旧的会话
+	if err := ctx.Add(&session); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if err := ctx.Delete(old.Account, old.ChannelId); err != nil {
+		log.Warn(err)
+	}
+	// 旧的会话删除之后不再缓存，重放切换过程中缓存的推送
+	h.replay(ctx, old.ChannelId, &session)
+	if h.presence != nil {
+		h.presence.Online(session.Account)
+	}
+	resp := &pkt.LoginResp{
+		ChannelId: session.ChannelId,
+		Resumed:   true,
+	}
+	var err error
+	if resp.ResumeToken, err = h.newResumeToken(session.ChannelId); err != nil {
+		log.Warn(err)
+	}
+	_ = ctx.Resp(pkt.Status_Success, resp)
+	h.fireLogin(&session)
+}
+
+// replay 取出channelId缓存的推送，按照顺序推送到恢复后的会话
+func (h LoginHandler) replay(ctx him.Context, channelId string, session *pkt.Session) {
+	log := logger.WithField("func", "replay")
+	payloads, err := h.resume.TakeBuffered(channelId)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	for _, payload := range payloads {
+		p, err := pkt.MustReadLogicPkt(bytes.NewBuffer(payload))
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		if err = ctx.Push(session.GateId, []string{session.ChannelId}, p); err != nil {
+			log.Warn(err)
+		}
+	}
 }
 
 func (h LoginHandler) DoSysLogout(ctx him.Context) {
-	logger.WithField("func", "DoSysLogout").Info("do Logout of %s %S ", ctx.Session().GetChannelId(), ctx.Session().GetAccount())
+	logger.WithField("func", "DoSysLogout").Infof("do Logout of %s %s ", ctx.Session().GetChannelId(), ctx.Session().GetAccount())
+
+	account, channelId := ctx.Session().GetAccount(), ctx.Session().GetChannelId()
+	_, disconnect := ctx.Header().LookupMeta(wire.MetaDisconnect)
 
-	err := ctx.Delete(ctx.Session().GetAccount(), ctx.Session().GetChannelId())
+	var err error
+	if disconnect && h.resume != nil {
+		// 连接断开时挂起会话，等待客户端恢复
+		_, err = h.resume.Suspend(account, channelId, h.grace)
+	} else {
+		err = ctx.Delete(account, channelId)
+	}
 	if err != nil {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
+	if h.presence != nil {
+		// 连接断开时等待重连，主动登出立即下线
+		if disconnect {
+			h.presence.Disconnect(account, channelId)
+		} else {
+			h.presence.Offline(account)
+		}
+	}
+	h.hooks.Fire(ctx.Session().GetApp(), webhook.EventLogout, &webhook.SessionEvent{
+		Account:    account,
+		ChannelId:  channelId,
+		GateId:     ctx.Session().GetGateId(),
+		Disconnect: disconnect,
+	})
 
 	_ = ctx.Resp(pkt.Status_Success, nil)
 }
+
+func (h LoginHandler) fireLogin(session *pkt.Session) {
+	h.hooks.Fire(session.App, webhook.EventLogin, &webhook.SessionEvent{
+		Account:   session.Account,
+		ChannelId: session.ChannelId,
+		GateId:    session.GateId,
+		Device:    session.Device,
+		RemoteIP:  session.RemoteIP,
+	})
+}
+
+func (h LoginHandler) newResumeToken(channelId string) (string, error) {
+	if h.resume == nil {
+		return "", nil
+	}
+	token := ksuid.New().String()
+	if err := h.resume.SaveResumeToken(token, channelId); err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+// pushRecorder 记录推送给网关的消息
+type pushRecorder struct {
+	sync.Mutex
+	pushed []*pkt.LogicPkt
+}
+
+func (d *pushRecorder) Push(_ string, _ []string, p *pkt.LogicPkt) error {
+	d.Lock()
+	defer d.Unlock()
+	d.pushed = append(d.pushed, p)
+	return nil
+}
+
+func newTestStorage(t *testing.T) (*storage.RedisStorage, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	cli, err := storage.InitRedis(mr.Addr(), "")
+	assert.Nil(t, err)
+	return storage.NewRedisStorage(cli), mr
+}
+
+func Test_touch_keeps_session(t *testing.T) {
+	cache, mr := newTestStorage(t)
+	session := &pkt.Session{ChannelId: "gate01_{test1}_1", GateId: "gate01", Account: "test1"}
+	assert.Nil(t, cache.Add(session))
+
+	r := him.NewRouter()
+	r.AddHandles(wire.CommandLoginTouch, NewLoginHandler(nil, nil, 0).DoSysTouch)
+	dispatcher := &pushRecorder{}
+
+	// 心跳一直在刷新，会话超过LocationExpired之后仍然有效
+	for i := 0; i < 3; i++ {
+		mr.FastForward(storage.LocationExpired / 2)
+		touch := pkt.New(wire.CommandLoginTouch, pkt.WithChannel(session.ChannelId))
+		assert.Nil(t, r.Serve(touch, dispatcher, cache, session))
+	}
+	_, err := cache.Get(session.ChannelId)
+	assert.Nil(t, err)
+	loc, err := cache.GetLocation("test1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, session.ChannelId, loc.ChannelId)
+	assert.Len(t, dispatcher.pushed, 0)
+
+	// 没有心跳之后过期
+	mr.FastForward(storage.LocationExpired + time.Second)
+	_, err = cache.Get(session.ChannelId)
+	assert.Equal(t, him.ErrSessionNil, err)
+}
+
+// lateBuffer 第一次取出缓存之后模拟一条并发到达的推送
+type lateBuffer struct {
+	*storage.RedisStorage
+	late *pkt.LogicPkt
+}
+
+func (b *lateBuffer) TakeBuffered(channelId string) ([][]byte, error) {
+	list, err := b.RedisStorage.TakeBuffered(channelId)
+	if b.late != nil {
+		_ = b.RedisStorage.Buffer(channelId, pkt.Marshal(b.late))
+		b.late = nil
+	}
+	return list, err
+}
+
+func Test_resume_replays_before_response(t *testing.T) {
+	cache, _ := newTestStorage(t)
+	old := &pkt.Session{ChannelId: "gate01_{test1}_1", GateId: "gate01", Account: "test1"}
+	assert.Nil(t, cache.Add(old))
+	assert.Nil(t, cache.SaveResumeToken("tk1", old.ChannelId))
+	_, err := cache.Suspend("test1", old.ChannelId, time.Minute)
+	assert.Nil(t, err)
+	for _, cmd := range []string{"chat.user.talk", "chat.group.talk"} {
+		assert.Nil(t, cache.Buffer(old.ChannelId, pkt.Marshal(pkt.New(cmd))))
+	}
+
+	resume := &lateBuffer{RedisStorage: cache, late: pkt.New("chat.talk.ack")}
+	r := him.NewRouter()
+	r.AddHandles(wire.CommandLoginResume, NewLoginHandler(nil, resume, time.Minute).DoSysResume)
+	dispatcher := &pushRecorder{}
+
+	session := &pkt.Session{ChannelId: "gate02_{test1}_1", GateId: "gate02", Account: "test1"}
+	req := pkt.New(wire.CommandLoginResume, pkt.WithChannel(session.ChannelId))
+	req.AddStringMeta(wire.MetaResumeToken, "tk1")
+	req.WriteBody(session)
+	assert.Nil(t, r.Serve(req, dispatcher, cache, session))
+
+	// 缓存的推送与切换过程中到达的推送都在登录响应之前按照顺序重放
+	var commands []string
+	for _, p := range dispatcher.pushed {
+		commands = append(commands, p.Command)
+	}
+	assert.Equal(t, []string{"chat.user.talk", "chat.group.talk", "chat.talk.ack", wire.CommandLoginResume}, commands)
+	var resp pkt.LoginResp
+	assert.Nil(t, dispatcher.pushed[3].ReadBody(&resp))
+	assert.True(t, resp.Resumed)
+
+	loc, err := cache.GetLocation("test1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, session.ChannelId, loc.ChannelId)
+	// 旧的会话已经删除，不再缓存推送
+	assert.Equal(t, him.ErrSessionNil, cache.Buffer(old.ChannelId, []byte("m")))
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/klintcheng/kim/logger"
+)
+
+// MaxPresenceAccounts 单次订阅或查询的账号上限
+const MaxPresenceAccounts = 500
+
+// DefaultPresenceDebounce 连接断开后等待重连的默认时间
+const DefaultPresenceDebounce = time.Second * 10
+
+var ErrTooManyAccounts = errors.New("too many accounts")
+
+// PresenceHandler 在线状态
+// 状态由登录、登出与连接断开事件推导，以Location为准
+// 只能订阅与查询同一个app中的好友，被对方加入黑名单之后不可见
+type PresenceHandler struct {
+	store      him.PresenceStorage
+	friends    him.FriendStorage
+	cache      him.SessionStorage
+	dispatcher him.Dispatcher
+	// debounce 连接断开后等待重连的时间，期间状态为Away且不通知订阅者
+	debounce time.Duration
+}
+
+func NewPresenceHandler(store him.PresenceStorage, friends him.FriendStorage, cache him.SessionStorage, dispatcher him.Dispatcher, debounce time.Duration) *PresenceHandler {
+	if debounce <= 0 {
+		debounce = DefaultPresenceDebounce
+	}
+	return &PresenceHandler{
+		store:      store,
+		friends:    friends,
+		cache:      cache,
+		dispatcher: dispatcher,
+		debounce:   debounce,
+	}
+}
+
+// DoSubscribe 订阅在线状态，返回被订阅账号的当前状态
+func (h *PresenceHandler) DoSubscribe(ctx him.Context) {
+	var req pkt.PresenceSubscribeReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if len(req.Accounts) > MaxPresenceAccounts {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrTooManyAccounts)
+		return
+	}
+	accounts, err := h.visible(ctx.Session(), req.Accounts)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if err = h.store.Subscribe(ctx.Session().GetAccount(), accounts...); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	list, err := h.store.GetPresences(accounts...)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.PresenceQueryResp{List: list})
+}
+
+// DoUnsubscribe 取消订阅，accounts为空时取消全部订阅
+func (h *PresenceHandler) DoUnsubscribe(ctx him.Context) {
+	var req pkt.PresenceSubscribeReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if err := h.store.Unsubscribe(ctx.Session().GetAccount(), req.Accounts...); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoQuery 批量查询在线状态
+func (h *PresenceHandler) DoQuery(ctx him.Context) {
+	var req pkt.PresenceQueryReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if len(req.Accounts) > MaxPresenceAccounts {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrTooManyAccounts)
+		return
+	}
+	accounts, err := h.visible(ctx.Session(), req.Accounts)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	list, err := h.store.GetPresences(accounts...)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.PresenceQueryResp{List: list})
+}
+
+// visible 过滤出session可以看到在线状态的账号，其它账号直接忽略
+// 好友关系按app保存，双方都在这个app中确认过才会成为好友
+func (h *PresenceHandler) visible(session him.Session, accounts []string) ([]string, error) {
+	app, self := session.GetApp(), session.GetAccount()
+	list := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		friend, err := h.friends.IsFriend(app, self, account)
+		if err != nil {
+			return nil, err
+		}
+		if !friend {
+			continue
+		}
+		blocked, err := h.friends.IsBlocked(app, account, self)
+		if err != nil {
+			return nil, err
+		}
+		if !blocked {
+			list = append(list, account)
+		}
+	}
+	return list, nil
+}
+
+// Online 账号登录，在重连窗口内的登录不通知订阅者
+func (h *PresenceHandler) Online(account string) {
+	away, err := h.store.ClearAway(account)
+	if err != nil {
+		logger.WithField("func", "Online").Warn(err)
+	}
+	if away {
+		return
+	}
+	h.notify(account, pkt.PresenceStatus_Online)
+}
+
+// Offline 账号主动登出
+func (h *PresenceHandler) Offline(account string) {
+	if h.online(account) {
+		return
+	}
+	_, _ = h.store.ClearAway(account)
+	h.offline(account)
+}
+
+// Disconnect 连接断开，debounce之后仍未重新登录才通知订阅者下线
+func (h *PresenceHandler) Disconnect(account string, channelId string) {
+	log := logger.WithField("func", "Disconnect")
+	if h.online(account) {
+		return
+	}
+	// 标记的过期时间比debounce长，避免在检查之前过期
+	if err := h.store.MarkAway(account, channelId, h.debounce*2); err != nil {
+		log.Warn(err)
+		return
+	}
+	time.AfterFunc(h.debounce, func() {
+		gone, err := h.store.ExpireAway(account, channelId)
+		if err != nil {
+			log.Warn(err)
+			return
+		}
+		if gone {
+			h.offline(account)
+		}
+	})
+}
+
+// online 账号已经在其它channel上登录
+func (h *PresenceHandler) online(account string) bool {
+	loc, _ := h.cache.GetLocation(account, "")
+	return loc != nil && !loc.Suspended()
+}
+
+func (h *PresenceHandler) offline(account string) {
+	h.notify(account, pkt.PresenceStatus_Offline)
+	if err := h.store.Unsubscribe(account); err != nil {
+		logger.WithField("func", "offline").Warn(err)
+	}
+}
+
+// notify 推送状态变更给订阅者
+func (h *PresenceHandler) notify(account string, status pkt.PresenceStatus) {
+	log := logger.WithFields(logger.Fields{
+		"func":    "notify",
+		"account": account,
+	})
+	subscribers, err := h.store.Subscribers(account)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	p := pkt.New(wire.CommandPresenceNotify)
+	p.WriteBody(&pkt.Presence{Account: account, Status: status})
+	if err = push(h.cache, h.dispatcher, subscribers, p); err != nil {
+		log.Warn(err)
+	}
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_presence_only_friends(t *testing.T) {
+	cache, mr := newTestStorage(t)
+	cli, err := storage.InitRedis(mr.Addr(), "")
+	assert.Nil(t, err)
+	friends := storage.NewRedisFriendStorage(cli)
+	presences := storage.NewRedisPresenceStorage(cli)
+	// test2是好友，test3把test1加入了黑名单，test4只是另一个app中的好友
+	assert.Nil(t, friends.AddFriend("app1", "test1", "test2"))
+	assert.Nil(t, friends.AddFriend("app1", "test1", "test3"))
+	assert.Nil(t, friends.Block("app1", "test3", "test1"))
+	assert.Nil(t, friends.AddFriend("app2", "test1", "test4"))
+	for _, account := range []string{"test2", "test3", "test4", "test5"} {
+		assert.Nil(t, cache.Add(&pkt.Session{ChannelId: "gate01_{" + account + "}_1", GateId: "gate01", Account: account, App: "app1"}))
+	}
+
+	h := NewPresenceHandler(presences, friends, cache, &pushRecorder{}, 0)
+	r := him.NewRouter()
+	r.AddHandles(wire.CommandPresenceSubscribe, h.DoSubscribe)
+	r.AddHandles(wire.CommandPresenceQuery, h.DoQuery)
+	session := &pkt.Session{ChannelId: "gate01_{test1}_1", GateId: "gate01", Account: "test1", App: "app1"}
+	accounts := []string{"test2", "test3", "test4", "test5"}
+
+	for _, command := range []string{wire.CommandPresenceQuery, wire.CommandPresenceSubscribe} {
+		dispatcher := &pushRecorder{}
+		req := pkt.New(command, pkt.WithChannel(session.ChannelId))
+		// 查询与订阅请求的结构相同
+		req.WriteBody(&pkt.PresenceSubscribeReq{Accounts: accounts})
+		assert.Nil(t, r.Serve(req, dispatcher, cache, session))
+		assert.Len(t, dispatcher.pushed, 1)
+		var resp pkt.PresenceQueryResp
+		assert.Nil(t, dispatcher.pushed[0].ReadBody(&resp))
+		assert.Len(t, resp.List, 1)
+		assert.Equal(t, "test2", resp.List[0].Account)
+		assert.Equal(t, pkt.PresenceStatus_Online, resp.List[0].Status)
+	}
+	// 只订阅了好友
+	for _, account := range accounts {
+		subscribers, err := presences.Subscribers(account)
+		assert.Nil(t, err)
+		if account == "test2" {
+			assert.Equal(t, []string{"test1"}, subscribers)
+		} else {
+			assert.Empty(t, subscribers)
+		}
+	}
+}
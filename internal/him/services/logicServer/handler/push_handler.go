@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/services/logicServer/service"
+	"github.com/chang144/gotalk/internal/him/webhook"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"github.com/klintcheng/kim/logger"
+)
+
+// broadcastBatch 广播时每次从在线索引中读取的连接数
+const broadcastBatch = 1000
+
+// PushHandler 投递其它服务通过推送队列发来的消息
+type PushHandler struct {
+	cache      him.SessionStorage
+	online     him.OnlineStorage
+	dispatcher him.Dispatcher
+	hooks      *webhook.Client
+	// messages 保存系统消息，为nil时只推送给在线的账号
+	messages service.Message
+}
+
+// NewPushHandler online为nil时不支持广播
+func NewPushHandler(cache him.SessionStorage, online him.OnlineStorage, dispatcher him.Dispatcher) *PushHandler {
+	return &PushHandler{
+		cache:      cache,
+		online:     online,
+		dispatcher: dispatcher,
+	}
+}
+
+// SetWebhook 踢下线事件推送给业务服务
+func (h *PushHandler) SetWebhook(hooks *webhook.Client) {
+	h.hooks = hooks
+}
+
+// SetMessages 系统消息保存之后再推送，不在线的账号上线后可以拉取
+func (h *PushHandler) SetMessages(messages service.Message) {
+	h.messages = messages
+}
+
+// Deliver 推送给accounts中在线的账号，不在线的账号直接忽略
+// 带有MetaBroadcast时推送给全部在线连接，带有MetaKickout时踢下accounts的连接
+func (h *PushHandler) Deliver(accounts []string, packet *pkt.LogicPkt) error {
+	if _, ok := packet.GetMeta(wire.MetaBroadcast); ok {
+		return h.broadcast(packet)
+	}
+	if _, ok := packet.GetMeta(wire.MetaKickout); ok {
+		return h.kickout(accounts, packet)
+	}
+	if packet.Command == wire.CommandSystemNotify && h.messages != nil {
+		// 保存失败时返回错误由推送队列重试，保存之后推送失败不再重试，避免重复保存
+		if err := h.saveSystem(accounts, packet); err != nil {
+			return err
+		}
+		if err := push(h.cache, h.dispatcher, accounts, packet); err != nil {
+			logger.WithField("func", "Deliver").Warn(err)
+		}
+		return nil
+	}
+	return push(h.cache, h.dispatcher, accounts, packet)
+}
+
+// saveSystem 保存系统消息，并把消息ID写入推送的消息
+func (h *PushHandler) saveSystem(accounts []string, packet *pkt.LogicPkt) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+	var body pkt.MessagePush
+	if err := packet.ReadBody(&body); err != nil {
+		return err
+	}
+	meta, _ := packet.GetMeta(wire.MetaApp)
+	app, _ := meta.(string)
+	resp, err := h.messages.InsertSystem(app, &rpc.InsertMessageReq{
+		Sender:   body.Sender,
+		Dest:     packet.Dest,
+		SendTime: body.SendTime,
+		Message: &rpc.Message{
+			Type:  body.Type,
+			Body:  body.Body,
+			Extra: body.Extra,
+		},
+	}, accounts)
+	if err != nil {
+		return err
+	}
+	body.MessageId = resp.MessageId
+	packet.WriteBody(&body)
+	return nil
+}
+
+// kickout 推送下线通知并由网关关闭连接，MetaDestChannels不为空时只踢下其中的连接
+// 挂起的会话没有连接，直接删除
+func (h *PushHandler) kickout(accounts []string, packet *pkt.LogicPkt) error {
+	var only map[string]bool
+	if v, ok := packet.GetMeta(wire.MetaDestChannels); ok {
+		only = make(map[string]bool)
+		for _, id := range strings.Split(v.(string), ",") {
+			only[id] = true
+		}
+	}
+	locs, err := h.cache.GetLocations(accounts...)
+	if err == him.ErrSessionNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, loc := range locs {
+		if only != nil && !only[loc.ChannelId] {
+			continue
+		}
+		// 会话读取失败时仍然推送下线通知，只是不回调webhook
+		session, e := h.cache.Get(loc.ChannelId)
+		if e == nil {
+			h.hooks.Fire(session.App, webhook.EventKickout, &webhook.SessionEvent{
+				Account:   session.Account,
+				ChannelId: loc.ChannelId,
+				GateId:    loc.GateId,
+			})
+		}
+		if loc.Suspended() {
+			if e == nil {
+				_ = h.cache.Delete(session.Account, loc.ChannelId)
+			}
+			continue
+		}
+		p := pkt.New(wire.CommandLoginSignIn, pkt.WithChannel(loc.ChannelId))
+		p.Flag = pkt.Flag_Push
+		p.WriteBody(&pkt.KickoutNotify{ChannelId: loc.ChannelId})
+		p.AddStringMeta(wire.MetaKickout, "true")
+		if e := h.dispatcher.Push(loc.GateId, []string{loc.ChannelId}, p); e != nil {
+			logger.WithFields(logger.Fields{
+				"func":    "kickout",
+				"channel": loc.ChannelId,
+			}).Warn(e)
+			err = e
+		}
+	}
+	return err
+}
+
+// broadcast 按照网关遍历在线索引，分批推送
+func (h *PushHandler) broadcast(packet *pkt.LogicPkt) error {
+	if h.online == nil {
+		return nil
+	}
+	gateways, err := h.online.CountByGateway()
+	if err != nil {
+		return err
+	}
+	log := logger.WithField("func", "broadcast")
+	for gateway := range gateways {
+		var cursor uint64
+		for {
+			list, next, err := h.online.ScanOnline(gateway, cursor, broadcastBatch)
+			if err != nil {
+				log.Warn(err)
+				break
+			}
+			if len(list) > 0 {
+				ids := make([]string, len(list))
+				for i, loc := range list {
+					ids[i] = loc.ChannelId
+				}
+				if err = h.dispatcher.Push(gateway, ids, copyPkt(packet)); err != nil {
+					log.Warn(err)
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return nil
+}
+
+// push 按照网关分组推送，每个网关使用独立的包
+func push(cache him.SessionStorage, dispatcher him.Dispatcher, accounts []string, packet *pkt.LogicPkt) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+	locs, err := cache.GetLocations(accounts...)
+	if err == him.ErrSessionNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	group := make(map[string][]string)
+	for _, loc := range locs {
+		group[loc.GateId] = append(group[loc.GateId], loc.ChannelId)
+	}
+	for gateway, ids := range group {
+		if e := dispatcher.Push(gateway, ids, copyPkt(packet)); e != nil {
+			logger.WithField("func", "push").Warn(e)
+			err = e
+		}
+	}
+	return err
+}
+
+// copyPkt 复制header与body作为推送包，不复制meta
+func copyPkt(packet *pkt.LogicPkt) *pkt.LogicPkt {
+	p := pkt.NewLogicPkt(&packet.Header)
+	p.Flag = pkt.Flag_Push
+	p.Body = packet.Body
+	return p
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+// messageRecorder 记录保存的系统消息
+type messageRecorder struct {
+	app      string
+	req      *rpc.InsertMessageReq
+	accounts []string
+}
+
+func (m *messageRecorder) InsertUser(string, *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error) {
+	return &rpc.InsertMessageResp{}, nil
+}
+
+func (m *messageRecorder) InsertGroup(string, *rpc.InsertMessageReq, []string) (*rpc.InsertMessageResp, error) {
+	return &rpc.InsertMessageResp{}, nil
+}
+
+func (m *messageRecorder) InsertSystem(app string, req *rpc.InsertMessageReq, accounts []string) (*rpc.InsertMessageResp, error) {
+	m.app, m.req, m.accounts = app, req, accounts
+	return &rpc.InsertMessageResp{MessageId: 1001}, nil
+}
+
+func Test_system_message_saved(t *testing.T) {
+	cache, _ := newTestStorage(t)
+	assert.Nil(t, cache.Add(&pkt.Session{ChannelId: "gate01_{test1}_1", GateId: "gate01", Account: "test1"}))
+	dispatcher := &pushRecorder{}
+	messages := &messageRecorder{}
+	h := NewPushHandler(cache, cache, dispatcher)
+	h.SetMessages(messages)
+
+	p := pkt.New(wire.CommandSystemNotify, pkt.WithDest("group1"))
+	p.WriteBody(&pkt.MessagePush{Type: 1, Body: "hello", Sender: wire.SystemAccount, SendTime: 100})
+	p.AddStringMeta(wire.MetaApp, "kim")
+	assert.Nil(t, h.Deliver([]string{"test1", "test2"}, p))
+
+	// 不在线的test2也保存了索引，只有在线的test1收到推送
+	assert.Equal(t, "kim", messages.app)
+	assert.Equal(t, []string{"test1", "test2"}, messages.accounts)
+	assert.Equal(t, "group1", messages.req.Dest)
+	assert.Equal(t, "hello", messages.req.Message.Body)
+	assert.Len(t, dispatcher.pushed, 1)
+	var body pkt.MessagePush
+	assert.Nil(t, dispatcher.pushed[0].ReadBody(&body))
+	assert.EqualValues(t, 1001, body.MessageId)
+}
+
+func Test_kickout_without_session(t *testing.T) {
+	cache, mr := newTestStorage(t)
+	channelId := "gate01_{test1}_1"
+	assert.Nil(t, cache.Add(&pkt.Session{ChannelId: channelId, GateId: "gate01", Account: "test1"}))
+	// 会话已经过期或者被删除，位置信息还在
+	mr.Del(storage.KeySession(channelId))
+	dispatcher := &pushRecorder{}
+	h := NewPushHandler(cache, cache, dispatcher)
+
+	p := pkt.New(wire.CommandLoginSignIn)
+	p.AddStringMeta(wire.MetaKickout, "true")
+	assert.Nil(t, h.Deliver([]string{"test1"}, p))
+
+	assert.Len(t, dispatcher.pushed, 1)
+	assert.Equal(t, channelId, dispatcher.pushed[0].ChannelId)
+}
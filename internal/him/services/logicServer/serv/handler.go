@@ -2,8 +2,10 @@ package serv
 
 import (
 	"bytes"
+	"fmt"
 
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/protobuf/proto"
@@ -25,17 +27,29 @@ type LogicHandler struct {
 	r          *him.Router
 	cache      him.SessionStorage
 	dispatcher *ChatServerDispatcher
+	// secret 校验网关握手签名的共享密钥，为空时不校验签名
+	secret string
+	// nonces 记录握手中使用过的随机数，为nil时不检查重放
+	nonces him.NonceStorage
+	// instances 带有实例ID的网关连接
+	instances sync.Map
 }
 
 // NewLogicHandler creates a new LogicHandler
-func NewLogicHandler(r *him.Router, cache him.SessionStorage) *LogicHandler {
+func NewLogicHandler(r *him.Router, cache him.SessionStorage, dispatcher *ChatServerDispatcher, secret string) *LogicHandler {
 	return &LogicHandler{
 		r:          r,
 		cache:      cache,
-		dispatcher: &ChatServerDispatcher{},
+		dispatcher: dispatcher,
+		secret:     secret,
 	}
 }
 
+// SetNonceStorage 拒绝时间戳仍在允许范围之内的重放握手请求
+func (h *LogicHandler) SetNonceStorage(nonces him.NonceStorage) {
+	h.nonces = nonces
+}
+
 // Receive 回调到业务层
 func (h *LogicHandler) Receive(agent him.Agent, payload []byte) {
 	buf := bytes.NewBuffer(payload)
@@ -44,7 +58,7 @@ func (h *LogicHandler) Receive(agent him.Agent, payload []byte) {
 		return
 	}
 	var session *pkt.Session
-	if logicPkt.Command == wire.CommandLoginSignIn {
+	if logicPkt.Command == wire.CommandLoginSignIn || logicPkt.Command == wire.CommandLoginResume {
 		server, _ := logicPkt.GetMeta(wire.MetaDestServer)
 		session = &pkt.Session{
 			ChannelId: logicPkt.ChannelId,
@@ -52,7 +66,7 @@ func (h *LogicHandler) Receive(agent him.Agent, payload []byte) {
 			Tags:      []string{"AutoGenerated"},
 		}
 	} else {
-		_, err := h.cache.Get(logicPkt.ChannelId)
+		session, err = h.cache.Get(logicPkt.ChannelId)
 		if err == him.ErrSessionNil {
 			_ = RespErr(agent, logicPkt, pkt.Status_SessionNotFound)
 			return
@@ -68,7 +82,27 @@ func (h *LogicHandler) Receive(agent him.Agent, payload []byte) {
 
 }
 
+// OrderKey 一个网关连接上有多个用户的消息，按照用户的channel保证顺序
+// 在读取的goroutine中调用，只解析头部中的channelId，完整的消息在Receive中解析
+func (h *LogicHandler) OrderKey(_ him.Agent, payload []byte) string {
+	channelId, err := pkt.ReadChannelId(payload)
+	if err != nil {
+		return ""
+	}
+	return channelId
+}
+
+// Busy 消息因为处理队列已满被丢弃，通过网关通知客户端稍后重试
+func (h *LogicHandler) Busy(agent him.Agent, payload []byte) {
+	logicPkt, err := pkt.MustReadLogicPkt(bytes.NewBuffer(payload))
+	if err != nil {
+		return
+	}
+	_ = RespErr(agent, logicPkt, pkt.Status_Busy)
+}
+
 // Accept  系统内部握手请求
+// 校验协议版本与签名，并把结果通过InnerHandshakeResponse返回给对方
 func (h *LogicHandler) Accept(conn him.Conn, timeout time.Duration) (string, error) {
 	log.Infoln("try enter chat handler")
 
@@ -81,17 +115,73 @@ func (h *LogicHandler) Accept(conn him.Conn, timeout time.Duration) (string, err
 	var req pkt.InnerHandshakeRequest
 	err = proto.Unmarshal(frame.GetPayload(), &req)
 	if err != nil {
+		_ = respHandshake(conn, pkt.Status_InvalidPacketBody, err)
 		return "", err
 	}
 	log.Info("Accept -- chat handler", req.ServiceId)
 
-	return req.ServiceId, nil
+	err = req.Verify(h.secret)
+	// 启用mTLS时，握手中的serviceId必须与对端证书一致
+	if err == nil {
+		err = him.VerifyPeerIdentity(conn, req.ServiceId)
+	}
+	if err == nil {
+		err = h.claimNonce(&req)
+	}
+	if err != nil {
+		_ = respHandshake(conn, pkt.HandshakeStatus(err), err)
+		return "", err
+	}
+	if err = respHandshake(conn, pkt.Status_Success, nil); err != nil {
+		return "", err
+	}
+	// 网关交接时新旧进程的ServiceId相同，按照实例ID区分连接，推送时按照channelId的前缀选择
+	id := him.InstanceId(req.ServiceId, req.Instance)
+	if req.Instance != "" {
+		h.instances.Store(id, struct{}{})
+	}
+	return id, nil
+}
+
+// claimNonce 签名校验通过之后记录随机数，时间戳允许前后偏差MaxHandshakeSkew，记录需要保留HandshakeNonceExpiresIn
+func (h *LogicHandler) claimNonce(req *pkt.InnerHandshakeRequest) error {
+	if h.secret == "" || h.nonces == nil {
+		return nil
+	}
+	ok, err := h.nonces.Claim(req.Nonce, pkt.HandshakeNonceExpiresIn)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return pkt.ErrHandshakeReplayed
+	}
+	return nil
+}
+
+func respHandshake(conn him.Conn, status pkt.Status, err error) error {
+	resp := &pkt.InnerHandshakeResponse{
+		Code:    uint32(status),
+		Version: pkt.InnerProtocolVersion,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	bts, _ := proto.Marshal(resp)
+	return conn.WriteFrame(him.OpBinary, bts)
 }
 
 func (h *LogicHandler) Disconnect(id string) error {
+	h.instances.Delete(id)
 	return nil
 }
 
+// Replace 带有实例ID的连接只属于一个网关进程，进程只会在本端发现连接断开之后重新连接，
+// 此时旧连接已经失效，只是还没有超时，由新连接替换；没有实例ID的旧版本网关不替换
+func (h *LogicHandler) Replace(id string) bool {
+	_, ok := h.instances.Load(id)
+	return ok
+}
+
 var _ him.Handler = (*LogicHandler)(nil)
 
 func RespErr(ag him.Agent, p *pkt.LogicPkt, status pkt.Status) error {
@@ -103,11 +193,52 @@ func RespErr(ag him.Agent, p *pkt.LogicPkt, status pkt.Status) error {
 }
 
 type ChatServerDispatcher struct {
+	// container 通过网关连接推送消息
+	container *container.Container
+	// buffer 缓存推送给挂起会话的消息，为nil时不缓存
+	buffer him.ResumeStorage
 }
 
+func NewChatServerDispatcher(c *container.Container, buffer him.ResumeStorage) *ChatServerDispatcher {
+	return &ChatServerDispatcher{container: c, buffer: buffer}
+}
+
+// Push 推送消息到网关，挂起的会话没有网关，消息缓存起来等待恢复后重放
 func (c *ChatServerDispatcher) Push(gateway string, channels []string, p *pkt.LogicPkt) error {
-	p.AddStringMeta(wire.MetaDestChannels, strings.Join(channels, ","))
-	return container.Push(gateway, p)
+	if gateway == "" {
+		if c.buffer == nil {
+			return fmt.Errorf("channels %v are suspended", channels)
+		}
+		payload := pkt.Marshal(p)
+		for _, channel := range channels {
+			if err := c.buffer.Buffer(channel, payload); err != nil {
+				log.Warn(err)
+			}
+		}
+		return nil
+	}
+	// 交接期间同一个网关的channel可能属于新旧两个进程，按照channelId的前缀分别推送
+	var conns []string
+	group := make(map[string][]string, 1)
+	for _, channel := range channels {
+		conn := him.InstanceOf(channel)
+		if conn == "" {
+			conn = gateway
+		}
+		if _, ok := group[conn]; !ok {
+			conns = append(conns, conn)
+		}
+		group[conn] = append(group[conn], channel)
+	}
+	var err error
+	for _, conn := range conns {
+		p.DelMeta(wire.MetaDestChannels)
+		p.AddStringMeta(wire.MetaDestChannels, strings.Join(group[conn], ","))
+		if e := c.container.PushTo(conn, gateway, p); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
 var _ him.Dispatcher = (*ChatServerDispatcher)(nil)
@@ -0,0 +1,92 @@
+package serv
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/container"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/tcp"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+// dialGateway 模拟网关进程连接逻辑服务并完成握手
+func dialGateway(t *testing.T, addr string, instance string) him.Conn {
+	var raw net.Conn
+	assert.Eventually(t, func() bool {
+		var err error
+		raw, err = net.Dial("tcp", addr)
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+	conn := tcp.NewConn(raw)
+	bts, _ := proto.Marshal(pkt.NewInnerHandshakeRequest("gate01", instance, "secret"))
+	assert.Nil(t, conn.WriteFrame(him.OpBinary, bts))
+	frame, err := conn.ReadFrame()
+	assert.Nil(t, err)
+	var resp pkt.InnerHandshakeResponse
+	assert.Nil(t, proto.Unmarshal(frame.GetPayload(), &resp))
+	assert.EqualValues(t, pkt.Status_Success, resp.Code)
+	return conn
+}
+
+func Test_handoff_connections(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := lst.Addr().String()
+	_ = lst.Close()
+
+	h := NewLogicHandler(him.NewRouter(), nil, nil, "secret")
+	srv := tcp.NewServer(addr, &naming.RegisterService{Id: "logic01", Name: wire.SNChat})
+	srv.SetAcceptor(h)
+	srv.SetMessageListener(h)
+	srv.SetStateListener(h)
+	channels := srv.(*tcp.Server).ChannelMap
+	go func() { _ = srv.Start() }()
+	defer srv.Shutdown(context.Background())
+
+	// 交接期间新旧进程使用相同的ServiceId，两个连接同时保留
+	old := dialGateway(t, addr, "k1")
+	cur := dialGateway(t, addr, "k2")
+	defer old.Close()
+	defer cur.Close()
+	assert.Eventually(t, func() bool { return channels.Len() == 2 }, time.Second, time.Millisecond*10)
+	_, ok := channels.Get("gate01_k1")
+	assert.True(t, ok)
+	_, ok = channels.Get("gate01_k2")
+	assert.True(t, ok)
+
+	// 按照channelId中的实例ID推送到所在的进程
+	dispatcher := NewChatServerDispatcher(&container.Container{Srv: srv}, nil)
+	p := pkt.New(wire.CommandChatUserTalk)
+	p.Flag = pkt.Flag_Push
+	assert.Nil(t, dispatcher.Push("gate01", []string{"gate01_k1_{test1}_1", "gate01_k2_{test2}_1"}, p))
+	for conn, channel := range map[him.Conn]string{old: "gate01_k1_{test1}_1", cur: "gate01_k2_{test2}_1"} {
+		frame, err := conn.ReadFrame()
+		assert.Nil(t, err)
+		received, err := pkt.MustReadLogicPkt(bytes.NewBuffer(frame.GetPayload()))
+		assert.Nil(t, err)
+		server, _ := received.GetMeta(wire.MetaDestServer)
+		assert.Equal(t, "gate01", server)
+		channels, _ := received.GetMeta(wire.MetaDestChannels)
+		assert.Equal(t, channel, channels)
+	}
+
+	// 同一个进程在本端发现断开之后重新连接，替换还没有超时的旧连接
+	first, _ := channels.Get("gate01_k1")
+	again := dialGateway(t, addr, "k1")
+	defer again.Close()
+	assert.Eventually(t, func() bool {
+		ch, _ := channels.Get("gate01_k1")
+		return ch != first
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, 2, channels.Len())
+	// 没有实例ID的旧版本网关不替换
+	assert.False(t, h.Replace("gate01"))
+}
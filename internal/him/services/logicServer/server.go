@@ -2,21 +2,37 @@ package logicServer
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/chang144/gotalk/internal/him"
 	"github.com/chang144/gotalk/internal/him/container"
 	"github.com/chang144/gotalk/internal/him/naming"
 	"github.com/chang144/gotalk/internal/him/naming/consul"
+	"github.com/chang144/gotalk/internal/him/services/logicServer/api"
 	"github.com/chang144/gotalk/internal/him/services/logicServer/conf"
 	"github.com/chang144/gotalk/internal/him/services/logicServer/handler"
 	"github.com/chang144/gotalk/internal/him/services/logicServer/serv"
+	"github.com/chang144/gotalk/internal/him/services/logicServer/service"
+	"github.com/chang144/gotalk/internal/him/services/service/database"
 	"github.com/chang144/gotalk/internal/him/storage"
 	"github.com/chang144/gotalk/internal/him/tcp"
+	"github.com/chang144/gotalk/internal/him/webhook"
 	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/pkg/snowflake"
+	"github.com/klintcheng/kim/logger"
 	"github.com/spf13/cobra"
 )
 
 const DefaultPath = "../../internal/him/services/logicServer/conf.yaml"
 
+// apiShutdownTimeout 关闭时等待业务服务接口处理中请求的时间
+const apiShutdownTimeout = time.Second * 10
+
 // ServerStarOptions TODO: 这里是chat以及login逻辑服务器
 type ServerStarOptions struct {
 	config      string
@@ -34,7 +50,7 @@ func NewServerStartCmd(ctx context.Context, version string) *cobra.Command {
 		},
 	}
 	cmd.PersistentFlags().StringVarP(&opts.config, "config", "c", DefaultPath, "Config file")
-	cmd.PersistentFlags().StringVarP(&opts.config, "serverName", "s", "chat", "define a service name, option is login or chat")
+	cmd.PersistentFlags().StringVarP(&opts.serviceName, "serverName", "s", "chat", "define a service name, option is login or chat")
 
 	return cmd
 }
@@ -44,19 +60,46 @@ func RunServerStart(ctx context.Context, opts *ServerStarOptions, version string
 	if err != nil {
 		return err
 	}
+	// 没有密钥时任何人都可以冒充网关接入
+	if config.InnerSecret == "" {
+		return errors.New("InnerSecret is required to authenticate gateways")
+	}
 
 	r := him.NewRouter()
-	// login
-	loginHandler := handler.NewLoginHandler()
-	r.AddHandles(wire.CommandLoginSignIn, loginHandler.DoSysLogin)
-	r.AddHandles(wire.CommandLoginSignOut, loginHandler.DoSysLogout)
 
-	rdb, err := storage.InitRedis(config.RedisAddr, "")
+	rdb, err := storage.InitUniversalRedis(storage.RedisOptions{
+		Mode:             config.Redis.Mode,
+		Addrs:            config.Redis.Addrs,
+		MasterName:       config.Redis.MasterName,
+		Username:         config.Redis.Username,
+		Password:         config.Redis.Password,
+		SentinelPassword: config.Redis.SentinelPassword,
+		DB:               config.Redis.DB,
+		TLS: storage.TLSOptions{
+			Enable:             config.Redis.TLS.Enable,
+			CAFile:             config.Redis.TLS.CAFile,
+			CertFile:           config.Redis.TLS.CertFile,
+			KeyFile:            config.Redis.TLS.KeyFile,
+			ServerName:         config.Redis.TLS.ServerName,
+			InsecureSkipVerify: config.Redis.TLS.InsecureSkipVerify,
+		},
+	})
 	if err != nil {
 		return err
 	}
-	cache := storage.NewRedisStorage(rdb)
-	h := serv.NewLogicHandler(r, cache)
+	redisStorage := storage.NewRedisStorage(rdb)
+	var cache him.SessionStorage = redisStorage
+	var resume him.ResumeStorage = redisStorage
+	if config.LocalCacheSize > 0 {
+		cachedStorage := storage.NewCachedStorage(rdb, config.LocalCacheSize, config.LocalCacheTTL)
+		cache, resume = cachedStorage, cachedStorage
+	}
+	if config.ResumeGrace <= 0 {
+		resume = nil
+	}
+	// 收到退出信号时关闭容器与推送队列
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
 
 	rService := &naming.RegisterService{
 		Id:       config.ServerId,
@@ -67,21 +110,194 @@ func RunServerStart(ctx context.Context, opts *ServerStarOptions, version string
 		Tags:     config.Tags,
 	}
 	tSrv := tcp.NewServer(config.Listen, rService)
+	ns, err := consul.NewNaming(config.ConsulRUL)
+	if err != nil {
+		return err
+	}
+	pushQueue := storage.NewRedisPushQueue(rdb, config.ServerId)
+	// 网关连接
+	channels := him.NewChannelMap(100)
+	cont := container.New(container.Options{
+		Server: tSrv,
+		Naming: ns,
+		Load: &container.LoadOptions{
+			Interval:  config.LoadReportInterval,
+			Threshold: config.LoadThreshold,
+			Connections: func() int {
+				return channels.Len()
+			},
+			Queue: func() int {
+				n, _ := pushQueue.Pending()
+				return int(n)
+			},
+		},
+	})
 
-	tSrv.SetReadWait(him.DefaultReadWait)
-	tSrv.SetAcceptor(h)
-	tSrv.SetMessageListener(h)
-	tSrv.SetStateListener(h)
+	dispatcher := serv.NewChatServerDispatcher(cont, resume)
+	h := serv.NewLogicHandler(r, cache, dispatcher, config.InnerSecret)
+	h.SetNonceStorage(storage.NewRedisNonceStorage(rdb))
 
-	if err := container.Init(tSrv); err != nil {
+	hooks, err := newWebhook(config)
+	if err != nil {
 		return err
 	}
+	// 关闭时队列中未投递的事件写入死信
+	defer hooks.Close()
 
-	ns, err := consul.NewNaming(config.ConsulRUL)
+	friends := storage.NewRedisFriendStorage(rdb)
+	// presence
+	presenceHandler := handler.NewPresenceHandler(storage.NewRedisPresenceStorage(rdb), friends, cache, dispatcher, config.PresenceDebounce)
+	r.AddHandles(wire.CommandPresenceSubscribe, presenceHandler.DoSubscribe)
+	r.AddHandles(wire.CommandPresenceUnsubscribe, presenceHandler.DoUnsubscribe)
+	r.AddHandles(wire.CommandPresenceQuery, presenceHandler.DoQuery)
+	// 其它服务通过推送队列发来的消息
+	pushHandler := handler.NewPushHandler(cache, redisStorage, dispatcher)
+	pushHandler.SetWebhook(hooks)
+	go func() {
+		if err := pushQueue.Consume(ctx, pushHandler.Deliver); err != nil {
+			logger.Error(err)
+		}
+	}()
+
+	// friend
+	friendHandler := handler.NewFriendHandler(friends, cache, dispatcher)
+	r.AddHandles(wire.CommandFriendRequest, friendHandler.DoRequest)
+	r.AddHandles(wire.CommandFriendAccept, friendHandler.DoAccept)
+	r.AddHandles(wire.CommandFriendReject, friendHandler.DoReject)
+	r.AddHandles(wire.CommandFriendDelete, friendHandler.DoDelete)
+	r.AddHandles(wire.CommandFriendList, friendHandler.DoList)
+	r.AddHandles(wire.CommandFriendRequests, friendHandler.DoRequests)
+	r.AddHandles(wire.CommandBlockAdd, friendHandler.DoBlock)
+	r.AddHandles(wire.CommandBlockRemove, friendHandler.DoUnblock)
+	r.AddHandles(wire.CommandBlockList, friendHandler.DoBlocklist)
+	// chat
+	chatOpts := handler.ChatOptions{
+		Friends:        friends,
+		FriendOnlyApps: config.FriendOnlyApps,
+		Webhooks:       hooks,
+	}
+	if config.MessageDb != "" {
+		messageDb, err := database.InitMysqlDb(config.MessageDb)
+		if err != nil {
+			return err
+		}
+		if err = messageDb.AutoMigrate(&database.MessageIndex{}, &database.MessageContent{}); err != nil {
+			return err
+		}
+		idgen, err := snowflake.NewIDGenerator(config.NodeID)
+		if err != nil {
+			return err
+		}
+		chatOpts.Messages = service.NewMessageDb(messageDb, idgen)
+		pushHandler.SetMessages(chatOpts.Messages)
+	}
+	if config.BaseDb != "" {
+		baseDb, err := database.InitMysqlDb(config.BaseDb)
+		if err != nil {
+			return err
+		}
+		chatOpts.Groups = service.NewGroupDb(baseDb)
+	}
+	chatHandler := handler.NewChatHandler(cache, dispatcher, chatOpts)
+	r.AddHandles(wire.CommandChatUserTalk, chatHandler.DoUserTalk)
+	r.AddHandles(wire.CommandChatGroupTalk, chatHandler.DoGroupTalk)
+	// 业务服务发送消息
+	sender := api.NewSender(chatHandler, storage.NewRedisIdempotencyStorage(rdb), config.Api.IdempotencyTTL)
+	if err = startApi(ctx, config.Api, sender); err != nil {
+		return err
+	}
+	// login
+	loginHandler := handler.NewLoginHandler(presenceHandler, resume, config.ResumeGrace)
+	loginHandler.SetWebhook(hooks)
+	r.AddHandles(wire.CommandLoginSignIn, loginHandler.DoSysLogin)
+	r.AddHandles(wire.CommandLoginResume, loginHandler.DoSysResume)
+	r.AddHandles(wire.CommandLoginSignOut, loginHandler.DoSysLogout)
+	r.AddHandles(wire.CommandLoginTouch, loginHandler.DoSysTouch)
+
+	tSrv.SetChannelMap(channels)
+	pool, err := him.NewWorkerPool(config.WorkerPool)
 	if err != nil {
 		return err
 	}
-	container.SetServiceNaming(ns)
+	defer pool.Release()
+	tSrv.(him.Poolable).SetWorkerPool(pool)
+
+	tSrv.SetReadWait(him.DefaultReadWait)
+	tSrv.SetAcceptor(h)
+	tSrv.SetMessageListener(h)
+	tSrv.SetStateListener(h)
+	if config.TLS.Enable {
+		tlsConfig, err := him.NewServerTLSConfig(him.TLSOptions{
+			CertFile: config.TLS.CertFile,
+			KeyFile:  config.TLS.KeyFile,
+			CAFile:   config.TLS.CAFile,
+		})
+		if err != nil {
+			return err
+		}
+		tSrv.SetTLSConfig(tlsConfig)
+	}
+
+	return cont.Run(ctx)
+}
 
-	return container.Start()
+// startApi 启动业务服务发送消息的HTTP与gRPC接口，ctx结束时等待处理中的请求完成后关闭
+func startApi(ctx context.Context, config conf.ApiConfig, sender *api.Sender) error {
+	if config.HttpListen != "" {
+		srv := &http.Server{
+			Addr:    config.HttpListen,
+			Handler: api.NewHTTPHandler(sender, config.Keys),
+		}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error(err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				logger.Warn(err)
+			}
+		}()
+	}
+	if config.GrpcListen != "" {
+		lis, err := net.Listen("tcp", config.GrpcListen)
+		if err != nil {
+			return err
+		}
+		srv := api.NewGrpcServer(sender, config.Keys)
+		go func() {
+			if err := srv.Serve(lis); err != nil {
+				logger.Error(err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			srv.GracefulStop()
+		}()
+	}
+	return nil
+}
+
+// newWebhook 没有配置webhook时返回nil
+func newWebhook(config *conf.LogicServerConfig) (*webhook.Client, error) {
+	if len(config.Webhooks) == 0 {
+		return nil, nil
+	}
+	opts := webhook.Options{
+		MaxRetries: config.Webhook.MaxRetries,
+		Backoff:    config.Webhook.Backoff,
+		MaxBackoff: config.Webhook.MaxBackoff,
+		Workers:    config.Webhook.Workers,
+	}
+	if config.Webhook.DeadLetter != "" {
+		deadLetter, err := webhook.NewFileDeadLetter(config.Webhook.DeadLetter)
+		if err != nil {
+			return nil, err
+		}
+		opts.DeadLetter = deadLetter
+	}
+	return webhook.NewClient(config.Webhooks, opts), nil
 }
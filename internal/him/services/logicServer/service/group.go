@@ -1 +1,32 @@
 package service
+
+import (
+	"github.com/chang144/gotalk/internal/him/services/service/database"
+	"gorm.io/gorm"
+)
+
+// Group 群信息
+type Group interface {
+	// Members 群成员账号，群不存在时返回空列表
+	Members(app string, group string) ([]string, error)
+}
+
+// GroupDb 基于mysql的群信息
+type GroupDb struct {
+	db *gorm.DB
+}
+
+func NewGroupDb(db *gorm.DB) *GroupDb {
+	return &GroupDb{db: db}
+}
+
+func (s *GroupDb) Members(app string, group string) ([]string, error) {
+	var accounts []string
+	err := s.db.Model(&database.GroupMember{}).
+		Joins("JOIN t_group ON t_group.`group` = t_group_member.`group`").
+		Where("t_group_member.`group` = ? AND t_group.app = ?", group, app).
+		Pluck("t_group_member.account", &accounts).Error
+	return accounts, err
+}
+
+var _ Group = (*GroupDb)(nil)
@@ -1 +1,111 @@
 package service
+
+import (
+	"github.com/chang144/gotalk/internal/him/services/service/database"
+	"github.com/chang144/gotalk/internal/him/wire/rpc"
+	"github.com/chang144/gotalk/internal/pkg/snowflake"
+	"gorm.io/gorm"
+)
+
+// Message 消息存储，离线消息按照索引读取
+type Message interface {
+	// InsertUser 保存单聊消息，发送方与接收方各写一条索引
+	InsertUser(app string, req *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error)
+	// InsertGroup 保存群聊消息，每个成员写一条索引
+	InsertGroup(app string, req *rpc.InsertMessageReq, members []string) (*rpc.InsertMessageResp, error)
+	// InsertSystem 保存系统消息，每个接收方写一条索引，Dest为群ID时索引中带上群
+	InsertSystem(app string, req *rpc.InsertMessageReq, accounts []string) (*rpc.InsertMessageResp, error)
+}
+
+// MessageDb 基于mysql的消息存储
+type MessageDb struct {
+	db    *gorm.DB
+	idgen *snowflake.IDGenerator
+}
+
+func NewMessageDb(db *gorm.DB, idgen *snowflake.IDGenerator) *MessageDb {
+	return &MessageDb{
+		db:    db,
+		idgen: idgen,
+	}
+}
+
+func (s *MessageDb) InsertUser(app string, req *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error) {
+	messageId := s.idgen.Next().Int64()
+	indexes := []database.MessageIndex{
+		{ID: s.idgen.Next().Int64(), AccountA: req.Dest, AccountB: req.Sender, Direction: 0, MessageID: messageId, SendTime: req.SendTime},
+		{ID: s.idgen.Next().Int64(), AccountA: req.Sender, AccountB: req.Dest, Direction: 1, MessageID: messageId, SendTime: req.SendTime},
+	}
+	if err := s.insert(messageId, req, indexes); err != nil {
+		return nil, err
+	}
+	return &rpc.InsertMessageResp{MessageId: messageId}, nil
+}
+
+func (s *MessageDb) InsertGroup(app string, req *rpc.InsertMessageReq, members []string) (*rpc.InsertMessageResp, error) {
+	messageId := s.idgen.Next().Int64()
+	indexes := make([]database.MessageIndex, 0, len(members))
+	for _, member := range members {
+		index := database.MessageIndex{
+			ID:        s.idgen.Next().Int64(),
+			AccountA:  member,
+			AccountB:  req.Sender,
+			MessageID: messageId,
+			Group:     req.Dest,
+			SendTime:  req.SendTime,
+		}
+		if member == req.Sender {
+			index.Direction = 1
+		}
+		indexes = append(indexes, index)
+	}
+	if err := s.insert(messageId, req, indexes); err != nil {
+		return nil, err
+	}
+	return &rpc.InsertMessageResp{MessageId: messageId}, nil
+}
+
+func (s *MessageDb) InsertSystem(app string, req *rpc.InsertMessageReq, accounts []string) (*rpc.InsertMessageResp, error) {
+	messageId := s.idgen.Next().Int64()
+	indexes := make([]database.MessageIndex, 0, len(accounts))
+	for _, account := range accounts {
+		index := database.MessageIndex{
+			ID:        s.idgen.Next().Int64(),
+			AccountA:  account,
+			AccountB:  req.Sender,
+			MessageID: messageId,
+			SendTime:  req.SendTime,
+		}
+		// 单个用户的系统消息Dest就是接收方
+		if req.Dest != account {
+			index.Group = req.Dest
+		}
+		indexes = append(indexes, index)
+	}
+	if err := s.insert(messageId, req, indexes); err != nil {
+		return nil, err
+	}
+	return &rpc.InsertMessageResp{MessageId: messageId}, nil
+}
+
+// insert 内容与索引在同一个事务中写入
+func (s *MessageDb) insert(messageId int64, req *rpc.InsertMessageReq, indexes []database.MessageIndex) error {
+	content := database.MessageContent{
+		ID:       messageId,
+		Type:     byte(req.Message.Type),
+		Body:     req.Message.Body,
+		Extra:    req.Message.Extra,
+		SendTime: req.SendTime,
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&content).Error; err != nil {
+			return err
+		}
+		if len(indexes) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(indexes, 500).Error
+	})
+}
+
+var _ Message = (*MessageDb)(nil)
@@ -0,0 +1,60 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him/services/router/routing"
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire/token"
+	"github.com/spf13/viper"
+)
+
+type RouterConfig struct {
+	Listen string `default:":8080"`
+	BaseDb string
+	// Keys 签发与校验token的密钥，与网关使用相同的配置
+	Keys              []token.KeyConfig
+	KeyReloadInterval time.Duration
+	// Audience 签发的token中的aud
+	Audience        string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// Redis 保存token吊销记录，必须与网关使用同一个redis
+	Redis         storage.RedisOptions
+	RevocationTTL time.Duration
+	// AdminKeys 运维接口的密钥，为空时不开放运维接口
+	AdminKeys []string
+	// ConsulURL 为空时不提供网关路由
+	ConsulURL string
+	// Regions 客户端IP段对应的区域与运营商
+	Regions []routing.Region
+	// MaxGateways 路由返回的网关数量
+	MaxGateways int
+	LogLevel    string `default:"INFO"`
+}
+
+func (c RouterConfig) String() string {
+	bts, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return string(bts)
+}
+
+// InitRouterConfig 从配置文件file读取
+func InitRouterConfig(file string) (*RouterConfig, error) {
+	viper.SetConfigFile(file)
+	viper.AddConfigPath(".")
+
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("config file not found: %v", err)
+	}
+
+	var config RouterConfig
+	if err := viper.Unmarshal(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
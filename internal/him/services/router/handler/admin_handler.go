@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/services/service/database"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// MaxScanOnline 单次列出在线连接的上限
+const MaxScanOnline = 1000
+
+var (
+	ErrNotOnline     = errors.New("account is not online")
+	ErrNoTarget      = errors.New("account, channel_id or group is required")
+	ErrGroupNotFound = errors.New("group not found")
+)
+
+// AdminHandler 在线用户运维接口
+// 推送与踢下线通过推送队列交给逻辑服务，由逻辑服务经容器的Push发到对应的网关
+type AdminHandler struct {
+	BaseDb      *gorm.DB
+	Sessions    him.SessionStorage
+	Online      him.OnlineStorage
+	Pushes      him.PushQueue
+	Revocations him.RevocationStorage
+}
+
+type KickReq struct {
+	Account   string `json:"account"`
+	ChannelId string `json:"channel_id"`
+	// Revoke 同时吊销账号已签发的token，避免客户端重新登录
+	Revoke bool `json:"revoke"`
+}
+
+type SystemMessageReq struct {
+	// App 群消息只查找该应用中的群，同时用于保存消息
+	App     string `json:"app" binding:"max=30"`
+	Account string `json:"account"`
+	Group   string `json:"group"`
+	Type    int32  `json:"type"`
+	Body    string `json:"body" binding:"required,max=5000"`
+	Extra   string `json:"extra" binding:"max=500"`
+}
+
+type OnlineResp struct {
+	Account   string `json:"account"`
+	ChannelId string `json:"channel_id"`
+	Gateway   string `json:"gateway"`
+}
+
+// Register 注册路由，全部接口都需要运维密钥
+func (h *AdminHandler) Register(r gin.IRouter, auth gin.HandlerFunc) {
+	g := r.Group("/api/admin", auth)
+	g.GET("/gateways", h.Gateways)
+	g.GET("/online", h.ListOnline)
+	g.GET("/online/:account", h.GetOnline)
+	g.POST("/kick", h.Kick)
+	g.POST("/message", h.SendMessage)
+	g.POST("/broadcast", h.Broadcast)
+}
+
+// Gateways 每个网关上的连接数
+func (h *AdminHandler) Gateways(c *gin.Context) {
+	counts, err := h.Online.CountByGateway()
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	c.JSON(http.StatusOK, gin.H{"gateways": counts, "total": total})
+}
+
+// ListOnline 分页列出网关上的在线连接，返回的cursor为0时结束
+func (h *AdminHandler) ListOnline(c *gin.Context) {
+	gateway := c.Query("gateway")
+	if gateway == "" {
+		respErr(c, http.StatusBadRequest, errors.New("gateway is required"))
+		return
+	}
+	cursor, _ := strconv.ParseUint(c.Query("cursor"), 10, 64)
+	count, _ := strconv.ParseInt(c.Query("count"), 10, 64)
+	if count <= 0 || count > MaxScanOnline {
+		count = MaxScanOnline
+	}
+	list, next, err := h.Online.ScanOnline(gateway, cursor, count)
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	resp := make([]*OnlineResp, len(list))
+	for i, loc := range list {
+		resp[i] = &OnlineResp{Account: loc.Account, ChannelId: loc.ChannelId, Gateway: loc.GateId}
+	}
+	c.JSON(http.StatusOK, gin.H{"list": resp, "cursor": next})
+}
+
+// GetOnline 查询账号的位置信息，挂起的会话gateway为空
+func (h *AdminHandler) GetOnline(c *gin.Context) {
+	account := c.Param("account")
+	loc, err := h.Sessions.GetLocation(account, "")
+	if err == him.ErrSessionNil {
+		respErr(c, http.StatusNotFound, ErrNotOnline)
+		return
+	}
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, &OnlineResp{Account: account, ChannelId: loc.ChannelId, Gateway: loc.GateId})
+}
+
+// Kick 踢下一个连接或者账号的全部连接
+func (h *AdminHandler) Kick(c *gin.Context) {
+	var req KickReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	p := pkt.New(wire.CommandLoginSignIn)
+	p.AddStringMeta(wire.MetaKickout, "true")
+	account := req.Account
+	if req.ChannelId != "" {
+		session, err := h.Sessions.Get(req.ChannelId)
+		if err == him.ErrSessionNil {
+			respErr(c, http.StatusNotFound, ErrNotOnline)
+			return
+		}
+		if err != nil {
+			respErr(c, http.StatusInternalServerError, err)
+			return
+		}
+		account = session.Account
+		p.AddStringMeta(wire.MetaDestChannels, req.ChannelId)
+	}
+	if account == "" {
+		respErr(c, http.StatusBadRequest, ErrNoTarget)
+		return
+	}
+	if req.Revoke && h.Revocations != nil {
+		if err := h.Revocations.RevokeAccount(account, time.Now()); err != nil {
+			respErr(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := h.Pushes.Publish([]string{account}, p); err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// SendMessage 给用户或者群发送系统消息，群消息的Dest为群ID
+// 消息由逻辑服务保存之后推送，不在线的账号上线后可以拉取
+func (h *AdminHandler) SendMessage(c *gin.Context) {
+	var req SystemMessageReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	var (
+		accounts []string
+		options  []pkt.HeaderOption
+	)
+	switch {
+	case req.Account != "":
+		accounts = []string{req.Account}
+		options = append(options, pkt.WithDest(req.Account))
+	case req.Group != "":
+		appGroups := h.BaseDb.Model(&database.Group{}).Select("`group`").Where("app = ?", req.App)
+		err := h.BaseDb.Model(&database.GroupMember{}).
+			Where("`group` = ? AND `group` IN (?)", req.Group, appGroups).
+			Pluck("account", &accounts).Error
+		if err != nil {
+			respErr(c, http.StatusInternalServerError, err)
+			return
+		}
+		if len(accounts) == 0 {
+			respErr(c, http.StatusNotFound, ErrGroupNotFound)
+			return
+		}
+		options = append(options, pkt.WithDest(req.Group))
+	default:
+		respErr(c, http.StatusBadRequest, ErrNoTarget)
+		return
+	}
+	p := pkt.New(wire.CommandSystemNotify, options...)
+	sendTime := time.Now().UnixNano()
+	p.WriteBody(newSystemMessage(req.Type, req.Body, req.Extra, sendTime))
+	p.AddStringMeta(wire.MetaApp, req.App)
+	for i := 0; i < len(accounts); i += notifyBatch {
+		end := i + notifyBatch
+		if end > len(accounts) {
+			end = len(accounts)
+		}
+		if err := h.Pushes.Publish(accounts[i:end], p); err != nil {
+			respErr(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"send_time": sendTime})
+}
+
+// Broadcast 给全部在线连接发送系统消息
+func (h *AdminHandler) Broadcast(c *gin.Context) {
+	var req SystemMessageReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	p := pkt.New(wire.CommandSystemNotify)
+	sendTime := time.Now().UnixNano()
+	p.WriteBody(newSystemMessage(req.Type, req.Body, req.Extra, sendTime))
+	p.AddStringMeta(wire.MetaBroadcast, "true")
+	if err := h.Pushes.Publish(nil, p); err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"send_time": sendTime})
+}
+
+func newSystemMessage(typ int32, body, extra string, sendTime int64) *pkt.MessagePush {
+	return &pkt.MessagePush{
+		Type:     typ,
+		Body:     body,
+		Extra:    extra,
+		Sender:   wire.SystemAccount,
+		SendTime: sendTime,
+	}
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/services/service/database"
+	"github.com/chang144/gotalk/internal/him/wire/token"
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/ksuid"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultAccessTokenTTL  = time.Hour * 2
+	DefaultRefreshTokenTTL = time.Hour * 24 * 7
+)
+
+var ErrInvalidCredentials = errors.New("invalid account or password")
+
+// dummyHash 账号不存在时也做一次哈希比较，避免通过响应时间判断账号是否存在
+var dummyHash, _ = database.HashPassword("gotalk-dummy-password")
+
+// AuthHandler 授权服务，签发访问token与刷新token
+type AuthHandler struct {
+	BaseDb      *gorm.DB
+	Keys        token.KeyProvider
+	Tokens      *token.Parser
+	Revocations him.RevocationStorage
+	// Audience 写入token的aud，为空时不写入
+	Audience        string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+type LoginReq struct {
+	App      string `json:"app"`
+	Account  string `json:"account" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type LogoutReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenResp struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Register 注册路由
+func (h *AuthHandler) Register(r gin.IRouter) {
+	g := r.Group("/api/auth")
+	g.POST("/login", h.Login)
+	g.POST("/refresh", h.Refresh)
+	g.POST("/logout", h.Logout)
+}
+
+// Login 账号密码登录
+func (h *AuthHandler) Login(c *gin.Context) {
+	var req LoginReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	var user database.User
+	err := h.BaseDb.Where("account = ?", req.Account).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user.Password = dummyHash
+	} else if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !user.CheckPassword(req.Password) || user.ID == 0 || req.App != "" && user.App != req.App {
+		respErr(c, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	resp, err := h.issue(user.Account, user.App)
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Refresh 使用刷新token换取新的token，旧的刷新token随即被吊销，不影响在线的连接
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req RefreshReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	tk, err := h.Tokens.ParseRefresh(req.RefreshToken)
+	if err != nil {
+		respErr(c, http.StatusUnauthorized, err)
+		return
+	}
+	revoked, err := h.Revocations.IsRevoked(tk.Account, tk.ID, time.Unix(tk.Iat, 0))
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if revoked {
+		respErr(c, http.StatusUnauthorized, errors.New("refresh token is revoked"))
+		return
+	}
+	// 并发使用同一个刷新token时只有一个请求可以占用
+	claimed, err := h.Revocations.ClaimToken(tk.Account, tk.ID, time.Unix(tk.Exp, 0))
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !claimed {
+		respErr(c, http.StatusUnauthorized, errors.New("refresh token is revoked"))
+		return
+	}
+	resp, err := h.issue(tk.Account, tk.App)
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Logout 吊销当前的访问token与刷新token，账号在线的连接会被踢下线
+func (h *AuthHandler) Logout(c *gin.Context) {
+	access, err := h.Tokens.Parse(bearer(c))
+	if err != nil {
+		respErr(c, http.StatusUnauthorized, err)
+		return
+	}
+	var req LogoutReq
+	_ = c.ShouldBindJSON(&req)
+	if req.RefreshToken != "" {
+		refresh, err := h.Tokens.ParseRefresh(req.RefreshToken)
+		if err == nil && refresh.Account == access.Account {
+			_ = h.Revocations.RevokeToken(refresh.Account, refresh.ID, time.Unix(refresh.Exp, 0))
+		}
+	}
+	if err = h.Revocations.RevokeToken(access.Account, access.ID, time.Unix(access.Exp, 0)); err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err = h.Revocations.Notify(access.Account); err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// issue 签发一对访问token与刷新token
+func (h *AuthHandler) issue(account, app string) (*TokenResp, error) {
+	accessTTL, refreshTTL := h.AccessTokenTTL, h.RefreshTokenTTL
+	if accessTTL <= 0 {
+		accessTTL = DefaultAccessTokenTTL
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = DefaultRefreshTokenTTL
+	}
+	now := time.Now()
+	var aud token.Audience
+	if h.Audience != "" {
+		aud = token.Audience{h.Audience}
+	}
+	access, err := token.Sign(h.Keys, &token.Token{
+		Account: account,
+		App:     app,
+		Iat:     now.Unix(),
+		Exp:     now.Add(accessTTL).Unix(),
+		Aud:     aud,
+		ID:      ksuid.New().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := token.Sign(h.Keys, &token.Token{
+		Account: account,
+		App:     app,
+		Iat:     now.Unix(),
+		Exp:     now.Add(refreshTTL).Unix(),
+		Aud:     aud,
+		ID:      ksuid.New().String(),
+		Type:    token.TypeRefresh,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResp{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTTL.Seconds()),
+	}, nil
+}
+
+func bearer(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:]
+	}
+	return ""
+}
+
+func respErr(c *gin.Context, code int, err error) {
+	c.AbortWithStatusJSON(code, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire/token"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAuth() (*AuthHandler, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	keys := token.NewKeySet(&token.Key{ID: "k1", Algorithm: token.AlgHS256, Secret: []byte("secret")})
+	h := &AuthHandler{
+		Keys:        keys,
+		Tokens:      token.NewParser(keys, ""),
+		Revocations: storage.NewMemoryRevocationStorage(),
+	}
+	r := gin.New()
+	h.Register(r)
+	return h, r
+}
+
+func post(r *gin.Engine, path string, body interface{}, access string) *httptest.ResponseRecorder {
+	bts, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(bts))
+	req.Header.Set("Content-Type", "application/json")
+	if access != "" {
+		req.Header.Set("Authorization", "Bearer "+access)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func Test_refresh_and_logout(t *testing.T) {
+	h, r := newTestAuth()
+	// 网关订阅吊销事件，踢下账号的全部连接
+	kicked := make(chan string, 1)
+	assert.Nil(t, h.Revocations.Subscribe(func(account string) {
+		kicked <- account
+	}))
+	pair, err := h.issue("test1", "kim")
+	assert.Nil(t, err)
+
+	// 访问token不能用于刷新
+	w := post(r, "/api/auth/refresh", RefreshReq{RefreshToken: pair.AccessToken}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = post(r, "/api/auth/refresh", RefreshReq{RefreshToken: pair.RefreshToken}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var next TokenResp
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &next))
+	tk, err := h.Tokens.Parse(next.AccessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, "test1", tk.Account)
+	assert.Equal(t, "kim", tk.App)
+
+	// 刷新时其它设备的连接不受影响
+	select {
+	case account := <-kicked:
+		t.Fatalf("%s kicked by refresh", account)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// 刷新token只能使用一次
+	w = post(r, "/api/auth/refresh", RefreshReq{RefreshToken: pair.RefreshToken}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = post(r, "/api/auth/logout", LogoutReq{RefreshToken: next.RefreshToken}, next.AccessToken)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	revoked, _ := h.Revocations.IsRevoked(tk.Account, tk.ID, time.Unix(tk.Iat, 0))
+	assert.True(t, revoked)
+	select {
+	case account := <-kicked:
+		assert.Equal(t, "test1", account)
+	case <-time.After(time.Second):
+		t.Fatal("logout not kicked")
+	}
+	w = post(r, "/api/auth/refresh", RefreshReq{RefreshToken: next.RefreshToken}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func Test_refresh_concurrently(t *testing.T) {
+	h, r := newTestAuth()
+	pair, err := h.issue("test1", "kim")
+	assert.Nil(t, err)
+
+	// 同一个刷新token并发刷新，只有一个成功
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- post(r, "/api/auth/refresh", RefreshReq{RefreshToken: pair.RefreshToken}, "").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	success := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			success++
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, code)
+		}
+	}
+	assert.Equal(t, 1, success)
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/token"
+	"github.com/gin-gonic/gin"
+)
+
+// KeyToken 校验通过的访问token在gin.Context中的key
+const KeyToken = "token"
+
+var ErrTokenRevoked = errors.New("token is revoked")
+
+// Authenticate 校验Authorization头中的访问token，revocations为nil时不检查吊销
+func Authenticate(tokens *token.Parser, revocations him.RevocationStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tk, err := tokens.Parse(bearer(c))
+		if err != nil {
+			respErr(c, http.StatusUnauthorized, err)
+			return
+		}
+		if revocations != nil {
+			revoked, err := revocations.IsRevoked(tk.Account, tk.ID, time.Unix(tk.Iat, 0))
+			if err != nil {
+				respErr(c, http.StatusInternalServerError, err)
+				return
+			}
+			if revoked {
+				respErr(c, http.StatusUnauthorized, ErrTokenRevoked)
+				return
+			}
+		}
+		c.Set(KeyToken, tk)
+		c.Next()
+	}
+}
+
+// currentToken 返回Authenticate写入的访问token
+func currentToken(c *gin.Context) *token.Token {
+	tk, _ := c.MustGet(KeyToken).(*token.Token)
+	return tk
+}
+
+// HeaderAdminKey 运维接口使用的密钥头
+const HeaderAdminKey = "X-Admin-Key"
+
+var ErrInvalidAdminKey = errors.New("invalid admin key")
+
+// AdminAuth 校验运维密钥，keys为空时拒绝全部请求
+func AdminAuth(keys []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := []byte(c.GetHeader(HeaderAdminKey))
+		for _, k := range keys {
+			if k != "" && subtle.ConstantTimeCompare(key, []byte(k)) == 1 {
+				c.Next()
+				return
+			}
+		}
+		respErr(c, http.StatusUnauthorized, ErrInvalidAdminKey)
+	}
+}
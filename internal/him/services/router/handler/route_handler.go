@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/chang144/gotalk/internal/him/services/router/routing"
+	"github.com/gin-gonic/gin"
+)
+
+// RouteHandler 客户端连接之前查询接入的网关，不需要登录
+type RouteHandler struct {
+	Router *routing.Router
+}
+
+type LookupReq struct {
+	App string `form:"app"`
+	// Zone 与 ISP 为空时按照客户端IP识别
+	Zone string `form:"zone"`
+	ISP  string `form:"isp"`
+	// Protocol ws(默认)或者tcp
+	Protocol string `form:"protocol"`
+}
+
+func (h *RouteHandler) Register(r gin.IRouter) {
+	r.GET("/api/gateways", h.Lookup)
+}
+
+// Lookup 返回按照优先级排序的网关地址，客户端依次尝试连接
+func (h *RouteHandler) Lookup(c *gin.Context) {
+	var req LookupReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := h.Router.Lookup(&routing.Request{
+		IP:       c.ClientIP(),
+		Zone:     req.Zone,
+		ISP:      req.ISP,
+		App:      req.App,
+		Protocol: req.Protocol,
+	})
+	if err == routing.ErrUnknownProtocol {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		respErr(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/services/service/database"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/gin-gonic/gin"
+	"github.com/klintcheng/kim/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxBatchUsers 批量查询的账号上限
+	MaxBatchUsers = 100
+	// MaxSearchUsers 搜索返回的最大条数
+	MaxSearchUsers = 50
+	// notifyBatch 资料变更通知每个推送消息包含的最大账号数
+	notifyBatch = 1000
+)
+
+var (
+	ErrUserExists   = errors.New("account already exists")
+	ErrUserNotFound = errors.New("user not found")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// UserHandler 用户管理，查询与修改都限定在token所属的App内
+type UserHandler struct {
+	BaseDb *gorm.DB
+	// Pushes 推送资料变更通知，为nil时不通知
+	Pushes him.PushQueue
+	// Friends 为nil时只通知同群的成员
+	Friends him.FriendStorage
+}
+
+type CreateUserReq struct {
+	App      string `json:"app" binding:"max=30"`
+	Account  string `json:"account" binding:"required,max=60"`
+	Password string `json:"password" binding:"required,min=6,max=72"`
+	Nickname string `json:"nickname" binding:"max=20"`
+	Avatar   string `json:"avatar" binding:"max=200"`
+}
+
+// UpdateUserReq 为nil的字段不修改
+type UpdateUserReq struct {
+	Nickname *string `json:"nickname" binding:"omitempty,max=20"`
+	Avatar   *string `json:"avatar" binding:"omitempty,max=200"`
+}
+
+type BatchGetReq struct {
+	Accounts []string `json:"accounts" binding:"required"`
+}
+
+type UserResp struct {
+	App       string    `json:"app"`
+	Account   string    `json:"account"`
+	Nickname  string    `json:"nickname"`
+	Avatar    string    `json:"avatar"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newUserResp(u *database.User) *UserResp {
+	return &UserResp{
+		App:       u.App,
+		Account:   u.Account,
+		Nickname:  u.Nickname,
+		Avatar:    u.Avatar,
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+// Register 注册路由，创建用户由业务服务通过运维密钥调用
+func (h *UserHandler) Register(r gin.IRouter, auth gin.HandlerFunc, admin gin.HandlerFunc) {
+	g := r.Group("/api/users")
+	g.POST("", admin, h.Create)
+
+	authed := g.Group("", auth)
+	authed.GET("", h.Search)
+	authed.POST("/batch", h.BatchGet)
+	authed.GET("/:account", h.Get)
+	authed.PUT("/:account", h.Update)
+}
+
+// Create 创建用户
+func (h *UserHandler) Create(c *gin.Context) {
+	var req CreateUserReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	hash, err := database.HashPassword(req.Password)
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	user := &database.User{
+		App:      req.App,
+		Account:  req.Account,
+		Password: hash,
+		Nickname: req.Nickname,
+		Avatar:   req.Avatar,
+	}
+	// 账号是否存在由唯一索引判断，并发创建时只有一个成功
+	if err = h.BaseDb.Create(user).Error; database.IsDuplicateKey(err) {
+		respErr(c, http.StatusConflict, ErrUserExists)
+		return
+	} else if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, newUserResp(user))
+}
+
+// Get 查询用户详情
+func (h *UserHandler) Get(c *gin.Context) {
+	user, err := h.find(currentToken(c).App, c.Param("account"))
+	if err != nil {
+		respFindErr(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newUserResp(user))
+}
+
+// Update 修改自己的资料，昵称或头像变化时通知联系人
+func (h *UserHandler) Update(c *gin.Context) {
+	tk := currentToken(c)
+	if tk.Account != c.Param("account") {
+		respErr(c, http.StatusForbidden, ErrForbidden)
+		return
+	}
+	var req UpdateUserReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	user, err := h.find(tk.App, tk.Account)
+	if err != nil {
+		respFindErr(c, err)
+		return
+	}
+	updates := make(map[string]interface{})
+	if req.Nickname != nil && *req.Nickname != user.Nickname {
+		updates["nickname"] = *req.Nickname
+	}
+	if req.Avatar != nil && *req.Avatar != user.Avatar {
+		updates["avatar"] = *req.Avatar
+	}
+	if len(updates) > 0 {
+		if err = h.BaseDb.Model(user).Updates(updates).Error; err != nil {
+			respErr(c, http.StatusInternalServerError, err)
+			return
+		}
+		h.notifyProfile(user)
+	}
+	c.JSON(http.StatusOK, newUserResp(user))
+}
+
+// BatchGet 批量查询，不存在的账号不返回
+func (h *UserHandler) BatchGet(c *gin.Context) {
+	var req BatchGetReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Accounts) > MaxBatchUsers {
+		respErr(c, http.StatusBadRequest, errors.New("too many accounts"))
+		return
+	}
+	var users []*database.User
+	err := h.BaseDb.Where("app = ? AND account IN ?", currentToken(c).App, req.Accounts).Find(&users).Error
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": toUserResps(users)})
+}
+
+// Search 按照账号前缀或昵称搜索
+func (h *UserHandler) Search(c *gin.Context) {
+	keyword := c.Query("keyword")
+	if keyword == "" {
+		respErr(c, http.StatusBadRequest, errors.New("keyword is required"))
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > MaxSearchUsers {
+		limit = MaxSearchUsers
+	}
+	pattern := escapeLike(keyword)
+	var users []*database.User
+	err := h.BaseDb.Where("app = ? AND (account LIKE ? OR nickname LIKE ?)", currentToken(c).App, pattern+"%", "%"+pattern+"%").
+		Order("id").Limit(limit).Find(&users).Error
+	if err != nil {
+		respErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": toUserResps(users)})
+}
+
+func (h *UserHandler) find(app, account string) (*database.User, error) {
+	var user database.User
+	err := h.BaseDb.Where("app = ? AND account = ?", app, account).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// contacts 与用户有关系的账号，包括好友与所在群的其它成员，只包括app中的群
+func (h *UserHandler) contacts(app, account string) ([]string, error) {
+	appGroups := h.BaseDb.Model(&database.Group{}).Select("`group`").Where("app = ?", app)
+	groups := h.BaseDb.Model(&database.GroupMember{}).Select("`group`").
+		Where("account = ? AND `group` IN (?)", account, appGroups)
+	var accounts []string
+	err := h.BaseDb.Model(&database.GroupMember{}).Distinct("account").
+		Where("`group` IN (?) AND account <> ?", groups, account).
+		Pluck("account", &accounts).Error
+	if err != nil || h.Friends == nil {
+		return accounts, err
+	}
+	friends, err := h.Friends.Friends(app, account)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(accounts))
+	for _, a := range accounts {
+		seen[a] = true
+	}
+	for _, f := range friends {
+		if !seen[f] {
+			accounts = append(accounts, f)
+		}
+	}
+	return accounts, nil
+}
+
+// notifyProfile 把资料变更推送给联系人，失败时只记录日志
+func (h *UserHandler) notifyProfile(user *database.User) {
+	if h.Pushes == nil {
+		return
+	}
+	log := logger.WithFields(logger.Fields{
+		"func":    "notifyProfile",
+		"account": user.Account,
+	})
+	accounts, err := h.contacts(user.App, user.Account)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	p := pkt.New(wire.CommandUserProfileNotify)
+	p.WriteBody(&pkt.UserProfileNotify{
+		Account:  user.Account,
+		Nickname: user.Nickname,
+		Avatar:   user.Avatar,
+	})
+	for i := 0; i < len(accounts); i += notifyBatch {
+		end := i + notifyBatch
+		if end > len(accounts) {
+			end = len(accounts)
+		}
+		if err = h.Pushes.Publish(accounts[i:end], p); err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+func toUserResps(users []*database.User) []*UserResp {
+	list := make([]*UserResp, len(users))
+	for i, u := range users {
+		list[i] = newUserResp(u)
+	}
+	return list
+}
+
+func respFindErr(c *gin.Context, err error) {
+	if err == ErrUserNotFound {
+		respErr(c, http.StatusNotFound, err)
+		return
+	}
+	respErr(c, http.StatusInternalServerError, err)
+}
+
+// escapeLike 转义LIKE中的通配符
+func escapeLike(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' || s[i] == '_' || s[i] == '\\' {
+			out = append(out, '\\')
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
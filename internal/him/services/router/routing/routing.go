@@ -0,0 +1,234 @@
+package routing
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/klintcheng/kim/logger"
+)
+
+// 网关标签的前缀，格式为 zone:sh
+const (
+	TagZone = "zone:"
+	TagISP  = "isp:"
+	// TagApp 带有app标签的网关只接入这些应用
+	TagApp = "app:"
+)
+
+const (
+	// LoadBase 连接数达到LoadBase时网关的权重减半
+	LoadBase = 1000
+	// ZoneWeight 与客户端同区域的网关的权重倍数
+	ZoneWeight = 4
+	// ISPWeight 与客户端同运营商的网关的权重倍数
+	ISPWeight          = 2
+	DefaultMaxGateways = 3
+)
+
+var (
+	ErrNoGateway       = errors.New("no gateway available")
+	ErrUnknownProtocol = errors.New("unknown protocol")
+)
+
+// protocols 客户端协议对应的网关服务
+var protocols = map[string]string{
+	"ws":  wire.SNWGateway,
+	"tcp": wire.SNTGateway,
+}
+
+// Region 客户端IP段所在的区域与运营商
+type Region struct {
+	CIDR string
+	Zone string
+	ISP  string
+}
+
+type region struct {
+	ipnet *net.IPNet
+	Region
+}
+
+// Request 客户端没有提供Zone或ISP时按照IP识别
+type Request struct {
+	IP       string
+	Zone     string
+	ISP      string
+	App      string
+	Protocol string
+}
+
+type Result struct {
+	Zone     string   `json:"zone"`
+	ISP      string   `json:"isp"`
+	Gateways []string `json:"gateways"`
+}
+
+// Router 根据客户端所在的区域与网关的负载给出接入的网关列表
+type Router struct {
+	sync.RWMutex
+	// services 服务名对应的网关
+	services map[string][]him.ServiceRegistration
+	regions  []region
+	max      int
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+// NewRouter max是返回的网关数量上限，为0时使用DefaultMaxGateways
+func NewRouter(regions []Region, max int) (*Router, error) {
+	if max <= 0 {
+		max = DefaultMaxGateways
+	}
+	r := &Router{
+		services: make(map[string][]him.ServiceRegistration),
+		regions:  make([]region, 0, len(regions)),
+		max:      max,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, reg := range regions {
+		_, ipnet, err := net.ParseCIDR(reg.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		r.regions = append(r.regions, region{ipnet: ipnet, Region: reg})
+	}
+	return r, nil
+}
+
+// Watch 加载并订阅ws与tcp网关
+func (r *Router) Watch(ns naming.Naming) error {
+	for _, name := range protocols {
+		name := name
+		services, err := ns.Find(name)
+		if err != nil {
+			return err
+		}
+		r.Update(name, services)
+		err = ns.Subscribe(name, func(services []him.ServiceRegistration) {
+			r.Update(name, services)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update 替换serviceName下的全部网关
+func (r *Router) Update(serviceName string, services []him.ServiceRegistration) {
+	logger.WithField("module", "routing").Infof("%s updated: %d gateways", serviceName, len(services))
+	r.Lock()
+	defer r.Unlock()
+	r.services[serviceName] = services
+}
+
+// Lookup 返回按照优先级排序的网关地址
+// 权重由区域、运营商与连接数决定，同权重的网关之间随机排序，避免客户端集中连接同一个网关
+func (r *Router) Lookup(req *Request) (*Result, error) {
+	if req.Protocol == "" {
+		req.Protocol = "ws"
+	}
+	name, ok := protocols[req.Protocol]
+	if !ok {
+		return nil, ErrUnknownProtocol
+	}
+	result := &Result{Zone: req.Zone, ISP: req.ISP}
+	if reg := r.region(req.IP); reg != nil {
+		if result.Zone == "" {
+			result.Zone = reg.Zone
+		}
+		if result.ISP == "" {
+			result.ISP = reg.ISP
+		}
+	}
+
+	r.RLock()
+	services := r.services[name]
+	r.RUnlock()
+
+	type ranked struct {
+		url string
+		key float64
+	}
+	list := make([]ranked, 0, len(services))
+	r.randLock.Lock()
+	for _, s := range services {
+		tags := parseTags(s.GetTags())
+		if apps, ok := tags[TagApp]; ok && !apps[req.App] {
+			continue
+		}
+		weight := loadWeight(s.GetMeta())
+		if result.Zone != "" && tags[TagZone][result.Zone] {
+			weight *= ZoneWeight
+		}
+		if result.ISP != "" && tags[TagISP][result.ISP] {
+			weight *= ISPWeight
+		}
+		// 加权随机排序：key = u^(1/w)，按照key从大到小排列
+		list = append(list, ranked{url: s.DialURL(), key: math.Pow(r.rand.Float64(), 1/weight)})
+	}
+	r.randLock.Unlock()
+	if len(list) == 0 {
+		return nil, ErrNoGateway
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].key > list[j].key
+	})
+	if len(list) > r.max {
+		list = list[:r.max]
+	}
+	result.Gateways = make([]string, len(list))
+	for i, item := range list {
+		result.Gateways[i] = item.url
+	}
+	return result, nil
+}
+
+func (r *Router) region(ip string) *Region {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	for i := range r.regions {
+		if r.regions[i].ipnet.Contains(addr) {
+			return &r.regions[i].Region
+		}
+	}
+	return nil
+}
+
+// loadWeight 没有上报负载的网关按照空闲处理
+func loadWeight(meta map[string]string) float64 {
+	load, _ := naming.ParseLoad(meta)
+	conns := float64(load.Connections)
+	if conns < 0 {
+		conns = 0
+	}
+	return LoadBase / (LoadBase + conns)
+}
+
+// parseTags 按照前缀分组，如 zone:sh 解析为 tags["zone:"]["sh"]
+func parseTags(list []string) map[string]map[string]bool {
+	tags := make(map[string]map[string]bool, 3)
+	for _, tag := range list {
+		for _, prefix := range []string{TagZone, TagISP, TagApp} {
+			if strings.HasPrefix(tag, prefix) {
+				if tags[prefix] == nil {
+					tags[prefix] = make(map[string]bool)
+				}
+				tags[prefix][strings.TrimPrefix(tag, prefix)] = true
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,76 @@
+package routing
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/stretchr/testify/assert"
+)
+
+func gateway(id string, conns string, tags ...string) him.ServiceRegistration {
+	return &naming.RegisterService{
+		Id:       id,
+		Name:     wire.SNWGateway,
+		Address:  id,
+		Port:     8000,
+		Protocol: "ws",
+		Tags:     tags,
+		Meta:     map[string]string{naming.MetaConnections: conns, naming.MetaLoadTime: "1"},
+	}
+}
+
+func Test_lookup(t *testing.T) {
+	r, err := NewRouter([]Region{{CIDR: "10.0.0.0/8", Zone: "sh", ISP: "ctcc"}}, 2)
+	assert.Nil(t, err)
+	r.rand = rand.New(rand.NewSource(1))
+
+	_, err = r.Lookup(&Request{IP: "10.0.0.1"})
+	assert.Equal(t, ErrNoGateway, err)
+	_, err = r.Lookup(&Request{Protocol: "udp"})
+	assert.Equal(t, ErrUnknownProtocol, err)
+
+	r.Update(wire.SNWGateway, []him.ServiceRegistration{
+		gateway("sh1", "100", "zone:sh", "isp:ctcc"),
+		gateway("sh2", "100", "zone:sh", "isp:cmcc"),
+		gateway("bj1", "0", "zone:bj", "isp:ctcc"),
+		gateway("vip", "0", "zone:sh", "isp:ctcc", "app:vip"),
+	})
+
+	// 根据IP识别区域，专属网关不接入其它应用
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		result, err := r.Lookup(&Request{IP: "10.0.0.1", App: "im"})
+		assert.Nil(t, err)
+		assert.Equal(t, "sh", result.Zone)
+		assert.Equal(t, "ctcc", result.ISP)
+		assert.Len(t, result.Gateways, 2)
+		assert.NotContains(t, result.Gateways, "ws://vip:8000")
+		first[result.Gateways[0]]++
+	}
+	assert.Greater(t, first["ws://sh1:8000"], first["ws://sh2:8000"])
+	assert.Greater(t, first["ws://sh2:8000"], first["ws://bj1:8000"])
+
+	// 客户端指定的区域优先
+	result, err := r.Lookup(&Request{IP: "10.0.0.1", Zone: "bj", App: "im"})
+	assert.Nil(t, err)
+	assert.Equal(t, "bj", result.Zone)
+
+	result, err = r.Lookup(&Request{App: "vip", Zone: "sh", ISP: "ctcc"})
+	assert.Nil(t, err)
+	assert.Contains(t, result.Gateways, "ws://vip:8000")
+
+	// 负载高的网关排在后面
+	r.Update(wire.SNWGateway, []him.ServiceRegistration{
+		gateway("busy", "50000", "zone:sh"),
+		gateway("idle", "10", "zone:sh"),
+	})
+	first = make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		result, _ = r.Lookup(&Request{Zone: "sh"})
+		first[result.Gateways[0]]++
+	}
+	assert.Greater(t, first["ws://idle:8000"], 900)
+}
@@ -2,9 +2,19 @@ package router
 
 import (
 	"context"
+	"net/http"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming/consul"
+	"github.com/chang144/gotalk/internal/him/services/router/conf"
+	"github.com/chang144/gotalk/internal/him/services/router/handler"
+	"github.com/chang144/gotalk/internal/him/services/router/routing"
+	"github.com/chang144/gotalk/internal/him/services/service/database"
+	"github.com/chang144/gotalk/internal/him/storage"
+	"github.com/chang144/gotalk/internal/him/wire/token"
 	"github.com/gin-gonic/gin"
+	"github.com/klintcheng/kim/logger"
 	"github.com/spf13/cobra"
-	"net/http"
 )
 
 const DefaultPath = "../../internal/him/services/router/conf.yaml"
@@ -28,12 +38,108 @@ func NewServerStartCmd(ctx context.Context, version string) *cobra.Command {
 	return cmd
 }
 
-func RunServerStart(ctx context.Context, optS *ServerStartOption, version string) error {
+func RunServerStart(ctx context.Context, opts *ServerStartOption, version string) error {
+	config, err := conf.InitRouterConfig(opts.config)
+	if err != nil {
+		return err
+	}
+	logger.Init(logger.Settings{
+		Level:    config.LogLevel,
+		Filename: "./data/router.log",
+	})
+
+	baseDb, err := database.InitMysqlDb(config.BaseDb)
+	if err != nil {
+		return err
+	}
+	if err = baseDb.AutoMigrate(&database.User{}, &database.Group{}, &database.GroupMember{}); err != nil {
+		return err
+	}
+
+	keys, err := token.NewFileKeyProvider(config.Keys)
+	if err != nil {
+		return err
+	}
+	if config.KeyReloadInterval > 0 {
+		go keys.Watch(ctx, config.KeyReloadInterval)
+	}
+
+	var revocations him.RevocationStorage
+	// 没有配置redis时不推送通知
+	var pushes him.PushQueue
+	var friends him.FriendStorage
+	var sessions *storage.RedisStorage
+	if len(config.Redis.Addrs) > 0 {
+		rdb, err := storage.InitUniversalRedis(config.Redis)
+		if err != nil {
+			return err
+		}
+		revocations = storage.NewRedisRevocationStorage(rdb, config.RevocationTTL)
+		pushes = storage.NewRedisPushQueue(rdb, "")
+		friends = storage.NewRedisFriendStorage(rdb)
+		sessions = storage.NewRedisStorage(rdb)
+	} else {
+		revocations = storage.NewMemoryRevocationStorage()
+	}
+
 	r := gin.Default()
 
 	r.GET("/health", func(c *gin.Context) {
 		c.String(http.StatusOK, "ok")
 	})
 
-	return r.Run(":8080")
+	// 授权服务
+	auth := &handler.AuthHandler{
+		BaseDb:          baseDb,
+		Keys:            keys,
+		Tokens:          token.NewParser(keys, config.Audience),
+		Revocations:     revocations,
+		Audience:        config.Audience,
+		AccessTokenTTL:  config.AccessTokenTTL,
+		RefreshTokenTTL: config.RefreshTokenTTL,
+	}
+	auth.Register(r)
+
+	// 用户管理
+	users := &handler.UserHandler{
+		BaseDb:  baseDb,
+		Pushes:  pushes,
+		Friends: friends,
+	}
+	users.Register(r, handler.Authenticate(auth.Tokens, revocations), handler.AdminAuth(config.AdminKeys))
+
+	// 运维接口需要读取会话并通过推送队列下发
+	if len(config.AdminKeys) > 0 && sessions != nil {
+		admin := &handler.AdminHandler{
+			BaseDb:      baseDb,
+			Sessions:    sessions,
+			Online:      sessions,
+			Pushes:      pushes,
+			Revocations: revocations,
+		}
+		admin.Register(r, handler.AdminAuth(config.AdminKeys))
+	} else {
+		logger.Warn("admin api is disabled, AdminKeys and Redis are required")
+	}
+
+	// 网关路由
+	if config.ConsulURL != "" {
+		router, err := routing.NewRouter(config.Regions, config.MaxGateways)
+		if err != nil {
+			return err
+		}
+		ns, err := consul.NewNaming(config.ConsulURL)
+		if err != nil {
+			return err
+		}
+		if err = router.Watch(ns); err != nil {
+			return err
+		}
+		routes := &handler.RouteHandler{Router: router}
+		routes.Register(r)
+	} else {
+		logger.Warn("gateway routing is disabled, ConsulURL is required")
+	}
+
+	return r.Run(config.Listen)
 }
@@ -33,9 +33,10 @@ type MessageContent struct {
 
 type User struct {
 	Model
-	App      string `gorm:"size:30"`
-	Account  string `gorm:"uniqueIndex;size:60"`
-	Password string `gorm:"size:30"`
+	App     string `gorm:"size:30"`
+	Account string `gorm:"uniqueIndex;size:60"`
+	// Password bcrypt哈希，不保存明文
+	Password string `gorm:"size:100"`
 	Avatar   string `gorm:"size:200"`
 	Nickname string `gorm:"size:20"`
 }
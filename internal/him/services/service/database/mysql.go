@@ -1,11 +1,13 @@
 package database
 
 import (
+	"errors"
 	"log"
 	"os"
 	"strings"
 	"time"
 
+	driver "github.com/go-sql-driver/mysql"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -32,3 +34,12 @@ func InitMysqlDb(dsn string) (*gorm.DB, error) {
 	}
 	return db, nil
 }
+
+// erDupEntry mysql唯一索引冲突的错误码
+const erDupEntry = 1062
+
+// IsDuplicateKey 写入的数据与唯一索引冲突
+func IsDuplicateKey(err error) bool {
+	var e *driver.MySQLError
+	return errors.As(err, &e) && e.Number == erDupEntry
+}
@@ -2,6 +2,8 @@ package him
 
 import (
 	"errors"
+	"time"
+
 	"github.com/chang144/gotalk/internal/him/wire/pkt"
 )
 
@@ -12,8 +14,10 @@ var ErrSessionNil = errors.New("err:session nil")
 type SessionStorage interface {
 	// Add a session
 	Add(session *pkt.Session) error
-	// Delete a session
+	// Delete a session, the location is removed only if it still points at channelId
 	Delete(account string, channelId string) error
+	// Touch refresh the expiration of a session and its location
+	Touch(account string, channelId string) error
 	// Get session by channelId
 	Get(channelId string) (*pkt.Session, error)
 	// GetLocations Get Locations by accounts
@@ -21,3 +25,18 @@ type SessionStorage interface {
 	// GetLocation Get Location by account and device
 	GetLocation(account string, device string) (*Location, error)
 }
+
+// ResumeStorage 定义会话恢复所需的存储
+// 连接断开后会话被挂起，grace内客户端可以使用恢复令牌重新绑定到新的channel
+type ResumeStorage interface {
+	// SaveResumeToken 保存channelId的恢复令牌
+	SaveResumeToken(token string, channelId string) error
+	// Suspend 挂起会话，位置信息已经指向其它channel时直接删除会话并返回false
+	Suspend(account string, channelId string, grace time.Duration) (bool, error)
+	// TakeSuspended 根据恢复令牌取出仍处于挂起状态的会话，令牌只能使用一次
+	TakeSuspended(token string) (*pkt.Session, error)
+	// Buffer 缓存推送给挂起会话的消息，会话已经不存在时返回ErrSessionNil
+	Buffer(channelId string, payload []byte) error
+	// TakeBuffered 取出并清空缓存的消息
+	TakeBuffered(channelId string) ([][]byte, error)
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bytes"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/endian"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/chang144/gotalk/internal/pkg/lru"
+	"github.com/go-redis/redis/v7"
+	"github.com/klintcheng/kim/logger"
+)
+
+// ChannelInvalidate 登录、登出时广播缓存失效通知的redis频道
+const ChannelInvalidate = "login:invalidate"
+
+// DefaultCacheTTL 缓存条目的默认有效期，用于兜底丢失的失效通知
+const DefaultCacheTTL = time.Second * 30
+
+// CachedStorage 在RedisStorage之上增加进程内的LRU缓存
+// 会话与位置信息变更时通过redis pub/sub通知所有逻辑服务清除缓存
+type CachedStorage struct {
+	*RedisStorage
+	sessionCache  *lru.Cache
+	locationCache *lru.Cache
+	pubsub        *redis.PubSub
+
+	// fillLock 保证失效与回填缓存不交错
+	fillLock sync.Mutex
+	// sessionGen locationGen 失效的次数，未命中时在读redis之前记下，
+	// 读完之后次数变化说明期间收到了失效通知，不再回填旧的值
+	sessionGen  generations
+	locationGen generations
+}
+
+// generations 按照key的哈希分段计数，不同的key落在同一段时只会少回填一次
+type generations [256]uint64
+
+func (g *generations) of(key string) *uint64 {
+	return &g[crc32.ChecksumIEEE([]byte(key))%uint32(len(g))]
+}
+
+func (g *generations) load(key string) uint64 {
+	return atomic.LoadUint64(g.of(key))
+}
+
+// fill 从读redis之前到现在没有失效时才写入缓存
+func (s *CachedStorage) fill(cache *lru.Cache, gens *generations, key string, gen uint64, val interface{}) {
+	s.fillLock.Lock()
+	defer s.fillLock.Unlock()
+	if gens.load(key) == gen {
+		cache.Add(key, val)
+	}
+}
+
+// NewCachedStorage size为每类缓存的最大条目数
+func NewCachedStorage(cli redis.UniversalClient, size int, ttl time.Duration) *CachedStorage {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	s := &CachedStorage{
+		RedisStorage:  NewRedisStorage(cli),
+		sessionCache:  lru.New(size, ttl),
+		locationCache: lru.New(size, ttl),
+		pubsub:        cli.Subscribe(ChannelInvalidate),
+	}
+	go s.watch()
+	return s
+}
+
+// Get 读取会话，优先从本地缓存读取
+func (s *CachedStorage) Get(channelId string) (*pkt.Session, error) {
+	if val, ok := s.sessionCache.Get(channelId); ok {
+		return val.(*pkt.Session), nil
+	}
+	gen := s.sessionGen.load(channelId)
+	session, err := s.RedisStorage.Get(channelId)
+	if err != nil {
+		return nil, err
+	}
+	s.fill(s.sessionCache, &s.sessionGen, channelId, gen, session)
+	return session, nil
+}
+
+// GetLocation 读取位置信息，只缓存不区分设备的位置
+func (s *CachedStorage) GetLocation(account string, device string) (*him.Location, error) {
+	if device != "" {
+		return s.RedisStorage.GetLocation(account, device)
+	}
+	if val, ok := s.locationCache.Get(account); ok {
+		return val.(*him.Location), nil
+	}
+	gen := s.locationGen.load(account)
+	loc, err := s.RedisStorage.GetLocation(account, "")
+	if err != nil {
+		return nil, err
+	}
+	s.fill(s.locationCache, &s.locationGen, account, gen, loc)
+	return loc, nil
+}
+
+// GetLocations 批量读取位置信息，只从redis读取未命中缓存的账号
+func (s *CachedStorage) GetLocations(accounts ...string) ([]*him.Location, error) {
+	result := make([]*him.Location, 0, len(accounts))
+	missed := make([]string, 0)
+	for _, account := range accounts {
+		if val, ok := s.locationCache.Get(account); ok {
+			result = append(result, val.(*him.Location))
+			continue
+		}
+		missed = append(missed, account)
+	}
+	if len(missed) > 0 {
+		gens := make([]uint64, len(missed))
+		for i, account := range missed {
+			gens[i] = s.locationGen.load(account)
+		}
+		locs, err := s.RedisStorage.locations(missed...)
+		if err != nil {
+			return nil, err
+		}
+		for i, loc := range locs {
+			if loc == nil {
+				continue
+			}
+			s.fill(s.locationCache, &s.locationGen, missed[i], gens[i], loc)
+			result = append(result, loc)
+		}
+	}
+	if len(result) == 0 {
+		return nil, him.ErrSessionNil
+	}
+	return result, nil
+}
+
+// Add 添加会话并通知其它逻辑服务清除缓存
+func (s *CachedStorage) Add(session *pkt.Session) error {
+	if err := s.RedisStorage.Add(session); err != nil {
+		return err
+	}
+	s.invalidate(session.Account, session.ChannelId)
+	return nil
+}
+
+// Delete 删除会话并通知其它逻辑服务清除缓存
+func (s *CachedStorage) Delete(account string, channelId string) error {
+	if err := s.RedisStorage.Delete(account, channelId); err != nil {
+		return err
+	}
+	s.invalidate(account, channelId)
+	return nil
+}
+
+// Suspend 挂起会话并通知其它逻辑服务清除缓存
+func (s *CachedStorage) Suspend(account string, channelId string, grace time.Duration) (bool, error) {
+	ok, err := s.RedisStorage.Suspend(account, channelId, grace)
+	if err != nil {
+		return false, err
+	}
+	s.invalidate(account, channelId)
+	return ok, nil
+}
+
+// Close 取消订阅失效通知
+func (s *CachedStorage) Close() error {
+	return s.pubsub.Close()
+}
+
+func (s *CachedStorage) invalidate(account string, channelId string) {
+	s.evict(account, channelId)
+
+	buf := new(bytes.Buffer)
+	_ = endian.WriteShortBytes(buf, []byte(account))
+	_ = endian.WriteShortBytes(buf, []byte(channelId))
+	if err := s.cli.Publish(ChannelInvalidate, buf.Bytes()).Err(); err != nil {
+		logger.WithField("module", "CachedStorage").Warn(err)
+	}
+}
+
+func (s *CachedStorage) evict(account string, channelId string) {
+	s.fillLock.Lock()
+	defer s.fillLock.Unlock()
+	atomic.AddUint64(s.locationGen.of(account), 1)
+	atomic.AddUint64(s.sessionGen.of(channelId), 1)
+	s.locationCache.Remove(account)
+	s.sessionCache.Remove(channelId)
+}
+
+// watch 处理其它逻辑服务发出的失效通知
+func (s *CachedStorage) watch() {
+	log := logger.WithFields(logger.Fields{
+		"module": "CachedStorage",
+		"func":   "watch",
+	})
+	for msg := range s.pubsub.Channel() {
+		buf := bytes.NewBufferString(msg.Payload)
+		account, err := endian.ReadShortString(buf)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		channelId, err := endian.ReadShortString(buf)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		s.evict(account, channelId)
+	}
+}
+
+var _ him.SessionStorage = (*CachedStorage)(nil)
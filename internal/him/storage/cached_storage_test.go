@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCachedStorage(t *testing.T, mr *miniredis.Miniredis) *CachedStorage {
+	cli, err := InitRedis(mr.Addr(), "")
+	assert.Nil(t, err)
+	s := NewCachedStorage(cli, 100, time.Minute)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func Test_cached_invalidate(t *testing.T) {
+	mr := miniredis.RunT(t)
+	node1 := newTestCachedStorage(t, mr)
+	node2 := newTestCachedStorage(t, mr)
+
+	_ = node1.RedisStorage.Add(&pkt.Session{ChannelId: "ch1", GateId: "gateway1", Account: "test1"})
+	loc, err := node2.GetLocation("test1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ch1", loc.ChannelId)
+
+	// 命中缓存，不再访问redis
+	mr.Del(KeyLocation("test1", ""))
+	loc, _ = node2.GetLocation("test1", "")
+	assert.Equal(t, "ch1", loc.ChannelId)
+
+	// 其它节点登录后缓存失效
+	_ = node1.Add(&pkt.Session{ChannelId: "ch2", GateId: "gateway2", Account: "test1"})
+	assert.Eventually(t, func() bool {
+		loc, _ := node2.GetLocation("test1", "")
+		return loc != nil && loc.ChannelId == "ch2"
+	}, time.Second, time.Millisecond*10)
+
+	_ = node1.Delete("test1", "ch2")
+	assert.Eventually(t, func() bool {
+		_, err := node2.GetLocation("test1", "")
+		return err == him.ErrSessionNil
+	}, time.Second, time.Millisecond*10)
+}
+
+func Test_cached_locations(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestCachedStorage(t, mr)
+	_ = s.Add(&pkt.Session{ChannelId: "ch1", GateId: "gateway1", Account: "test1"})
+	_ = s.Add(&pkt.Session{ChannelId: "ch2", GateId: "gateway1", Account: "test2"})
+	_, _ = s.GetLocation("test1", "")
+
+	locs, err := s.GetLocations("test1", "test2", "test3")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(locs))
+
+	_, err = s.GetLocations("test3")
+	assert.Equal(t, him.ErrSessionNil, err)
+}
+
+func Test_cached_invalidate_during_read(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestCachedStorage(t, mr)
+	_ = s.RedisStorage.Add(&pkt.Session{ChannelId: "ch1", GateId: "gateway1", Account: "test1"})
+
+	// 读redis的过程中收到失效通知，读到的旧值不写入缓存
+	gen := s.locationGen.load("test1")
+	stale, err := s.RedisStorage.GetLocation("test1", "")
+	assert.Nil(t, err)
+	_ = s.RedisStorage.Add(&pkt.Session{ChannelId: "ch2", GateId: "gateway2", Account: "test1"})
+	s.evict("test1", "ch2")
+	s.fill(s.locationCache, &s.locationGen, "test1", gen, stale)
+
+	loc, err := s.GetLocation("test1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ch2", loc.ChannelId)
+}
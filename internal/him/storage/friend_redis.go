@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/go-redis/redis/v7"
+	"google.golang.org/protobuf/proto"
+)
+
+// FriendRequestExpiresIn 未处理的好友请求保留的时间
+const FriendRequestExpiresIn = time.Hour * 24 * 30
+
+// RedisFriendStorage 基于redis的好友关系与黑名单存储
+// 双方的好友集合属于不同的slot，不能在一个事务中修改
+type RedisFriendStorage struct {
+	cli redis.UniversalClient
+}
+
+func NewRedisFriendStorage(cli redis.UniversalClient) *RedisFriendStorage {
+	return &RedisFriendStorage{cli}
+}
+
+func (r *RedisFriendStorage) AddRequest(app string, to string, req *pkt.FriendRequest) error {
+	bts, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	key := KeyFriendRequests(app, to)
+	pipe := r.cli.TxPipeline()
+	pipe.HSet(key, req.From, bts)
+	pipe.Expire(key, FriendRequestExpiresIn)
+	_, err = pipe.Exec()
+	return err
+}
+
+// takeRequestScript KEYS: requests ARGV: from
+var takeRequestScript = redis.NewScript(`
+local req = redis.call('HGET', KEYS[1], ARGV[1])
+if req then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return req
+`)
+
+func (r *RedisFriendStorage) TakeRequest(app string, account string, from string) (*pkt.FriendRequest, error) {
+	bts, err := takeRequestScript.Run(r.cli, []string{KeyFriendRequests(app, account)}, from).Text()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var req pkt.FriendRequest
+	if err = proto.Unmarshal([]byte(bts), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (r *RedisFriendStorage) Requests(app string, account string) ([]*pkt.FriendRequest, error) {
+	values, err := r.cli.HGetAll(KeyFriendRequests(app, account)).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*pkt.FriendRequest, 0, len(values))
+	for _, v := range values {
+		var req pkt.FriendRequest
+		if err = proto.Unmarshal([]byte(v), &req); err != nil {
+			continue
+		}
+		list = append(list, &req)
+	}
+	return list, nil
+}
+
+func (r *RedisFriendStorage) AddFriend(app string, a string, b string) error {
+	pipe := r.cli.Pipeline()
+	pipe.SAdd(KeyFriends(app, a), b)
+	pipe.SAdd(KeyFriends(app, b), a)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (r *RedisFriendStorage) DeleteFriend(app string, a string, b string) error {
+	pipe := r.cli.Pipeline()
+	pipe.SRem(KeyFriends(app, a), b)
+	pipe.SRem(KeyFriends(app, b), a)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (r *RedisFriendStorage) IsFriend(app string, a string, b string) (bool, error) {
+	return r.cli.SIsMember(KeyFriends(app, a), b).Result()
+}
+
+func (r *RedisFriendStorage) Friends(app string, account string) ([]string, error) {
+	return r.cli.SMembers(KeyFriends(app, account)).Result()
+}
+
+func (r *RedisFriendStorage) Block(app string, account string, target string) error {
+	return r.cli.SAdd(KeyBlocklist(app, account), target).Err()
+}
+
+func (r *RedisFriendStorage) Unblock(app string, account string, target string) error {
+	return r.cli.SRem(KeyBlocklist(app, account), target).Err()
+}
+
+func (r *RedisFriendStorage) IsBlocked(app string, account string, target string) (bool, error) {
+	return r.cli.SIsMember(KeyBlocklist(app, account), target).Result()
+}
+
+func (r *RedisFriendStorage) Blocklist(app string, account string) ([]string, error) {
+	return r.cli.SMembers(KeyBlocklist(app, account)).Result()
+}
+
+var _ him.FriendStorage = (*RedisFriendStorage)(nil)
+
+func KeyFriends(app, account string) string {
+	return fmt.Sprintf("friend:%s:{%s}", app, account)
+}
+
+func KeyFriendRequests(app, account string) string {
+	return fmt.Sprintf("friend:req:%s:{%s}", app, account)
+}
+
+func KeyBlocklist(app, account string) string {
+	return fmt.Sprintf("block:%s:{%s}", app, account)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_friend(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	store := NewRedisFriendStorage(cc.cli)
+
+	assert.Nil(t, store.AddRequest("app", "test2", &pkt.FriendRequest{From: "test1", Message: "hi", Time: 1}))
+	// 同一个账号的请求只保留最新的一条
+	assert.Nil(t, store.AddRequest("app", "test2", &pkt.FriendRequest{From: "test1", Message: "hello", Time: 2}))
+	list, err := store.Requests("app", "test2")
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "hello", list[0].Message)
+
+	req, err := store.TakeRequest("app", "test2", "test1")
+	assert.Nil(t, err)
+	assert.Equal(t, "test1", req.From)
+	req, err = store.TakeRequest("app", "test2", "test1")
+	assert.Nil(t, err)
+	assert.Nil(t, req)
+
+	assert.Nil(t, store.AddFriend("app", "test1", "test2"))
+	ok, _ := store.IsFriend("app", "test2", "test1")
+	assert.True(t, ok)
+	friends, _ := store.Friends("app", "test1")
+	assert.Equal(t, []string{"test2"}, friends)
+
+	assert.Nil(t, store.DeleteFriend("app", "test2", "test1"))
+	ok, _ = store.IsFriend("app", "test1", "test2")
+	assert.False(t, ok)
+
+	// 黑名单是单向的
+	assert.Nil(t, store.Block("app", "test1", "test3"))
+	ok, _ = store.IsBlocked("app", "test1", "test3")
+	assert.True(t, ok)
+	ok, _ = store.IsBlocked("app", "test3", "test1")
+	assert.False(t, ok)
+	assert.Nil(t, store.Unblock("app", "test1", "test3"))
+	blocked, _ := store.Blocklist("app", "test1")
+	assert.Empty(t, blocked)
+}
+
+func Test_friend_cross_app(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	store := NewRedisFriendStorage(cc.cli)
+
+	// 不同app的同名账号是不同的用户
+	assert.Nil(t, store.AddFriend("app1", "test1", "test2"))
+	assert.Nil(t, store.Block("app1", "test2", "test3"))
+	assert.Nil(t, store.AddRequest("app1", "test4", &pkt.FriendRequest{From: "test1", Time: 1}))
+
+	ok, _ := store.IsFriend("app2", "test1", "test2")
+	assert.False(t, ok)
+	friends, _ := store.Friends("app2", "test1")
+	assert.Empty(t, friends)
+	ok, _ = store.IsBlocked("app2", "test2", "test3")
+	assert.False(t, ok)
+	list, _ := store.Requests("app2", "test4")
+	assert.Empty(t, list)
+	req, err := store.TakeRequest("app2", "test4", "test1")
+	assert.Nil(t, err)
+	assert.Nil(t, req)
+
+	ok, _ = store.IsFriend("app1", "test2", "test1")
+	assert.True(t, ok)
+	list, _ = store.Requests("app1", "test4")
+	assert.Len(t, list, 1)
+}
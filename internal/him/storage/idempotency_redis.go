@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/go-redis/redis/v7"
+)
+
+// idempotencyPending 处理中的占位值，真实结果不会为空
+const idempotencyPending = ""
+
+// RedisIdempotencyStorage 基于redis的幂等键存储
+type RedisIdempotencyStorage struct {
+	cli redis.UniversalClient
+}
+
+func NewRedisIdempotencyStorage(cli redis.UniversalClient) *RedisIdempotencyStorage {
+	return &RedisIdempotencyStorage{cli}
+}
+
+func (r *RedisIdempotencyStorage) Acquire(key string, ttl time.Duration) (bool, []byte, error) {
+	k := KeyIdempotency(key)
+	ok, err := r.cli.SetNX(k, idempotencyPending, ttl).Result()
+	if err != nil {
+		return false, nil, err
+	}
+	if ok {
+		return true, nil, nil
+	}
+	result, err := r.cli.Get(k).Bytes()
+	if err == redis.Nil {
+		// 刚好过期或者被释放，交给调用方重试
+		return false, nil, him.ErrIdempotencyPending
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if len(result) == 0 {
+		return false, nil, him.ErrIdempotencyPending
+	}
+	return false, result, nil
+}
+
+func (r *RedisIdempotencyStorage) Complete(key string, result []byte, ttl time.Duration) error {
+	return r.cli.Set(KeyIdempotency(key), result, ttl).Err()
+}
+
+func (r *RedisIdempotencyStorage) Release(key string) error {
+	return r.cli.Del(KeyIdempotency(key)).Err()
+}
+
+var _ him.IdempotencyStorage = (*RedisIdempotencyStorage)(nil)
+
+func KeyIdempotency(key string) string {
+	return fmt.Sprintf("idem:%s", key)
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/go-redis/redis/v7"
+)
+
+// RedisNonceStorage 基于redis的随机数记录
+type RedisNonceStorage struct {
+	cli redis.UniversalClient
+}
+
+func NewRedisNonceStorage(cli redis.UniversalClient) *RedisNonceStorage {
+	return &RedisNonceStorage{cli}
+}
+
+// Claim 记录至少保留HandshakeNonceExpiresIn，过早删除会让仍在时间窗口内的请求可以重放
+func (r *RedisNonceStorage) Claim(nonce string, ttl time.Duration) (bool, error) {
+	if ttl < pkt.HandshakeNonceExpiresIn {
+		ttl = pkt.HandshakeNonceExpiresIn
+	}
+	return r.cli.SetNX(KeyNonce(nonce), 1, ttl).Result()
+}
+
+var _ him.NonceStorage = (*RedisNonceStorage)(nil)
+
+func KeyNonce(nonce string) string {
+	return fmt.Sprintf("nonce:%s", nonce)
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nonce_claim(t *testing.T) {
+	cc, mr := newTestStorage(t)
+	nonces := NewRedisNonceStorage(cc.cli)
+
+	ok, err := nonces.Claim("n1", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// 重放的nonce
+	ok, err = nonces.Claim("n1", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 超过ttl之后时间戳已经不在允许的范围内，记录可以删除
+	mr.FastForward(time.Minute * 2)
+	ok, _ = nonces.Claim("n1", time.Minute)
+	assert.True(t, ok)
+
+	// ttl小于两倍的时间偏差时仍然保留到时间窗口结束
+	ok, _ = nonces.Claim("n2", pkt.MaxHandshakeSkew)
+	assert.True(t, ok)
+	mr.FastForward(pkt.MaxHandshakeSkew + time.Second)
+	ok, _ = nonces.Claim("n2", pkt.MaxHandshakeSkew)
+	assert.False(t, ok)
+	mr.FastForward(pkt.MaxHandshakeSkew)
+	ok, _ = nonces.Claim("n2", pkt.MaxHandshakeSkew)
+	assert.True(t, ok)
+}
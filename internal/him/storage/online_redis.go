@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/go-redis/redis/v7"
+)
+
+// KeyOnlineGateways 有在线连接的网关集合
+const KeyOnlineGateways = "online:gates"
+
+// timeNow 在线索引按照本地时间计算过期，测试时替换
+var timeNow = time.Now
+
+// onlineExpireAt 在线索引中记录的过期时间，与会话的过期时间一致，心跳时刷新
+func onlineExpireAt() int64 {
+	return timeNow().Add(LocationExpired).UnixMilli()
+}
+
+// onlineKeys 在会话脚本中一起更新的在线索引
+// 集群模式下索引与会话不在同一个slot，返回nil，由调用方在脚本之后单独更新
+func (r *RedisStorage) onlineKeys(gateway string) []string {
+	if gateway == "" {
+		return nil
+	}
+	if _, cluster := r.cli.(*redis.ClusterClient); cluster {
+		return nil
+	}
+	return []string{KeyOnline(gateway), KeyOnlineGateways}
+}
+
+// index 把channel加入网关的在线索引
+func (r *RedisStorage) index(gateway string, channelId string, expireAt int64) error {
+	pipe := r.cli.Pipeline()
+	pipe.SAdd(KeyOnlineGateways, gateway)
+	pipe.ZAdd(KeyOnline(gateway), &redis.Z{Score: float64(expireAt), Member: channelId})
+	_, err := pipe.Exec()
+	return err
+}
+
+// reindex 刷新channel在索引中的过期时间，已经不在索引中的不再加入
+func (r *RedisStorage) reindex(channelId string, expireAt int64) error {
+	gateway := gatewayOf(channelId)
+	if gateway == "" {
+		return nil
+	}
+	return r.cli.ZAddXX(KeyOnline(gateway), &redis.Z{Score: float64(expireAt), Member: channelId}).Err()
+}
+
+// unindex 从在线索引中删除channel
+func (r *RedisStorage) unindex(channelId string) error {
+	gateway := gatewayOf(channelId)
+	if gateway == "" {
+		return nil
+	}
+	return r.cli.ZRem(KeyOnline(gateway), channelId).Err()
+}
+
+// CountByGateway 先删除已经过期的记录再计数
+func (r *RedisStorage) CountByGateway() (map[string]int64, error) {
+	gateways, err := r.cli.SMembers(KeyOnlineGateways).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := strconv.FormatInt(timeNow().UnixMilli(), 10)
+	pipe := r.cli.Pipeline()
+	cmds := make([]*redis.IntCmd, len(gateways))
+	for i, gateway := range gateways {
+		pipe.ZRemRangeByScore(KeyOnline(gateway), "-inf", "("+now)
+		cmds[i] = pipe.ZCard(KeyOnline(gateway))
+	}
+	if len(gateways) > 0 {
+		if _, err = pipe.Exec(); err != nil {
+			return nil, err
+		}
+	}
+	result := make(map[string]int64, len(gateways))
+	for i, gateway := range gateways {
+		n := cmds[i].Val()
+		if n == 0 {
+			_ = r.cli.SRem(KeyOnlineGateways, gateway).Err()
+			continue
+		}
+		result[gateway] = n
+	}
+	return result, nil
+}
+
+// ScanOnline 遍历网关上的连接
+// 位置信息已经不指向该channel的记录视为过期，直接从索引中删除
+func (r *RedisStorage) ScanOnline(gateway string, cursor uint64, count int64) ([]*him.OnlineLocation, uint64, error) {
+	key := KeyOnline(gateway)
+	kvs, next, err := r.cli.ZScan(key, cursor, "", count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	channels := make([]string, 0, len(kvs)/2)
+	accounts := make([]string, 0, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		channels = append(channels, kvs[i])
+		accounts = append(accounts, accountOf(kvs[i]))
+	}
+	locs, err := r.locations(accounts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	result := make([]*him.OnlineLocation, 0, len(channels))
+	stale := make([]string, 0)
+	for i, loc := range locs {
+		if loc == nil || loc.ChannelId != channels[i] || loc.GateId != gateway {
+			stale = append(stale, channels[i])
+			continue
+		}
+		result = append(result, &him.OnlineLocation{Account: accounts[i], Location: *loc})
+	}
+	if len(stale) > 0 {
+		members := make([]interface{}, len(stale))
+		for i, channel := range stale {
+			members[i] = channel
+		}
+		_ = r.cli.ZRem(key, members...).Err()
+	}
+	return result, next, nil
+}
+
+var _ him.OnlineStorage = (*RedisStorage)(nil)
+
+// KeyOnline 网关的在线索引，channelId按照过期时间排序
+func KeyOnline(gateway string) string {
+	return fmt.Sprintf("online:gw:%s", gateway)
+}
+
+// gatewayOf 从网关生成的channelId中取出网关ID，格式为gateway_{account}_seq
+func gatewayOf(channelId string) string {
+	i := strings.Index(channelId, "_{")
+	if i < 0 {
+		return ""
+	}
+	return channelId[:i]
+}
+
+// accountOf 从网关生成的channelId中取出账号
+func accountOf(channelId string) string {
+	start := strings.IndexByte(channelId, '{')
+	end := strings.LastIndexByte(channelId, '}')
+	if start < 0 || end <= start {
+		return ""
+	}
+	return channelId[start+1 : end]
+}
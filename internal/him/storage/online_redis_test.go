@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_online_index(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	for _, s := range []*pkt.Session{
+		{ChannelId: "gw1_{test1}_1", GateId: "gw1", Account: "test1"},
+		{ChannelId: "gw1_{test2}_2", GateId: "gw1", Account: "test2"},
+		{ChannelId: "gw2_{test3}_3", GateId: "gw2", Account: "test3"},
+	} {
+		assert.Nil(t, cc.Add(s))
+	}
+	counts, err := cc.CountByGateway()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"gw1": 2, "gw2": 1}, counts)
+
+	list, next, err := cc.ScanOnline("gw1", 0, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), next)
+	assert.Len(t, list, 2)
+
+	assert.Nil(t, cc.Delete("test3", "gw2_{test3}_3"))
+	_, err = cc.Suspend("test2", "gw1_{test2}_2", time.Minute)
+	assert.Nil(t, err)
+	counts, _ = cc.CountByGateway()
+	assert.Equal(t, map[string]int64{"gw1": 1}, counts)
+
+	// 新的登录覆盖了位置信息，旧连接的记录在遍历时清除
+	assert.Nil(t, cc.Add(&pkt.Session{ChannelId: "gw2_{test1}_4", GateId: "gw2", Account: "test1"}))
+	list, _, err = cc.ScanOnline("gw1", 0, 100)
+	assert.Nil(t, err)
+	assert.Empty(t, list)
+	counts, _ = cc.CountByGateway()
+	assert.Equal(t, map[string]int64{"gw2": 1}, counts)
+
+	// 没有心跳的会话过期之后不再计数，心跳刷新的会话仍然在线
+	assert.Nil(t, cc.Add(&pkt.Session{ChannelId: "gw1_{test4}_5", GateId: "gw1", Account: "test4"}))
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now.Add(LocationExpired / 2) }
+	assert.Nil(t, cc.Touch("test1", "gw2_{test1}_4"))
+	timeNow = func() time.Time { return now.Add(LocationExpired + time.Minute) }
+	counts, _ = cc.CountByGateway()
+	assert.Equal(t, map[string]int64{"gw2": 1}, counts)
+}
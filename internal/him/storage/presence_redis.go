@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/go-redis/redis/v7"
+)
+
+// RedisPresenceStorage 基于redis的在线状态存储
+// 与RedisStorage共用位置信息，账号有位置信息即为在线
+type RedisPresenceStorage struct {
+	cli redis.UniversalClient
+}
+
+func NewRedisPresenceStorage(cli redis.UniversalClient) *RedisPresenceStorage {
+	return &RedisPresenceStorage{cli}
+}
+
+func (r *RedisPresenceStorage) MarkAway(account string, channelId string, ttl time.Duration) error {
+	return r.cli.Set(KeyPresenceAway(account), channelId, ttl).Err()
+}
+
+// expireAwayScript KEYS: away, location ARGV: channelId
+// 挂起状态的位置信息以2个字节的空网关结尾，视为不在线
+var expireAwayScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+local loc = redis.call('GET', KEYS[2])
+if loc and string.sub(loc, -2) ~= '\0\0' then
+	return 0
+end
+return 1
+`)
+
+func (r *RedisPresenceStorage) ExpireAway(account string, channelId string) (bool, error) {
+	keys := []string{KeyPresenceAway(account), KeyLocation(account, "")}
+	n, err := expireAwayScript.Run(r.cli, keys, channelId).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (r *RedisPresenceStorage) ClearAway(account string) (bool, error) {
+	n, err := r.cli.Del(KeyPresenceAway(account)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetPresences 批量查询在线状态
+// 有未挂起的位置信息为Online，只有离开标记为Away，否则为Offline
+func (r *RedisPresenceStorage) GetPresences(accounts ...string) ([]*pkt.Presence, error) {
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+	pipe := r.cli.Pipeline()
+	locs := make([]*redis.StringCmd, len(accounts))
+	aways := make([]*redis.IntCmd, len(accounts))
+	for i, account := range accounts {
+		locs[i] = pipe.Get(KeyLocation(account, ""))
+		aways[i] = pipe.Exists(KeyPresenceAway(account))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	result := make([]*pkt.Presence, len(accounts))
+	for i, account := range accounts {
+		status := pkt.PresenceStatus_Offline
+		var loc him.Location
+		if err := loc.Unmarshal([]byte(locs[i].Val())); err == nil && !loc.Suspended() {
+			status = pkt.PresenceStatus_Online
+		} else if aways[i].Val() > 0 {
+			status = pkt.PresenceStatus_Away
+		}
+		result[i] = &pkt.Presence{Account: account, Status: status}
+	}
+	return result, nil
+}
+
+// Subscribe 订阅关系双向保存，便于下线时取消全部订阅
+func (r *RedisPresenceStorage) Subscribe(subscriber string, accounts ...string) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+	pipe := r.cli.Pipeline()
+	members := make([]interface{}, len(accounts))
+	for i, account := range accounts {
+		pipe.SAdd(KeyPresenceSubscribers(account), subscriber)
+		members[i] = account
+	}
+	pipe.SAdd(KeyPresenceWatching(subscriber), members...)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (r *RedisPresenceStorage) Unsubscribe(subscriber string, accounts ...string) error {
+	watchKey := KeyPresenceWatching(subscriber)
+	if len(accounts) == 0 {
+		var err error
+		accounts, err = r.cli.SMembers(watchKey).Result()
+		if err != nil {
+			return err
+		}
+	}
+	pipe := r.cli.Pipeline()
+	members := make([]interface{}, len(accounts))
+	for i, account := range accounts {
+		pipe.SRem(KeyPresenceSubscribers(account), subscriber)
+		members[i] = account
+	}
+	if len(members) > 0 {
+		pipe.SRem(watchKey, members...)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (r *RedisPresenceStorage) Subscribers(account string) ([]string, error) {
+	return r.cli.SMembers(KeyPresenceSubscribers(account)).Result()
+}
+
+var _ him.PresenceStorage = (*RedisPresenceStorage)(nil)
+
+func KeyPresenceAway(account string) string {
+	return fmt.Sprintf("presence:away:{%s}", account)
+}
+
+func KeyPresenceSubscribers(account string) string {
+	return fmt.Sprintf("presence:sub:{%s}", account)
+}
+
+func KeyPresenceWatching(subscriber string) string {
+	return fmt.Sprintf("presence:watch:{%s}", subscriber)
+}
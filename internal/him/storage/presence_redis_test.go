@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_presence(t *testing.T) {
+	cc, mr := newTestStorage(t)
+	ps := NewRedisPresenceStorage(cc.cli)
+
+	_ = cc.Add(&pkt.Session{ChannelId: "ch1", GateId: "gateway1", Account: "test1"})
+	_ = ps.MarkAway("test2", "ch2", time.Minute)
+
+	list, err := ps.GetPresences("test1", "test2", "test3")
+	assert.Nil(t, err)
+	assert.Equal(t, pkt.PresenceStatus_Online, list[0].Status)
+	assert.Equal(t, pkt.PresenceStatus_Away, list[1].Status)
+	assert.Equal(t, pkt.PresenceStatus_Offline, list[2].Status)
+
+	mr.FastForward(time.Minute)
+	list, _ = ps.GetPresences("test2")
+	assert.Equal(t, pkt.PresenceStatus_Offline, list[0].Status)
+}
+
+func Test_presence_expire_away(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	ps := NewRedisPresenceStorage(cc.cli)
+
+	// 断开后又断开，只有最后一次断开的channel能够让账号下线
+	_ = ps.MarkAway("test1", "ch1", time.Minute)
+	_ = ps.MarkAway("test1", "ch2", time.Minute)
+	gone, err := ps.ExpireAway("test1", "ch1")
+	assert.Nil(t, err)
+	assert.False(t, gone)
+	gone, _ = ps.ExpireAway("test1", "ch2")
+	assert.True(t, gone)
+
+	// 重新登录之后不会下线
+	_ = ps.MarkAway("test1", "ch3", time.Minute)
+	_ = cc.Add(&pkt.Session{ChannelId: "ch4", GateId: "gateway1", Account: "test1"})
+	gone, _ = ps.ExpireAway("test1", "ch3")
+	assert.False(t, gone)
+}
+
+func Test_presence_subscribe(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	ps := NewRedisPresenceStorage(cc.cli)
+
+	_ = ps.Subscribe("test1", "test2", "test3")
+	_ = ps.Subscribe("test4", "test2")
+	subs, err := ps.Subscribers("test2")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"test1", "test4"}, subs)
+
+	err = ps.Unsubscribe("test1")
+	assert.Nil(t, err)
+	subs, _ = ps.Subscribers("test2")
+	assert.Equal(t, []string{"test4"}, subs)
+	subs, _ = ps.Subscribers("test3")
+	assert.Empty(t, subs)
+}
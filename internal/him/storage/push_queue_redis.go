@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/go-redis/redis/v7"
+	"github.com/klintcheng/kim/logger"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// StreamPush 推送队列使用的redis stream
+	StreamPush = "push:queue"
+	// GroupPush 所有逻辑服务共用一个消费组，保证每条消息只投递一次
+	GroupPush = "logic"
+	// MaxPushQueueLen stream保留的最大消息数
+	MaxPushQueueLen = 100000
+	// PushReclaimIdle 消息读取之后超过这个时间没有确认时，由消费者重新认领处理
+	PushReclaimIdle = time.Minute
+	// MaxPushDeliveries 消息最多投递的次数，超过之后确认并丢弃
+	MaxPushDeliveries = 10
+	// pushBacklogScan 无法读取lag时最多统计的未读取消息数
+	pushBacklogScan = 10000
+)
+
+// RedisPushQueue 基于redis stream的推送队列
+type RedisPushQueue struct {
+	cli      redis.UniversalClient
+	consumer string
+	// block 每次读取的最长等待时间
+	block time.Duration
+	// reclaimIdle 认领其它消费者或者上次运行遗留的未确认消息的空闲时间
+	reclaimIdle time.Duration
+}
+
+// NewRedisPushQueue consumer为消费者名称，重启之后需要保持不变，通常使用服务ID
+// 只发布消息时可以为空
+func NewRedisPushQueue(cli redis.UniversalClient, consumer string) *RedisPushQueue {
+	if consumer == "" {
+		consumer = ksuid.New().String()
+	}
+	return &RedisPushQueue{
+		cli:         cli,
+		consumer:    consumer,
+		block:       time.Second * 5,
+		reclaimIdle: PushReclaimIdle,
+	}
+}
+
+func (q *RedisPushQueue) Publish(accounts []string, packet *pkt.LogicPkt) error {
+	return q.cli.XAdd(&redis.XAddArgs{
+		Stream:       StreamPush,
+		MaxLenApprox: MaxPushQueueLen,
+		Values: map[string]interface{}{
+			"accounts": strings.Join(accounts, ","),
+			"packet":   pkt.Marshal(packet),
+		},
+	}).Err()
+}
+
+func (q *RedisPushQueue) Consume(ctx context.Context, handler func(accounts []string, packet *pkt.LogicPkt) error) error {
+	log := logger.WithFields(logger.Fields{
+		"module":   "RedisPushQueue",
+		"consumer": q.consumer,
+	})
+	err := q.cli.XGroupCreateMkStream(StreamPush, GroupPush, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	var reclaimed time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		// 处理失败、消费者退出之后遗留的消息
+		if time.Since(reclaimed) >= q.reclaimIdle {
+			if err = q.reclaim(handler); err != nil {
+				log.Warn(err)
+			}
+			reclaimed = time.Now()
+		}
+		streams, err := q.cli.XReadGroup(&redis.XReadGroupArgs{
+			Group:    GroupPush,
+			Consumer: q.consumer,
+			Streams:  []string{StreamPush, ">"},
+			Count:    100,
+			Block:    q.block,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Warn(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				q.process(msg, handler)
+			}
+		}
+	}
+}
+
+// process 处理成功之后确认，失败的消息留在PEL中等待重新认领
+func (q *RedisPushQueue) process(msg redis.XMessage, handler func(accounts []string, packet *pkt.LogicPkt) error) {
+	if err := q.handle(msg, handler); err != nil {
+		logger.WithFields(logger.Fields{
+			"module":   "RedisPushQueue",
+			"consumer": q.consumer,
+		}).Warnf("handle %s: %v", msg.ID, err)
+		return
+	}
+	_ = q.cli.XAck(StreamPush, GroupPush, msg.ID).Err()
+}
+
+// reclaim 认领空闲超过reclaimIdle的未确认消息并重新处理，投递次数过多的消息直接确认
+func (q *RedisPushQueue) reclaim(handler func(accounts []string, packet *pkt.LogicPkt) error) error {
+	pending, err := q.cli.XPendingExt(&redis.XPendingExtArgs{
+		Stream: StreamPush,
+		Group:  GroupPush,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	ids := make([]string, 0, len(pending))
+	for _, p := range pending {
+		if p.Idle < q.reclaimIdle {
+			continue
+		}
+		if p.RetryCount >= MaxPushDeliveries {
+			logger.WithField("module", "RedisPushQueue").Warnf("drop %s after %d deliveries", p.ID, p.RetryCount)
+			_ = q.cli.XAck(StreamPush, GroupPush, p.ID).Err()
+			continue
+		}
+		ids = append(ids, p.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	// 多个消费者同时认领时，MinIdle保证只有一个成功
+	msgs, err := q.cli.XClaim(&redis.XClaimArgs{
+		Stream:   StreamPush,
+		Group:    GroupPush,
+		Consumer: q.consumer,
+		MinIdle:  q.reclaimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	for _, msg := range msgs {
+		q.process(msg, handler)
+	}
+	return nil
+}
+
+func (q *RedisPushQueue) handle(msg redis.XMessage, handler func(accounts []string, packet *pkt.LogicPkt) error) error {
+	accounts, _ := msg.Values["accounts"].(string)
+	payload, _ := msg.Values["packet"].(string)
+	packet, err := pkt.MustReadLogicPkt(bytes.NewBufferString(payload))
+	if err != nil {
+		// 无法解析的消息直接确认，避免反复消费
+		logger.WithField("module", "RedisPushQueue").Warn(err)
+		return nil
+	}
+	// 广播消息没有指定账号
+	var list []string
+	if accounts != "" {
+		list = strings.Split(accounts, ",")
+	}
+	return handler(list, packet)
+}
+
+// Pending 消费组积压的消息数，包括还没有读取的和已经读取但没有确认的
+func (q *RedisPushQueue) Pending() (int64, error) {
+	// go-redis v7的XInfoGroups无法解析redis 7返回的entries-read与lag字段，这里自己解析
+	reply, err := q.cli.Do("XINFO", "GROUPS", StreamPush).Result()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "ERR no such key") {
+			return 0, nil
+		}
+		return 0, err
+	}
+	groups, _ := reply.([]interface{})
+	for _, g := range groups {
+		fields, _ := g.([]interface{})
+		info := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := fields[i].(string)
+			info[key] = fields[i+1]
+		}
+		if info["name"] != GroupPush {
+			continue
+		}
+		pending, _ := info["pending"].(int64)
+		// entries-read为空时消费组还没有读取过，lag不一定准确
+		if _, read := info["entries-read"].(int64); read {
+			if lag, ok := info["lag"].(int64); ok {
+				return pending + lag, nil
+			}
+		}
+		// redis 7之前没有lag，或者lag无法计算时，统计最后投递的消息之后的条数
+		last, _ := info["last-delivered-id"].(string)
+		unread, err := q.unread(last)
+		if err != nil {
+			return 0, err
+		}
+		return pending + unread, nil
+	}
+	return 0, nil
+}
+
+// unread 统计last之后的消息数，最多统计pushBacklogScan条
+func (q *RedisPushQueue) unread(last string) (int64, error) {
+	msgs, err := q.cli.XRangeN(StreamPush, last, "+", pushBacklogScan+1).Result()
+	if err != nil {
+		return 0, err
+	}
+	n := int64(len(msgs))
+	if n > 0 && msgs[0].ID == last {
+		n--
+	}
+	return n, nil
+}
+
+var _ him.PushQueue = (*RedisPushQueue)(nil)
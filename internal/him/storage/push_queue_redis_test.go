@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_push_queue(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type delivery struct {
+		accounts []string
+		packet   *pkt.LogicPkt
+	}
+	delivered := make(chan delivery, 4)
+	handler := func(accounts []string, packet *pkt.LogicPkt) error {
+		delivered <- delivery{accounts, packet}
+		return nil
+	}
+	// 两个消费者属于同一个消费组，每条消息只会被其中一个处理
+	for i := 0; i < 2; i++ {
+		q := NewRedisPushQueue(cc.cli, fmt.Sprintf("logic0%d", i))
+		q.block = time.Millisecond * 50
+		go func() {
+			_ = q.Consume(ctx, handler)
+		}()
+	}
+
+	p := pkt.New(wire.CommandUserProfileNotify)
+	p.WriteBody(&pkt.UserProfileNotify{Account: "test1", Nickname: "nick"})
+	assert.Nil(t, NewRedisPushQueue(cc.cli, "").Publish([]string{"test2", "test3"}, p))
+
+	select {
+	case got := <-delivered:
+		assert.Equal(t, []string{"test2", "test3"}, got.accounts)
+		assert.Equal(t, wire.CommandUserProfileNotify, got.packet.Command)
+		var body pkt.UserProfileNotify
+		assert.Nil(t, got.packet.ReadBody(&body))
+		assert.Equal(t, "nick", body.Nickname)
+	case <-time.After(time.Second * 2):
+		t.Fatal("packet not delivered")
+	}
+	select {
+	case <-delivered:
+		t.Fatal("packet delivered twice")
+	case <-time.After(time.Millisecond * 300):
+	}
+}
+
+func Test_push_queue_reclaim(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 第一个消费者处理失败后退出，消息留在它的PEL中
+	failed := make(chan struct{}, 1)
+	q1 := NewRedisPushQueue(cc.cli, "logic01")
+	q1.block = time.Millisecond * 50
+	ctx1, cancel1 := context.WithCancel(ctx)
+	go func() {
+		_ = q1.Consume(ctx1, func([]string, *pkt.LogicPkt) error {
+			failed <- struct{}{}
+			return errors.New("gateway unavailable")
+		})
+	}()
+	assert.Nil(t, q1.Publish([]string{"test1"}, pkt.New(wire.CommandUserProfileNotify)))
+	select {
+	case <-failed:
+	case <-time.After(time.Second * 2):
+		t.Fatal("packet not delivered")
+	}
+	cancel1()
+
+	// 空闲超过reclaimIdle之后由其它消费者认领
+	delivered := make(chan []string, 1)
+	q2 := NewRedisPushQueue(cc.cli, "logic02")
+	q2.block = time.Millisecond * 50
+	q2.reclaimIdle = time.Millisecond * 100
+	go func() {
+		_ = q2.Consume(ctx, func(accounts []string, _ *pkt.LogicPkt) error {
+			delivered <- accounts
+			return nil
+		})
+	}()
+	select {
+	case accounts := <-delivered:
+		assert.Equal(t, []string{"test1"}, accounts)
+	case <-time.After(time.Second * 2):
+		t.Fatal("packet not reclaimed")
+	}
+	assert.Eventually(t, func() bool {
+		pending, _ := cc.cli.XPending(StreamPush, GroupPush).Result()
+		return pending != nil && pending.Count == 0
+	}, time.Second, time.Millisecond*10)
+}
+
+func Test_push_queue_pending(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	q := NewRedisPushQueue(cc.cli, "logic01")
+	n, err := q.Pending()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, n)
+
+	assert.Nil(t, cc.cli.XGroupCreateMkStream(StreamPush, GroupPush, "0").Err())
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, q.Publish([]string{"test1"}, pkt.New(wire.CommandUserProfileNotify)))
+	}
+	// 还没有被任何消费者读取的消息也算积压
+	n, err = q.Pending()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, n)
+
+	// 其它消费者读取但没有确认的消息仍然算积压，确认之后减少
+	streams, err := cc.cli.XReadGroup(&redis.XReadGroupArgs{
+		Group:    GroupPush,
+		Consumer: "logic02",
+		Streams:  []string{StreamPush, ">"},
+		Count:    2,
+	}).Result()
+	assert.Nil(t, err)
+	n, _ = q.Pending()
+	assert.EqualValues(t, 3, n)
+	assert.Nil(t, cc.cli.XAck(StreamPush, GroupPush, streams[0].Messages[0].ID).Err())
+	n, _ = q.Pending()
+	assert.EqualValues(t, 2, n)
+
+	// 没有lag时按照最后投递的消息统计
+	unread, err := q.unread(streams[0].Messages[1].ID)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, unread)
+}
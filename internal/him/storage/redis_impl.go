@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/chang144/gotalk/internal/him"
@@ -50,27 +53,219 @@ func InitFailoverRedis(masterName string, sentinelAddrs []string, password strin
 	return redisdb, nil
 }
 
+// addScript KEYS: location, session, [online, online gateways] ARGV: location, session, ttl(s), expireAt(ms), gateway, channelId
+var addScript = redis.NewScript(`
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[3])
+redis.call('SET', KEYS[2], ARGV[2], 'EX', ARGV[3])
+if KEYS[3] then
+	redis.call('ZADD', KEYS[3], ARGV[4], ARGV[6])
+	redis.call('SADD', KEYS[4], ARGV[5])
+end
+return 1
+`)
+
+// locOwnedBy 判断位置信息是否属于ARGV[1]中的channel
+// him.Location的编码以2字节长度+ChannelId开头
+const locOwnedBy = `
+local function owned(loc)
+	if not loc then
+		return false
+	end
+	local n = string.byte(loc, 1) * 256 + string.byte(loc, 2)
+	return string.sub(loc, 3, 2 + n) == ARGV[1]
+end
+`
+
+// delScript KEYS: location, session, [online] ARGV: channelId
+var delScript = redis.NewScript(locOwnedBy + `
+if owned(redis.call('GET', KEYS[1])) then
+	redis.call('DEL', KEYS[1])
+end
+if KEYS[3] then
+	redis.call('ZREM', KEYS[3], ARGV[1])
+end
+return redis.call('DEL', KEYS[2])
+`)
+
+// touchScript KEYS: location, session, [online] ARGV: channelId, ttl(s), expireAt(ms)
+var touchScript = redis.NewScript(locOwnedBy + `
+if redis.call('EXPIRE', KEYS[2], ARGV[2]) == 0 then
+	return 0
+end
+if owned(redis.call('GET', KEYS[1])) then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+if KEYS[3] then
+	redis.call('ZADD', KEYS[3], 'XX', ARGV[3], ARGV[1])
+end
+return 1
+`)
+
+// redis 部署模式
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+// RedisOptions redis连接选项
+type RedisOptions struct {
+	// Mode standalone, sentinel or cluster
+	Mode string
+	// Addrs 单机地址，哨兵地址列表或者集群种子节点
+	Addrs []string
+	// MasterName 哨兵模式下的master名称
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+	Timeout          time.Duration
+	TLS              TLSOptions
+}
+
+// TLSOptions redis TLS选项，Enable为false时使用明文连接
+type TLSOptions struct {
+	Enable             bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// InitUniversalRedis 根据Mode创建单机、哨兵或者集群客户端
+func InitUniversalRedis(opts RedisOptions) (redis.UniversalClient, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("redis addrs is empty")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second * 5
+	}
+	tlsConfig, err := opts.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	var cli redis.UniversalClient
+	switch opts.Mode {
+	case RedisModeStandalone, "":
+		cli = redis.NewClient(&redis.Options{
+			Addr:         opts.Addrs[0],
+			Username:     opts.Username,
+			Password:     opts.Password,
+			DB:           opts.DB,
+			DialTimeout:  time.Second * 5,
+			ReadTimeout:  opts.Timeout,
+			WriteTimeout: opts.Timeout,
+			TLSConfig:    tlsConfig,
+		})
+	case RedisModeSentinel:
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("redis master name is required in sentinel mode")
+		}
+		cli = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.MasterName,
+			SentinelAddrs:    opts.Addrs,
+			SentinelPassword: opts.SentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			DB:               opts.DB,
+			DialTimeout:      time.Second * 5,
+			ReadTimeout:      opts.Timeout,
+			WriteTimeout:     opts.Timeout,
+			TLSConfig:        tlsConfig,
+		})
+	case RedisModeCluster:
+		cli = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        opts.Addrs,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			DialTimeout:  time.Second * 5,
+			ReadTimeout:  opts.Timeout,
+			WriteTimeout: opts.Timeout,
+			TLSConfig:    tlsConfig,
+		})
+	default:
+		return nil, fmt.Errorf("unknown redis mode: %s", opts.Mode)
+	}
+
+	if err := cli.Ping().Err(); err != nil {
+		_ = cli.Close()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// Config 构建tls.Config，未启用时返回nil
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if !o.Enable {
+		return nil, nil
+	}
+	conf := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", o.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
 type RedisStorage struct {
-	cli *redis.Client
+	cli redis.UniversalClient
 }
 
-func NewRedisStorage(cli *redis.Client) *RedisStorage {
+func NewRedisStorage(cli redis.UniversalClient) *RedisStorage {
 	return &RedisStorage{cli}
 }
 
+// Delete 删除会话
+// 只有当位置信息仍然指向channelId时才删除位置信息，避免旧连接的登出覆盖新登录
 func (r *RedisStorage) Delete(account string, channelId string) error {
-	locKey := KeyLocation(account, "")
-	err := r.cli.Del(locKey).Err()
-	if err != nil {
+	online := r.onlineKeys(gatewayOf(channelId))
+	keys := append([]string{KeyLocation(account, ""), KeySession(channelId)}, online...)
+	if err := delScript.Run(r.cli, keys, channelId).Err(); err != nil {
 		return err
 	}
+	if online != nil {
+		return nil
+	}
+	return r.unindex(channelId)
+}
 
-	snKey := KeySession(channelId)
-	err = r.cli.Del(snKey).Err()
+// Touch 刷新会话与位置信息的过期时间，由心跳驱动
+// 位置信息已经指向其它channel时只刷新会话本身
+func (r *RedisStorage) Touch(account string, channelId string) error {
+	online := r.onlineKeys(gatewayOf(channelId))
+	keys := append([]string{KeyLocation(account, ""), KeySession(channelId)}, online...)
+	expireAt := onlineExpireAt()
+	n, err := touchScript.Run(r.cli, keys, channelId, int64(LocationExpired/time.Second), expireAt).Int()
 	if err != nil {
 		return err
 	}
-	return nil
+	if n == 0 {
+		return him.ErrSessionNil
+	}
+	if online != nil {
+		return nil
+	}
+	return r.reindex(channelId, expireAt)
 }
 
 // Get GetByID to get session by sessionID
@@ -83,23 +278,41 @@ func (r *RedisStorage) Get(channelId string) (*pkt.Session, error) {
 		}
 		return nil, err
 	}
-	var session *pkt.Session
-	err = proto.Unmarshal(bytes, session)
+	var session pkt.Session
+	err = proto.Unmarshal(bytes, &session)
 	if err != nil {
 		return nil, err
 	}
-	return session, nil
+	return &session, nil
 }
 
 // GetLocations 批量读取位置信息
 func (r *RedisStorage) GetLocations(account ...string) ([]*him.Location, error) {
-	keys := KeyLocations(account...)
-	list, err := r.cli.MGet(keys...).Result()
+	locs, err := r.locations(account...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*him.Location, 0, len(locs))
+	for _, loc := range locs {
+		if loc != nil {
+			result = append(result, loc)
+		}
+	}
+	if len(result) == 0 {
+		return nil, him.ErrSessionNil
+	}
+	return result, nil
+}
+
+// locations 返回与accounts一一对应的位置信息，不在线的账号为nil
+func (r *RedisStorage) locations(accounts ...string) ([]*him.Location, error) {
+	keys := KeyLocations(accounts...)
+	list, err := r.mget(keys)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]*him.Location, 0)
-	for _, l := range list {
+	result := make([]*him.Location, len(list))
+	for i, l := range list {
 		if l == nil {
 			continue
 		}
@@ -108,14 +321,47 @@ func (r *RedisStorage) GetLocations(account ...string) ([]*him.Location, error)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, &loc)
-	}
-	if len(result) == 0 {
-		return nil, him.ErrSessionNil
+		result[i] = &loc
 	}
 	return result, nil
 }
 
+// mget 集群模式下MGet不能跨slot，按slot拆分后通过pipeline读取
+// 返回值的顺序与keys一致
+func (r *RedisStorage) mget(keys []string) ([]interface{}, error) {
+	if _, ok := r.cli.(*redis.ClusterClient); !ok {
+		return r.cli.MGet(keys...).Result()
+	}
+	slots := make(map[int][]int)
+	for i, key := range keys {
+		slot := Slot(key)
+		slots[slot] = append(slots[slot], i)
+	}
+	pipe := r.cli.Pipeline()
+	cmds := make(map[*redis.SliceCmd][]int, len(slots))
+	for _, idx := range slots {
+		group := make([]string, len(idx))
+		for i, j := range idx {
+			group[i] = keys[j]
+		}
+		cmds[pipe.MGet(group...)] = idx
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	list := make([]interface{}, len(keys))
+	for cmd, idx := range cmds {
+		vals, err := cmd.Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, j := range idx {
+			list[j] = vals[i]
+		}
+	}
+	return list, nil
+}
+
 func (r *RedisStorage) GetLocation(account string, device string) (*him.Location, error) {
 	key := KeyLocation(account, device)
 	bytes, err := r.cli.Get(key).Bytes()
@@ -131,41 +377,39 @@ func (r *RedisStorage) GetLocation(account string, device string) (*him.Location
 }
 
 // Add 添加会话
+// 位置信息、会话与在线索引在同一个脚本中写入，保证原子性
 func (r *RedisStorage) Add(session *pkt.Session) error {
-	// 保存 him.location
 	loc := him.Location{
 		ChannelId: session.ChannelId,
 		GateId:    session.GateId,
 	}
-	locKey := KeyLocation(session.Account, "")
-	err := r.cli.Set(locKey, loc.Bytes(), LocationExpired).Err()
-	if err != nil {
-		return err
-	}
-	// save session
-	snKey := KeySession(session.ChannelId)
 	buf, err := proto.Marshal(session)
 	if err != nil {
 		return err
 	}
-	err = r.cli.Set(snKey, buf, LocationExpired).Err()
-	if err != nil {
+	online := r.onlineKeys(session.GateId)
+	keys := append([]string{KeyLocation(session.Account, ""), KeySession(session.ChannelId)}, online...)
+	expireAt := onlineExpireAt()
+	err = addScript.Run(r.cli, keys, loc.Bytes(), buf, int64(LocationExpired/time.Second), expireAt, session.GateId, session.ChannelId).Err()
+	if err != nil || online != nil {
 		return err
 	}
-	return nil
+	return r.index(session.GateId, session.ChannelId, expireAt)
 }
 
 var _ him.SessionStorage = (*RedisStorage)(nil)
 
+// KeySession 会话key
+// 网关生成的channelId中带有{account}的hash-tag，集群模式下与位置信息落在同一个slot
 func KeySession(channel string) string {
 	return fmt.Sprintf("login:sn:%s", channel)
 }
 
 func KeyLocation(account, device string) string {
 	if device == "" {
-		return fmt.Sprintf("login:loc:%s", account)
+		return fmt.Sprintf("login:loc:{%s}", account)
 	}
-	return fmt.Sprintf("login:loc:%s:%s", account, device)
+	return fmt.Sprintf("login:loc:{%s}:%s", account, device)
 }
 
 func KeyLocations(accounts ...string) []string {
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStorage(t *testing.T) (*RedisStorage, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	cli, err := InitRedis(mr.Addr(), "")
+	assert.Nil(t, err)
+	return NewRedisStorage(cli), mr
+}
+
+func Test_crud(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	err := cc.Add(&pkt.Session{
+		ChannelId: "ch1",
+		GateId:    "gateway1",
+		Account:   "test1",
+		Device:    "Phone",
+	})
+	assert.Nil(t, err)
+
+	session, err := cc.Get("ch1")
+	assert.Nil(t, err)
+	assert.Equal(t, "gateway1", session.GateId)
+	assert.Equal(t, "test1", session.Account)
+
+	loc, err := cc.GetLocation("test1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ch1", loc.ChannelId)
+
+	err = cc.Delete("test1", "ch1")
+	assert.Nil(t, err)
+	_, err = cc.Get("ch1")
+	assert.Equal(t, him.ErrSessionNil, err)
+	_, err = cc.GetLocation("test1", "")
+	assert.Equal(t, him.ErrSessionNil, err)
+}
+
+func Test_delete_stale_channel(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	_ = cc.Add(&pkt.Session{ChannelId: "ch1", GateId: "gateway1", Account: "test1"})
+	_ = cc.Add(&pkt.Session{ChannelId: "ch2", GateId: "gateway2", Account: "test1"})
+
+	// 旧连接迟到的登出不能删除新登录的位置信息
+	err := cc.Delete("test1", "ch1")
+	assert.Nil(t, err)
+
+	loc, err := cc.GetLocation("test1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ch2", loc.ChannelId)
+	assert.Equal(t, "gateway2", loc.GateId)
+
+	_, err = cc.Get("ch1")
+	assert.Equal(t, him.ErrSessionNil, err)
+}
+
+func Test_touch(t *testing.T) {
+	cc, mr := newTestStorage(t)
+	_ = cc.Add(&pkt.Session{ChannelId: "ch1", GateId: "gateway1", Account: "test1"})
+
+	mr.FastForward(LocationExpired - time.Minute)
+	err := cc.Touch("test1", "ch1")
+	assert.Nil(t, err)
+	assert.Equal(t, LocationExpired, mr.TTL(KeyLocation("test1", "")))
+	assert.Equal(t, LocationExpired, mr.TTL(KeySession("ch1")))
+
+	mr.FastForward(LocationExpired - time.Minute)
+	_, err = cc.GetLocation("test1", "")
+	assert.Nil(t, err)
+
+	err = cc.Touch("test1", "ch9")
+	assert.Equal(t, him.ErrSessionNil, err)
+}
+
+func Test_slot(t *testing.T) {
+	assert.Equal(t, 12739, Slot("123456789"))
+	assert.Equal(t, Slot("{user1000}.following"), Slot("{user1000}.followers"))
+	// 会话与位置信息在同一个slot
+	assert.Equal(t, Slot(KeyLocation("test1", "")), Slot(KeySession("gate01_{test1}_1")))
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/go-redis/redis/v7"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxBufferedMessages 挂起期间每个会话最多缓存的消息数量，超过时丢弃最早的消息
+const MaxBufferedMessages = 200
+
+// suspendScript KEYS: location, session, [online] ARGV: channelId, grace(ms), suspended location
+// 挂起的会话不再属于任何网关
+var suspendScript = redis.NewScript(locOwnedBy + `
+if KEYS[3] then
+	redis.call('ZREM', KEYS[3], ARGV[1])
+end
+if not owned(redis.call('GET', KEYS[1])) then
+	redis.call('DEL', KEYS[2])
+	return 0
+end
+if redis.call('PEXPIRE', KEYS[2], ARGV[2]) == 0 then
+	redis.call('DEL', KEYS[1])
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[3], 'PX', ARGV[2])
+return 1
+`)
+
+// bufferScript KEYS: buffer, session ARGV: payload, max
+// 缓存与挂起的会话同时过期
+var bufferScript = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[2])
+if ttl <= 0 then
+	return 0
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[2]), -1)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+// takeTokenScript KEYS: resume token
+// 读取并删除令牌，并发恢复时只有一个可以拿到
+var takeTokenScript = redis.NewScript(`
+local channel = redis.call('GET', KEYS[1])
+if channel then
+	redis.call('DEL', KEYS[1])
+end
+return channel
+`)
+
+// takeBufferedScript KEYS: buffer
+var takeBufferedScript = redis.NewScript(`
+local list = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+return list
+`)
+
+func (r *RedisStorage) SaveResumeToken(token string, channelId string) error {
+	return r.cli.Set(KeyResumeToken(token), channelId, LocationExpired).Err()
+}
+
+// Suspend 挂起会话
+// 位置信息改写为没有网关的挂起状态，会话与位置信息在grace之后过期
+func (r *RedisStorage) Suspend(account string, channelId string, grace time.Duration) (bool, error) {
+	loc := him.Location{ChannelId: channelId}
+	online := r.onlineKeys(gatewayOf(channelId))
+	keys := append([]string{KeyLocation(account, ""), KeySession(channelId)}, online...)
+	n, err := suspendScript.Run(r.cli, keys, channelId, grace.Milliseconds(), loc.Bytes()).Int()
+	if err != nil {
+		return false, err
+	}
+	if online == nil {
+		if err = r.unindex(channelId); err != nil {
+			return false, err
+		}
+	}
+	return n == 1, nil
+}
+
+func (r *RedisStorage) TakeSuspended(token string) (*pkt.Session, error) {
+	val, err := takeTokenScript.Run(r.cli, []string{KeyResumeToken(token)}).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, him.ErrSessionNil
+		}
+		return nil, err
+	}
+	channelId, _ := val.(string)
+
+	bytes, err := r.cli.Get(KeySession(channelId)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, him.ErrSessionNil
+		}
+		return nil, err
+	}
+	var session pkt.Session
+	if err = proto.Unmarshal(bytes, &session); err != nil {
+		return nil, err
+	}
+	// 只有位置信息仍然是该channel的挂起状态时才可以恢复
+	loc, err := r.GetLocation(session.Account, "")
+	if err != nil {
+		return nil, err
+	}
+	if loc.ChannelId != channelId || !loc.Suspended() {
+		return nil, him.ErrSessionNil
+	}
+	return &session, nil
+}
+
+// Buffer 会话已经恢复或者过期时返回ErrSessionNil
+func (r *RedisStorage) Buffer(channelId string, payload []byte) error {
+	keys := []string{KeyBuffer(channelId), KeySession(channelId)}
+	n, err := bufferScript.Run(r.cli, keys, payload, MaxBufferedMessages).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return him.ErrSessionNil
+	}
+	return nil
+}
+
+func (r *RedisStorage) TakeBuffered(channelId string) ([][]byte, error) {
+	list, err := takeBufferedScript.Run(r.cli, []string{KeyBuffer(channelId)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	vals, _ := list.([]interface{})
+	result := make([][]byte, 0, len(vals))
+	for _, v := range vals {
+		if s, ok := v.(string); ok {
+			result = append(result, []byte(s))
+		}
+	}
+	return result, nil
+}
+
+var _ him.ResumeStorage = (*RedisStorage)(nil)
+
+func KeyResumeToken(token string) string {
+	return fmt.Sprintf("login:rt:%s", token)
+}
+
+// KeyBuffer 挂起会话的消息缓存，与会话落在同一个slot
+func KeyBuffer(channel string) string {
+	return fmt.Sprintf("login:buf:%s", channel)
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/wire/pkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_resume(t *testing.T) {
+	cc, mr := newTestStorage(t)
+	_ = cc.Add(&pkt.Session{ChannelId: "ch1", GateId: "gateway1", Account: "test1"})
+	assert.Nil(t, cc.SaveResumeToken("tk1", "ch1"))
+
+	ok, err := cc.Suspend("test1", "ch1", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	loc, err := cc.GetLocation("test1", "")
+	assert.Nil(t, err)
+	assert.True(t, loc.Suspended())
+
+	assert.Nil(t, cc.Buffer("ch1", []byte("m1")))
+	assert.Nil(t, cc.Buffer("ch1", []byte("m2")))
+
+	session, err := cc.TakeSuspended("tk1")
+	assert.Nil(t, err)
+	assert.Equal(t, "test1", session.Account)
+	// token只能使用一次
+	_, err = cc.TakeSuspended("tk1")
+	assert.Equal(t, him.ErrSessionNil, err)
+
+	list, err := cc.TakeBuffered("ch1")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("m1"), []byte("m2")}, list)
+	list, _ = cc.TakeBuffered("ch1")
+	assert.Empty(t, list)
+
+	// 超过grace之后会话过期
+	_ = cc.Add(&pkt.Session{ChannelId: "ch2", GateId: "gateway1", Account: "test2"})
+	_ = cc.SaveResumeToken("tk2", "ch2")
+	_, _ = cc.Suspend("test2", "ch2", time.Minute)
+	mr.FastForward(time.Minute * 2)
+	_, err = cc.TakeSuspended("tk2")
+	assert.Equal(t, him.ErrSessionNil, err)
+	_, err = cc.GetLocation("test2", "")
+	assert.Equal(t, him.ErrSessionNil, err)
+}
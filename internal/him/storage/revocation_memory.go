@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+)
+
+// MemoryRevocationStorage 进程内的token吊销存储，只适用于单个网关或测试
+type MemoryRevocationStorage struct {
+	sync.RWMutex
+	tokens   map[string]time.Time
+	accounts map[string]time.Time
+	handlers []func(account string)
+}
+
+func NewMemoryRevocationStorage() *MemoryRevocationStorage {
+	return &MemoryRevocationStorage{
+		tokens:   make(map[string]time.Time),
+		accounts: make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryRevocationStorage) RevokeToken(account string, tokenId string, expires time.Time) error {
+	m.Lock()
+	now := time.Now()
+	// 顺便清理已经过期的记录
+	for id, exp := range m.tokens {
+		if exp.Before(now) {
+			delete(m.tokens, id)
+		}
+	}
+	if expires.After(now) {
+		m.tokens[tokenId] = expires
+	}
+	m.Unlock()
+	return nil
+}
+
+func (m *MemoryRevocationStorage) ClaimToken(account string, tokenId string, expires time.Time) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	if !expires.After(now) {
+		return false, nil
+	}
+	if exp, ok := m.tokens[tokenId]; ok && exp.After(now) {
+		return false, nil
+	}
+	m.tokens[tokenId] = expires
+	return true, nil
+}
+
+func (m *MemoryRevocationStorage) RevokeAccount(account string, at time.Time) error {
+	m.Lock()
+	m.accounts[account] = at
+	m.Unlock()
+	return m.Notify(account)
+}
+
+func (m *MemoryRevocationStorage) IsRevoked(account string, tokenId string, issuedAt time.Time) (bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	if exp, ok := m.tokens[tokenId]; ok && tokenId != "" && exp.After(time.Now()) {
+		return true, nil
+	}
+	at, ok := m.accounts[account]
+	return ok && !issuedAt.After(at), nil
+}
+
+func (m *MemoryRevocationStorage) Subscribe(handler func(account string)) error {
+	m.Lock()
+	m.handlers = append(m.handlers, handler)
+	m.Unlock()
+	return nil
+}
+
+func (m *MemoryRevocationStorage) Notify(account string) error {
+	m.RLock()
+	handlers := m.handlers
+	m.RUnlock()
+	for _, handler := range handlers {
+		go handler(account)
+	}
+	return nil
+}
+
+var _ him.RevocationStorage = (*MemoryRevocationStorage)(nil)
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/go-redis/redis/v7"
+	"github.com/klintcheng/kim/logger"
+)
+
+// ChannelRevoke 吊销token时广播被吊销账号的redis频道
+const ChannelRevoke = "login:revoke"
+
+// DefaultRevocationTTL 账号吊销记录的默认保留时间，不能短于token的最长有效期
+const DefaultRevocationTTL = time.Hour * 24 * 7
+
+// RedisRevocationStorage 基于redis的token吊销存储
+type RedisRevocationStorage struct {
+	cli redis.UniversalClient
+	ttl time.Duration
+}
+
+// NewRedisRevocationStorage ttl为账号吊销记录的保留时间
+func NewRedisRevocationStorage(cli redis.UniversalClient, ttl time.Duration) *RedisRevocationStorage {
+	if ttl <= 0 {
+		ttl = DefaultRevocationTTL
+	}
+	return &RedisRevocationStorage{cli: cli, ttl: ttl}
+}
+
+func (r *RedisRevocationStorage) RevokeToken(account string, tokenId string, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil
+	}
+	return r.cli.Set(KeyRevokedToken(tokenId), account, ttl).Err()
+}
+
+func (r *RedisRevocationStorage) ClaimToken(account string, tokenId string, expires time.Time) (bool, error) {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return false, nil
+	}
+	return r.cli.SetNX(KeyRevokedToken(tokenId), account, ttl).Result()
+}
+
+func (r *RedisRevocationStorage) RevokeAccount(account string, at time.Time) error {
+	if err := r.cli.Set(KeyRevokedAccount(account), at.UnixMilli(), r.ttl).Err(); err != nil {
+		return err
+	}
+	return r.Notify(account)
+}
+
+func (r *RedisRevocationStorage) Notify(account string) error {
+	return r.cli.Publish(ChannelRevoke, account).Err()
+}
+
+func (r *RedisRevocationStorage) IsRevoked(account string, tokenId string, issuedAt time.Time) (bool, error) {
+	pipe := r.cli.Pipeline()
+	accCmd := pipe.Get(KeyRevokedAccount(account))
+	var tkCmd *redis.IntCmd
+	if tokenId != "" {
+		tkCmd = pipe.Exists(KeyRevokedToken(tokenId))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return false, err
+	}
+	if tkCmd != nil && tkCmd.Val() > 0 {
+		return true, nil
+	}
+	if accCmd.Err() == redis.Nil {
+		return false, nil
+	}
+	at, err := strconv.ParseInt(accCmd.Val(), 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return issuedAt.UnixMilli() <= at, nil
+}
+
+// Subscribe 在独立的goroutine中处理吊销事件
+func (r *RedisRevocationStorage) Subscribe(handler func(account string)) error {
+	pubsub := r.cli.Subscribe(ChannelRevoke)
+	if _, err := pubsub.Receive(); err != nil {
+		_ = pubsub.Close()
+		return err
+	}
+	go func() {
+		log := logger.WithField("module", "RedisRevocationStorage")
+		for msg := range pubsub.Channel() {
+			log.Infof("account %s revoked", msg.Payload)
+			handler(msg.Payload)
+		}
+	}()
+	return nil
+}
+
+var _ him.RevocationStorage = (*RedisRevocationStorage)(nil)
+
+func KeyRevokedToken(tokenId string) string {
+	return fmt.Sprintf("revoke:tk:%s", tokenId)
+}
+
+func KeyRevokedAccount(account string) string {
+	return fmt.Sprintf("revoke:acc:{%s}", account)
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRevocation(t *testing.T, store him.RevocationStorage) {
+	revoked := make(chan string, 2)
+	assert.Nil(t, store.Subscribe(func(account string) {
+		revoked <- account
+	}))
+	now := time.Now()
+
+	ok, err := store.IsRevoked("test1", "tk1", now)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 吊销单个token不通知订阅者
+	assert.Nil(t, store.RevokeToken("test1", "tk1", now.Add(time.Hour)))
+	ok, _ = store.IsRevoked("test1", "tk1", now)
+	assert.True(t, ok)
+	ok, _ = store.IsRevoked("test1", "tk2", now)
+	assert.False(t, ok)
+	select {
+	case got := <-revoked:
+		t.Fatalf("%s notified by RevokeToken", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+	assert.Nil(t, store.Notify("test1"))
+
+	// token只能被占用一次
+	ok, err = store.ClaimToken("test1", "tk5", now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = store.ClaimToken("test1", "tk5", now.Add(time.Hour))
+	assert.False(t, ok)
+	ok, _ = store.ClaimToken("test1", "tk1", now.Add(time.Hour))
+	assert.False(t, ok)
+	ok, _ = store.IsRevoked("test1", "tk5", now)
+	assert.True(t, ok)
+
+	// 吊销之前签发的token全部失效，之后签发的不受影响
+	assert.Nil(t, store.RevokeAccount("test2", now))
+	ok, _ = store.IsRevoked("test2", "tk3", now.Add(-time.Minute))
+	assert.True(t, ok)
+	ok, _ = store.IsRevoked("test2", "tk4", now.Add(time.Minute))
+	assert.False(t, ok)
+
+	accounts := make([]string, 0, 2)
+	for len(accounts) < 2 {
+		select {
+		case got := <-revoked:
+			accounts = append(accounts, got)
+		case <-time.After(time.Second):
+			t.Fatal("revocation not notified")
+		}
+	}
+	assert.ElementsMatch(t, []string{"test1", "test2"}, accounts)
+}
+
+func Test_redis_revocation(t *testing.T) {
+	cc, _ := newTestStorage(t)
+	testRevocation(t, NewRedisRevocationStorage(cc.cli, 0))
+}
+
+func Test_memory_revocation(t *testing.T) {
+	testRevocation(t, NewMemoryRevocationStorage())
+}
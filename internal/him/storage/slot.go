@@ -0,0 +1,32 @@
+package storage
+
+import "strings"
+
+// SlotNumber redis集群的slot数量
+const SlotNumber = 16384
+
+// Slot 计算key在redis集群中的slot，key中带有{hash-tag}时只使用hash-tag计算
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s > -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+e+1]
+		}
+	}
+	return int(crc16(key) % SlotNumber)
+}
+
+// crc16 CRC16-CCITT(XMODEM)，与redis集群使用的算法一致
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
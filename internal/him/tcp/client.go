@@ -29,6 +29,8 @@ type Client struct {
 	options ClientOptions
 
 	Meta map[string]string
+	// Tags 服务注册时的标签
+	Tags []string
 }
 
 func NewClient(id, name string, opts ClientOptions) him.Client {
@@ -36,6 +38,11 @@ func NewClient(id, name string, opts ClientOptions) him.Client {
 }
 
 func NewClientWithProps(id, name string, meta map[string]string, opts ClientOptions) him.Client {
+	return NewClientWithTags(id, name, meta, nil, opts)
+}
+
+// NewClientWithTags 带有服务标签的客户端，选择器可以按照标签路由
+func NewClientWithTags(id, name string, meta map[string]string, tags []string, opts ClientOptions) him.Client {
 	if opts.WriteWait == 0 {
 		opts.WriteWait = him.DefaultWriteWait
 	}
@@ -48,6 +55,7 @@ func NewClientWithProps(id, name string, meta map[string]string, opts ClientOpti
 		name:    name,
 		options: opts,
 		Meta:    meta,
+		Tags:    tags,
 	}
 	return cli
 }
@@ -64,6 +72,10 @@ func (c *Client) GetMeta() map[string]string {
 	return c.Meta
 }
 
+func (c *Client) GetTags() []string {
+	return c.Tags
+}
+
 func (c *Client) SetDialer(dialer him.Dialer) {
 	c.Dialer = dialer
 }
@@ -99,7 +111,8 @@ func (c *Client) Read() (him.Frame, error) {
 // Close 关闭
 func (c *Client) Close() {
 	c.once.Do(func() {
-		if c.conn == nil {
+		if c.conn != nil {
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
 			_ = WriteFrame(c.conn, him.OpClose, nil)
 
 			c.conn.Close()
@@ -23,6 +23,11 @@ func NewConn(conn net.Conn) *TcpConn {
 	}
 }
 
+// NetConn 返回被封装的连接
+func (c *TcpConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 func (c *TcpConn) ReadFrame() (him.Frame, error) {
 	opcode, err := endian.ReadUint8(c.Conn)
 	if err != nil {
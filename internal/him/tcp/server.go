@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/chang144/gotalk/internal/him"
@@ -28,9 +29,17 @@ type Server struct {
 	him.MessageListener
 	him.StateListener
 
-	once    sync.Once
-	options ServerOptions
-	quit    *him.Event
+	once      sync.Once
+	options   ServerOptions
+	quit      *him.Event
+	tlsConfig *tls.Config
+	// pool 处理收到的消息，保证同一个channel的消息按照顺序处理
+	pool *him.WorkerPool
+
+	lock sync.Mutex
+	lst  net.Listener
+	// conns 处理中的连接，Shutdown等待它们的断开回调完成
+	conns sync.WaitGroup
 }
 
 func NewServer(listen string, service him.ServiceRegistration) him.Server {
@@ -61,21 +70,44 @@ func (s *Server) Start() error {
 	if s.Acceptor == nil {
 		s.Acceptor = new(defaultAcceptor)
 	}
+	if s.pool == nil {
+		s.pool = him.DefaultWorkerPool()
+	}
+	listener := s.pool.Listener(s.MessageListener)
 	// step 1
-	lst, err := net.Listen("tcp", s.listen)
-	if err != nil {
-		return err
+	s.lock.Lock()
+	lst := s.lst
+	s.lock.Unlock()
+	if lst == nil {
+		var err error
+		if lst, err = net.Listen("tcp", s.listen); err != nil {
+			return err
+		}
+	}
+	if s.tlsConfig != nil {
+		lst = tls.NewListener(lst, s.tlsConfig)
 	}
+	s.lock.Lock()
+	if s.quit.HasFired() {
+		s.lock.Unlock()
+		return lst.Close()
+	}
+	s.lst = lst
+	s.lock.Unlock()
 	log.Info("starting tcp logicServer")
 	for {
 		//step 2
 		rawconn, err := lst.Accept()
 		if err != nil {
-			rawconn.Close()
+			if s.quit.HasFired() {
+				return nil
+			}
 			log.Warn(err)
 			continue
 		}
+		s.conns.Add(1)
 		go func(rawconn net.Conn) {
+			defer s.conns.Done()
 			conn := NewConn(rawconn)
 			// step 3
 			id, err := s.Accept(conn, s.options.loginWait)
@@ -84,8 +116,8 @@ func (s *Server) Start() error {
 				conn.Close()
 				return
 			}
-			if _, ok := s.Get(id); ok {
-				log.Warn("channel %s existed", id)
+			if him.Duplicated(s.ChannelMap, s.Acceptor, id) {
+				log.Warnf("channel %s existed", id)
 				_ = conn.WriteFrame(him.OpClose, []byte("channelId is exists"))
 				conn.Close()
 				return
@@ -95,15 +127,20 @@ func (s *Server) Start() error {
 			channel.SetReadWait(s.options.readWait)
 			channel.SetWriteWait(s.options.writeWait)
 			s.Add(channel)
+			// Shutdown之后加入的连接没有被通知，直接关闭
+			if s.quit.HasFired() {
+				_ = channel.Close()
+			}
 
 			//step 5
-			err = channel.ReadLoop(s.MessageListener)
+			err = channel.ReadLoop(listener)
 			if err != nil {
 				log.Info(err)
 			}
 			// step 6
-			s.Remove(channel.ID())
-			_ = s.Disconnect(channel.ID())
+			if s.RemoveChannel(channel) {
+				_ = s.Disconnect(channel.ID())
+			}
 			channel.Close()
 		}(rawconn)
 	}
@@ -119,25 +156,35 @@ func (s *Server) Push(id string, data []byte) error {
 	return ch.Push(data)
 }
 
+// Shutdown 停止接收新连接，推送GoAway通知并等待推送写完之后关闭连接
 func (s *Server) Shutdown(ctx context.Context) error {
-	logger.WithFields(logger.Fields{
+	log := logger.WithFields(logger.Fields{
 		"module": "tcp.logicServer",
 		"id":     s.ServiceID(),
 	})
 	s.once.Do(func() {
 		defer func() {
-			logger.Infoln("shutdown")
+			log.Infoln("shutdown")
 		}()
-		channels := s.ChannelMap.All()
-		for _, channel := range channels {
-			channel.Close()
+		s.quit.Fire()
+		s.lock.Lock()
+		if s.lst != nil {
+			_ = s.lst.Close()
+		}
+		s.lock.Unlock()
 
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				continue
-			}
+		him.DrainChannels(ctx, s.ChannelMap.All(), s.StateListener)
+
+		// 等待断开回调完成
+		done := make(chan struct{})
+		go func() {
+			s.conns.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Warn(ctx.Err())
 		}
 	})
 	return nil
@@ -163,9 +210,28 @@ func (s *Server) SetChannelMap(channelMap him.ChannelMap) {
 	s.ChannelMap = channelMap
 }
 
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// SetListener 使用已经建立的监听，在Start之前调用
+func (s *Server) SetListener(lst net.Listener) {
+	s.lock.Lock()
+	s.lst = lst
+	s.lock.Unlock()
+}
+
 type defaultAcceptor struct {
 }
 
 func (d defaultAcceptor) Accept(conn him.Conn, duration time.Duration) (string, error) {
 	return ksuid.New().String(), nil
 }
+
+// SetWorkerPool 设置处理消息的协程池，在Start之前调用
+func (s *Server) SetWorkerPool(pool *him.WorkerPool) {
+	s.pool = pool
+}
+
+var _ him.Listenable = (*Server)(nil)
+var _ him.Poolable = (*Server)(nil)
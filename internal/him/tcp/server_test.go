@@ -0,0 +1,180 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chang144/gotalk/internal/him"
+	"github.com/chang144/gotalk/internal/him/naming"
+	"github.com/stretchr/testify/assert"
+)
+
+type drainHandler struct {
+	disconnected int32
+}
+
+func (h *drainHandler) Receive(him.Agent, []byte) {}
+
+func (h *drainHandler) Disconnect(string) error {
+	atomic.AddInt32(&h.disconnected, 1)
+	return nil
+}
+
+func (h *drainHandler) GoAway(ch him.Channel) []byte {
+	return []byte("goaway " + ch.ID())
+}
+
+func freeAddr(t *testing.T) string {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer lst.Close()
+	return lst.Addr().String()
+}
+
+func Test_shutdown_drain(t *testing.T) {
+	addr := freeAddr(t)
+	handler := &drainHandler{}
+	srv := NewServer(addr, &naming.RegisterService{Id: "gate01", Name: "tgateway"})
+	srv.SetMessageListener(handler)
+	srv.SetStateListener(handler)
+	started := make(chan error, 1)
+	go func() { started <- srv.Start() }()
+
+	var raw net.Conn
+	assert.Eventually(t, func() bool {
+		var err error
+		raw, err = net.Dial("tcp", addr)
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+	conn := NewConn(raw)
+
+	channels := srv.(*Server).ChannelMap
+	assert.Eventually(t, func() bool {
+		return channels.Len() == 1
+	}, time.Second, time.Millisecond*10)
+	id := channels.All()[0].ID()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, srv.Push(id, []byte("message")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+	// 关闭之前断开回调已经完成
+	assert.EqualValues(t, 1, atomic.LoadInt32(&handler.disconnected))
+	assert.Equal(t, 0, channels.Len())
+	assert.Nil(t, <-started)
+
+	// 已经推送的消息之后是GoAway通知，然后连接被关闭
+	for i := 0; i < 3; i++ {
+		frame, err := conn.ReadFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, "message", string(frame.GetPayload()))
+	}
+	frame, err := conn.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, "goaway "+id, string(frame.GetPayload()))
+	_, err = conn.ReadFrame()
+	assert.NotNil(t, err)
+
+	// 不再接收新连接
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+}
+
+func Test_push_after_drain(t *testing.T) {
+	local, remote := net.Pipe()
+	ch := him.NewChannel("ch1", NewConn(local))
+	received := make(chan string, 4)
+	go func() {
+		conn := NewConn(remote)
+		for {
+			frame, err := conn.ReadFrame()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(frame.GetPayload())
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, ch.Push([]byte("before")))
+	assert.Nil(t, ch.Drain(ctx))
+	// 客户端收到GoAway之后重连之前的推送仍然接收，关闭之前写完
+	assert.Nil(t, ch.Push([]byte("after")))
+	assert.Nil(t, ch.Close())
+
+	var got []string
+	for payload := range received {
+		got = append(got, payload)
+	}
+	assert.Equal(t, []string{"before", "after"}, got)
+	assert.Equal(t, him.ErrChannelClosed, ch.Push([]byte("closed")))
+}
+
+// replaceAcceptor 每个连接都使用相同的id
+type replaceAcceptor struct {
+	replace bool
+}
+
+func (a replaceAcceptor) Accept(him.Conn, time.Duration) (string, error) {
+	return "gate01", nil
+}
+
+func (a replaceAcceptor) Replace(string) bool {
+	return a.replace
+}
+
+func Test_replace_channel(t *testing.T) {
+	addr := freeAddr(t)
+	handler := &drainHandler{}
+	srv := NewServer(addr, &naming.RegisterService{Id: "logic01", Name: "chat"})
+	srv.SetMessageListener(handler)
+	srv.SetStateListener(handler)
+	srv.SetAcceptor(replaceAcceptor{replace: true})
+	channels := srv.(*Server).ChannelMap
+	go func() { _ = srv.Start() }()
+	defer srv.Shutdown(context.Background())
+
+	var old net.Conn
+	assert.Eventually(t, func() bool {
+		var err error
+		old, err = net.Dial("tcp", addr)
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+	assert.Eventually(t, func() bool { return channels.Len() == 1 }, time.Second, time.Millisecond*10)
+	first, _ := channels.Get("gate01")
+
+	// 相同id的新连接替换旧连接
+	raw, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	conn := NewConn(raw)
+	assert.Eventually(t, func() bool {
+		ch, _ := channels.Get("gate01")
+		return ch != first
+	}, time.Second, time.Millisecond*10)
+	assert.Nil(t, srv.Push("gate01", []byte("message")))
+	frame, err := conn.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, "message", string(frame.GetPayload()))
+
+	// 旧连接断开之后新连接仍然有效，也不回调Disconnect
+	_ = old.Close()
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 1, channels.Len())
+	assert.EqualValues(t, 0, atomic.LoadInt32(&handler.disconnected))
+	assert.Nil(t, srv.Push("gate01", []byte("again")))
+	frame, err = conn.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, "again", string(frame.GetPayload()))
+
+	// 没有实现Replacer或者返回false时拒绝新连接
+	assert.True(t, him.Duplicated(channels, replaceAcceptor{}, "gate01"))
+	assert.False(t, him.Duplicated(channels, replaceAcceptor{replace: true}, "gate01"))
+	assert.False(t, him.Duplicated(channels, replaceAcceptor{}, "gate02"))
+}
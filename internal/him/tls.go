@@ -0,0 +1,186 @@
+package him
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCertCheckInterval 检查证书文件是否变更的最小间隔
+const DefaultCertCheckInterval = time.Second * 10
+
+var ErrPeerIdentity = errors.New("peer certificate does not match service id")
+
+// TLSOptions 服务端与服务之间通用的TLS配置
+// 服务端配置了CAFile时要求并校验客户端证书(mTLS)，客户端配置了CAFile时用它校验服务端证书
+type TLSOptions struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+}
+
+// CertReloader 证书文件更新后在下一次握手时自动加载，不需要重启服务
+type CertReloader struct {
+	sync.RWMutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+	interval  time.Duration
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: DefaultCertCheckInterval,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetCheckInterval interval为0时每次握手都检查证书文件
+func (r *CertReloader) SetCheckInterval(interval time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.interval = interval
+}
+
+// Reload 重新加载证书，失败时继续使用旧的证书
+func (r *CertReloader) Reload() error {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.cert = &cert
+	r.modTime = info.ModTime()
+	r.checkedAt = time.Now()
+	return nil
+}
+
+func (r *CertReloader) certificate() (*tls.Certificate, error) {
+	r.RLock()
+	cert, modTime, due := r.cert, r.modTime, time.Since(r.checkedAt) >= r.interval
+	r.RUnlock()
+	if !due {
+		return cert, nil
+	}
+	r.Lock()
+	r.checkedAt = time.Now()
+	r.Unlock()
+	if info, err := os.Stat(r.certFile); err == nil && !info.ModTime().Equal(modTime) {
+		if err := r.Reload(); err == nil {
+			r.RLock()
+			cert = r.cert
+			r.RUnlock()
+		}
+	}
+	return cert, nil
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// NewServerTLSConfig 服务端TLS配置
+func NewServerTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	reloader, err := NewCertReloader(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// NewClientTLSConfig 服务之间连接使用的TLS配置，CertFile为空时不发送客户端证书
+func NewClientTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
+	}
+	if opts.CertFile != "" {
+		reloader, err := NewCertReloader(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.GetClientCertificate
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// ConnectionState 返回连接的TLS状态，会逐层解开对net.Conn的封装
+func ConnectionState(conn net.Conn) (tls.ConnectionState, bool) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case interface{ ConnectionState() tls.ConnectionState }:
+			return c.ConnectionState(), true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return tls.ConnectionState{}, false
+		}
+	}
+	return tls.ConnectionState{}, false
+}
+
+// VerifyPeerIdentity 校验对端证书中的DNS名称包含serviceId
+// 明文连接或对端没有提供证书时不校验，是否强制mTLS由服务端的ClientAuth决定
+func VerifyPeerIdentity(conn net.Conn, serviceId string) error {
+	state, ok := ConnectionState(conn)
+	if !ok || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	if err := state.PeerCertificates[0].VerifyHostname(serviceId); err != nil {
+		return ErrPeerIdentity
+	}
+	return nil
+}
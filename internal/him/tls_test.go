@@ -0,0 +1,170 @@
+package him
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePem(t, filepath.Join(ca.dir, "ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+// issue 签发证书，name同时作为CN与DNS名称，返回证书与私钥文件
+func (ca *testCA) issue(t *testing.T, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certFile := filepath.Join(ca.dir, name+".pem")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	writePem(t, certFile, "CERTIFICATE", der)
+	writePem(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePem(t *testing.T, file, typ string, der []byte) {
+	err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	assert.Nil(t, err)
+}
+
+// serveOnce 接受一个连接并返回对端证书的校验结果
+func serveOnce(t *testing.T, config *tls.Config, serviceId string) (string, <-chan error) {
+	lst, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.Nil(t, err)
+	result := make(chan error, 1)
+	go func() {
+		defer lst.Close()
+		conn, err := lst.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		if err = conn.(*tls.Conn).Handshake(); err != nil {
+			result <- err
+			return
+		}
+		result <- VerifyPeerIdentity(&wrappedConn{conn}, serviceId)
+	}()
+	return lst.Addr().String(), result
+}
+
+type wrappedConn struct {
+	net.Conn
+}
+
+func (c *wrappedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func Test_mutual_tls(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	serverCert, serverKey := ca.issue(t, "chat01", 2)
+	clientCert, clientKey := ca.issue(t, "gate01", 3)
+
+	serverConfig, err := NewServerTLSConfig(TLSOptions{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile})
+	assert.Nil(t, err)
+	clientConfig, err := NewClientTLSConfig(TLSOptions{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile, ServerName: "chat01"})
+	assert.Nil(t, err)
+
+	addr, result := serveOnce(t, serverConfig, "gate01")
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Handshake())
+	assert.Nil(t, <-result)
+	_ = conn.Close()
+
+	// 握手中声明的serviceId与证书不一致
+	addr, result = serveOnce(t, serverConfig, "gate02")
+	conn, err = tls.Dial("tcp", addr, clientConfig)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrPeerIdentity, <-result)
+	_ = conn.Close()
+
+	// 没有客户端证书时握手失败
+	noCert, _ := NewClientTLSConfig(TLSOptions{CAFile: caFile, ServerName: "chat01"})
+	addr, result = serveOnce(t, serverConfig, "gate01")
+	conn, err = tls.Dial("tcp", addr, noCert)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+	assert.NotNil(t, err)
+	assert.NotNil(t, <-result)
+}
+
+func Test_cert_reload(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "gate01", 2)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	reloader.SetCheckInterval(0)
+	cert, _ := reloader.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, int64(2), leaf.SerialNumber.Int64())
+
+	// 覆盖证书文件后下一次握手使用新证书
+	time.Sleep(time.Millisecond * 10)
+	ca.issue(t, "gate01", 3)
+	now := time.Now().Add(time.Second)
+	_ = os.Chtimes(certFile, now, now)
+	cert, _ = reloader.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, int64(3), leaf.SerialNumber.Int64())
+
+	// 文件损坏时继续使用旧证书
+	assert.Nil(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	_ = os.Chtimes(certFile, now.Add(time.Second), now.Add(time.Second))
+	cert, err = reloader.GetCertificate(nil)
+	assert.Nil(t, err)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, int64(3), leaf.SerialNumber.Int64())
+}
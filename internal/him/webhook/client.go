@@ -0,0 +1,338 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klintcheng/kim/logger"
+	"github.com/segmentio/ksuid"
+)
+
+// 请求头
+const (
+	HeaderEvent     = "X-Him-Event"
+	HeaderTimestamp = "X-Him-Timestamp"
+	// HeaderSignature hex(HMAC-SHA256(secret, timestamp + "." + body))
+	HeaderSignature = "X-Him-Signature"
+)
+
+const (
+	DefaultTimeout    = time.Second * 5
+	DefaultMaxRetries = 5
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = time.Minute
+	DefaultWorkers    = 4
+	DefaultQueueSize  = 10000
+)
+
+var (
+	ErrQueueFull = errors.New("webhook queue is full")
+	ErrClosed    = errors.New("webhook client is closed")
+)
+
+// Config 应用的webhook配置，App为空时作为默认配置
+type Config struct {
+	App    string
+	URL    string
+	Secret string
+	// Events 订阅的事件，为空时订阅全部
+	Events []string
+	// BeforeSendURL 发送消息之前同步回调，为空时不回调
+	BeforeSendURL string
+	// FailOpen 同步回调失败时仍然允许发送
+	FailOpen bool
+	Timeout  time.Duration
+}
+
+func (c *Config) subscribed(typ string) bool {
+	if c.URL == "" {
+		return false
+	}
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Options 异步投递的参数
+type Options struct {
+	// MaxRetries 第一次失败之后的重试次数
+	MaxRetries int
+	// Backoff 第一次重试的等待时间，之后每次翻倍，最多MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Workers    int
+	QueueSize  int
+	// DeadLetter 重试耗尽的投递，为nil时只记录日志
+	DeadLetter DeadLetter
+}
+
+// Delivery 一次事件投递
+type Delivery struct {
+	URL      string          `json:"url"`
+	Event    *Event          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Payload  json.RawMessage `json:"-"`
+	secret   string
+}
+
+// Client webhook客户端，nil值可以安全调用，不做任何事
+type Client struct {
+	hooks map[string]*Config
+	opts  Options
+	http  *http.Client
+	queue chan *Delivery
+	done  chan struct{}
+	// closed 关闭之后入队的投递直接写入死信，和Close互斥避免写入已经清空的队列
+	closed bool
+	lock   sync.RWMutex
+	wg     sync.WaitGroup
+}
+
+func NewClient(configs []Config, opts Options) *Client {
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.DeadLetter == nil {
+		opts.DeadLetter = logDeadLetter{}
+	}
+	c := &Client{
+		hooks: make(map[string]*Config, len(configs)),
+		opts:  opts,
+		http:  &http.Client{},
+		queue: make(chan *Delivery, opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+	for i := range configs {
+		conf := configs[i]
+		if conf.Timeout <= 0 {
+			conf.Timeout = DefaultTimeout
+		}
+		c.hooks[conf.App] = &conf
+	}
+	for i := 0; i < opts.Workers; i++ {
+		c.wg.Add(1)
+		go c.work()
+	}
+	return c
+}
+
+// config 应用自己的配置优先，其次是默认配置
+func (c *Client) config(app string) *Config {
+	if conf, ok := c.hooks[app]; ok {
+		return conf
+	}
+	return c.hooks[""]
+}
+
+// Fire 异步投递事件，应用没有订阅该事件时直接忽略
+func (c *Client) Fire(app string, typ string, data interface{}) {
+	if c == nil {
+		return
+	}
+	conf := c.config(app)
+	if conf == nil || !conf.subscribed(typ) {
+		return
+	}
+	event := &Event{
+		ID:   ksuid.New().String(),
+		Type: typ,
+		App:  app,
+		Time: time.Now().UnixMilli(),
+		Data: data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.WithField("module", "webhook").Warn(err)
+		return
+	}
+	c.enqueue(&Delivery{
+		URL:     conf.URL,
+		Event:   event,
+		Payload: payload,
+		secret:  conf.Secret,
+	})
+}
+
+func (c *Client) enqueue(d *Delivery) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		c.opts.DeadLetter.Write(d, ErrClosed)
+		return
+	}
+	select {
+	case c.queue <- d:
+	default:
+		c.opts.DeadLetter.Write(d, ErrQueueFull)
+	}
+}
+
+func (c *Client) work() {
+	defer c.wg.Done()
+	for {
+		// 优先检查关闭，关闭之后队列中剩余的投递由Close写入死信
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		select {
+		case <-c.done:
+			return
+		case d := <-c.queue:
+			c.deliver(d)
+		}
+	}
+}
+
+// deliver 失败时按照指数退避重新入队，不阻塞worker
+func (c *Client) deliver(d *Delivery) {
+	d.Attempts++
+	err := c.post(d.URL, d.secret, d.Event.Type, d.Payload, c.config(d.Event.App).Timeout, nil)
+	if err == nil {
+		return
+	}
+	if d.Attempts > c.opts.MaxRetries {
+		c.opts.DeadLetter.Write(d, err)
+		return
+	}
+	time.AfterFunc(c.backoff(d.Attempts), func() {
+		c.enqueue(d)
+	})
+}
+
+func (c *Client) backoff(attempts int) time.Duration {
+	wait := c.opts.Backoff
+	for i := 1; i < attempts && wait < c.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > c.opts.MaxBackoff {
+		wait = c.opts.MaxBackoff
+	}
+	return wait
+}
+
+// BeforeSend 同步回调，应用没有配置BeforeSendURL时直接允许
+// 回调失败时按照FailOpen决定是否允许发送
+func (c *Client) BeforeSend(req *BeforeSendReq) (*BeforeSendResp, error) {
+	allow := &BeforeSendResp{Allow: true}
+	if c == nil {
+		return allow, nil
+	}
+	conf := c.config(req.App)
+	if conf == nil || conf.BeforeSendURL == "" {
+		return allow, nil
+	}
+	payload, _ := json.Marshal(req)
+	var resp BeforeSendResp
+	if err := c.post(conf.BeforeSendURL, conf.Secret, "before.send", payload, conf.Timeout, &resp); err != nil {
+		if conf.FailOpen {
+			logger.WithField("module", "webhook").Warn(err)
+			return allow, nil
+		}
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// post 返回非2xx时视为失败，out不为nil时解析响应体
+func (c *Client) post(url, secret, typ string, payload []byte, timeout time.Duration, out interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, typ)
+	req.Header.Set(HeaderTimestamp, ts)
+	if secret != "" {
+		req.Header.Set(HeaderSignature, Sign(secret, ts, payload))
+	}
+	cli := *c.http
+	cli.Timeout = timeout
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("webhook %s responded %d", url, resp.StatusCode)
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Close 停止投递，队列中未投递的事件和之后等待重试的事件都写入死信
+func (c *Client) Close() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.done)
+	c.lock.Unlock()
+	c.wg.Wait()
+	for {
+		select {
+		case d := <-c.queue:
+			c.opts.DeadLetter.Write(d, ErrClosed)
+		default:
+			return
+		}
+	}
+}
+
+// Sign 计算签名，业务服务使用相同的方法校验
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 校验签名
+func Verify(secret string, timestamp string, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(Sign(secret, timestamp, body))
+	return hmac.Equal(sig, expected)
+}
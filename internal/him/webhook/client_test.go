@@ -0,0 +1,205 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_fire_signed_with_retry(t *testing.T) {
+	var calls int32
+	received := make(chan *Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("secret", r.Header.Get(HeaderTimestamp), body, r.Header.Get(HeaderSignature)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// 第一次返回失败，触发重试
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event Event
+		_ = json.Unmarshal(body, &event)
+		assert.Equal(t, EventLogin, r.Header.Get(HeaderEvent))
+		received <- &event
+	}))
+	defer srv.Close()
+
+	cli := NewClient([]Config{{App: "im", URL: srv.URL, Secret: "secret"}}, Options{
+		Backoff: time.Millisecond * 10,
+	})
+	defer cli.Close()
+
+	cli.Fire("im", EventLogin, &SessionEvent{Account: "test1"})
+	// 未配置的应用与未订阅的事件不投递
+	cli.Fire("other", EventLogin, &SessionEvent{Account: "test2"})
+
+	select {
+	case event := <-received:
+		assert.Equal(t, "im", event.App)
+		assert.Equal(t, EventLogin, event.Type)
+		assert.Equal(t, "test1", event.Data.(map[string]interface{})["account"])
+	case <-time.After(time.Second * 2):
+		t.Fatal("webhook not delivered")
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	assert.False(t, Verify("secret", "1", []byte("{}"), Sign("wrong", "1", []byte("{}"))))
+}
+
+func Test_fire_dead_letter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "dead.log")
+	deadLetter, err := NewFileDeadLetter(path)
+	assert.Nil(t, err)
+	defer deadLetter.Close()
+
+	cli := NewClient([]Config{{URL: srv.URL, Events: []string{EventLogout}}}, Options{
+		MaxRetries: 2,
+		Backoff:    time.Millisecond * 10,
+		DeadLetter: deadLetter,
+	})
+	defer cli.Close()
+
+	cli.Fire("im", EventLogin, &SessionEvent{Account: "test1"})
+	cli.Fire("im", EventLogout, &SessionEvent{Account: "test1"})
+
+	var buf []byte
+	assert.Eventually(t, func() bool {
+		buf, _ = os.ReadFile(path)
+		return len(buf) > 0
+	}, time.Second*2, time.Millisecond*10)
+	// 第一次投递加两次重试
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	assert.Len(t, lines, 1)
+	var record struct {
+		Event    Event  `json:"event"`
+		Attempts int    `json:"attempts"`
+		Error    string `json:"error"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, EventLogout, record.Event.Type)
+	assert.Equal(t, 3, record.Attempts)
+	assert.Contains(t, record.Error, "502")
+}
+
+type deadLetterRecorder struct {
+	sync.Mutex
+	errs []error
+}
+
+func (r *deadLetterRecorder) Write(_ *Delivery, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+func Test_close_dead_letter_queued(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+
+	deadLetter := &deadLetterRecorder{}
+	cli := NewClient([]Config{{URL: srv.URL}}, Options{
+		Workers:    1,
+		DeadLetter: deadLetter,
+	})
+	cli.Fire("im", EventLogin, &SessionEvent{Account: "test1"})
+	<-arrived
+	// 唯一的worker阻塞在第一次投递上，后面两个事件留在队列中
+	cli.Fire("im", EventLogin, &SessionEvent{Account: "test2"})
+	cli.Fire("im", EventLogin, &SessionEvent{Account: "test3"})
+
+	closed := make(chan struct{})
+	go func() {
+		cli.Close()
+		close(closed)
+	}()
+	assert.Eventually(t, func() bool {
+		cli.lock.RLock()
+		defer cli.lock.RUnlock()
+		return cli.closed
+	}, time.Second, time.Millisecond*10)
+	close(release)
+	<-closed
+
+	// 关闭之后的事件同样写入死信
+	cli.Fire("im", EventLogout, &SessionEvent{Account: "test1"})
+
+	deadLetter.Lock()
+	defer deadLetter.Unlock()
+	assert.Equal(t, []error{ErrClosed, ErrClosed, ErrClosed}, deadLetter.errs)
+}
+
+func Test_before_send(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req BeforeSendReq
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch req.Body {
+		case "spam":
+			_ = json.NewEncoder(w).Encode(&BeforeSendResp{Allow: false, Reason: "spam"})
+		case "hello":
+			body := "hello ***"
+			_ = json.NewEncoder(w).Encode(&BeforeSendResp{Allow: true, Body: &body})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	cli := NewClient([]Config{
+		{App: "strict", BeforeSendURL: srv.URL},
+		{App: "loose", BeforeSendURL: srv.URL, FailOpen: true},
+	}, Options{})
+	defer cli.Close()
+
+	resp, err := cli.BeforeSend(&BeforeSendReq{App: "strict", Body: "spam"})
+	assert.Nil(t, err)
+	assert.False(t, resp.Allow)
+	assert.Equal(t, "spam", resp.Reason)
+
+	resp, err = cli.BeforeSend(&BeforeSendReq{App: "strict", Body: "hello"})
+	assert.Nil(t, err)
+	assert.True(t, resp.Allow)
+	assert.Equal(t, "hello ***", *resp.Body)
+	assert.Nil(t, resp.Extra)
+
+	// 回调失败
+	_, err = cli.BeforeSend(&BeforeSendReq{App: "strict", Body: "error"})
+	assert.NotNil(t, err)
+	resp, err = cli.BeforeSend(&BeforeSendReq{App: "loose", Body: "error"})
+	assert.Nil(t, err)
+	assert.True(t, resp.Allow)
+
+	// 没有配置回调的应用与nil客户端直接允许
+	resp, err = cli.BeforeSend(&BeforeSendReq{App: "none", Body: "spam"})
+	assert.Nil(t, err)
+	assert.True(t, resp.Allow)
+	var nilCli *Client
+	resp, _ = nilCli.BeforeSend(&BeforeSendReq{App: "strict"})
+	assert.True(t, resp.Allow)
+}
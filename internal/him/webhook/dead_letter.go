@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klintcheng/kim/logger"
+)
+
+// DeadLetter 记录重试耗尽的投递
+type DeadLetter interface {
+	Write(d *Delivery, err error)
+}
+
+type logDeadLetter struct{}
+
+func (logDeadLetter) Write(d *Delivery, err error) {
+	logger.WithFields(logger.Fields{
+		"module":   "webhook",
+		"event":    d.Event.ID,
+		"type":     d.Event.Type,
+		"attempts": d.Attempts,
+	}).Warnf("dead letter: %v", err)
+}
+
+// FileDeadLetter 以JSON Lines格式追加到文件，便于人工重放
+type FileDeadLetter struct {
+	sync.Mutex
+	file *os.File
+}
+
+func NewFileDeadLetter(path string) (*FileDeadLetter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetter{file: f}, nil
+}
+
+type deadLetterRecord struct {
+	*Delivery
+	Error string `json:"error"`
+	Time  int64  `json:"time"`
+}
+
+func (l *FileDeadLetter) Write(d *Delivery, err error) {
+	line, _ := json.Marshal(&deadLetterRecord{
+		Delivery: d,
+		Error:    err.Error(),
+		Time:     time.Now().UnixMilli(),
+	})
+	l.Lock()
+	defer l.Unlock()
+	if _, e := l.file.Write(append(line, '\n')); e != nil {
+		logDeadLetter{}.Write(d, err)
+	}
+}
+
+func (l *FileDeadLetter) Close() error {
+	return l.file.Close()
+}
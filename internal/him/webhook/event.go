@@ -0,0 +1,59 @@
+package webhook
+
+// 事件类型
+const (
+	EventLogin       = "login"
+	EventLogout      = "logout"
+	EventKickout     = "kickout"
+	EventMessageSent = "message.sent"
+)
+
+// Event 推送给业务服务的事件
+type Event struct {
+	ID   string      `json:"id"`
+	Type string      `json:"type"`
+	App  string      `json:"app"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type SessionEvent struct {
+	Account   string `json:"account"`
+	ChannelId string `json:"channel_id"`
+	GateId    string `json:"gate_id,omitempty"`
+	Device    string `json:"device,omitempty"`
+	RemoteIP  string `json:"remote_ip,omitempty"`
+	// Disconnect 登出事件中表示连接断开而不是主动登出
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+type MessageEvent struct {
+	MessageId int64  `json:"message_id"`
+	Sender    string `json:"sender"`
+	// Dest 单聊为接收方账号，群聊为群ID
+	Dest     string `json:"dest"`
+	Group    bool   `json:"group"`
+	Type     int32  `json:"type"`
+	Body     string `json:"body"`
+	Extra    string `json:"extra,omitempty"`
+	SendTime int64  `json:"send_time"`
+}
+
+// BeforeSendReq 同步回调的请求体
+type BeforeSendReq struct {
+	App    string `json:"app"`
+	Sender string `json:"sender"`
+	Dest   string `json:"dest"`
+	Group  bool   `json:"group"`
+	Type   int32  `json:"type"`
+	Body   string `json:"body"`
+	Extra  string `json:"extra,omitempty"`
+}
+
+// BeforeSendResp Allow为false时拒绝发送，Body或Extra不为nil时替换消息内容
+type BeforeSendResp struct {
+	Allow  bool    `json:"allow"`
+	Reason string  `json:"reason,omitempty"`
+	Body   *string `json:"body,omitempty"`
+	Extra  *string `json:"extra,omitempty"`
+}
@@ -49,6 +49,11 @@ func NewConn(conn net.Conn) *WsConn {
 	}
 }
 
+// NetConn 返回被封装的连接
+func (c *WsConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 func (c *WsConn) ReadFrame() (him.Frame, error) {
 	frame, err := ws.ReadFrame(c.Conn)
 	if err != nil {
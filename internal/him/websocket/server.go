@@ -2,9 +2,11 @@ package websocket
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/segmentio/ksuid"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -30,14 +32,25 @@ type Server struct {
 	him.MessageListener
 	him.StateListener
 
-	once    sync.Once
-	options ServerOptions
+	once      sync.Once
+	options   ServerOptions
+	quit      *him.Event
+	tlsConfig *tls.Config
+	// pool 处理收到的消息，保证同一个channel的消息按照顺序处理
+	pool *him.WorkerPool
+
+	lock    sync.Mutex
+	lst     net.Listener
+	httpSrv *http.Server
+	// conns 处理中的连接，Shutdown等待它们的断开回调完成
+	conns sync.WaitGroup
 }
 
 func NewServer(listen string, service him.ServiceRegistration) him.Server {
 	return &Server{
 		listen:              listen,
 		ServiceRegistration: service,
+		quit:                him.NewEvent(),
 		options: ServerOptions{
 			loginWait: him.DefaultLoginWait,
 			readWait:  him.DefaultReadWait,
@@ -66,6 +79,22 @@ func (s *Server) SetChannelMap(channelMap him.ChannelMap) {
 	s.ChannelMap = channelMap
 }
 
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// SetListener 使用已经建立的监听，在Start之前调用
+func (s *Server) SetListener(lst net.Listener) {
+	s.lock.Lock()
+	s.lst = lst
+	s.lock.Unlock()
+}
+
+// SetWorkerPool 设置处理消息的协程池，在Start之前调用
+func (s *Server) SetWorkerPool(pool *him.WorkerPool) {
+	s.pool = pool
+}
+
 func (s *Server) Start() error {
 	mux := http.NewServeMux()
 	log := logger.WithFields(logger.Fields{
@@ -80,6 +109,10 @@ func (s *Server) Start() error {
 	if s.StateListener == nil {
 		return fmt.Errorf("StateListener is nil")
 	}
+	if s.pool == nil {
+		s.pool = him.DefaultWorkerPool()
+	}
+	listener := s.pool.Listener(s.MessageListener)
 
 	// 连接管理器
 	if s.ChannelMap == nil {
@@ -91,7 +124,15 @@ func (s *Server) Start() error {
 		rawconn, _, _, err := ws.UpgradeHTTP(r, w)
 		if err != nil {
 			resp(w, http.StatusBadRequest, err.Error())
+			return
 		}
+		s.conns.Add(1)
+		connDone := true
+		defer func() {
+			if connDone {
+				s.conns.Done()
+			}
+		}()
 
 		// 包装conn
 		conn := NewConn(rawconn)
@@ -104,7 +145,7 @@ func (s *Server) Start() error {
 			return
 		}
 
-		if _, ok := s.Get(id); !ok {
+		if him.Duplicated(s.ChannelMap, s.Acceptor, id) {
 			log.Warnf("channel %s existed", id)
 			_ = conn.WriteFrame(him.OpClose, []byte("channelId is repeated"))
 			conn.Close()
@@ -116,26 +157,60 @@ func (s *Server) Start() error {
 		channel.SetReadWait(s.options.readWait)
 		channel.SetWriteWait(s.options.writeWait)
 		s.Add(channel)
+		// Shutdown之后加入的连接没有被通知，直接关闭
+		if s.quit.HasFired() {
+			_ = channel.Close()
+		}
 
+		// 由读消息的goroutine结束连接
+		connDone = false
 		go func(ch him.Channel) {
+			defer s.conns.Done()
 			// 5
-			err := ch.ReadLoop(s.MessageListener)
+			err := ch.ReadLoop(listener)
 			if err != nil {
 				log.Info(err)
 			}
 			// 6
-			s.Remove(ch.ID())
-			err = s.Disconnect(ch.ID())
-			if err != nil {
-				log.Warn(err)
+			if s.RemoveChannel(ch) {
+				if err = s.Disconnect(ch.ID()); err != nil {
+					log.Warn(err)
+				}
 			}
 			ch.Close()
 		}(channel)
 	})
 
 	log.Infoln("started logicServer")
-	return http.ListenAndServe(s.listen, mux)
-
+	srv := &http.Server{
+		Addr:      s.listen,
+		Handler:   mux,
+		TLSConfig: s.tlsConfig,
+	}
+	s.lock.Lock()
+	if s.quit.HasFired() {
+		s.lock.Unlock()
+		return nil
+	}
+	s.httpSrv = srv
+	lst := s.lst
+	s.lock.Unlock()
+	var err error
+	switch {
+	case lst != nil && s.tlsConfig != nil:
+		err = srv.ServeTLS(lst, "", "")
+	case lst != nil:
+		err = srv.Serve(lst)
+	case s.tlsConfig != nil:
+		// 证书由TLSConfig提供
+		err = srv.ListenAndServeTLS("", "")
+	default:
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
 func (s *Server) Push(id string, data []byte) error {
@@ -146,6 +221,7 @@ func (s *Server) Push(id string, data []byte) error {
 	return ch.Push(data)
 }
 
+// Shutdown 停止接收新连接，推送GoAway通知并等待推送写完之后关闭连接
 func (s *Server) Shutdown(ctx context.Context) error {
 	log := logger.WithFields(logger.Fields{
 		"module": "ws.logicServer",
@@ -155,18 +231,30 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		defer func() {
 			log.Infoln("shutdown")
 		}()
-		// close channels
-		channelMap := s.ChannelMap.All()
-		for _, channel := range channelMap {
-			channel.Close()
-
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				continue
+		s.quit.Fire()
+		s.lock.Lock()
+		srv := s.httpSrv
+		s.lock.Unlock()
+		if srv != nil {
+			// 升级之后的连接不由http.Server管理，这里只关闭监听
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Warn(err)
 			}
 		}
+
+		him.DrainChannels(ctx, s.ChannelMap.All(), s.StateListener)
+
+		// 等待断开回调完成
+		done := make(chan struct{})
+		go func() {
+			s.conns.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Warn(ctx.Err())
+		}
 	})
 	return nil
 }
@@ -188,3 +276,6 @@ type defaultAcceptor struct {
 func (s *defaultAcceptor) Accept(conn him.Conn, timeout time.Duration) (string, error) {
 	return ksuid.New().String(), nil
 }
+
+var _ him.Listenable = (*Server)(nil)
+var _ him.Poolable = (*Server)(nil)
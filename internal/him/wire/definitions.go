@@ -12,6 +12,13 @@ const (
 	// login
 	CommandLoginSignIn  = "login.signin"
 	CommandLoginSignOut = "login.signout"
+	CommandLoginResume  = "login.resume"
+	// CommandLoginTouch 网关按照客户端心跳定期发送，刷新会话的过期时间
+	CommandLoginTouch = "login.touch"
+
+	// gateway
+	// CommandGatewayGoAway 网关关闭之前推送，客户端收到之后重连到通知中的网关
+	CommandGatewayGoAway = "gateway.goaway"
 
 	// chat
 	CommandChatUserTalk  = "chat.user.talk"
@@ -28,12 +35,51 @@ const (
 	CommandGroupQuit    = "chat.group.quit"
 	CommandGroupMembers = "chat.group.members"
 	CommandGroupDetail  = "chat.group.detail"
+
+	// 在线状态
+	CommandPresenceSubscribe   = "chat.presence.subscribe"
+	CommandPresenceUnsubscribe = "chat.presence.unsubscribe"
+	CommandPresenceQuery       = "chat.presence.query"
+	CommandPresenceNotify      = "chat.presence.notify"
+
+	// 好友
+	CommandFriendRequest  = "chat.friend.request"
+	CommandFriendAccept   = "chat.friend.accept"
+	CommandFriendReject   = "chat.friend.reject"
+	CommandFriendDelete   = "chat.friend.delete"
+	CommandFriendList     = "chat.friend.list"
+	CommandFriendRequests = "chat.friend.requests"
+	CommandFriendNotify   = "chat.friend.notify"
+
+	// 黑名单
+	CommandBlockAdd    = "chat.block.add"
+	CommandBlockRemove = "chat.block.remove"
+	CommandBlockList   = "chat.block.list"
+
+	// 用户资料
+	CommandUserProfileNotify = "chat.user.profile"
+
+	// 系统消息
+	CommandSystemNotify = "chat.system.notify"
 )
 
 // Meta Key of a packet
 const (
 	MetaDestServer   = "dest.server"
 	MetaDestChannels = "dest.channels"
+	// MetaDisconnect 由网关在连接断开时添加到登出包中，用于区分主动登出
+	MetaDisconnect = "disconnect"
+	// MetaResumeToken 会话恢复令牌
+	MetaResumeToken = "resume.token"
+	// MetaKickout 网关推送之后关闭目标连接
+	MetaKickout = "kickout"
+	// MetaBroadcast 推送队列中的消息发给全部在线连接
+	MetaBroadcast = "broadcast"
+	// 网关转发时添加的连接属性，用于按照规则选择逻辑服务
+	MetaApp     = "app"
+	MetaAccount = "account"
+	MetaZone    = "zone"
+	MetaVersion = "version"
 )
 
 // Protocol Protocol
@@ -54,6 +100,9 @@ const (
 	SNService  = "service" //rpc service
 )
 
+// SystemAccount 系统消息的发送方
+const SystemAccount = "system"
+
 // ServiceID Service ID
 type ServiceID string
 
@@ -0,0 +1,97 @@
+package pkt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// InnerProtocolVersion 服务之间通信协议的版本，握手时版本不一致直接拒绝
+const InnerProtocolVersion = uint32(1)
+
+// MaxHandshakeSkew 握手请求的时间戳与本地时间允许的最大偏差，用于限制重放
+const MaxHandshakeSkew = time.Second * 30
+
+// HandshakeNonceExpiresIn 握手随机数至少保留的时间
+// 时间戳超前MaxHandshakeSkew的请求在本地时间过去2*MaxHandshakeSkew之前都能通过校验
+const HandshakeNonceExpiresIn = MaxHandshakeSkew * 2
+
+var (
+	ErrHandshakeVersion   = errors.New("inner protocol version mismatch")
+	ErrHandshakeSignature = errors.New("invalid handshake signature")
+	ErrHandshakeExpired   = errors.New("handshake timestamp out of range")
+	ErrHandshakeReplayed  = errors.New("handshake nonce already used")
+)
+
+// NewInnerHandshakeRequest 创建握手请求，secret为空时不签名
+// instance区分同一个ServiceId的不同进程，为空时对方按照ServiceId识别连接
+func NewInnerHandshakeRequest(serviceId string, instance string, secret string) *InnerHandshakeRequest {
+	req := &InnerHandshakeRequest{
+		ServiceId: serviceId,
+		Instance:  instance,
+		Version:   InnerProtocolVersion,
+		Timestamp: time.Now().UnixMilli(),
+		Nonce:     ksuid.New().String(),
+	}
+	if secret != "" {
+		req.Signature = req.sign(secret)
+	}
+	return req
+}
+
+// Verify 校验协议版本与签名，secret为空时只校验版本
+func (x *InnerHandshakeRequest) Verify(secret string) error {
+	if x.Version != InnerProtocolVersion {
+		return ErrHandshakeVersion
+	}
+	if secret == "" {
+		return nil
+	}
+	skew := time.Since(time.UnixMilli(x.Timestamp))
+	if skew > MaxHandshakeSkew || skew < -MaxHandshakeSkew {
+		return ErrHandshakeExpired
+	}
+	sig, err := hex.DecodeString(x.Signature)
+	if err != nil {
+		return ErrHandshakeSignature
+	}
+	expected, _ := hex.DecodeString(x.sign(secret))
+	if !hmac.Equal(sig, expected) {
+		return ErrHandshakeSignature
+	}
+	return nil
+}
+
+func (x *InnerHandshakeRequest) sign(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatUint(uint64(x.Version), 10)))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(x.ServiceId))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(strconv.FormatInt(x.Timestamp, 10)))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(x.Nonce))
+	// 没有实例ID的旧版本签名保持不变
+	if x.Instance != "" {
+		mac.Write([]byte{'|'})
+		mac.Write([]byte(x.Instance))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandshakeStatus 把校验错误转换为握手响应的Code
+func HandshakeStatus(err error) Status {
+	switch err {
+	case nil:
+		return Status_Success
+	case ErrHandshakeVersion:
+		return Status_ProtocolMismatch
+	default:
+		return Status_Unauthorized
+	}
+}
@@ -0,0 +1,39 @@
+package pkt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_inner_handshake(t *testing.T) {
+	req := NewInnerHandshakeRequest("gate01", "", "secret")
+	assert.Nil(t, req.Verify("secret"))
+	assert.Equal(t, ErrHandshakeSignature, req.Verify("other"))
+
+	// 冒充其它服务
+	req.ServiceId = "gate02"
+	assert.Equal(t, ErrHandshakeSignature, req.Verify("secret"))
+
+	// 冒充同一个服务的其它进程
+	req = NewInnerHandshakeRequest("gate01", "k1", "secret")
+	assert.Nil(t, req.Verify("secret"))
+	req.Instance = "k2"
+	assert.Equal(t, ErrHandshakeSignature, req.Verify("secret"))
+
+	req = NewInnerHandshakeRequest("gate01", "", "secret")
+	req.Version = InnerProtocolVersion + 1
+	assert.Equal(t, ErrHandshakeVersion, req.Verify("secret"))
+	assert.Equal(t, Status_ProtocolMismatch, HandshakeStatus(req.Verify("")))
+
+	req = NewInnerHandshakeRequest("gate01", "", "")
+	assert.Equal(t, ErrHandshakeSignature, req.Verify("secret"))
+	assert.Nil(t, req.Verify(""))
+
+	req = NewInnerHandshakeRequest("gate01", "", "secret")
+	req.Timestamp = time.Now().Add(-MaxHandshakeSkew * 2).UnixMilli()
+	req.Signature = req.sign("secret")
+	assert.Equal(t, ErrHandshakeExpired, req.Verify("secret"))
+	assert.Equal(t, Status_Unauthorized, HandshakeStatus(req.Verify("secret")))
+}
@@ -158,7 +158,12 @@ func (p *LogicPkt) AddStringMeta(key, value string) {
 
 // GetMeta extra value
 func (p *LogicPkt) GetMeta(key string) (interface{}, bool) {
-	for _, m := range p.Meta {
+	return p.Header.LookupMeta(key)
+}
+
+// LookupMeta 按照key读取header中的meta，生成的GetMeta()已经占用了这个名字
+func (h *Header) LookupMeta(key string) (interface{}, bool) {
+	for _, m := range h.GetMeta() {
 		if m.Key == key {
 			switch m.Type {
 			case MetaType_int:
@@ -8,8 +8,13 @@ import (
 	"reflect"
 
 	"github.com/chang144/gotalk/internal/him/wire"
+	"github.com/chang144/gotalk/internal/him/wire/endian"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
+// headerChannelId Header中channelId字段的编号
+const headerChannelId protowire.Number = 2
+
 type Packet interface {
 	Decode(r io.Reader) error
 	Encode(r io.Writer) error
@@ -67,6 +72,41 @@ func MustReadLogicPkt(r io.Reader) (*LogicPkt, error) {
 	return nil, fmt.Errorf("packet is not a logic packet")
 }
 
+// ReadChannelId 只解析LogicPkt头部中的channelId，不反序列化头部的其它字段，也不复制消息体
+// 用于处理消息之前按照channel计算顺序
+func ReadChannelId(payload []byte) (string, error) {
+	if len(payload) < len(wire.MagicLogicPkt)+4 || !bytes.Equal(payload[:len(wire.MagicLogicPkt)], wire.MagicLogicPkt[:]) {
+		return "", fmt.Errorf("packet is not a logic packet")
+	}
+	payload = payload[len(wire.MagicLogicPkt):]
+	size := endian.Default.Uint32(payload)
+	payload = payload[4:]
+	if uint64(size) > uint64(len(payload)) {
+		return "", io.ErrUnexpectedEOF
+	}
+	header := payload[:size]
+	for len(header) > 0 {
+		num, typ, n := protowire.ConsumeTag(header)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		header = header[n:]
+		if num == headerChannelId && typ == protowire.BytesType {
+			val, n := protowire.ConsumeBytes(header)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			return string(val), nil
+		}
+		n = protowire.ConsumeFieldValue(num, typ, header)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		header = header[n:]
+	}
+	return "", nil
+}
+
 func MustReadBasicPkt(r io.Reader) (*HeartbeatPkt, error) {
 	val, err := ReadMagic(r)
 	if err != nil {
@@ -0,0 +1,29 @@
+package pkt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_read_channel_id(t *testing.T) {
+	p := New("chat.user.talk", WithChannel("gate01_{test1}_1"), WithDest("test2"), WithSeq(3))
+	p.AddStringMeta("dest.server", "gate01")
+	p.WriteBody(&MessageReq{Type: 1, Body: "hello"})
+	payload := Marshal(p)
+
+	channelId, err := ReadChannelId(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, "gate01_{test1}_1", channelId)
+
+	// 没有channelId
+	channelId, err = ReadChannelId(Marshal(New("chat.user.talk")))
+	assert.Nil(t, err)
+	assert.Empty(t, channelId)
+
+	// 头部不完整与不是逻辑协议的包
+	_, err = ReadChannelId(payload[:10])
+	assert.NotNil(t, err)
+	_, err = ReadChannelId(Marshal(&HeartbeatPkt{Code: CodePing}))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// MessageServiceName gRPC服务全名，与rpc.proto中的定义一致
+const MessageServiceName = "rpc.MessageService"
+
+// MessageServiceServer 业务服务发送消息
+type MessageServiceServer interface {
+	Send(context.Context, *SendMessageReq) (*SendMessageResp, error)
+}
+
+func RegisterMessageServiceServer(s grpc.ServiceRegistrar, srv MessageServiceServer) {
+	s.RegisterService(&MessageServiceDesc, srv)
+}
+
+func messageServiceSendHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendMessageReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServiceServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + MessageServiceName + "/Send",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServiceServer).Send(ctx, req.(*SendMessageReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MessageServiceDesc MessageService的服务描述
+var MessageServiceDesc = grpc.ServiceDesc{
+	ServiceName: MessageServiceName,
+	HandlerType: (*MessageServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    messageServiceSendHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/rpc.proto",
+}
+
+// MessageServiceClient 业务服务使用的客户端
+type MessageServiceClient interface {
+	Send(ctx context.Context, in *SendMessageReq, opts ...grpc.CallOption) (*SendMessageResp, error)
+}
+
+type messageServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMessageServiceClient(cc grpc.ClientConnInterface) MessageServiceClient {
+	return &messageServiceClient{cc}
+}
+
+func (c *messageServiceClient) Send(ctx context.Context, in *SendMessageReq, opts ...grpc.CallOption) (*SendMessageResp, error) {
+	out := new(SendMessageResp)
+	err := c.cc.Invoke(ctx, "/"+MessageServiceName+"/Send", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -12,27 +13,91 @@ const (
 	DefaultSecret = "jwt-him-secret"
 )
 
+// DefaultLeeway 校验exp与nbf时默认允许的时钟偏差
+const DefaultLeeway = time.Second * 30
+
 // Token Token
 type Token struct {
-	Account string `json:"acc,omitempty"`
-	App     string `json:"app,omitempty"`
-	Exp     int64  `json:"exp,omitempty"`
+	Account string   `json:"acc,omitempty"`
+	App     string   `json:"app,omitempty"`
+	Exp     int64    `json:"exp,omitempty"`
+	Nbf     int64    `json:"nbf,omitempty"`
+	Iat     int64    `json:"iat,omitempty"`
+	Aud     Audience `json:"aud,omitempty"`
+	// ID token的唯一标识(jti)
+	ID string `json:"jti,omitempty"`
+	// Type 为空时是访问token，刷新token只能用于换取新的token
+	Type string `json:"typ,omitempty"`
 }
 
-var errExpiredToken = errors.New("expired token")
+// TypeRefresh 刷新token
+const TypeRefresh = "refresh"
+
+var (
+	errExpiredToken  = errors.New("expired token")
+	errNotValidYet   = errors.New("token is not valid yet")
+	errInvalidAud    = errors.New("invalid audience")
+	errMissingExpire = errors.New("token has no expiration")
+	errTokenType     = errors.New("unexpected token type")
+)
 
 // Valid Valid
 func (t *Token) Valid() error {
-	if t.Exp < time.Now().Unix() {
+	return t.validate(time.Now(), 0)
+}
+
+// validate exp是必需的，nbf可选
+func (t *Token) validate(now time.Time, leeway time.Duration) error {
+	if t.Exp == 0 {
+		return errMissingExpire
+	}
+	if now.Add(-leeway).Unix() >= t.Exp {
 		return errExpiredToken
 	}
+	if t.Nbf != 0 && now.Add(leeway).Unix() < t.Nbf {
+		return errNotValidYet
+	}
+	return nil
+}
+
+// Audience 兼容字符串与字符串数组两种格式
+type Audience []string
+
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
 	return nil
 }
 
 // Parse ParseJwtToken
 func Parse(secret, tk string) (*Token, error) {
 	var token = new(Token)
-	_, err := jwtgo.ParseWithClaims(tk, token, func(jwttk *jwtgo.Token) (interface{}, error) {
+	parser := &jwtgo.Parser{ValidMethods: []string{AlgHS256}}
+	_, err := parser.ParseWithClaims(tk, token, func(jwttk *jwtgo.Token) (interface{}, error) {
 		return []byte(secret), nil
 	})
 	if err != nil {
@@ -46,3 +111,76 @@ func Generate(secret string, token *Token) (string, error) {
 	jtk := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, token)
 	return jtk.SignedString([]byte(secret))
 }
+
+// Sign 使用应用当前的签名密钥签发token，kid写入头部
+func Sign(keys KeyProvider, token *Token) (string, error) {
+	key, err := keys.SigningKey(token.App)
+	if err != nil {
+		return "", err
+	}
+	method := jwtgo.GetSigningMethod(key.Algorithm)
+	if method == nil {
+		return "", ErrAlgorithm
+	}
+	jtk := jwtgo.NewWithClaims(method, token)
+	if key.ID != "" {
+		jtk.Header["kid"] = key.ID
+	}
+	return jtk.SignedString(key.signKey())
+}
+
+// Parser 按照token中的app与kid选择密钥校验token
+type Parser struct {
+	Keys KeyProvider
+	// Audience 不为空时token的aud必须包含它
+	Audience string
+	Leeway   time.Duration
+}
+
+func NewParser(keys KeyProvider, audience string) *Parser {
+	return &Parser{
+		Keys:     keys,
+		Audience: audience,
+		Leeway:   DefaultLeeway,
+	}
+}
+
+// Parse 校验访问token
+func (p *Parser) Parse(tk string) (*Token, error) {
+	return p.parse(tk, "")
+}
+
+// ParseRefresh 校验刷新token
+func (p *Parser) ParseRefresh(tk string) (*Token, error) {
+	return p.parse(tk, TypeRefresh)
+}
+
+func (p *Parser) parse(tk string, typ string) (*Token, error) {
+	var token = new(Token)
+	parser := &jwtgo.Parser{
+		ValidMethods:         []string{AlgHS256, AlgRS256, AlgES256},
+		SkipClaimsValidation: true,
+	}
+	_, err := parser.ParseWithClaims(tk, token, func(jwttk *jwtgo.Token) (interface{}, error) {
+		kid, _ := jwttk.Header["kid"].(string)
+		// 算法必须与密钥一致，避免用公钥作为HMAC密钥伪造token
+		key, err := p.Keys.VerifyKey(token.App, kid, jwttk.Method.Alg())
+		if err != nil {
+			return nil, err
+		}
+		return key.verifyKey(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = token.validate(time.Now(), p.Leeway); err != nil {
+		return nil, err
+	}
+	if p.Audience != "" && !token.Aud.Contains(p.Audience) {
+		return nil, errInvalidAud
+	}
+	if token.Type != typ {
+		return nil, errTokenType
+	}
+	return token, nil
+}
@@ -1,9 +1,21 @@
 package token
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	jwtgo "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,3 +35,142 @@ func TestParseJwtToken(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "test1", tk2.Account)
 }
+
+func newTestKeys(t *testing.T) *KeySet {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	now := time.Now()
+	return NewKeySet(
+		&Key{ID: "k1", App: "kim", Algorithm: AlgRS256, PrivateKey: rsaKey, SignFrom: now.Add(-time.Hour * 2), Expires: now.Add(time.Hour)},
+		&Key{ID: "k2", App: "kim", Algorithm: AlgES256, PrivateKey: ecKey, SignFrom: now.Add(-time.Hour)},
+		&Key{ID: "k3", App: "kim", Algorithm: AlgHS256, Secret: []byte("next"), SignFrom: now.Add(time.Hour)},
+		&Key{ID: "d1", Algorithm: AlgHS256, Secret: []byte("default")},
+	)
+}
+
+func Test_key_rotation(t *testing.T) {
+	keys := newTestKeys(t)
+	parser := NewParser(keys, "")
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// k3还没有生效，当前使用k2签发
+	key, err := keys.SigningKey("kim")
+	assert.Nil(t, err)
+	assert.Equal(t, "k2", key.ID)
+
+	tk, err := Sign(keys, &Token{Account: "test1", App: "kim", Exp: exp})
+	assert.Nil(t, err)
+	got, err := parser.Parse(tk)
+	assert.Nil(t, err)
+	assert.Equal(t, "test1", got.Account)
+
+	// 重叠窗口内旧密钥签发的token仍然有效
+	k1, _ := keys.VerifyKey("kim", "k1", AlgRS256)
+	old := jwtgo.NewWithClaims(jwtgo.SigningMethodRS256, &Token{Account: "test1", App: "kim", Exp: exp})
+	old.Header["kid"] = "k1"
+	oldTk, _ := old.SignedString(k1.PrivateKey)
+	_, err = parser.Parse(oldTk)
+	assert.Nil(t, err)
+
+	// 没有专属密钥的应用使用默认密钥
+	tk, err = Sign(keys, &Token{Account: "test2", App: "other", Exp: exp})
+	assert.Nil(t, err)
+	_, err = parser.Parse(tk)
+	assert.Nil(t, err)
+	// 应用不能使用其它应用的密钥
+	tk, _ = Sign(keys, &Token{Account: "test2", App: "kim", Exp: exp})
+	forged := strings.Replace(tk, strings.Split(tk, ".")[1], encodeClaims(t, &Token{Account: "test2", App: "other", Exp: exp}), 1)
+	_, err = parser.Parse(forged)
+	assert.NotNil(t, err)
+}
+
+func Test_algorithm_confusion(t *testing.T) {
+	keys := newTestKeys(t)
+	parser := NewParser(keys, "")
+	k1, _ := keys.VerifyKey("kim", "k1", AlgRS256)
+	pub, _ := x509.MarshalPKIXPublicKey(k1.PrivateKey.Public())
+
+	// 使用RSA公钥作为HMAC密钥伪造token
+	forged := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, &Token{Account: "admin", App: "kim", Exp: time.Now().Add(time.Hour).Unix()})
+	forged.Header["kid"] = "k1"
+	tk, _ := forged.SignedString(pub)
+	_, err := parser.Parse(tk)
+	assert.NotNil(t, err)
+}
+
+func Test_claims(t *testing.T) {
+	keys := NewKeySet(&Key{Algorithm: AlgHS256, Secret: []byte("secret")})
+	parser := NewParser(keys, "im")
+	parser.Leeway = 0
+	now := time.Now()
+
+	cases := []struct {
+		token *Token
+		ok    bool
+	}{
+		{&Token{Account: "a", Exp: now.Add(time.Hour).Unix(), Aud: Audience{"im"}}, true},
+		{&Token{Account: "a", Exp: now.Add(time.Hour).Unix(), Aud: Audience{"web", "im"}}, true},
+		{&Token{Account: "a", Exp: now.Add(time.Hour).Unix(), Aud: Audience{"web"}}, false},
+		{&Token{Account: "a", Exp: now.Add(time.Hour).Unix()}, false},
+		{&Token{Account: "a", Aud: Audience{"im"}}, false},
+		{&Token{Account: "a", Exp: now.Add(-time.Minute).Unix(), Aud: Audience{"im"}}, false},
+		{&Token{Account: "a", Exp: now.Add(time.Hour).Unix(), Nbf: now.Add(time.Minute).Unix(), Aud: Audience{"im"}}, false},
+	}
+	for i, c := range cases {
+		tk, err := Sign(keys, c.token)
+		assert.Nil(t, err)
+		_, err = parser.Parse(tk)
+		assert.Equal(t, c.ok, err == nil, "case %d", i)
+	}
+}
+
+func Test_token_type(t *testing.T) {
+	keys := NewKeySet(&Key{Algorithm: AlgHS256, Secret: []byte("secret")})
+	parser := NewParser(keys, "")
+	exp := time.Now().Add(time.Hour).Unix()
+
+	refresh, _ := Sign(keys, &Token{Account: "a", Exp: exp, Type: TypeRefresh})
+	_, err := parser.Parse(refresh)
+	assert.Equal(t, errTokenType, err)
+	_, err = parser.ParseRefresh(refresh)
+	assert.Nil(t, err)
+
+	access, _ := Sign(keys, &Token{Account: "a", Exp: exp})
+	_, err = parser.ParseRefresh(access)
+	assert.Equal(t, errTokenType, err)
+}
+
+func Test_load_jwks(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	doc := fmt.Sprintf(`{"keys":[
+		{"kty":"EC","kid":"e1","crv":"P-256","x":"%s","y":"%s"},
+		{"kty":"oct","kid":"o1","k":"%s"},
+		{"kty":"EC","kid":"enc","use":"enc","crv":"P-256","x":"%s","y":"%s"}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+		base64.RawURLEncoding.EncodeToString([]byte("secret")),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()))
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	assert.Nil(t, os.WriteFile(file, []byte(doc), 0600))
+
+	provider, err := NewFileKeyProvider([]KeyConfig{{App: "kim", JWKS: file}})
+	assert.Nil(t, err)
+	_, err = provider.VerifyKey("kim", "enc", AlgES256)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	jtk := jwtgo.NewWithClaims(jwtgo.SigningMethodES256, &Token{Account: "a", App: "kim", Exp: time.Now().Add(time.Hour).Unix()})
+	jtk.Header["kid"] = "e1"
+	tk, _ := jtk.SignedString(ecKey)
+	_, err = NewParser(provider, "").Parse(tk)
+	assert.Nil(t, err)
+}
+
+func encodeClaims(t *testing.T, token *Token) string {
+	bts, err := json.Marshal(token)
+	assert.Nil(t, err)
+	return base64.RawURLEncoding.EncodeToString(bts)
+}
@@ -0,0 +1,153 @@
+package token
+
+import (
+	"crypto"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 支持的签名算法
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+var (
+	ErrKeyNotFound  = errors.New("signing key not found")
+	ErrNoSigningKey = errors.New("no active signing key")
+	ErrAlgorithm    = errors.New("unexpected signing algorithm")
+)
+
+// Key 签名密钥
+// 轮换时新密钥的SignFrom设置为切换时间，旧密钥的Expires至少要比切换时间晚一个token有效期，
+// 这样在重叠窗口内新旧两个密钥签发的token都可以通过校验
+type Key struct {
+	// ID 写入token头部的kid
+	ID string
+	// App 所属应用，为空时作为所有应用的默认密钥
+	App       string
+	Algorithm string
+	// Secret HS256使用的共享密钥
+	Secret []byte
+	// PrivateKey RS256/ES256签发使用，只用于校验的密钥可以为空
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+	// SignFrom 开始用于签发的时间
+	SignFrom time.Time
+	// Expires 之后不再用于签发与校验，为零值时不过期
+	Expires time.Time
+}
+
+func (k *Key) expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+func (k *Key) canSign(now time.Time) bool {
+	if k.expired(now) || now.Before(k.SignFrom) {
+		return false
+	}
+	if k.Algorithm == AlgHS256 {
+		return len(k.Secret) > 0
+	}
+	return k.PrivateKey != nil
+}
+
+// signKey 返回jwt-go需要的签名密钥
+func (k *Key) signKey() interface{} {
+	if k.Algorithm == AlgHS256 {
+		return k.Secret
+	}
+	return k.PrivateKey
+}
+
+// verifyKey 返回jwt-go需要的校验密钥
+func (k *Key) verifyKey() interface{} {
+	if k.Algorithm == AlgHS256 {
+		return k.Secret
+	}
+	if k.PublicKey == nil && k.PrivateKey != nil {
+		return k.PrivateKey.Public()
+	}
+	return k.PublicKey
+}
+
+// KeyProvider 按照应用与kid查找密钥
+type KeyProvider interface {
+	// VerifyKey kid为空时返回该应用可用于alg的最新密钥
+	VerifyKey(app, kid, alg string) (*Key, error)
+	// SigningKey 返回应用当前用于签发的密钥
+	SigningKey(app string) (*Key, error)
+}
+
+// KeySet 内存中的密钥集合，Replace可以在运行时整体替换密钥
+type KeySet struct {
+	sync.RWMutex
+	// keys 按App分组，组内按SignFrom从新到旧排序
+	keys map[string][]*Key
+}
+
+func NewKeySet(keys ...*Key) *KeySet {
+	s := &KeySet{}
+	s.Replace(keys)
+	return s
+}
+
+// Replace 替换全部密钥
+func (s *KeySet) Replace(keys []*Key) {
+	group := make(map[string][]*Key)
+	for _, key := range keys {
+		group[key.App] = append(group[key.App], key)
+	}
+	for _, list := range group {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].SignFrom.After(list[j].SignFrom)
+		})
+	}
+	s.Lock()
+	s.keys = group
+	s.Unlock()
+}
+
+// candidates 应用自己的密钥优先，其次是默认密钥
+func (s *KeySet) candidates(app string) []*Key {
+	s.RLock()
+	defer s.RUnlock()
+	list := make([]*Key, 0, len(s.keys[app])+len(s.keys[""]))
+	list = append(list, s.keys[app]...)
+	if app != "" {
+		list = append(list, s.keys[""]...)
+	}
+	return list
+}
+
+func (s *KeySet) VerifyKey(app, kid, alg string) (*Key, error) {
+	now := time.Now()
+	for _, key := range s.candidates(app) {
+		if key.expired(now) || key.ID != kid && kid != "" {
+			continue
+		}
+		if key.Algorithm != alg {
+			if kid != "" {
+				return nil, ErrAlgorithm
+			}
+			continue
+		}
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (s *KeySet) SigningKey(app string) (*Key, error) {
+	now := time.Now()
+	for _, key := range s.candidates(app) {
+		if key.canSign(now) {
+			return key, nil
+		}
+	}
+	return nil, ErrNoSigningKey
+}
+
+var _ KeyProvider = (*KeySet)(nil)
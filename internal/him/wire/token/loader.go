@@ -0,0 +1,269 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klintcheng/kim/logger"
+)
+
+// KeyConfig 密钥配置，Secret、File与JWKS三选一
+type KeyConfig struct {
+	ID        string
+	App       string
+	Algorithm string
+	// Secret HS256的共享密钥
+	Secret string
+	// File HS256为密钥文件，RS256/ES256为PEM格式的私钥、公钥或证书
+	File string
+	// JWKS 磁盘上的JWKS文档，文档中的全部密钥都属于App
+	JWKS     string
+	SignFrom time.Time
+	Expires  time.Time
+}
+
+// LoadKeys 按照配置从文件加载密钥
+func LoadKeys(configs []KeyConfig) ([]*Key, error) {
+	keys := make([]*Key, 0, len(configs))
+	for _, c := range configs {
+		if c.JWKS != "" {
+			list, err := LoadJWKS(c.JWKS, c.App)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, list...)
+			continue
+		}
+		key := &Key{
+			ID:        c.ID,
+			App:       c.App,
+			Algorithm: strings.ToUpper(c.Algorithm),
+			SignFrom:  c.SignFrom,
+			Expires:   c.Expires,
+		}
+		if key.Algorithm == "" {
+			key.Algorithm = AlgHS256
+		}
+		switch key.Algorithm {
+		case AlgHS256:
+			key.Secret = []byte(c.Secret)
+			if c.File != "" {
+				bts, err := os.ReadFile(c.File)
+				if err != nil {
+					return nil, err
+				}
+				key.Secret = []byte(strings.TrimSpace(string(bts)))
+			}
+			if len(key.Secret) == 0 {
+				return nil, fmt.Errorf("key %s: secret is empty", c.ID)
+			}
+		case AlgRS256, AlgES256:
+			if err := loadPem(key, c.File); err != nil {
+				return nil, fmt.Errorf("key %s: %v", c.ID, err)
+			}
+		default:
+			return nil, fmt.Errorf("key %s: unsupported algorithm %s", c.ID, c.Algorithm)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// loadPem 读取PEM文件中的私钥、公钥或证书，并检查类型与算法是否匹配
+func loadPem(key *Key, file string) error {
+	bts, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return fmt.Errorf("no pem block found in %s", file)
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		key.PublicKey = cert.PublicKey
+	case "PUBLIC KEY":
+		key.PublicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key.PrivateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key.PrivateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var pk interface{}
+		pk, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if signer, ok := pk.(crypto.Signer); ok {
+			key.PrivateKey = signer
+		}
+	default:
+		return fmt.Errorf("unsupported pem type %s", block.Type)
+	}
+	if err != nil {
+		return err
+	}
+	pub := key.PublicKey
+	if key.PrivateKey != nil {
+		pub = key.PrivateKey.Public()
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		if key.Algorithm == AlgRS256 {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if key.Algorithm == AlgES256 {
+			return nil
+		}
+	}
+	return ErrAlgorithm
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadJWKS 读取JWKS文档中的校验密钥，不支持的密钥会被跳过
+func LoadJWKS(file string, app string) ([]*Key, error) {
+	bts, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(bts, &doc); err != nil {
+		return nil, err
+	}
+	keys := make([]*Key, 0, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			logger.WithField("module", "token").Warnf("skip jwk %s: %v", k.Kid, err)
+			continue
+		}
+		key.App = app
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (k *jwk) key() (*Key, error) {
+	key := &Key{ID: k.Kid}
+	switch k.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, err
+		}
+		key.Algorithm, key.Secret = AlgHS256, secret
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		key.Algorithm = AlgRS256
+		key.PublicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key.Algorithm = AlgES256
+		key.PublicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return nil, fmt.Errorf("unsupported kty %s", k.Kty)
+	}
+	if k.Alg != "" && k.Alg != key.Algorithm {
+		return nil, ErrAlgorithm
+	}
+	return key, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	bts, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bts), nil
+}
+
+// FileKeyProvider 从配置的文件加载密钥，Watch定时重新加载以完成轮换
+type FileKeyProvider struct {
+	*KeySet
+	configs []KeyConfig
+}
+
+func NewFileKeyProvider(configs []KeyConfig) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{
+		KeySet:  NewKeySet(),
+		configs: configs,
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload 重新加载全部密钥，失败时继续使用旧的密钥
+func (p *FileKeyProvider) Reload() error {
+	keys, err := LoadKeys(p.configs)
+	if err != nil {
+		return err
+	}
+	p.Replace(keys)
+	return nil
+}
+
+// Watch 每隔interval重新加载一次，直到ctx结束
+func (p *FileKeyProvider) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Reload(); err != nil {
+				logger.WithField("module", "token").Warn(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package him
+
+import (
+	"errors"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klintcheng/kim/logger"
+	"github.com/panjf2000/ants/v2"
+)
+
+const (
+	DefaultWorkerPoolSize  = 1024
+	DefaultWorkerQueueSize = 256
+)
+
+var (
+	ErrWorkerPoolBusy   = errors.New("worker pool is busy")
+	ErrWorkerPoolClosed = errors.New("worker pool closed")
+)
+
+// WorkerPoolOptions 为0的参数使用默认值
+type WorkerPoolOptions struct {
+	// PoolSize 处理消息的goroutine上限，也是队列的数量
+	PoolSize int
+	// QueueSize 每个队列等待处理的消息上限，队列满了之后丢弃新的消息
+	QueueSize int
+}
+
+// WorkerPool 处理消息的协程池
+// 按照顺序键把消息分配到固定的队列，每个队列同时只有一个goroutine在处理，
+// 所以顺序键相同的消息按照接收的顺序处理，goroutine由ants复用，空闲时回收
+type WorkerPool struct {
+	pool   *ants.Pool
+	queues []*workerQueue
+	closed int32
+}
+
+type workerQueue struct {
+	tasks chan func()
+	// running 为1时已经有goroutine在处理这个队列
+	running int32
+}
+
+func NewWorkerPool(opts WorkerPoolOptions) (*WorkerPool, error) {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DefaultWorkerPoolSize
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultWorkerQueueSize
+	}
+	// 每个队列最多占用一个goroutine，提交的任务不会超过池的大小
+	pool, err := ants.NewPool(opts.PoolSize)
+	if err != nil {
+		return nil, err
+	}
+	queues := make([]*workerQueue, opts.PoolSize)
+	for i := range queues {
+		queues[i] = &workerQueue{tasks: make(chan func(), opts.QueueSize)}
+	}
+	return &WorkerPool{pool: pool, queues: queues}, nil
+}
+
+var (
+	defaultWorkerPool *WorkerPool
+	defaultPoolOnce   sync.Once
+)
+
+// DefaultWorkerPool 没有设置WorkerPool的Server共用的协程池
+func DefaultWorkerPool() *WorkerPool {
+	defaultPoolOnce.Do(func() {
+		p, err := NewWorkerPool(WorkerPoolOptions{})
+		if err != nil {
+			panic(err)
+		}
+		defaultWorkerPool = p
+	})
+	return defaultWorkerPool
+}
+
+// Dispatch 把task放入key对应的队列，队列已满时返回ErrWorkerPoolBusy
+func (p *WorkerPool) Dispatch(key string, task func()) error {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return ErrWorkerPoolClosed
+	}
+	q := p.queues[crc32.ChecksumIEEE([]byte(key))%uint32(len(p.queues))]
+	select {
+	case q.tasks <- task:
+	default:
+		return ErrWorkerPoolBusy
+	}
+	p.schedule(q)
+	return nil
+}
+
+func (p *WorkerPool) schedule(q *workerQueue) {
+	if !atomic.CompareAndSwapInt32(&q.running, 0, 1) {
+		return
+	}
+	if err := p.pool.Submit(func() { p.drain(q) }); err != nil {
+		// 协程池已经释放
+		atomic.StoreInt32(&q.running, 0)
+	}
+}
+
+// drain 处理队列直到为空
+func (p *WorkerPool) drain(q *workerQueue) {
+	for {
+		select {
+		case task := <-q.tasks:
+			run(task)
+		default:
+			atomic.StoreInt32(&q.running, 0)
+			// 退出之前又有消息入队，并且没有被其它goroutine接手时继续处理
+			if len(q.tasks) == 0 || !atomic.CompareAndSwapInt32(&q.running, 0, 1) {
+				return
+			}
+		}
+	}
+}
+
+func run(task func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.WithField("module", "worker_pool").Errorf("task panic: %v", err)
+		}
+	}()
+	task()
+}
+
+// Running 正在处理消息的goroutine数量
+func (p *WorkerPool) Running() int {
+	return p.pool.Running()
+}
+
+// Release 不再接收新的消息，正在处理的队列处理完之后退出
+func (p *WorkerPool) Release() {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		p.pool.Release()
+	}
+}
+
+// KeyedListener 可选，由MessageListener实现
+// 返回消息的顺序键，键相同的消息按照接收的顺序处理，为空时使用channel的ID
+type KeyedListener interface {
+	OrderKey(Agent, []byte) string
+}
+
+// BusyListener 可选，由MessageListener实现
+// 消息因为队列已满被丢弃时在读取的goroutine中调用，不能阻塞
+type BusyListener interface {
+	Busy(Agent, []byte)
+}
+
+// Listener 返回一个通过协程池调用lst的MessageListener
+// 默认同一个channel的消息按照顺序处理
+func (p *WorkerPool) Listener(lst MessageListener) MessageListener {
+	return &poolListener{pool: p, lst: lst}
+}
+
+type poolListener struct {
+	pool *WorkerPool
+	lst  MessageListener
+}
+
+// Heartbeat 心跳与消息使用同一个队列，队列已满时丢弃
+func (l *poolListener) Heartbeat(ag Agent) {
+	if hl, ok := l.lst.(HeartbeatListener); ok {
+		_ = l.pool.Dispatch(ag.ID(), func() { hl.Heartbeat(ag) })
+	}
+}
+
+func (l *poolListener) Receive(ag Agent, payload []byte) {
+	key := ""
+	if keyed, ok := l.lst.(KeyedListener); ok {
+		key = keyed.OrderKey(ag, payload)
+	}
+	if key == "" {
+		key = ag.ID()
+	}
+	err := l.pool.Dispatch(key, func() { l.lst.Receive(ag, payload) })
+	if err == nil {
+		return
+	}
+	logger.WithFields(logger.Fields{
+		"module": "worker_pool",
+		"id":     ag.ID(),
+	}).Warn(err)
+	if busy, ok := l.lst.(BusyListener); ok {
+		busy.Busy(ag, payload)
+	}
+}
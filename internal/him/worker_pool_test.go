@@ -0,0 +1,113 @@
+package him
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAgent struct {
+	id string
+}
+
+func (a *testAgent) ID() string        { return a.id }
+func (a *testAgent) Push([]byte) error { return nil }
+
+type orderListener struct {
+	sync.Mutex
+	// block 关闭之前Receive阻塞
+	block    chan struct{}
+	received map[string][]byte
+	busy     []byte
+}
+
+func (l *orderListener) Receive(ag Agent, payload []byte) {
+	<-l.block
+	l.Lock()
+	defer l.Unlock()
+	key := string(payload[:1])
+	l.received[key] = append(l.received[key], payload[1])
+}
+
+// OrderKey 第一个字节是顺序键
+func (l *orderListener) OrderKey(_ Agent, payload []byte) string {
+	return string(payload[:1])
+}
+
+func (l *orderListener) Busy(_ Agent, payload []byte) {
+	l.Lock()
+	defer l.Unlock()
+	l.busy = append(l.busy, payload[1])
+}
+
+func Test_worker_pool_order(t *testing.T) {
+	pool, err := NewWorkerPool(WorkerPoolOptions{PoolSize: 4, QueueSize: 300})
+	assert.Nil(t, err)
+	defer pool.Release()
+
+	lst := &orderListener{block: make(chan struct{}), received: make(map[string][]byte)}
+	close(lst.block)
+	listener := pool.Listener(lst)
+	ag := &testAgent{id: "gateway01"}
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			listener.Receive(ag, []byte{key[0], byte(i)})
+		}
+	}
+	assert.Eventually(t, func() bool {
+		lst.Lock()
+		defer lst.Unlock()
+		return len(lst.received["a"])+len(lst.received["b"])+len(lst.received["c"]) == 300
+	}, time.Second, time.Millisecond*10)
+	assert.Len(t, lst.busy, 0)
+	// 同一个键的消息按照接收的顺序处理
+	for _, list := range lst.received {
+		for i, v := range list {
+			assert.EqualValues(t, i, v)
+		}
+	}
+	assert.LessOrEqual(t, pool.Running(), 4)
+}
+
+func Test_worker_pool_busy(t *testing.T) {
+	pool, err := NewWorkerPool(WorkerPoolOptions{PoolSize: 1, QueueSize: 2})
+	assert.Nil(t, err)
+	defer pool.Release()
+
+	lst := &orderListener{block: make(chan struct{}), received: make(map[string][]byte)}
+	listener := pool.Listener(lst)
+	ag := &testAgent{id: "channel01"}
+	// 第一条消息阻塞在处理中，之后的两条在队列中
+	listener.Receive(ag, []byte{'a', 0})
+	assert.Eventually(t, func() bool {
+		return len(pool.queues[0].tasks) == 0
+	}, time.Second, time.Millisecond)
+	listener.Receive(ag, []byte{'a', 1})
+	listener.Receive(ag, []byte{'a', 2})
+	listener.Receive(ag, []byte{'a', 3})
+
+	lst.Lock()
+	assert.Equal(t, []byte{3}, lst.busy)
+	lst.Unlock()
+	close(lst.block)
+	assert.Eventually(t, func() bool {
+		lst.Lock()
+		defer lst.Unlock()
+		return len(lst.received["a"]) == 3
+	}, time.Second, time.Millisecond*10)
+
+	// 任务panic之后队列继续处理
+	assert.Nil(t, pool.Dispatch("a", func() { panic("boom") }))
+	done := make(chan struct{})
+	assert.Nil(t, pool.Dispatch("a", func() { close(done) }))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queue stopped after panic")
+	}
+
+	pool.Release()
+	assert.Equal(t, ErrWorkerPoolClosed, pool.Dispatch("a", func() {}))
+}